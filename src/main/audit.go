@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the audit trail
+const (
+	AuditUserSignedUp           = "userSignedUp"
+	AuditFriendshipRequested    = "friendshipRequested"
+	AuditFriendshipAccepted     = "friendshipAccepted"
+	AuditFriendshipDeclined     = "friendshipDeclined"
+	AuditProfileUpdated         = "profileUpdated"
+	AuditPrivacySettingsUpdated = "privacySettingsUpdated"
+	AuditPasswordChanged        = "passwordChanged"
+	AuditPasswordResetRequested = "passwordResetRequested"
+	AuditPasswordReset          = "passwordReset"
+	AuditUsernameChanged        = "usernameChanged"
+	AuditAccountDeleted         = "accountDeleted"
+	AuditAccountRestored        = "accountRestored"
+	AuditAccountPurged          = "accountPurged"
+	AuditMessageSent            = "messageSent"
+	AuditUserDeleted            = "userDeleted"
+	AuditFriendshipRemoved      = "friendshipRemoved"
+	AuditRoleChanged            = "roleChanged"
+	AuditWebhookAdded           = "webhookAdded"
+	AuditWebhookRemoved         = "webhookRemoved"
+	AuditGraphExported          = "graphExported"
+	AuditGraphImported          = "graphImported"
+)
+
+// AuditEntry records an action performed by Actor on Target. Each entry holds the hash of the previous one
+// (PrevHash, empty for the first entry) and its own Hash, which covers all the other fields, so that modifying or
+// removing an entry breaks the chain
+type AuditEntry struct {
+	Seq       uint64            `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Actor     string            `json:"actor"`
+	Action    string            `json:"action"`
+	Target    string            `json:"target"`
+	Details   map[string]string `json:"details,omitempty"`
+	SourceIP  string            `json:"sourceIp,omitempty"`
+	RequestID string            `json:"requestId,omitempty"`
+	PrevHash  string            `json:"prevHash"`
+	Hash      string            `json:"hash"`
+}
+
+// AuditContext identifies who performs an action and where the request comes from
+type AuditContext struct {
+	Actor     string
+	SourceIP  string
+	RequestID string
+}
+
+// auditHead is the last entry of a log file, kept in a separate file (path + ".head") so that removing entries from
+// the end of the log can be detected
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// DefaultAuditMemoryEntries is the number of entries an AuditLog keeps in memory
+const DefaultAuditMemoryEntries = 10000
+
+// AuditLog is an append-only, hash-chained trail of the mutations performed through the server. If it is backed by a
+// file (see OpenAuditLog) entries are appended to it as JSON lines, and the file can be checked with VerifyAuditLog.
+// Only the last entries are kept in memory (see GetEntries).
+// It is safe for concurrent use, and a nil *AuditLog records nothing.
+type AuditLog struct {
+	mu         sync.Mutex
+	entries    []AuditEntry // last entries, oldest first; never longer than maxEntries
+	maxEntries int
+	last       auditHead // last entry recorded, which the next one is chained to
+	file       *os.File  // nil if the log is only kept in memory
+	path       string
+}
+
+// Record appends an entry for action performed on target in context ctx
+func (a *AuditLog) Record(ctx AuditContext, action, target string, details map[string]string) AuditEntry {
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Actor:     ctx.Actor,
+		Action:    action,
+		Target:    target,
+		Details:   details,
+		SourceIP:  ctx.SourceIP,
+		RequestID: ctx.RequestID,
+	}
+	if a == nil {
+		return entry
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry.Seq = a.last.Seq + 1
+	entry.PrevHash = a.last.Hash
+	entry.Hash = HashAuditEntry(entry)
+	a.last = auditHead{Seq: entry.Seq, Hash: entry.Hash}
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > a.maxEntries {
+		a.entries = append([]AuditEntry(nil), a.entries[len(a.entries)-a.maxEntries:]...)
+	}
+
+	if a.file != nil {
+		if err := a.write(entry); err != nil {
+			log.Printf("could not write audit entry %d: %v", entry.Seq, err)
+		}
+	}
+	return entry
+}
+
+// GetEntries returns the entries, oldest first: all of them, read from the file backing the log, or if the log is
+// only kept in memory (or the file can't be read) the last ones. The file is read and verified up to the last entry
+// recorded when it is called, without blocking Record
+func (a *AuditLog) GetEntries() []AuditEntry {
+	a.mu.Lock()
+	backed, path, last := a.file != nil, a.path, a.last
+	entries := make([]AuditEntry, len(a.entries))
+	copy(entries, a.entries)
+	a.mu.Unlock()
+
+	if backed {
+		all, err := readAuditEntries(path, &last)
+		if err == nil {
+			err = checkAuditHead(all, last)
+		}
+		if err == nil {
+			return all
+		}
+		log.Printf("could not read audit log %s: %v", path, err)
+	}
+	return entries
+}
+
+// Close closes the file backing the log, if any
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// write appends entry to the log file and updates the head file. Caller must hold a.mu
+func (a *AuditLog) write(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+
+	head, _ := json.Marshal(auditHead{Seq: entry.Seq, Hash: entry.Hash})
+	tmp := a.path + ".head.tmp"
+	if err := ioutil.WriteFile(tmp, head, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path+".head") // atomic, so the head is never half-written
+}
+
+// HashAuditEntry returns the hex-encoded SHA-256 hash of entry, ignoring its Hash field
+func HashAuditEntry(entry AuditEntry) string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyAuditLog reads the audit log file at path and checks that it has not been tampered with: every entry must
+// hash to its Hash, point to the previous one and have consecutive sequence numbers starting at 1, and the last entry
+// must match the head file (so that entries removed from the end are detected).
+// Returns the entries, or an error describing the first problem found. A missing log with no head file is empty
+func VerifyAuditLog(path string) ([]AuditEntry, error) {
+	entries, err := readAuditEntries(path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	want := auditHead{}
+	if data, err := ioutil.ReadFile(path + ".head"); err == nil {
+		if err := json.Unmarshal(data, &want); err != nil {
+			return nil, fmt.Errorf("head file: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if len(entries) > 0 {
+		return nil, errors.New("head file is missing")
+	}
+
+	if err := checkAuditHead(entries, want); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readAuditEntries reads the entries of the audit log file at path, checking that they are chained (see
+// VerifyAuditLog), and stops after the entry of head if it is not nil (entries may be being appended after it).
+// A missing log is empty
+func readAuditEntries(path string, head *auditHead) ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+
+		reader := bufio.NewReader(file)
+		for line := 1; head == nil || uint64(line) <= head.Seq; line++ {
+			data, err := reader.ReadString('\n')
+			if err != nil && data == "" {
+				break
+			}
+			if !strings.HasSuffix(data, "\n") {
+				return nil, fmt.Errorf("line %d: incomplete entry", line)
+			}
+
+			var entry AuditEntry
+			if err := json.Unmarshal([]byte(data), &entry); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+
+			prevHash := ""
+			if len(entries) > 0 {
+				prevHash = entries[len(entries)-1].Hash
+			}
+			switch {
+			case entry.Seq != uint64(line):
+				return nil, fmt.Errorf("line %d: got sequence number %d, want %d", line, entry.Seq, line)
+			case entry.PrevHash != prevHash:
+				return nil, fmt.Errorf("line %d: entry does not follow the previous one", line)
+			case HashAuditEntry(entry) != entry.Hash:
+				return nil, fmt.Errorf("line %d: entry has been modified", line)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// checkAuditHead returns an error if entries don't end at the entry of want
+func checkAuditHead(entries []AuditEntry, want auditHead) error {
+	got := auditHead{}
+	if len(entries) > 0 {
+		got = auditHead{Seq: entries[len(entries)-1].Seq, Hash: entries[len(entries)-1].Hash}
+	}
+	if got != want {
+		return fmt.Errorf("log ends at entry %d but head is entry %d: log has been truncated", got.Seq, want.Seq)
+	}
+	return nil
+}
+
+// --- INITIALIZER ---
+
+// NewAuditLog returns an empty AuditLog kept in memory, which keeps the last DefaultAuditMemoryEntries entries
+func NewAuditLog() *AuditLog {
+	log := AuditLog{entries: make([]AuditEntry, 0), maxEntries: DefaultAuditMemoryEntries}
+	return &log
+}
+
+// OpenAuditLog returns an AuditLog backed by the file at path, which is created if it does not exist. Existing
+// entries are verified (see VerifyAuditLog) and new ones are chained to them. The last DefaultAuditMemoryEntries
+// entries are kept in memory too
+func OpenAuditLog(path string) (*AuditLog, error) {
+	entries, err := VerifyAuditLog(path)
+	if err != nil {
+		return nil, fmt.Errorf("audit log %s is not valid: %v", path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	log := AuditLog{entries: entries, maxEntries: DefaultAuditMemoryEntries, file: file, path: path}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		log.last = auditHead{Seq: last.Seq, Hash: last.Hash}
+	}
+	if len(entries) > log.maxEntries {
+		log.entries = append([]AuditEntry(nil), entries[len(entries)-log.maxEntries:]...)
+	}
+	return &log, nil
+}
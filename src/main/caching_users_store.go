@@ -0,0 +1,136 @@
+package main
+
+// CachingUsersStore is a UsersStore which wraps another one, caching the most read data (friend lists and whether
+// users exist) in bounded LRU caches. Every mutation made through it invalidates the cached values it may change, so
+// the wrapped store must not be modified directly.
+// Operations which are not cached are delegated to the wrapped store
+type CachingUsersStore struct {
+	UsersStore
+	friends *LRUCache // by username, sorted []string
+	exists  *LRUCache // by username, bool
+}
+
+// CachingStoreStats are the statistics of the caches of a CachingUsersStore
+type CachingStoreStats struct {
+	Friends CacheStats `json:"friends"`
+	Exists  CacheStats `json:"exists"`
+}
+
+// Stats returns the statistics of the caches
+func (s *CachingUsersStore) Stats() CachingStoreStats {
+	return CachingStoreStats{Friends: s.friends.Stats(), Exists: s.exists.Stats()}
+}
+
+// UserExists returns true iff user with name `name` exists
+func (s *CachingUsersStore) UserExists(name string) bool {
+	exists, ok, generation := s.exists.Get(name)
+	if ok {
+		return exists.(bool)
+	}
+	userExists := s.UsersStore.UserExists(name)
+	s.exists.Add(name, userExists, generation)
+	return userExists
+}
+
+// GetFriends returns the list of friends of a given user, sorted. The returned slice is a copy and can be modified
+// freely
+func (s *CachingUsersStore) GetFriends(user string) []string {
+	friends, ok, generation := s.friends.Get(user)
+	if !ok {
+		friends = s.UsersStore.GetFriends(user)
+		s.friends.Add(user, friends, generation)
+	}
+	return append([]string{}, friends.([]string)...)
+}
+
+// AddUser adds a user with given username and password (see UsersStore)
+func (s *CachingUsersStore) AddUser(name string, password string) bool {
+	defer s.exists.Invalidate(name)
+	return s.UsersStore.AddUser(name, password)
+}
+
+// AddUserWithID adds a user with given ID, username and password (see UsersStore)
+func (s *CachingUsersStore) AddUserWithID(id, name, password string) bool {
+	defer s.exists.Invalidate(name)
+	return s.UsersStore.AddUserWithID(id, name, password)
+}
+
+// RespondToFriendshipRequest responds to a friendship request from otherUser made to user (see UsersStore)
+func (s *CachingUsersStore) RespondToFriendshipRequest(user, otherUser string, acceptRequest bool) bool {
+	defer s.friends.Invalidate(user, otherUser)
+	return s.UsersStore.RespondToFriendshipRequest(user, otherUser, acceptRequest)
+}
+
+// RespondToFriendshipRequestIf responds to a friendship request from otherUser made to user iff condition returns true
+// (see UsersStore)
+func (s *CachingUsersStore) RespondToFriendshipRequestIf(user, otherUser string, acceptRequest bool, condition func(versions UserVersions) bool) bool {
+	defer s.friends.Invalidate(user, otherUser)
+	return s.UsersStore.RespondToFriendshipRequestIf(user, otherUser, acceptRequest, condition)
+}
+
+// RemoveFriendship removes the friendship between user and otherUser (see UsersStore)
+func (s *CachingUsersStore) RemoveFriendship(user, otherUser string) bool {
+	defer s.friends.Invalidate(user, otherUser)
+	return s.UsersStore.RemoveFriendship(user, otherUser)
+}
+
+// RenameUser changes the username of user oldName to newName (see UsersStore). The old name may be in the cached
+// friend lists of any of their friends, so all friend lists are invalidated
+func (s *CachingUsersStore) RenameUser(oldName, newName string) bool {
+	defer s.friends.Clear()
+	defer s.exists.Invalidate(oldName, newName)
+	return s.UsersStore.RenameUser(oldName, newName)
+}
+
+// DeleteUser soft-deletes user `name` (see UsersStore). All friend lists are invalidated, like in RenameUser
+func (s *CachingUsersStore) DeleteUser(name string) bool {
+	defer s.friends.Clear()
+	defer s.exists.Invalidate(name)
+	return s.UsersStore.DeleteUser(name)
+}
+
+// RestoreUser restores the soft-deleted user `name` (see UsersStore). All friend lists are invalidated, like in
+// RenameUser
+func (s *CachingUsersStore) RestoreUser(name, password string) bool {
+	defer s.friends.Clear()
+	defer s.exists.Invalidate(name)
+	return s.UsersStore.RestoreUser(name, password)
+}
+
+// BeginTransaction tells the wrapped store that a transaction begins (see TransactionParticipant). The caches need
+// nothing, since reverting a mutation invalidates the same values
+func (s *CachingUsersStore) BeginTransaction() {
+	BeginTransaction(s.UsersStore)
+}
+
+// EndTransaction tells the wrapped store that the transaction ended (see TransactionParticipant)
+func (s *CachingUsersStore) EndTransaction(commit bool) {
+	EndTransaction(s.UsersStore, commit)
+}
+
+// GetCachingUsersStore returns the CachingUsersStore which is store or is wrapped by it (through the tracing and
+// transactional decorators). ok is false iff there is none
+func GetCachingUsersStore(store UsersStore) (cached *CachingUsersStore, ok bool) {
+	for {
+		switch wrapper := store.(type) {
+		case *CachingUsersStore:
+			return wrapper, true
+		case *TracingUsersStore:
+			store = wrapper.store
+		case *TransactionalUsersStore:
+			store = wrapper.store
+		case *ReplicatedUsersStore:
+			store = wrapper.UsersStore
+		default:
+			return nil, false
+		}
+	}
+}
+
+// --- INITIALIZER ---
+
+// NewCachingUsersStore returns a CachingUsersStore wrapping store, with room for capacity friend lists and as many
+// users in the existence cache
+func NewCachingUsersStore(store UsersStore, capacity int) *CachingUsersStore {
+	return &CachingUsersStore{UsersStore: store, friends: NewLRUCache(capacity), exists: NewLRUCache(capacity)}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultServerURL is the URL of the server used by subcommands which talk to a running server
+const DefaultServerURL = "http://localhost:5000"
+
+// RunVerifyCommand runs the verify subcommand, which checks the audit log file given in args (or in the AUDIT_LOG
+// environment variable) for tampering or truncation. Returns the exit code
+func RunVerifyCommand(args []string) int {
+	path := os.Getenv("AUDIT_LOG")
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "usage: main verify <audit log file>")
+		return 2
+	}
+
+	entries, err := VerifyAuditLog(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit log %s is NOT valid: %v\n", path, err)
+		return 1
+	}
+
+	fmt.Printf("audit log %s is valid (%d entries)\n", path, len(entries))
+	return 0
+}
+
+// RunExportCommand runs the export subcommand, which exports the social graph of a running server to a file (or to
+// the standard output). Returns the exit code
+func RunExportCommand(args []string) int {
+	flags, server, token := NewAdminCommandFlags("export")
+	passwords := flags.Bool("passwords", true, "include passwords (users imported without them must reset them)")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: main export [-server url] [-token token] [-passwords=false] [file]")
+		return 2
+	}
+
+	url := fmt.Sprintf("%s/admin/export?passwords=%t", strings.TrimRight(*server, "/"), *passwords)
+	response, err := SendAdminRequest(http.MethodGet, url, *token, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer response.Body.Close()
+
+	if err := WriteCommandOutput(flags.Arg(0), response.Body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// RunImportCommand runs the import subcommand, which imports the social graph in a file (or in the standard input)
+// into a running server and prints the report. Returns the exit code
+func RunImportCommand(args []string) int {
+	flags, server, token := NewAdminCommandFlags("import")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: main import [-server url] [-token token] [file]")
+		return 2
+	}
+
+	var in io.Reader = os.Stdin
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		in = file
+	}
+
+	response, err := SendAdminRequest(http.MethodPost, strings.TrimRight(*server, "/")+"/admin/import", *token, in)
+	if err != nil && response == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer response.Body.Close()
+
+	var report GraphReport
+	json.NewDecoder(response.Body).Decode(&report)
+	if len(report.Conflicts) > 0 {
+		fmt.Fprintf(os.Stderr, "nothing was imported because of %d conflicts:\n", len(report.Conflicts))
+		for _, conflict := range report.Conflicts {
+			fmt.Fprintf(os.Stderr, "- %s\n", conflict)
+		}
+		return 1
+	}
+
+	fmt.Printf("imported %d users, %d friendships and %d friendship requests\n", report.Users, report.Friendships, report.Requests)
+	if report.PasswordResets > 0 {
+		fmt.Printf("%d users were imported without password and must reset it\n", report.PasswordResets)
+	}
+	return 0
+}
+
+// RunGraphCommand runs the graph subcommand, which writes the friendship graph of a running server (or of a file
+// exported with the export subcommand, given with -from) in DOT, GraphML or GEXF to a file (or to the standard
+// output). Returns the exit code
+func RunGraphCommand(args []string) int {
+	flags, server, token := NewAdminCommandFlags("graph")
+	format := flags.String("format", GraphFormatDOT, "output format: "+strings.Join(GraphFormats, ", "))
+	requests := flags.Bool("requests", false, "include pending friendship requests as directed edges")
+	user := flags.String("user", "", "only include the ego network of this user")
+	hops := flags.Int("hops", 1, "with -user, include users up to this many friendships away")
+	from := flags.String("from", "", "read the graph from this export file instead of the server")
+	flags.Parse(args)
+	if flags.NArg() > 1 || !IsValidGraphFormat(*format) || *hops < 0 {
+		fmt.Fprintln(os.Stderr, "usage: main graph [-format dot|graphml|gexf] [-requests] [-user user [-hops n]] [-from export file | -server url -token token] [file]")
+		return 2
+	}
+
+	var in io.Reader
+	if *from != "" {
+		var graph bytes.Buffer
+		if err := ConvertExportFile(*from, &graph, SocialGraphOptions{Requests: *requests, Ego: *user, Hops: *hops}, *format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		in = &graph
+	} else {
+		query := url.Values{"format": {*format}, "requests": {strconv.FormatBool(*requests)}}
+		if *user != "" {
+			query.Set("user", *user)
+			query.Set("hops", strconv.Itoa(*hops))
+		}
+		response, err := SendAdminRequest(http.MethodGet, strings.TrimRight(*server, "/")+"/admin/graph?"+query.Encode(), *token, nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer response.Body.Close()
+		in = response.Body
+	}
+
+	if err := WriteCommandOutput(flags.Arg(0), in); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// RunSeedCommand runs the seed subcommand, which generates synthetic users and friendships (see SeedUsersStore) and
+// writes them as an export file (see ExportGraph) to a file (or to the standard output), ready to be imported.
+// Returns the exit code
+func RunSeedCommand(args []string) int {
+	defaults := DefaultSeedConfig()
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	users := flags.Int("users", defaults.Users, "number of users")
+	model := flags.String("model", defaults.Model, "model of the friendship graph: "+strings.Join(SeedModels, ", "))
+	degree := flags.Int("degree", defaults.Degree, "mean number of friends per user")
+	rewire := flags.Float64("rewire", defaults.Rewire, "probability of rewiring each friendship of the smallworld model")
+	requests := flags.Float64("requests", defaults.Requests, "fraction of friendships left as pending friendship requests")
+	seed := flags.Int64("seed", defaults.Seed, "seed of the random generator")
+	flags.Parse(args)
+
+	config := SeedConfig{Users: *users, Model: *model, Degree: *degree, Rewire: *rewire, Requests: *requests, Seed: *seed}
+	if err := config.Check(); err != nil || flags.NArg() > 1 {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Fprintln(os.Stderr, "usage: main seed [-users n] [-model er|ba|smallworld] [-degree n] [-rewire p] [-requests f] [-seed n] [file]")
+		return 2
+	}
+
+	store := EmptyUsersStore()
+	report, err := SeedUsersStore(store, config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var export bytes.Buffer
+	if _, err := ExportGraph(store, &export, true); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := WriteCommandOutput(flags.Arg(0), &export); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "generated %d users, %d friendships and %d friendship requests\n", report.Users, report.Friendships, report.Requests)
+	return 0
+}
+
+// RunLoadTestCommand runs the loadtest subcommand, which replays a mix of requests against a running server (see
+// RunLoadTest) and prints the throughput and latency percentiles of each operation. Returns the exit code, which is 1
+// if any request failed
+func RunLoadTestCommand(args []string) int {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	server := flags.String("server", DefaultServerURL, "URL of the server")
+	duration := flags.Duration("duration", 30*time.Second, "how long to generate traffic")
+	requests := flags.Int("requests", 0, "number of requests to send (instead of running for -duration)")
+	concurrency := flags.Int("concurrency", 16, "number of concurrent clients")
+	users := flags.Int("users", 1000, "number of users signed up before starting")
+	mix := flags.String("mix", "signUp=1,requestFriendship=4,respond=2,getFriends=10", "relative weight of each operation")
+	seed := flags.Int64("seed", 1, "seed of the random generators")
+	jsonOutput := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+
+	weights, err := ParseLoadTestMix(*mix)
+	config := LoadTestConfig{Server: *server, Duration: *duration, Requests: *requests, Concurrency: *concurrency,
+		Users: *users, Mix: weights, Seed: *seed}
+	if err == nil {
+		err = config.Check()
+	}
+	if err != nil || flags.NArg() > 0 {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Fprintln(os.Stderr, "usage: main loadtest [-server url] [-duration 30s | -requests n] [-concurrency n] [-users n] [-mix op=weight,...] [-seed n] [-json]")
+		return 2
+	}
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}, Timeout: 30 * time.Second}
+	report, err := RunLoadTest(client, config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		report.Print(os.Stdout)
+	}
+	if report.Total.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// ConvertExportFile reads the export file at path (see ExportGraph) and writes the friendship graph selected by
+// options to w in format (see WriteSocialGraph)
+func ConvertExportFile(path string, w io.Writer, options SocialGraphOptions, format string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	store := EmptyUsersStore()
+	report, err := ImportGraph(store, file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(report.Conflicts) > 0 {
+		return fmt.Errorf("%s: %s", path, report.Conflicts[0])
+	}
+
+	graph, ok := BuildSocialGraph(store, options)
+	if !ok {
+		return fmt.Errorf("user %s does not exist", options.Ego)
+	}
+	return WriteSocialGraph(w, graph, format)
+}
+
+// WriteCommandOutput copies in to the file at path, or to the standard output if path is empty or "-"
+func WriteCommandOutput(path string, in io.Reader) error {
+	var out io.Writer = os.Stdout
+	if path != "" && path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	_, err := io.Copy(out, in)
+	return err
+}
+
+// NewAdminCommandFlags returns the flags of a subcommand which calls the admin endpoints of a running server: the
+// server URL and the admin token (the ADMIN_TOKEN environment variable by default)
+func NewAdminCommandFlags(name string) (flags *flag.FlagSet, server, token *string) {
+	flags = flag.NewFlagSet(name, flag.ExitOnError)
+	server = flags.String("server", DefaultServerURL, "URL of the server")
+	token = flags.String("token", os.Getenv("ADMIN_TOKEN"), "admin token of the server")
+	return flags, server, token
+}
+
+// SendAdminRequest sends a request to an admin endpoint authenticated with the admin token. Returns an error if the
+// request fails or the response status is not 200 OK; in the latter case the response is returned too, with its body
+// unread if the status is 409 Conflict
+func SendAdminRequest(method, url, token string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response, nil
+	case http.StatusConflict:
+		return response, fmt.Errorf("%s %s: %s", method, url, response.Status)
+	}
+
+	defer response.Body.Close()
+	message, _ := ioutil.ReadAll(response.Body)
+	return nil, fmt.Errorf("%s %s: %s %s", method, url, response.Status, message)
+}
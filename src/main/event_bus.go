@@ -0,0 +1,166 @@
+package main
+
+import "sync"
+
+// Event is a notification addressed to a single user (eg "you have received a friendship request")
+type Event struct {
+	ID   uint64
+	Type string
+	User string            // recipient of the event
+	Data map[string]string // event payload, eg {"from": "arnau"}
+}
+
+// Event types published by UsersServer
+const (
+	EventFriendshipRequestReceived = "friendshipRequestReceived"
+	EventFriendshipRequestAccepted = "friendshipRequestAccepted"
+	EventFriendshipRequestDeclined = "friendshipRequestDeclined"
+	EventMessageReceived           = "messageReceived"
+)
+
+// EventBus dispatches events to subscribed clients. It keeps the last events in memory so that clients which
+// reconnect can resume from the last event they received (see Subscribe).
+// Publish, Unsubscribe, CloseUser and ForgetUser can be called on a nil *EventBus, in which case they do nothing.
+type EventBus struct {
+	mu          sync.Mutex
+	lastID      uint64
+	history     []Event // last published events, oldest first; never longer than historySize
+	historySize int
+	bufferSize  int
+	subscribers map[*Subscription]bool
+}
+
+// Subscription receives the events addressed to User through the Events channel.
+// The channel is closed when the subscription ends, either because Unsubscribe was called or because the client
+// was too slow and its buffer filled up (in which case the client should subscribe again using the last event ID).
+type Subscription struct {
+	User   string
+	Events chan Event
+}
+
+// Publish sends an event of type eventType to user and returns it
+func (b *EventBus) Publish(eventType, user string, data map[string]string) Event {
+	if b == nil {
+		return Event{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	event := Event{ID: b.lastID, Type: eventType, User: user, Data: data}
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+
+	for sub := range b.subscribers {
+		if sub.User != user {
+			continue
+		}
+		select {
+		case sub.Events <- event:
+		default:
+			// Client buffer is full: drop the client, it can resume later with Last-Event-ID
+			b.remove(sub)
+		}
+	}
+
+	return event
+}
+
+// Subscribe registers a new subscription for the events addressed to user.
+// Events addressed to user with ID greater than lastEventID which are still in the history are returned (oldest
+// first) so that they can be sent to the client before any new event. Use lastEventID 0 to skip the history.
+func (b *EventBus) Subscribe(user string, lastEventID uint64) (*Subscription, []Event) {
+	sub := &Subscription{User: user, Events: make(chan Event, b.bufferSize)}
+	missed := make([]Event, 0)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastEventID > 0 {
+		for _, event := range b.history {
+			if event.ID > lastEventID && event.User == user {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	b.subscribers[sub] = true
+	return sub, missed
+}
+
+// Unsubscribe ends the subscription sub. It is safe to call it more than once.
+func (b *EventBus) Unsubscribe(sub *Subscription) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(sub)
+}
+
+// CloseUser ends all subscriptions of user, eg to disconnect the user's clients when their account changes
+func (b *EventBus) CloseUser(user string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if sub.User == user {
+			b.remove(sub)
+		}
+	}
+}
+
+// ForgetUser ends all subscriptions of user and drops the events addressed to them from the history, so that they
+// are not replayed to whoever takes the username next (eg when the account is renamed or deleted)
+func (b *EventBus) ForgetUser(user string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if sub.User == user {
+			b.remove(sub)
+		}
+	}
+
+	history := make([]Event, 0, len(b.history))
+	for _, event := range b.history {
+		if event.User != user {
+			history = append(history, event)
+		}
+	}
+	b.history = history
+}
+
+// remove unregisters sub and closes its channel. Caller must hold b.mu
+func (b *EventBus) remove(sub *Subscription) {
+	if _, subscribed := b.subscribers[sub]; subscribed {
+		delete(b.subscribers, sub)
+		close(sub.Events)
+	}
+}
+
+// --- INITIALIZER ---
+
+// NewEventBus returns an EventBus which remembers the last historySize events and buffers up to bufferSize events
+// per subscription
+func NewEventBus(historySize, bufferSize int) *EventBus {
+	bus := EventBus{
+		historySize: historySize,
+		bufferSize:  bufferSize,
+		subscribers: map[*Subscription]bool{},
+	}
+	return &bus
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// GraphFormatVersion is the version of the format written by ExportGraph. ImportGraph reads versions up to this one
+const GraphFormatVersion = 1
+
+// Types of GraphRecord
+const (
+	GraphRecordHeader     = "header"
+	GraphRecordUser       = "user"
+	GraphRecordFriendship = "friendship"
+	GraphRecordRequest    = "request"
+)
+
+// GraphRecord is a line of a social graph export (a JSON Lines file). Type says which of the other fields are set:
+// - header (always the first line): Version and ExportedAt
+// - user: ID, User, Password (unless it was exported without passwords), Role, Profile and Privacy
+// - friendship: Users (the usernames of both friends)
+// - request: From and To (usernames of the users who sent and received a pending friendship request)
+type GraphRecord struct {
+	Type       string           `json:"type"`
+	Version    int              `json:"version,omitempty"`
+	ExportedAt *time.Time       `json:"exportedAt,omitempty"`
+	ID         string           `json:"id,omitempty"`
+	User       string           `json:"user,omitempty"`
+	Password   string           `json:"password,omitempty"`
+	Role       string           `json:"role,omitempty"`
+	Profile    *GraphProfile    `json:"profile,omitempty"`
+	Privacy    *PrivacySettings `json:"privacy,omitempty"`
+	Users      []string         `json:"users,omitempty"`
+	From       string           `json:"from,omitempty"`
+	To         string           `json:"to,omitempty"`
+}
+
+// GraphProfile holds the editable fields of the profile of a user in a GraphRecord
+type GraphProfile struct {
+	DisplayName string `json:"displayName,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+}
+
+// GraphReport counts the records exported or imported. Conflicts holds the reasons why an import was rejected
+type GraphReport struct {
+	Users          int      `json:"users"`
+	Friendships    int      `json:"friendships"`
+	Requests       int      `json:"requests"`
+	PasswordResets int      `json:"passwordResets,omitempty"` // users imported without password, who must reset it
+	Conflicts      []string `json:"conflicts,omitempty"`
+}
+
+// Details returns the counts of report as audit entry details
+func (report GraphReport) Details() map[string]string {
+	return map[string]string{
+		"users":       strconv.Itoa(report.Users),
+		"friendships": strconv.Itoa(report.Friendships),
+		"requests":    strconv.Itoa(report.Requests),
+	}
+}
+
+// ExportGraph writes all users, friendships and pending friendship requests in store to w as JSON Lines (see
+// GraphRecord). Passwords are stored in plain text, so unless passwords is false the export includes them and must be
+// kept as safe as the store; users imported from an export without passwords must reset them (see ImportGraph).
+// The store is not locked, so concurrent modifications may or may not be included
+func ExportGraph(store UsersStore, w io.Writer, passwords bool) (GraphReport, error) {
+	report := GraphReport{}
+	encoder := json.NewEncoder(w)
+
+	now := time.Now().UTC()
+	if err := encoder.Encode(GraphRecord{Type: GraphRecordHeader, Version: GraphFormatVersion, ExportedAt: &now}); err != nil {
+		return report, err
+	}
+
+	users := store.GetUsers()
+	exported := make([]string, 0, len(users)) // users still existing when exported
+	isExported := NewStringSet()
+	for _, user := range users {
+		id, idOk := store.GetUserID(user)
+		password, passwordOk := store.GetPassword(user)
+		role, roleOk := store.GetRole(user)
+		profile, profileOk := store.GetProfile(user)
+		privacy, privacyOk := store.GetPrivacySettings(user)
+		if !idOk || !passwordOk || !roleOk || !profileOk || !privacyOk {
+			continue // deleted since listed
+		}
+
+		record := GraphRecord{
+			Type:    GraphRecordUser,
+			ID:      id,
+			User:    user,
+			Role:    role,
+			Profile: &GraphProfile{DisplayName: profile.DisplayName, Bio: profile.Bio, AvatarURL: profile.AvatarURL},
+			Privacy: &privacy,
+		}
+		if passwords {
+			record.Password = password
+		}
+		if err := encoder.Encode(record); err != nil {
+			return report, err
+		}
+		exported = append(exported, user)
+		isExported.Add(user)
+		report.Users++
+	}
+
+	// Each friendship is written once, from the user whose name comes first
+	for _, user := range exported {
+		friends := store.GetFriends(user)
+		sort.Strings(friends)
+		for _, friend := range friends {
+			if user < friend && isExported.Contains(friend) {
+				if err := encoder.Encode(GraphRecord{Type: GraphRecordFriendship, Users: []string{user, friend}}); err != nil {
+					return report, err
+				}
+				report.Friendships++
+			}
+		}
+	}
+
+	for _, user := range exported {
+		sent, _, _ := store.GetFriendshipRequests(user)
+		sort.Strings(sent)
+		for _, to := range sent {
+			if isExported.Contains(to) {
+				if err := encoder.Encode(GraphRecord{Type: GraphRecordRequest, From: user, To: to}); err != nil {
+					return report, err
+				}
+				report.Requests++
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// ImportGraph reads users, friendships and pending friendship requests written by ExportGraph from r and adds them to
+// store, which may already have users. Records are checked against each other and against store with the same
+// invariants as the store (unique usernames and IDs, also among deleted users which have not been purged, valid users,
+// no duplicate friendships, no request between friends or users with a pending request). If any record breaks them
+// nothing is imported and the report lists the conflicts. Users without password get a random one, so they must reset
+// it (see UsersServer.RequestPasswordReset) to log in, and are counted in the report as password resets.
+// The records are checked and added in a transaction (see TransactionalUsersStore), so that nothing is imported if
+// one can't be added. If store is a TransactionalUsersStore nothing else can modify it during the import; otherwise
+// it is wrapped in one, so it must not be modified during the import (which would otherwise stop at the first record
+// which can't be added, reported as a conflict, and could lose the versions of the concurrent changes when rolled
+// back). Returns an error iff r is not a valid export
+func ImportGraph(store UsersStore, r io.Reader) (GraphReport, error) {
+	transactions, ok := store.(*TransactionalUsersStore)
+	if !ok {
+		transactions = NewTransactionalUsersStore(store)
+	}
+	return importGraph(transactions.Begin, r)
+}
+
+// importGraph imports the records of r (see ImportGraph) in a transaction started by begin once they are read
+func importGraph(begin func() *UsersTransaction, r io.Reader) (GraphReport, error) {
+	records, err := ReadGraphRecords(r)
+	if err != nil {
+		return GraphReport{}, err
+	}
+
+	tx := begin()
+	defer tx.Rollback()
+	plan := newGraphImportPlan(tx)
+	for _, record := range records {
+		plan.check(record)
+	}
+	if len(plan.report.Conflicts) > 0 {
+		return plan.report, nil
+	}
+
+	if err := plan.apply(); err != nil {
+		plan.report.Conflicts = append(plan.report.Conflicts, err.Error())
+		return plan.report, nil
+	}
+	tx.Commit()
+	return plan.report, nil
+}
+
+// ReadGraphRecords reads the records of a social graph export from r, checking that it starts with a header with a
+// supported version. The header is not returned
+func ReadGraphRecords(r io.Reader) ([]GraphRecord, error) {
+	records := make([]GraphRecord, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		var record GraphRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if line == 1 {
+			if record.Type != GraphRecordHeader {
+				return nil, errors.New("line 1: missing header")
+			}
+			if record.Version < 1 || record.Version > GraphFormatVersion {
+				return nil, fmt.Errorf("line 1: unsupported version %d", record.Version)
+			}
+			continue
+		}
+
+		switch record.Type {
+		case GraphRecordUser, GraphRecordFriendship, GraphRecordRequest:
+			records = append(records, record)
+		default:
+			return nil, fmt.Errorf("line %d: unknown record type %q", line, record.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if line == 0 {
+		return nil, errors.New("missing header")
+	}
+
+	return records, nil
+}
+
+// graphImportPlan checks the records of an import against each other and against the store, and then applies them
+type graphImportPlan struct {
+	store       UsersStore
+	report      GraphReport
+	users       []GraphRecord
+	usernames   map[string]bool // users in the import
+	ids         map[string]bool
+	friendships [][2]string
+	friends     map[[2]string]bool // pairs of friends in the import (see NewUserPair)
+	requests    [][2]string        // from, to
+	requested   map[[2]string]bool // requests in the import
+}
+
+// check adds record to the plan, or a conflict to the report if it breaks an invariant
+func (p *graphImportPlan) check(record GraphRecord) {
+	switch record.Type {
+	case GraphRecordUser:
+		p.checkUser(record)
+	case GraphRecordFriendship:
+		p.checkFriendship(record)
+	case GraphRecordRequest:
+		p.checkRequest(record)
+	}
+}
+
+func (p *graphImportPlan) checkUser(record GraphRecord) {
+	conflicts := make([]string, 0)
+
+	password := record.Password
+	if password == "" {
+		password = NewRandomPassword() // only to check the username
+	}
+	if ok, msg := CheckUsernameAndPassword(record.User, password); !ok {
+		conflicts = append(conflicts, msg)
+	}
+	if p.usernames[record.User] {
+		conflicts = append(conflicts, "User appears more than once")
+	} else if p.store.UserExists(record.User) {
+		conflicts = append(conflicts, "User already exists")
+	} else if p.store.IsDeletedUser(record.User) {
+		conflicts = append(conflicts, "User belongs to a deleted user")
+	}
+
+	if record.ID != "" {
+		if p.ids[record.ID] {
+			conflicts = append(conflicts, fmt.Sprintf("ID %s appears more than once", record.ID))
+		} else if _, exists := p.store.GetUsername(record.ID); exists {
+			conflicts = append(conflicts, fmt.Sprintf("ID %s already exists", record.ID))
+		} else if p.store.IsDeletedID(record.ID) {
+			conflicts = append(conflicts, fmt.Sprintf("ID %s belongs to a deleted user", record.ID))
+		}
+	}
+
+	if record.Role != "" && !IsValidRole(record.Role) {
+		conflicts = append(conflicts, fmt.Sprintf("Invalid role %q", record.Role))
+	}
+	if record.Profile != nil {
+		if ok, msg := CheckProfileUpdate(record.Profile.Update()); !ok {
+			conflicts = append(conflicts, msg)
+		}
+	}
+	if record.Privacy != nil {
+		if ok, msg := CheckPrivacySettingsUpdate(record.Privacy.Update()); !ok {
+			conflicts = append(conflicts, msg)
+		}
+	}
+
+	for _, conflict := range conflicts {
+		p.conflict("user %s: %s", record.User, conflict)
+	}
+	if len(conflicts) == 0 {
+		p.users = append(p.users, record)
+		p.usernames[record.User] = true
+		if record.ID != "" {
+			p.ids[record.ID] = true
+		}
+		p.report.Users++
+		if record.Password == "" {
+			p.report.PasswordResets++
+		}
+	}
+}
+
+func (p *graphImportPlan) checkFriendship(record GraphRecord) {
+	if len(record.Users) != 2 || record.Users[0] == record.Users[1] {
+		p.conflict("friendship %v: A friendship must have two different users", record.Users)
+		return
+	}
+
+	a, b := record.Users[0], record.Users[1]
+	switch {
+	case !p.userExists(a) || !p.userExists(b):
+		p.conflict("friendship %s&%s: User does not exist", a, b)
+	case p.areFriends(a, b):
+		p.conflict("friendship %s&%s: Users are already friends", a, b)
+	case p.hasPendingRequest(a, b):
+		p.conflict("friendship %s&%s: There is a pending friendship request between users", a, b)
+	default:
+		p.friendships = append(p.friendships, [2]string{a, b})
+		p.friends[NewUserPair(a, b)] = true
+		p.report.Friendships++
+	}
+}
+
+func (p *graphImportPlan) checkRequest(record GraphRecord) {
+	from, to := record.From, record.To
+	switch {
+	case from == to:
+		p.conflict("request %s->%s: Users can't send friendship requests to themselves", from, to)
+	case !p.userExists(from) || !p.userExists(to):
+		p.conflict("request %s->%s: User does not exist", from, to)
+	case p.areFriends(from, to):
+		p.conflict("request %s->%s: Users are already friends", from, to)
+	case p.hasPendingRequest(from, to):
+		p.conflict("request %s->%s: Friendship request already exists", from, to)
+	default:
+		p.requests = append(p.requests, [2]string{from, to})
+		p.requested[[2]string{from, to}] = true
+		p.report.Requests++
+	}
+}
+
+// userExists returns true iff user is in the import or in the store
+func (p *graphImportPlan) userExists(user string) bool {
+	return p.usernames[user] || p.store.UserExists(user)
+}
+
+// areFriends returns true iff a and b are friends in the import or in the store
+func (p *graphImportPlan) areFriends(a, b string) bool {
+	return p.friends[NewUserPair(a, b)] || p.store.AreFriends(a, b)
+}
+
+// hasPendingRequest returns true iff there is a pending friendship request between a and b (in either direction) in
+// the import or in the store
+func (p *graphImportPlan) hasPendingRequest(a, b string) bool {
+	if p.requested[[2]string{a, b}] || p.requested[[2]string{b, a}] {
+		return true
+	}
+	return p.store.HasFriendshipRequest(a, b) || p.store.HasFriendshipRequest(b, a)
+}
+
+func (p *graphImportPlan) conflict(format string, args ...interface{}) {
+	p.report.Conflicts = append(p.report.Conflicts, fmt.Sprintf(format, args...))
+}
+
+// apply adds the checked records to the store. It only fails if the store has been modified since they were checked,
+// which can't happen if it is a transaction of a TransactionalUsersStore which is not used directly
+func (p *graphImportPlan) apply() error {
+	for _, user := range p.users {
+		id := user.ID
+		if id == "" {
+			id = NewUserID()
+		}
+		password := user.Password
+		if password == "" {
+			password = NewRandomPassword()
+		}
+		if !p.store.AddUserWithID(id, user.User, password) {
+			return fmt.Errorf("user %s: could not be added because the store has been modified", user.User)
+		}
+		if user.Role != "" {
+			p.store.SetRole(user.User, user.Role)
+		}
+		if user.Profile != nil {
+			p.store.UpdateProfile(user.User, user.Profile.Update())
+		}
+		if user.Privacy != nil {
+			p.store.UpdatePrivacySettings(user.User, user.Privacy.Update())
+		}
+	}
+
+	for _, pair := range p.friendships {
+		if !p.store.RequestFriendship(pair[0], pair[1]) || !p.store.RespondToFriendshipRequest(pair[1], pair[0], true) {
+			return fmt.Errorf("friendship %s&%s: could not be added because the store has been modified", pair[0], pair[1])
+		}
+	}
+
+	for _, request := range p.requests {
+		if !p.store.RequestFriendship(request[0], request[1]) {
+			return fmt.Errorf("request %s->%s: could not be added because the store has been modified", request[0], request[1])
+		}
+	}
+
+	return nil
+}
+
+// Update returns the ProfileUpdate which sets all fields of p
+func (p GraphProfile) Update() ProfileUpdate {
+	return ProfileUpdate{DisplayName: &p.DisplayName, Bio: &p.Bio, AvatarURL: &p.AvatarURL}
+}
+
+// NewUserPair returns the unordered pair of users a and b, ie NewUserPair(a, b) == NewUserPair(b, a)
+func NewUserPair(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// NewRandomPassword returns a new random valid password, which nobody knows
+func NewRandomPassword() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// --- INITIALIZER ---
+
+// newGraphImportPlan returns an empty plan to import records into store
+func newGraphImportPlan(store UsersStore) *graphImportPlan {
+	plan := graphImportPlan{
+		store:     store,
+		report:    GraphReport{Conflicts: make([]string, 0)},
+		usernames: map[string]bool{},
+		ids:       map[string]bool{},
+		friends:   map[[2]string]bool{},
+		requested: map[[2]string]bool{},
+	}
+	return &plan
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats in which a SocialGraph can be written
+const (
+	GraphFormatDOT     = "dot"
+	GraphFormatGraphML = "graphml"
+	GraphFormatGEXF    = "gexf"
+)
+
+// GraphFormats are all formats in which a SocialGraph can be written
+var GraphFormats = []string{GraphFormatDOT, GraphFormatGraphML, GraphFormatGEXF}
+
+// SocialGraph is the friendship graph of (some of) the users in a store, for analysis. Nodes are users, friendships
+// are undirected edges and pending friendship requests (if included) are directed edges from sender to receiver.
+// Edges reference users by username, and all lists are sorted
+type SocialGraph struct {
+	Nodes       []GraphNode
+	Friendships [][2]string
+	Requests    [][2]string
+}
+
+// GraphNode is a user in a SocialGraph
+type GraphNode struct {
+	ID          string
+	User        string
+	DisplayName string
+}
+
+// SocialGraphOptions select what is included in a SocialGraph
+type SocialGraphOptions struct {
+	Requests bool   // include pending friendship requests
+	Ego      string // if not empty, only include the ego network of this user, ie the users at most Hops friendships away
+	Hops     int
+}
+
+// BuildSocialGraph returns the social graph of the users in store selected by options.
+// ok is false iff options.Ego does not exist
+func BuildSocialGraph(store UsersStore, options SocialGraphOptions) (graph SocialGraph, ok bool) {
+	users := store.GetUsers()
+	if options.Ego != "" {
+		if !store.UserExists(options.Ego) {
+			return SocialGraph{}, false
+		}
+		users = GetEgoNetwork(store, options.Ego, options.Hops)
+	}
+
+	included := map[string]bool{}
+	for _, user := range users {
+		if profile, exists := store.GetProfile(user); exists {
+			graph.Nodes = append(graph.Nodes, GraphNode{ID: profile.ID, User: user, DisplayName: profile.DisplayName})
+			included[user] = true
+		}
+	}
+
+	for _, node := range graph.Nodes {
+		friends := store.GetFriends(node.User)
+		sort.Strings(friends)
+		for _, friend := range friends {
+			if node.User < friend && included[friend] {
+				graph.Friendships = append(graph.Friendships, [2]string{node.User, friend})
+			}
+		}
+
+		if options.Requests {
+			sent, _, _ := store.GetFriendshipRequests(node.User)
+			sort.Strings(sent)
+			for _, to := range sent {
+				if included[to] {
+					graph.Requests = append(graph.Requests, [2]string{node.User, to})
+				}
+			}
+		}
+	}
+
+	return graph, true
+}
+
+// GetEgoNetwork returns the users at most hops friendships away from ego (including ego), sorted
+func GetEgoNetwork(store UsersStore, ego string, hops int) []string {
+	visited := map[string]bool{ego: true}
+	frontier := []string{ego}
+	users := []string{ego}
+
+	for hop := 0; hop < hops && len(frontier) > 0; hop++ {
+		next := make([]string, 0)
+		for _, user := range frontier {
+			for _, friend := range store.GetFriends(user) {
+				if !visited[friend] {
+					visited[friend] = true
+					next = append(next, friend)
+					users = append(users, friend)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	sort.Strings(users)
+	return users
+}
+
+// IsValidGraphFormat returns true iff format is one of GraphFormats
+func IsValidGraphFormat(format string) bool {
+	for _, f := range GraphFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteSocialGraph writes graph to w in format (one of GraphFormats)
+func WriteSocialGraph(w io.Writer, graph SocialGraph, format string) error {
+	switch format {
+	case GraphFormatDOT:
+		return WriteDOT(w, graph)
+	case GraphFormatGraphML:
+		return WriteGraphML(w, graph)
+	case GraphFormatGEXF:
+		return WriteGEXF(w, graph)
+	}
+	return fmt.Errorf("unknown graph format %q", format)
+}
+
+// GetGraphContentType returns the MIME type of format (one of GraphFormats)
+func GetGraphContentType(format string) string {
+	switch format {
+	case GraphFormatDOT:
+		return "text/vnd.graphviz"
+	case GraphFormatGraphML:
+		return "application/graphml+xml"
+	}
+	return "application/xml"
+}
+
+// WriteDOT writes graph to w in the DOT language of Graphviz. Nodes are identified by username. If there are
+// requests the graph is directed and friendships are edges without direction
+func WriteDOT(w io.Writer, graph SocialGraph) error {
+	kind, edge, friendshipAttributes := "graph", "--", ""
+	if len(graph.Requests) > 0 {
+		kind, edge, friendshipAttributes = "digraph", "->", ", dir=none"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s social {\n", kind)
+	for _, node := range graph.Nodes {
+		fmt.Fprintf(&b, "  %s [id=%s, label=%s];\n", QuoteDOT(node.User), QuoteDOT(node.ID), QuoteDOT(node.Label()))
+	}
+	for _, friendship := range graph.Friendships {
+		fmt.Fprintf(&b, "  %s %s %s [type=friendship%s];\n", QuoteDOT(friendship[0]), edge, QuoteDOT(friendship[1]), friendshipAttributes)
+	}
+	for _, request := range graph.Requests {
+		fmt.Fprintf(&b, "  %s -> %s [type=request, style=dashed];\n", QuoteDOT(request[0]), QuoteDOT(request[1]))
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteGraphML writes graph to w in GraphML (http://graphml.graphdrawing.org/). Nodes are identified by user ID and
+// have label and user data; edges have type data (friendship or request) and requests are directed
+func WriteGraphML(w io.Writer, graph SocialGraph) error {
+	ids := graph.getIDs()
+
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	b.WriteString(`  <key id="label" for="node" attr.name="label" attr.type="string"/>` + "\n")
+	b.WriteString(`  <key id="user" for="node" attr.name="user" attr.type="string"/>` + "\n")
+	b.WriteString(`  <key id="type" for="edge" attr.name="type" attr.type="string"/>` + "\n")
+	b.WriteString(`  <graph id="social" edgedefault="undirected">` + "\n")
+	for _, node := range graph.Nodes {
+		fmt.Fprintf(&b, `    <node id="%s"><data key="label">%s</data><data key="user">%s</data></node>`+"\n",
+			EscapeXML(node.ID), EscapeXML(node.Label()), EscapeXML(node.User))
+	}
+	for i, friendship := range graph.Friendships {
+		fmt.Fprintf(&b, `    <edge id="f%d" source="%s" target="%s"><data key="type">friendship</data></edge>`+"\n",
+			i, EscapeXML(ids[friendship[0]]), EscapeXML(ids[friendship[1]]))
+	}
+	for i, request := range graph.Requests {
+		fmt.Fprintf(&b, `    <edge id="r%d" source="%s" target="%s" directed="true"><data key="type">request</data></edge>`+"\n",
+			i, EscapeXML(ids[request[0]]), EscapeXML(ids[request[1]]))
+	}
+	b.WriteString("  </graph>\n</graphml>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteGEXF writes graph to w in GEXF 1.3 (https://gexf.net/), the native format of Gephi. Nodes are identified by
+// user ID and labeled; edges have a type attribute (friendship or request) and requests are directed
+func WriteGEXF(w io.Writer, graph SocialGraph) error {
+	ids := graph.getIDs()
+
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<gexf xmlns="http://gexf.net/1.3" version="1.3">` + "\n")
+	fmt.Fprintf(&b, "  <meta lastmodifieddate=\"%s\"><creator>GoServer</creator></meta>\n", time.Now().UTC().Format("2006-01-02"))
+	b.WriteString(`  <graph mode="static" defaultedgetype="undirected">` + "\n")
+	b.WriteString(`    <attributes class="node"><attribute id="user" title="user" type="string"/></attributes>` + "\n")
+	b.WriteString(`    <attributes class="edge"><attribute id="type" title="type" type="string"/></attributes>` + "\n")
+	b.WriteString("    <nodes>\n")
+	for _, node := range graph.Nodes {
+		fmt.Fprintf(&b, `      <node id="%s" label="%s"><attvalues><attvalue for="user" value="%s"/></attvalues></node>`+"\n",
+			EscapeXML(node.ID), EscapeXML(node.Label()), EscapeXML(node.User))
+	}
+	b.WriteString("    </nodes>\n    <edges>\n")
+	for i, friendship := range graph.Friendships {
+		fmt.Fprintf(&b, `      <edge id="f%d" source="%s" target="%s"><attvalues><attvalue for="type" value="friendship"/></attvalues></edge>`+"\n",
+			i, EscapeXML(ids[friendship[0]]), EscapeXML(ids[friendship[1]]))
+	}
+	for i, request := range graph.Requests {
+		fmt.Fprintf(&b, `      <edge id="r%d" source="%s" target="%s" type="directed"><attvalues><attvalue for="type" value="request"/></attvalues></edge>`+"\n",
+			i, EscapeXML(ids[request[0]]), EscapeXML(ids[request[1]]))
+	}
+	b.WriteString("    </edges>\n  </graph>\n</gexf>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Label returns the display name of the user, or the username if it has none
+func (node GraphNode) Label() string {
+	if node.DisplayName != "" {
+		return node.DisplayName
+	}
+	return node.User
+}
+
+// getIDs returns the IDs of the nodes of graph by username
+func (graph SocialGraph) getIDs() map[string]string {
+	ids := make(map[string]string, len(graph.Nodes))
+	for _, node := range graph.Nodes {
+		ids[node.User] = node.ID
+	}
+	return ids
+}
+
+// QuoteDOT returns s as a quoted DOT identifier
+func QuoteDOT(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// EscapeXML returns s escaped to be used as XML text or attribute value
+func EscapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
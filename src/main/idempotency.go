@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header with which clients identify a POST request, so that retrying it does not
+// apply it twice (see IdempotencyKeys)
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set to "true" in the responses which are replayed (see IdempotencyKeys)
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// MaxIdempotencyKeyLength is the maximum length of an idempotency key
+const MaxIdempotencyKeyLength = 255
+
+// MaxIdempotentBodySize is the maximum size in bytes of the body of a request with an idempotency key
+const MaxIdempotentBodySize = 1 << 20
+
+// DefaultIdempotencyWindow is the time during which the response to a request with an idempotency key is kept
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// DefaultIdempotencyCapacity is the maximum number of keys whose responses are kept
+const DefaultIdempotencyCapacity = 100000
+
+// IdempotencyKeys keeps the responses to the POST requests with an idempotency key for some time (the window), and
+// replays them when the requests are retried with the same key: the request is only processed the first time.
+// Keys are scoped to the caller (its credentials and user field), and at most capacity of them are kept: when full,
+// the oldest one is forgotten. It is safe for concurrent use.
+type IdempotencyKeys struct {
+	mu        sync.Mutex
+	window    time.Duration
+	capacity  int
+	responses map[string]*idempotentResponse // by caller and key (see getScopedKey)
+	order     []string                       // keys in the order they were first used, so that they expire in order
+}
+
+// idempotentResponse is the response to the request first made with a key
+type idempotentResponse struct {
+	fingerprint string // of the request (see GetRequestFingerprint)
+	done        bool   // false while the request is being processed
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// ServeIdempotentHTTP serves request r, which has an idempotency key, with server s (see IdempotencyKeys).
+// If the key was used with a different request, it populates the ResponseWriter (w) with 422 Unprocessable Entity,
+// and if the request is still being processed, with 409 Conflict. Bodies larger than MaxIdempotentBodySize get
+// 413 Request Entity Too Large. Responses with a 5xx status are not kept, so those requests are processed again
+// when retried
+func (k *IdempotencyKeys) ServeIdempotentHTTP(s *UsersServer, w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) > MaxIdempotencyKeyLength {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s must have at most %d characters", IdempotencyKeyHeader, MaxIdempotencyKeyLength)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxIdempotentBodySize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "Requests with an %s must have at most %d bytes", IdempotencyKeyHeader, MaxIdempotentBodySize)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	key = getScopedKey(r, body, key)
+	previous, isNew := k.begin(key, GetRequestFingerprint(r, body))
+	switch {
+	case isNew:
+	case previous == nil:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "%s was already used with a different request", IdempotencyKeyHeader)
+		return
+	case !previous.done:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "A request with this %s is still being processed", IdempotencyKeyHeader)
+		return
+	default:
+		for name, values := range previous.header {
+			if name != http.CanonicalHeaderKey(RequestIDHeader) {
+				w.Header()[name] = values
+			}
+		}
+		w.Header().Set(IdempotentReplayedHeader, "true")
+		w.WriteHeader(previous.status)
+		w.Write(previous.body)
+		return
+	}
+
+	processed := *s
+	processed.idempotency = nil
+	recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	processed.ServeHTTP(recorder, r)
+	k.end(key, recorder)
+}
+
+// begin registers that the request with fingerprint starts being processed with key. If key is being used (and has
+// not expired), returns its response, which is nil if it was used with a different request. Otherwise returns isNew,
+// forgetting the oldest key if there are already capacity of them
+func (k *IdempotencyKeys) begin(key, fingerprint string) (previous *idempotentResponse, isNew bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	k.expire(now)
+	if response, exists := k.responses[key]; exists {
+		if response.fingerprint != fingerprint {
+			return nil, false
+		}
+		replayed := *response
+		return &replayed, false
+	}
+
+	for len(k.responses) >= k.capacity && len(k.order) > 0 {
+		delete(k.responses, k.order[0]) // may have been released already
+		k.order = k.order[1:]
+	}
+	k.responses[key] = &idempotentResponse{fingerprint: fingerprint, expires: now.Add(k.window)}
+	k.order = append(k.order, key)
+	return nil, true
+}
+
+// end keeps the response recorded by recorder to the request made with key, unless it has a 5xx status, in which
+// case key is released
+func (k *IdempotencyKeys) end(key string, recorder *responseRecorder) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	response, exists := k.responses[key]
+	if !exists || response.done {
+		return // expired while being processed (and maybe used again)
+	}
+	if recorder.status >= http.StatusInternalServerError {
+		delete(k.responses, key) // left in order, expire skips it
+		return
+	}
+
+	response.done = true
+	response.status = recorder.status
+	response.header = recorder.Header().Clone()
+	response.body = recorder.body.Bytes()
+	response.expires = time.Now().Add(k.window)
+}
+
+// expire forgets the keys which expired at now. Keys are first used in order and kept for the same time, so the
+// ones which have expired are at the start of order (a key which was released and used again may be found later,
+// in which case it is kept until the next time)
+func (k *IdempotencyKeys) expire(now time.Time) {
+	expired := 0
+	for ; expired < len(k.order); expired++ {
+		response, exists := k.responses[k.order[expired]]
+		if exists && now.Before(response.expires) {
+			break
+		}
+		if exists {
+			delete(k.responses, k.order[expired])
+		}
+	}
+	k.order = k.order[expired:]
+}
+
+// responseRecorder is a http.ResponseWriter which records the status and body of the response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// getScopedKey returns the key under which the response to request r with body and idempotency key is kept: a
+// hash of its caller, which is identified by its credentials and its user field, followed by key. This way, callers
+// can't replay nor block each other's keys
+func getScopedKey(r *http.Request, body []byte, key string) string {
+	var info struct {
+		User string `json:"user"`
+	}
+	json.Unmarshal(body, &info)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s", r.Header.Get("Authorization"), info.User)
+	return hex.EncodeToString(hash.Sum(nil)) + " " + key
+}
+
+// GetRequestFingerprint returns a hash of request r with body, which tells apart requests with different methods,
+// URLs, credentials or bodies
+func GetRequestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n%s\n", r.Method, r.URL.RequestURI(), r.Header.Get("Authorization"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// --- INITIALIZER ---
+
+// NewIdempotencyKeys returns an empty IdempotencyKeys which keeps responses for window, and at most
+// DefaultIdempotencyCapacity of them
+func NewIdempotencyKeys(window time.Duration) *IdempotencyKeys {
+	return NewBoundedIdempotencyKeys(window, DefaultIdempotencyCapacity)
+}
+
+// NewBoundedIdempotencyKeys returns an empty IdempotencyKeys which keeps at most capacity responses for window
+func NewBoundedIdempotencyKeys(window time.Duration, capacity int) *IdempotencyKeys {
+	return &IdempotencyKeys{window: window, capacity: capacity, responses: make(map[string]*idempotentResponse)}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Message is a direct message sent by user From to user To
+type Message struct {
+	ID   int       `json:"id"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	Body string    `json:"body"`
+	Time time.Time `json:"time"`
+	Read bool      `json:"read"`
+}
+
+// InMemoryMessageStore collects direct messages in memory.
+// It is safe for concurrent use.
+type InMemoryMessageStore struct {
+	mu            sync.RWMutex
+	lastID        int
+	conversations map[ConversationKey][]Message // messages between two users, oldest first
+	partners      map[string]StringSet          // users each user has a conversation with, so that they are found without scanning all conversations
+	unread        map[string]map[string]int     // unread["peter"]["mike5"] == 2 means peter has 2 unread messages from mike5
+}
+
+// ConversationKey identifies the conversation between two users, regardless of who sent each message
+type ConversationKey struct {
+	a, b string // a < b
+}
+
+// AddMessage stores a message from user `from` to user `to` and returns it
+// Precondition: users exist in the users DB and are allowed to message each other
+func (s *InMemoryMessageStore) AddMessage(from, to, body string) Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+	message := Message{ID: s.lastID, From: from, To: to, Body: body, Time: time.Now().UTC()}
+
+	key := NewConversationKey(from, to)
+	s.conversations[key] = append(s.conversations[key], message)
+	s.addPartner(from, to)
+	s.addPartner(to, from)
+
+	if s.unread[to] == nil {
+		s.unread[to] = map[string]int{}
+	}
+	s.unread[to][from]++
+
+	return message
+}
+
+// GetConversation returns up to limit messages between user and otherUser, newest first.
+// If before is greater than 0, only messages with ID lower than before are returned (so that the next page can be
+// retrieved using the ID of the last message of the previous one).
+func (s *InMemoryMessageStore) GetConversation(user, otherUser string, before, limit int) []Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	conversation := s.conversations[NewConversationKey(user, otherUser)]
+	messages := make([]Message, 0)
+	for i := len(conversation) - 1; i >= 0 && len(messages) < limit; i-- {
+		if before <= 0 || conversation[i].ID < before {
+			messages = append(messages, conversation[i])
+		}
+	}
+	return messages
+}
+
+// MarkConversationRead marks all messages sent by otherUser to user as read
+func (s *InMemoryMessageStore) MarkConversationRead(user, otherUser string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unread[user][otherUser] == 0 {
+		return
+	}
+
+	conversation := s.conversations[NewConversationKey(user, otherUser)]
+	for i := range conversation {
+		if conversation[i].To == user {
+			conversation[i].Read = true
+		}
+	}
+	delete(s.unread[user], otherUser)
+}
+
+// GetUnreadCounts returns the number of unread messages of user by sender. Senders without unread messages are
+// not included
+func (s *InMemoryMessageStore) GetUnreadCounts(user string) map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := map[string]int{}
+	for from, count := range s.unread[user] {
+		counts[from] = count
+	}
+	return counts
+}
+
+// RenameUser calls rename, which renames user oldName to newName in the users DB, and if it succeeds rewrites all
+// messages and unread counts of oldName so that they belong to newName. No other operation on the store runs in
+// between, so messages are never seen under a username which the users DB does not know. Returns the error of rename
+// Precondition: newName has no messages
+func (s *InMemoryMessageStore) RenameUser(oldName, newName string, rename func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := rename(); err != nil {
+		return err
+	}
+
+	for otherUser := range s.partners[oldName] {
+		key := NewConversationKey(oldName, otherUser)
+		conversation := s.conversations[key]
+		for i := range conversation {
+			if conversation[i].From == oldName {
+				conversation[i].From = newName
+			}
+			if conversation[i].To == oldName {
+				conversation[i].To = newName
+			}
+		}
+		delete(s.conversations, key)
+		s.conversations[NewConversationKey(newName, otherUser)] = conversation
+
+		s.partners[otherUser].Remove(oldName)
+		s.addPartner(otherUser, newName)
+	}
+	if partners, ok := s.partners[oldName]; ok {
+		s.partners[newName] = partners
+		delete(s.partners, oldName)
+	}
+
+	if unread, ok := s.unread[oldName]; ok {
+		s.unread[newName] = unread
+		delete(s.unread, oldName)
+	}
+	for otherUser := range s.partners[newName] {
+		if count, ok := s.unread[otherUser][oldName]; ok {
+			s.unread[otherUser][newName] = count
+			delete(s.unread[otherUser], oldName)
+		}
+	}
+	return nil
+}
+
+// DeleteUser removes all messages sent or received by user, eg once the user can no longer be restored
+func (s *InMemoryMessageStore) DeleteUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for otherUser := range s.partners[user] {
+		delete(s.conversations, NewConversationKey(user, otherUser))
+		s.partners[otherUser].Remove(user)
+		delete(s.unread[otherUser], user)
+	}
+	delete(s.partners, user)
+	delete(s.unread, user)
+}
+
+// addPartner records that user has a conversation with otherUser. Caller must hold s.mu
+func (s *InMemoryMessageStore) addPartner(user, otherUser string) {
+	if s.partners[user] == nil {
+		s.partners[user] = NewStringSet()
+	}
+	s.partners[user].Add(otherUser)
+}
+
+// --- AUXILIARY FUNCTIONS ---
+
+// NewConversationKey returns the key of the conversation between users a and b
+func NewConversationKey(a, b string) ConversationKey {
+	if a > b {
+		a, b = b, a
+	}
+	return ConversationKey{a: a, b: b}
+}
+
+// --- INITIALIZER ---
+
+// EmptyMessageStore returns a new empty InMemoryMessageStore
+func EmptyMessageStore() *InMemoryMessageStore {
+	store := InMemoryMessageStore{
+		conversations: map[ConversationKey][]Message{},
+		partners:      map[string]StringSet{},
+		unread:        map[string]map[string]int{},
+	}
+	return &store
+}
@@ -1,95 +1,851 @@
 package main
 
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
 // InMemoryUsersStore collects data about users in memory.
+// Each user has an immutable ID generated when it is added; all data is keyed by ID and usernames are just a mutable
+// unique index over IDs, so that users can be renamed without rewriting any reference.
+// Friendships and pending friendship requests are kept as sets of IDs, indexed in both directions, so that checking or
+// changing a relationship between two users takes constant time regardless of how many friends they have.
+// It is safe for concurrent use: reads share a lock, writes hold it exclusively.
 type InMemoryUsersStore struct {
-	users              map[string]string
-	friendshipRequests map[string][]string // friendshipRequests["john0"] == {"peter", "mike5"} means john0 has sent a friendship request to peter and mike5
-	friends            map[string][]string // must be kept symmetric all time, ie Contains(friends["peter"], "mike5") <==> Contains(friends["mike5"], "peter")
+	mu               sync.RWMutex
+	users            map[string]string          // users["john0"] is the ID of john0
+	usernames        map[string]string          // usernames[id] is the username of user with this ID (inverse of users)
+	passwords        map[string]string          // by ID
+	sentRequests     map[string]StringSet       // by ID, sentRequests[id("john0")] == {id("peter"), id("mike5")} means john0 has sent a friendship request to peter and mike5
+	receivedRequests map[string]StringSet       // by ID, inverse of sentRequests: receivedRequests[b].Contains(a) <==> sentRequests[a].Contains(b)
+	friends          map[string]StringSet       // by ID, must be kept symmetric all time, ie friends[a].Contains(b) <==> friends[b].Contains(a)
+	profiles         map[string]Profile         // by ID
+	privacy          map[string]PrivacySettings // by ID
+	roles            map[string]string          // by ID
+	deletedUsers     map[string]deletedUser     // by username, soft-deleted users which can still be restored (see DeleteUser)
+	deletedIDs       StringSet                  // IDs of deletedUsers
+	versions         map[string]UserVersions    // by ID
+	lastVersion      uint64                     // last version given to a list (see UserVersions)
+	backup           versionsBackup             // of the versions changed by the transaction in progress, if any
+}
+
+// deletedUser holds the data of a soft-deleted user needed to restore it
+type deletedUser struct {
+	id               string
+	password         string
+	profile          Profile
+	privacy          PrivacySettings
+	role             string
+	friends          []string // IDs
+	sentRequests     []string // IDs
+	receivedRequests []string // IDs
+	deletedAt        time.Time
+}
+
+// UsersStoreSnapshot is a copy of all the data of an InMemoryUsersStore, including deleted users and versions, which
+// can be loaded into another one (see InMemoryUsersStore.Snapshot)
+type UsersStoreSnapshot struct {
+	Users        []UserSnapshot `json:"users"`
+	DeletedUsers []UserSnapshot `json:"deletedUsers"`
+	LastVersion  uint64         `json:"lastVersion"`
+}
+
+// UserSnapshot is the data of a user in a UsersStoreSnapshot. Relationships are given by ID; the received requests
+// of users which are not deleted are not given, since they are the inverse of the sent ones
+type UserSnapshot struct {
+	ID               string          `json:"id"`
+	User             string          `json:"user"`
+	Password         string          `json:"password"`
+	Role             string          `json:"role"`
+	Profile          Profile         `json:"profile"`
+	Privacy          PrivacySettings `json:"privacy"`
+	Friends          []string        `json:"friends"`
+	SentRequests     []string        `json:"sentRequests"`
+	ReceivedRequests []string        `json:"receivedRequests,omitempty"` // deleted users only
+	Versions         UserVersions    `json:"versions"`                   // users which are not deleted only
+	DeletedAt        *time.Time      `json:"deletedAt,omitempty"`        // deleted users only
 }
 
-// GetUsers retrieves a list of all users
+// versionsBackup keeps the versions changed by the mutations of a transaction as they were when it began, so that
+// they can be restored if it is rolled back (see TransactionParticipant). It is safe for concurrent use
+type versionsBackup struct {
+	mu          sync.Mutex
+	active      bool
+	lastVersion uint64                   // when the transaction began
+	versions    map[string]*UserVersions // by ID, nil if the ID had no versions
+}
+
+// GetUsers retrieves a list of all users, sorted alphabetically
 func (s *InMemoryUsersStore) GetUsers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	usernames := GetKeys(&s.users)
+	sort.Strings(usernames)
 	return usernames
 }
 
-// AddUser adds a user with given username and password.
-// Returns false iff username already exists (in this case no modifications are made)
+// AddUser adds a user with given username and password, and a newly generated ID.
+// Returns false iff username already exists or belongs to a deleted user which has not been purged yet (in this case
+// no modifications are made)
 func (s *InMemoryUsersStore) AddUser(name string, password string) bool {
+	return s.AddUserWithID(NewUserID(), name, password)
+}
+
+// AddUserWithID adds a user with given ID, username and password (eg when importing users).
+// Returns false iff ID or username already exist or username belongs to a deleted user which has not been purged yet
+// (in this case no modifications are made)
+func (s *InMemoryUsersStore) AddUserWithID(id, name, password string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if _, alreadyExists := s.users[name]; alreadyExists {
 		return false
 	}
-	s.users[name] = password
-	s.friendshipRequests[name] = make([]string, 0)
-	s.friends[name] = make([]string, 0)
+	if _, isDeleted := s.deletedUsers[name]; isDeleted {
+		return false
+	}
+	if _, idExists := s.usernames[id]; idExists || s.deletedIDs.Contains(id) {
+		return false
+	}
+
+	now := time.Now().UTC()
+	s.users[name] = id
+	s.usernames[id] = name
+	s.passwords[id] = password
+	s.sentRequests[id] = NewStringSet()
+	s.receivedRequests[id] = NewStringSet()
+	s.friends[id] = NewStringSet()
+	s.profiles[id] = Profile{ID: id, User: name, CreatedAt: now, LastSeen: now}
+	s.privacy[id] = DefaultPrivacySettings()
+	s.roles[id] = RoleUser
+	version := s.newVersion()
+	s.backupVersions(id)
+	s.versions[id] = UserVersions{Friends: version, Requests: version}
 	return true
 }
 
 // UserExists returns true iff user with name `name` exists
 func (s *InMemoryUsersStore) UserExists(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	_, exists := s.users[name]
 	return exists
 }
 
+// GetUserID returns the ID of user with name `name`.
+// ok is false iff user does not exist
+func (s *InMemoryUsersStore) GetUserID(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.users[name]
+	return id, ok
+}
+
+// GetUsername returns the username of user with ID `id`.
+// ok is false iff user does not exist
+func (s *InMemoryUsersStore) GetUsername(id string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name, ok := s.usernames[id]
+	return name, ok
+}
+
+// IsDeletedUser returns true iff `name` is the username of a deleted user which has not been purged yet, so it can't
+// be taken by another user
+func (s *InMemoryUsersStore) IsDeletedUser(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, isDeleted := s.deletedUsers[name]
+	return isDeleted
+}
+
+// IsDeletedID returns true iff `id` is the ID of a deleted user which has not been purged yet, so it can't be taken
+// by another user
+func (s *InMemoryUsersStore) IsDeletedID(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.deletedIDs.Contains(id)
+}
+
 // RequestFriendship adds a friendship request from user `from` to user `to`.
-// Returns false iff friendship request between both users already exists or users are already friends (in this case no modifications are made)
-// Precondition: from and to users exist in the DB and have been correctly initialized (ie using AddUser function)
+// Returns false iff friendship request between both users already exists, users are already friends or any of them
+// does not exist (in this case no modifications are made)
 func (s *InMemoryUsersStore) RequestFriendship(from, to string) bool {
-	myRequests := s.friendshipRequests[from]
-	if Contains(myRequests, to) {
+	return s.RequestFriendshipIf(from, to, nil)
+}
+
+// RequestFriendshipIf adds a friendship request from user `from` to user `to` iff condition, called with the
+// versions of `from` while no other operation can change them, returns true (a nil condition always does).
+// Returns false iff condition returned false or RequestFriendship would return false (in this case no modifications
+// are made)
+func (s *InMemoryUsersStore) RequestFriendshipIf(from, to string, condition func(versions UserVersions) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fromID, fromExists := s.users[from]
+	toID, toExists := s.users[to]
+	if !fromExists || !toExists {
 		return false
 	}
-
-	theirRequests := s.friendshipRequests[to]
-	if Contains(theirRequests, from) {
+	if condition != nil && !condition(s.versions[fromID]) {
 		return false
 	}
-
-	myFriends := s.friends[from]
-	if Contains(myFriends, to) {
+	if s.sentRequests[fromID].Contains(toID) || s.sentRequests[toID].Contains(fromID) || s.friends[fromID].Contains(toID) {
 		return false
 	}
 
-	s.friendshipRequests[from] = append(myRequests, to)
+	s.sentRequests[fromID].Add(toID)
+	s.receivedRequests[toID].Add(fromID)
+	s.setRequestsVersion(s.newVersion(), fromID, toID)
 	return true
 }
 
+// GetPassword returns the password of user (eg to export users).
+// ok is false iff user does not exist
+func (s *InMemoryUsersStore) GetPassword(user string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, exists := s.users[user]
+	if !exists {
+		return "", false
+	}
+	return s.passwords[id], true
+}
+
 // CheckUsersPassword returns true if user existst and has this password
 func (s *InMemoryUsersStore) CheckUsersPassword(user, password string) bool {
-	storedPassword, exists := s.users[user]
-	return exists && storedPassword == password
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, exists := s.users[user]
+	return exists && s.passwords[id] == password
+}
+
+// ChangePassword sets the password of user to newPassword.
+// Returns false iff user does not exist (in this case no modifications are made)
+// Precondition: newPassword is valid (ie using CheckUsernameAndPassword function)
+func (s *InMemoryUsersStore) ChangePassword(user, newPassword string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, exists := s.users[user]
+	if !exists {
+		return false
+	}
+	s.passwords[id] = newPassword
+	return true
 }
 
 // RespondToFriendshipRequest responds to a friendship request from otherUser made to user
 // Returns false iff friendship request does not exist (in this case no modifications are made)
 // Precondition: user and otherUser exist in the DB and have been correctly initialized (ie using AddUser function)
 func (s *InMemoryUsersStore) RespondToFriendshipRequest(user, otherUser string, acceptRequest bool) bool {
-	requests, hasRequests := s.friendshipRequests[otherUser]
-	if !hasRequests {
+	return s.RespondToFriendshipRequestIf(user, otherUser, acceptRequest, nil)
+}
+
+// RespondToFriendshipRequestIf responds to a friendship request from otherUser made to user iff condition, called with
+// the versions of user while no other operation can change them, returns true (a nil condition always does).
+// Returns false iff condition returned false or RespondToFriendshipRequest would return false (in this case no
+// modifications are made)
+func (s *InMemoryUsersStore) RespondToFriendshipRequestIf(user, otherUser string, acceptRequest bool, condition func(versions UserVersions) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userID, otherUserID := s.users[user], s.users[otherUser]
+	if !s.receivedRequests[userID].Contains(otherUserID) {
+		return false
+	}
+	if condition != nil && !condition(s.versions[userID]) {
 		return false
 	}
 
-	myFriends := s.friends[user]
-	theirFriends := s.friends[otherUser]
+	s.receivedRequests[userID].Remove(otherUserID)
+	s.sentRequests[otherUserID].Remove(userID)
+	version := s.newVersion()
+	s.setRequestsVersion(version, userID, otherUserID)
+	if acceptRequest {
+		s.friends[userID].Add(otherUserID)
+		s.friends[otherUserID].Add(userID)
+		s.setFriendsVersion(version, userID, otherUserID)
+	}
+	return true
+}
 
-	for i := 0; i < len(requests); i++ {
-		if requests[i] == user {
-			s.friendshipRequests[otherUser] = Remove(requests, i)
-			if acceptRequest {
-				s.friends[user] = append(myFriends, otherUser)
-				s.friends[otherUser] = append(theirFriends, user)
-			}
-			return true
+// GetFriends returns the list od friends of a given user, sorted. The returned slice is a copy and can be modified freely.
+// Precondition: user exists in the DB and has been correctly initialized (ie using AddUser function)
+func (s *InMemoryUsersStore) GetFriends(user string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.getUsernames(s.friends[s.users[user]])
+}
+
+// GetFriendshipRequests returns the users to whom user has sent a friendship request which is still pending (sent)
+// and the users who have sent one to user (received), sorted. The returned slices are copies and can be modified freely.
+// ok is false iff user does not exist
+func (s *InMemoryUsersStore) GetFriendshipRequests(user string) (sent, received []string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, exists := s.users[user]
+	if !exists {
+		return nil, nil, false
+	}
+
+	return s.getUsernames(s.sentRequests[id]), s.getUsernames(s.receivedRequests[id]), true
+}
+
+// AreFriends returns true iff users user and otherUser exist and are friends. It takes constant time
+func (s *InMemoryUsersStore) AreFriends(user, otherUser string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, exists := s.users[user]
+	otherID, otherExists := s.users[otherUser]
+	return exists && otherExists && s.friends[id].Contains(otherID)
+}
+
+// HasFriendshipRequest returns true iff users `from` and `to` exist and there is a pending friendship request from
+// `from` to `to`. It takes constant time
+func (s *InMemoryUsersStore) HasFriendshipRequest(from, to string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fromID, fromExists := s.users[from]
+	toID, toExists := s.users[to]
+	return fromExists && toExists && s.sentRequests[fromID].Contains(toID)
+}
+
+// HaveCommonFriend returns true iff users user and otherUser exist and have a friend in common. It takes time
+// proportional to the number of friends of the one with fewer friends
+func (s *InMemoryUsersStore) HaveCommonFriend(user, otherUser string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, exists := s.users[user]
+	otherID, otherExists := s.users[otherUser]
+	return exists && otherExists && s.friends[id].Intersects(s.friends[otherID])
+}
+
+// RemoveFriendship removes the friendship between user and otherUser.
+// Returns false iff they are not friends (in this case no modifications are made)
+func (s *InMemoryUsersStore) RemoveFriendship(user, otherUser string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userID, otherUserID := s.users[user], s.users[otherUser]
+
+	if !s.friends[userID].Contains(otherUserID) {
+		return false
+	}
+
+	s.friends[userID].Remove(otherUserID)
+	s.friends[otherUserID].Remove(userID)
+	s.setFriendsVersion(s.newVersion(), userID, otherUserID)
+	return true
+}
+
+// GetProfile returns the profile of user.
+// ok is false iff user does not exist
+func (s *InMemoryUsersStore) GetProfile(user string) (Profile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, exists := s.users[user]
+	if !exists {
+		return Profile{}, false
+	}
+	return s.profiles[id], true
+}
+
+// UpdateProfile modifies the profile of user with the non-nil fields of update.
+// Returns false iff user does not exist (in this case no modifications are made)
+// Precondition: update has been validated (ie using CheckProfileUpdate function)
+func (s *InMemoryUsersStore) UpdateProfile(user string, update ProfileUpdate) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, exists := s.users[user]
+	if !exists {
+		return false
+	}
+	profile := s.profiles[id]
+	update.Apply(&profile)
+	s.profiles[id] = profile
+	return true
+}
+
+// GetPrivacySettings returns the privacy settings of user.
+// ok is false iff user does not exist
+func (s *InMemoryUsersStore) GetPrivacySettings(user string) (PrivacySettings, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, exists := s.users[user]
+	if !exists {
+		return PrivacySettings{}, false
+	}
+	return s.privacy[id], true
+}
+
+// UpdatePrivacySettings modifies the privacy settings of user with the non-nil fields of update.
+// Returns false iff user does not exist (in this case no modifications are made)
+// Precondition: update has been validated (ie using CheckPrivacySettingsUpdate function)
+func (s *InMemoryUsersStore) UpdatePrivacySettings(user string, update PrivacySettingsUpdate) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, exists := s.users[user]
+	if !exists {
+		return false
+	}
+	settings := s.privacy[id]
+	update.Apply(&settings)
+	s.privacy[id] = settings
+	return true
+}
+
+// GetRole returns the role of user.
+// ok is false iff user does not exist
+func (s *InMemoryUsersStore) GetRole(user string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, exists := s.users[user]
+	if !exists {
+		return "", false
+	}
+	return s.roles[id], true
+}
+
+// SetRole sets the role of user.
+// Returns false iff user does not exist (in this case no modifications are made)
+// Precondition: role is valid (ie using IsValidRole function)
+func (s *InMemoryUsersStore) SetRole(user, role string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, exists := s.users[user]
+	if !exists {
+		return false
+	}
+	s.roles[id] = role
+	return true
+}
+
+// TouchUser sets the last time user was seen to now. Does nothing if user does not exist
+func (s *InMemoryUsersStore) TouchUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, exists := s.users[user]; exists {
+		profile := s.profiles[id]
+		profile.LastSeen = time.Now().UTC()
+		s.profiles[id] = profile
+	}
+}
+
+// RenameUser changes the username of user oldName to newName. The ID of the user does not change, so no references
+// need to be rewritten.
+// Returns false iff oldName does not exist or newName already exists or belongs to a deleted user which has not
+// been purged yet (in this case no modifications are made)
+// Precondition: newName is valid (ie using CheckUsernameAndPassword function)
+func (s *InMemoryUsersStore) RenameUser(oldName, newName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, exists := s.users[oldName]
+	if !exists {
+		return false
+	}
+	if _, alreadyExists := s.users[newName]; alreadyExists {
+		return false
+	}
+	if _, isDeleted := s.deletedUsers[newName]; isDeleted {
+		return false
+	}
+
+	profile := s.profiles[id]
+	profile.User = newName
+	s.profiles[id] = profile
+	s.users[newName] = id
+	s.usernames[id] = newName
+	delete(s.users, oldName)
+
+	// The lists in which the user appears change
+	version := s.newVersion()
+	s.setFriendsVersion(version, s.friends[id].Slice()...)
+	s.setRequestsVersion(version, s.sentRequests[id].Slice()...)
+	s.setRequestsVersion(version, s.receivedRequests[id].Slice()...)
+	return true
+}
+
+// DeleteUser soft-deletes user `name`: the user is removed from users, from the friends lists of all their friends and
+// from all pending friendship requests (sent or received), but their data is kept so that they can be restored later
+// (see RestoreUser) until purged (see PurgeDeletedUsers).
+// Returns false iff user does not exist (in this case no modifications are made)
+func (s *InMemoryUsersStore) DeleteUser(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, exists := s.users[name]
+	if !exists {
+		return false
+	}
+
+	deleted := deletedUser{
+		id:               id,
+		password:         s.passwords[id],
+		profile:          s.profiles[id],
+		privacy:          s.privacy[id],
+		role:             s.roles[id],
+		friends:          s.friends[id].Slice(),
+		sentRequests:     s.sentRequests[id].Slice(),
+		receivedRequests: s.receivedRequests[id].Slice(),
+		deletedAt:        time.Now().UTC(),
+	}
+
+	version := s.newVersion()
+	for friend := range s.friends[id] {
+		s.friends[friend].Remove(id)
+		s.setFriendsVersion(version, friend)
+	}
+	for to := range s.sentRequests[id] {
+		s.receivedRequests[to].Remove(id)
+		s.setRequestsVersion(version, to)
+	}
+	for from := range s.receivedRequests[id] {
+		s.sentRequests[from].Remove(id)
+		s.setRequestsVersion(version, from)
+	}
+
+	delete(s.users, name)
+	delete(s.usernames, id)
+	delete(s.passwords, id)
+	delete(s.sentRequests, id)
+	delete(s.receivedRequests, id)
+	delete(s.friends, id)
+	delete(s.profiles, id)
+	delete(s.privacy, id)
+	delete(s.roles, id)
+	s.backupVersions(id)
+	delete(s.versions, id)
+	s.deletedUsers[name] = deleted
+	s.deletedIDs.Add(id)
+	return true
+}
+
+// RestoreUser restores the soft-deleted user `name` (with the same ID), along with their friendships and pending
+// friendship requests with users who still exist.
+// Returns false iff there is no deleted user with this name and password (in this case no modifications are made)
+func (s *InMemoryUsersStore) RestoreUser(name, password string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted, isDeleted := s.deletedUsers[name]
+	if !isDeleted || deleted.password != password {
+		return false
+	}
+
+	id := deleted.id
+	s.users[name] = id
+	s.usernames[id] = name
+	s.passwords[id] = password
+	s.sentRequests[id] = NewStringSet()
+	s.receivedRequests[id] = NewStringSet()
+	s.friends[id] = NewStringSet()
+	s.profiles[id] = deleted.profile
+	s.privacy[id] = deleted.privacy
+	s.roles[id] = deleted.role
+	delete(s.deletedUsers, name)
+	s.deletedIDs.Remove(id)
+	version := s.newVersion()
+	s.backupVersions(id)
+	s.versions[id] = UserVersions{Friends: version, Requests: version}
+
+	for _, friend := range deleted.friends {
+		if _, exists := s.usernames[friend]; exists {
+			s.friends[id].Add(friend)
+			s.friends[friend].Add(id)
+			s.setFriendsVersion(version, friend)
 		}
 	}
 
-	return false
+	for _, to := range deleted.sentRequests {
+		if _, exists := s.usernames[to]; exists && !s.friends[id].Contains(to) && !s.sentRequests[to].Contains(id) {
+			s.sentRequests[id].Add(to)
+			s.receivedRequests[to].Add(id)
+			s.setRequestsVersion(version, to)
+		}
+	}
+
+	for _, from := range deleted.receivedRequests {
+		if _, exists := s.usernames[from]; exists && !s.friends[id].Contains(from) && !s.sentRequests[id].Contains(from) {
+			s.sentRequests[from].Add(id)
+			s.receivedRequests[id].Add(from)
+			s.setRequestsVersion(version, from)
+		}
+	}
+
+	return true
 }
 
-// GetFriends returns the list od friends of a given user
-// Precondition: user exists in the DB and has been correctly initialized (ie using AddUser function)
-func (s *InMemoryUsersStore) GetFriends(user string) []string {
-	return s.friends[user]
+// PurgeDeletedUsers permanently removes the users deleted before deletedBefore, which can no longer be restored
+// and whose usernames become available again. Returns the usernames of the purged users
+func (s *InMemoryUsersStore) PurgeDeletedUsers(deletedBefore time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := make([]string, 0)
+	for name, deleted := range s.deletedUsers {
+		if deleted.deletedAt.Before(deletedBefore) {
+			delete(s.deletedUsers, name)
+			s.deletedIDs.Remove(deleted.id)
+			purged = append(purged, name)
+		}
+	}
+	return purged
+}
+
+// PurgeDeletedUser permanently removes the deleted user `name` regardless of when they were deleted.
+// Returns false iff there is no deleted user with this name
+func (s *InMemoryUsersStore) PurgeDeletedUser(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted, isDeleted := s.deletedUsers[name]
+	if !isDeleted {
+		return false
+	}
+	delete(s.deletedUsers, name)
+	s.deletedIDs.Remove(deleted.id)
+	return true
+}
+
+// GetVersions returns the versions of the friends list and the friendship requests of user.
+// ok is false iff user does not exist
+func (s *InMemoryUsersStore) GetVersions(user string) (UserVersions, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, exists := s.users[user]
+	if !exists {
+		return UserVersions{}, false
+	}
+	return s.versions[id], true
+}
+
+// newVersion returns a new version for the lists changed by an operation (see UserVersions). Caller must hold s.mu
+// for writing
+func (s *InMemoryUsersStore) newVersion() uint64 {
+	s.lastVersion++
+	return s.lastVersion
+}
+
+// setFriendsVersion sets the version of the friends lists of the users with the given IDs. Caller must hold s.mu for
+// writing
+func (s *InMemoryUsersStore) setFriendsVersion(version uint64, ids ...string) {
+	for _, id := range ids {
+		s.backupVersions(id)
+		versions := s.versions[id]
+		versions.Friends = version
+		s.versions[id] = versions
+	}
+}
+
+// setRequestsVersion sets the version of the friendship requests of the users with the given IDs. Caller must hold
+// s.mu for writing
+func (s *InMemoryUsersStore) setRequestsVersion(version uint64, ids ...string) {
+	for _, id := range ids {
+		s.backupVersions(id)
+		versions := s.versions[id]
+		versions.Requests = version
+		s.versions[id] = versions
+	}
+}
+
+// backupVersions backs up the versions of the user with ID id if a transaction is in progress (see BeginTransaction).
+// Caller must hold s.mu for writing
+func (s *InMemoryUsersStore) backupVersions(id string) {
+	versions, ok := s.versions[id]
+	s.backup.save(id, versions, ok)
+}
+
+// BeginTransaction starts backing up the versions changed by the mutations which follow, until EndTransaction is
+// called (see TransactionParticipant)
+func (s *InMemoryUsersStore) BeginTransaction() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.backup.begin(s.lastVersion)
+}
+
+// EndTransaction stops backing up versions, restoring the ones backed up (and the last version given) unless the
+// transaction was committed (see TransactionParticipant)
+func (s *InMemoryUsersStore) EndTransaction(commit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versions, lastVersion := s.backup.end()
+	if commit {
+		return
+	}
+	for id, saved := range versions {
+		if saved == nil {
+			delete(s.versions, id)
+		} else {
+			s.versions[id] = *saved
+		}
+	}
+	s.lastVersion = lastVersion
+}
+
+// begin starts backing up versions, given the last version given to a list
+func (b *versionsBackup) begin(lastVersion uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.active = true
+	b.lastVersion = lastVersion
+	b.versions = map[string]*UserVersions{}
+}
+
+// save backs up the versions of the user with ID id (ok is false if they have none) if a backup is in progress and
+// they have not been backed up yet
+func (b *versionsBackup) save(id string, versions UserVersions, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, saved := b.versions[id]; !b.active || saved {
+		return
+	}
+	if ok {
+		b.versions[id] = &versions
+	} else {
+		b.versions[id] = nil
+	}
+}
+
+// end stops backing up versions, returning the ones backed up and the last version when the backup began
+func (b *versionsBackup) end() (versions map[string]*UserVersions, lastVersion uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	versions, lastVersion = b.versions, b.lastVersion
+	b.active = false
+	b.versions = nil
+	return versions, lastVersion
+}
+
+// getUsernames returns the usernames of the users with the given IDs, sorted. Caller must hold s.mu
+func (s *InMemoryUsersStore) getUsernames(ids StringSet) []string {
+	names := make([]string, 0, len(ids))
+	for id := range ids {
+		names = append(names, s.usernames[id])
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Snapshot returns a copy of all the data of the store
+func (s *InMemoryUsersStore) Snapshot() UsersStoreSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := UsersStoreSnapshot{
+		Users:        make([]UserSnapshot, 0, len(s.users)),
+		DeletedUsers: make([]UserSnapshot, 0, len(s.deletedUsers)),
+		LastVersion:  s.lastVersion,
+	}
+	for name, id := range s.users {
+		snapshot.Users = append(snapshot.Users, UserSnapshot{
+			ID:           id,
+			User:         name,
+			Password:     s.passwords[id],
+			Role:         s.roles[id],
+			Profile:      s.profiles[id],
+			Privacy:      s.privacy[id],
+			Friends:      s.friends[id].Slice(),
+			SentRequests: s.sentRequests[id].Slice(),
+			Versions:     s.versions[id],
+		})
+	}
+	for name, deleted := range s.deletedUsers {
+		deletedAt := deleted.deletedAt
+		snapshot.DeletedUsers = append(snapshot.DeletedUsers, UserSnapshot{
+			ID:               deleted.id,
+			User:             name,
+			Password:         deleted.password,
+			Role:             deleted.role,
+			Profile:          deleted.profile,
+			Privacy:          deleted.privacy,
+			Friends:          deleted.friends,
+			SentRequests:     deleted.sentRequests,
+			ReceivedRequests: deleted.receivedRequests,
+			DeletedAt:        &deletedAt,
+		})
+	}
+	return snapshot
+}
+
+// LoadSnapshot replaces all the data of the store with the one of snapshot, which must have been returned by Snapshot
+func (s *InMemoryUsersStore) LoadSnapshot(snapshot UsersStoreSnapshot) {
+	loaded := EmptyUsersStore()
+	for _, user := range snapshot.Users {
+		loaded.users[user.User] = user.ID
+		loaded.usernames[user.ID] = user.User
+		loaded.passwords[user.ID] = user.Password
+		loaded.roles[user.ID] = user.Role
+		loaded.profiles[user.ID] = user.Profile
+		loaded.privacy[user.ID] = user.Privacy
+		loaded.friends[user.ID] = NewStringSet(user.Friends...)
+		loaded.sentRequests[user.ID] = NewStringSet(user.SentRequests...)
+		loaded.receivedRequests[user.ID] = NewStringSet()
+		loaded.versions[user.ID] = user.Versions
+	}
+	for _, user := range snapshot.Users {
+		for _, to := range user.SentRequests {
+			if received, exists := loaded.receivedRequests[to]; exists {
+				received.Add(user.ID)
+			}
+		}
+	}
+	for _, user := range snapshot.DeletedUsers {
+		deleted := deletedUser{
+			id:               user.ID,
+			password:         user.Password,
+			profile:          user.Profile,
+			privacy:          user.Privacy,
+			role:             user.Role,
+			friends:          user.Friends,
+			sentRequests:     user.SentRequests,
+			receivedRequests: user.ReceivedRequests,
+		}
+		if user.DeletedAt != nil {
+			deleted.deletedAt = *user.DeletedAt
+		}
+		loaded.deletedUsers[user.User] = deleted
+		loaded.deletedIDs.Add(user.ID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users, s.usernames, s.passwords, s.roles = loaded.users, loaded.usernames, loaded.passwords, loaded.roles
+	s.profiles, s.privacy = loaded.profiles, loaded.privacy
+	s.friends, s.sentRequests, s.receivedRequests = loaded.friends, loaded.sentRequests, loaded.receivedRequests
+	s.deletedUsers, s.deletedIDs = loaded.deletedUsers, loaded.deletedIDs
+	s.versions, s.lastVersion = loaded.versions, snapshot.LastVersion
 }
 
 // --- AUXILIARY FUNCTIONS ---
@@ -118,20 +874,55 @@ func Contains(s []string, e string) bool {
 	return false
 }
 
+// IndexOf returns the position of element e in slice s, or -1 if s does not contain e
+func IndexOf(s []string, e string) int {
+	for i, a := range s {
+		if a == e {
+			return i
+		}
+	}
+	return -1
+}
+
 // Remove returns a slice identical to s except that element at position i is eliminated (order not preserved)
 func Remove(s []string, i int) []string {
 	s[i] = s[len(s)-1]
 	return s[:len(s)-1]
 }
 
+// NewUserID returns a new random user ID (a version 4 UUID)
+func NewUserID() string {
+	return NewUserIDFrom(rand.Reader)
+}
+
+// NewUserIDFrom returns a new user ID (a version 4 UUID) made of bytes read from random
+func NewUserIDFrom(random io.Reader) string {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(random, b); err != nil {
+		panic(err) // neither crypto/rand (on supported platforms) nor math/rand fail
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
 // --- INITIALIZER ---
 
 // EmptyUsersStore returns a new empty InMemoryUsersStore
 func EmptyUsersStore() *InMemoryUsersStore {
 	store := InMemoryUsersStore{
-		users:              map[string]string{},
-		friendshipRequests: map[string][]string{},
-		friends:            map[string][]string{},
+		users:            map[string]string{},
+		usernames:        map[string]string{},
+		passwords:        map[string]string{},
+		sentRequests:     map[string]StringSet{},
+		receivedRequests: map[string]StringSet{},
+		friends:          map[string]StringSet{},
+		profiles:         map[string]Profile{},
+		privacy:          map[string]PrivacySettings{},
+		roles:            map[string]string{},
+		deletedUsers:     map[string]deletedUser{},
+		deletedIDs:       NewStringSet(),
+		versions:         map[string]UserVersions{},
 	}
 	return &store
 }
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations replayed by RunLoadTest
+const (
+	LoadTestSignUp            = "signUp"
+	LoadTestRequestFriendship = "requestFriendship"
+	LoadTestRespond           = "respond"
+	LoadTestGetFriends        = "getFriends"
+)
+
+// LoadTestOperations are all operations replayed by RunLoadTest, in the order they are reported
+var LoadTestOperations = []string{LoadTestSignUp, LoadTestRequestFriendship, LoadTestRespond, LoadTestGetFriends}
+
+// LoadTestPassword is the password of all users signed up by RunLoadTest
+const LoadTestPassword = "loadtest1"
+
+// LoadTestConfig describes the traffic generated by RunLoadTest
+type LoadTestConfig struct {
+	Server      string         // URL of the server
+	Duration    time.Duration  // how long to generate traffic (if Requests is 0)
+	Requests    int            // if not 0, number of requests to send instead of running for Duration
+	Concurrency int            // number of concurrent clients
+	Users       int            // number of users signed up before starting, not measured
+	Mix         map[string]int // relative weight of each of LoadTestOperations
+	Seed        int64          // seed of the random generators choosing operations and users
+}
+
+// LoadTestStats are the results of the requests of an operation (or all of them). Rejected requests got a 4xx
+// status, which is expected under random traffic (eg requesting the friendship of a friend); failed requests got a
+// 5xx status or no response at all
+type LoadTestStats struct {
+	Operation  string        `json:"operation"`
+	Requests   int           `json:"requests"`
+	Rejected   int           `json:"rejected"`
+	Failed     int           `json:"failed"`
+	Throughput float64       `json:"throughput"` // requests per second
+	P50        time.Duration `json:"p50"`
+	P90        time.Duration `json:"p90"`
+	P99        time.Duration `json:"p99"`
+	Max        time.Duration `json:"max"`
+}
+
+// LoadTestReport is the result of RunLoadTest: the stats of each operation and the total
+type LoadTestReport struct {
+	Duration   time.Duration   `json:"duration"`
+	Operations []LoadTestStats `json:"operations"`
+	Total      LoadTestStats   `json:"total"`
+}
+
+// loadTestSample is the result of a request
+type loadTestSample struct {
+	operation string
+	latency   time.Duration
+	status    int // 0 if the request failed without a response
+}
+
+// loadTest holds the state shared by the clients of RunLoadTest: the users signed up so far and the pending
+// friendship requests sent by them
+type loadTest struct {
+	config  LoadTestConfig
+	client  *http.Client
+	prefix  string // of the usernames signed up by this load test, so that it can run against a populated server (see NewLoadTestPrefix)
+	mu      sync.Mutex
+	next    int // number of the next user signed up, appended to prefix in base 36
+	users   []string
+	pending [][2]string
+}
+
+// RunLoadTest signs up config.Users users in the server and then replays a random mix of signUp, requestFriendship,
+// respondToFriendshipRequest and getFriends requests from config.Concurrency concurrent clients, either for
+// config.Duration or until config.Requests requests have been sent. Users are chosen at random among the ones signed
+// up by the load test; respond answers (accepting or declining) a random pending friendship request sent during the
+// load test, or sends one if there are none. Returns the throughput and latency percentiles of each operation
+func RunLoadTest(client *http.Client, config LoadTestConfig) (LoadTestReport, error) {
+	if err := config.Check(); err != nil {
+		return LoadTestReport{}, err
+	}
+
+	test := &loadTest{
+		config: config,
+		client: client,
+		prefix: NewLoadTestPrefix(),
+	}
+
+	// Sign up the initial users, without measuring
+	var wg sync.WaitGroup
+	errs := make(chan error, config.Concurrency)
+	for c := 0; c < config.Concurrency; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := c; i < config.Users; i += config.Concurrency {
+				if sample := test.signUp(); sample.status != http.StatusOK {
+					errs <- fmt.Errorf("could not sign up initial users: got status %d", sample.status)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return LoadTestReport{}, err
+	}
+
+	weights := make([]int, len(LoadTestOperations))
+	total := 0
+	for i, operation := range LoadTestOperations {
+		total += config.Mix[operation]
+		weights[i] = total
+	}
+
+	var remaining int64 = math.MaxInt64
+	if config.Requests > 0 {
+		remaining = int64(config.Requests)
+	}
+	var remainingMu sync.Mutex
+	deadline := time.Now().Add(config.Duration)
+	samples := make([][]loadTestSample, config.Concurrency)
+
+	start := time.Now()
+	for c := 0; c < config.Concurrency; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(config.Seed + int64(c) + 1))
+			for {
+				remainingMu.Lock()
+				done := remaining <= 0 || (config.Requests == 0 && time.Now().After(deadline))
+				remaining--
+				remainingMu.Unlock()
+				if done {
+					return
+				}
+
+				choice := random.Intn(total)
+				operation := LoadTestOperations[sort.SearchInts(weights, choice+1)]
+				samples[c] = append(samples[c], test.run(operation, random))
+			}
+		}(c)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	all := make([]loadTestSample, 0)
+	for _, s := range samples {
+		all = append(all, s...)
+	}
+	return NewLoadTestReport(all, elapsed), nil
+}
+
+// Check returns an error iff config is not valid
+func (config LoadTestConfig) Check() error {
+	total := 0
+	for operation, weight := range config.Mix {
+		if !Contains(LoadTestOperations, operation) {
+			return fmt.Errorf("unknown operation %q", operation)
+		}
+		if weight < 0 {
+			return fmt.Errorf("weight of %s must not be negative", operation)
+		}
+		total += weight
+	}
+
+	switch {
+	case config.Concurrency < 1:
+		return errors.New("concurrency must be at least 1")
+	case config.Requests < 0:
+		return errors.New("number of requests must not be negative")
+	case config.Requests == 0 && config.Duration <= 0:
+		return errors.New("either duration or number of requests must be positive")
+	case config.Users < 0:
+		return errors.New("number of users must not be negative")
+	case total == 0:
+		return errors.New("mix must have at least one operation with positive weight")
+	case config.Mix[LoadTestSignUp] == 0 && config.Users < 2:
+		return errors.New("at least 2 users are needed if there are no signUp requests")
+	}
+	return nil
+}
+
+// ParseLoadTestMix parses a mix of operations given as comma-separated operation=weight pairs, eg
+// "signUp=1,getFriends=10". Operations not given have weight 0
+func ParseLoadTestMix(s string) (map[string]int, error) {
+	mix := map[string]int{}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not operation=weight", pair)
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%q is not operation=weight", pair)
+		}
+		mix[parts[0]] = weight
+	}
+	return mix, nil
+}
+
+// NewLoadTestReport returns the report of samples collected during elapsed
+func NewLoadTestReport(samples []loadTestSample, elapsed time.Duration) LoadTestReport {
+	report := LoadTestReport{Duration: elapsed, Operations: make([]LoadTestStats, 0)}
+	byOperation := map[string][]loadTestSample{}
+	for _, sample := range samples {
+		byOperation[sample.operation] = append(byOperation[sample.operation], sample)
+	}
+	for _, operation := range LoadTestOperations {
+		if len(byOperation[operation]) > 0 {
+			report.Operations = append(report.Operations, NewLoadTestStats(operation, byOperation[operation], elapsed))
+		}
+	}
+	report.Total = NewLoadTestStats("total", samples, elapsed)
+	return report
+}
+
+// NewLoadTestStats returns the stats of the samples of operation collected during elapsed
+func NewLoadTestStats(operation string, samples []loadTestSample, elapsed time.Duration) LoadTestStats {
+	stats := LoadTestStats{Operation: operation, Requests: len(samples)}
+	if len(samples) == 0 {
+		return stats
+	}
+
+	latencies := make([]time.Duration, len(samples))
+	for i, sample := range samples {
+		latencies[i] = sample.latency
+		switch {
+		case sample.status == 0 || sample.status >= 500:
+			stats.Failed++
+		case sample.status >= 400:
+			stats.Rejected++
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	stats.Throughput = float64(len(samples)) / elapsed.Seconds()
+	stats.P50 = GetPercentile(latencies, 50)
+	stats.P90 = GetPercentile(latencies, 90)
+	stats.P99 = GetPercentile(latencies, 99)
+	stats.Max = latencies[len(latencies)-1]
+	return stats
+}
+
+// GetPercentile returns the p-th percentile (nearest rank) of sorted, which must not be empty
+func GetPercentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Print writes report to w as a table
+func (report LoadTestReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "%-18s %9s %9s %7s %10s %10s %10s %10s %10s\n", "operation", "requests", "rejected", "failed", "req/s", "p50", "p90", "p99", "max")
+	for _, stats := range append(report.Operations, report.Total) {
+		fmt.Fprintf(w, "%-18s %9d %9d %7d %10.1f %10s %10s %10s %10s\n", stats.Operation, stats.Requests, stats.Rejected,
+			stats.Failed, stats.Throughput, FormatLatency(stats.P50), FormatLatency(stats.P90), FormatLatency(stats.P99),
+			FormatLatency(stats.Max))
+	}
+	fmt.Fprintf(w, "%d requests in %s\n", report.Total.Requests, report.Duration.Round(time.Millisecond))
+}
+
+// FormatLatency returns d rounded to microseconds
+func FormatLatency(d time.Duration) string {
+	return d.Round(time.Microsecond).String()
+}
+
+// NewLoadTestPrefix returns a random prefix for the usernames signed up by a load test: "l" followed by 4 base 36
+// digits, which leaves 5 characters for the number of each user. It does not depend on the seed, so that the users of
+// a load test don't clash with the ones of a previous run against the same server
+func NewLoadTestPrefix() string {
+	var b [4]byte
+	cryptorand.Read(b[:])
+	n := binary.BigEndian.Uint32(b[:]) % (36 * 36 * 36 * 36)
+	return fmt.Sprintf("l%04s", strconv.FormatInt(int64(n), 36))
+}
+
+// run sends a request of operation using random to choose users
+func (test *loadTest) run(operation string, random *rand.Rand) loadTestSample {
+	switch operation {
+	case LoadTestSignUp:
+		return test.signUp()
+	case LoadTestRespond:
+		if sample, ok := test.respond(random); ok {
+			return sample
+		}
+	case LoadTestGetFriends:
+		return test.getFriends(random)
+	}
+	return test.requestFriendship(random)
+}
+
+// signUp signs up a new user
+func (test *loadTest) signUp() loadTestSample {
+	test.mu.Lock()
+	user := test.prefix + strconv.FormatInt(int64(test.next), 36)
+	test.next++
+	test.mu.Unlock()
+
+	sample := test.post(LoadTestSignUp, "/signUp", map[string]string{"user": user, "pass": LoadTestPassword})
+	if sample.status == http.StatusOK {
+		test.mu.Lock()
+		test.users = append(test.users, user)
+		test.mu.Unlock()
+	}
+	return sample
+}
+
+// requestFriendship sends a friendship request between two random users
+func (test *loadTest) requestFriendship(random *rand.Rand) loadTestSample {
+	from, to := test.getRandomUser(random), test.getRandomUser(random)
+	sample := test.post(LoadTestRequestFriendship, "/requestFriendship",
+		map[string]string{"user": from, "pass": LoadTestPassword, "userTo": to})
+	if sample.status == http.StatusOK {
+		test.mu.Lock()
+		test.pending = append(test.pending, [2]string{from, to})
+		test.mu.Unlock()
+	}
+	return sample
+}
+
+// respond accepts or declines a random pending friendship request. ok is false iff there are none
+func (test *loadTest) respond(random *rand.Rand) (sample loadTestSample, ok bool) {
+	test.mu.Lock()
+	if len(test.pending) == 0 {
+		test.mu.Unlock()
+		return loadTestSample{}, false
+	}
+	i := random.Intn(len(test.pending))
+	request := test.pending[i]
+	test.pending[i] = test.pending[len(test.pending)-1]
+	test.pending = test.pending[:len(test.pending)-1]
+	test.mu.Unlock()
+
+	accept := strconv.Itoa(random.Intn(2))
+	return test.post(LoadTestRespond, "/respondToFriendshipRequest",
+		map[string]string{"user": request[1], "pass": LoadTestPassword, "otherUser": request[0], "acceptRequest": accept}), true
+}
+
+// getFriends gets the friends of a random user, authenticated as that user
+func (test *loadTest) getFriends(random *rand.Rand) loadTestSample {
+	user := test.getRandomUser(random)
+	request, _ := http.NewRequest(http.MethodGet, strings.TrimRight(test.config.Server, "/")+"/getFriends/"+user, nil)
+	request.SetBasicAuth(user, LoadTestPassword)
+	return test.send(LoadTestGetFriends, request)
+}
+
+// getRandomUser returns a random user signed up by the load test
+func (test *loadTest) getRandomUser(random *rand.Rand) string {
+	test.mu.Lock()
+	defer test.mu.Unlock()
+	if len(test.users) == 0 {
+		return ""
+	}
+	return test.users[random.Intn(len(test.users))]
+}
+
+// post sends a POST request with body as JSON to path
+func (test *loadTest) post(operation, path string, body map[string]string) loadTestSample {
+	data, _ := json.Marshal(body)
+	request, _ := http.NewRequest(http.MethodPost, strings.TrimRight(test.config.Server, "/")+path, bytes.NewReader(data))
+	request.Header.Set("Content-Type", "application/json")
+	return test.send(operation, request)
+}
+
+// send sends request and measures its latency, including reading the whole response
+func (test *loadTest) send(operation string, request *http.Request) loadTestSample {
+	start := time.Now()
+	response, err := test.client.Do(request)
+	if err != nil {
+		return loadTestSample{operation: operation, latency: time.Since(start)}
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	return loadTestSample{operation: operation, latency: time.Since(start), status: response.StatusCode}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRUCache is a cache of at most capacity values by key which evicts the least recently used value when full.
+// To avoid caching stale values read while they were being modified, callers get the generation of the cache before
+// reading the value from the source, and Add ignores the value if any key was invalidated since then.
+// It is safe for concurrent use
+type LRUCache struct {
+	mu         sync.Mutex
+	capacity   int
+	entries    map[string]*list.Element
+	order      *list.List // of *lruEntry, most recently used first
+	generation uint64     // incremented by each invalidation
+	stats      CacheStats
+}
+
+// CacheStats are the statistics of a LRUCache
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// Get returns the value cached for key, and marks it as the most recently used.
+// ok is false iff there is no value cached for key, in which case generation can be passed to Add along with the
+// value read from the source
+func (c *LRUCache) Get(key string) (value interface{}, ok bool, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false, c.generation
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true, c.generation
+}
+
+// Add caches value for key, evicting the least recently used value if the cache is full.
+// Returns false iff any key was invalidated since generation (in this case no modifications are made)
+func (c *LRUCache) Add(key string, value interface{}, generation uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return false
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*lruEntry).value = value
+		c.order.MoveToFront(element)
+		return true
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+	return true
+}
+
+// Invalidate removes the values cached for keys
+func (c *LRUCache) Invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, key := range keys {
+		if element, ok := c.entries[key]; ok {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Clear removes all cached values
+func (c *LRUCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// Stats returns the statistics of the cache
+func (c *LRUCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = c.order.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
+
+// --- INITIALIZER ---
+
+// NewLRUCache returns an empty LRUCache with room for capacity values (at least 1)
+func NewLRUCache(capacity int) *LRUCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &LRUCache{capacity: capacity, entries: map[string]*list.Element{}, order: list.New()}
+}
@@ -1,13 +1,181 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 )
 
 func main() {
-	store := EmptyUsersStore()
-	server := &UsersServer{store: store}
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(RunVerifyCommand(os.Args[2:]))
+		case "export":
+			os.Exit(RunExportCommand(os.Args[2:]))
+		case "import":
+			os.Exit(RunImportCommand(os.Args[2:]))
+		case "graph":
+			os.Exit(RunGraphCommand(os.Args[2:]))
+		case "seed":
+			os.Exit(RunSeedCommand(os.Args[2:]))
+		case "loadtest":
+			os.Exit(RunLoadTestCommand(os.Args[2:]))
+		}
+	}
+
+	// Users are partitioned in shards with their own locks, so that writes on different users run in parallel
+	shards := DefaultStoreShards
+	if value := os.Getenv("STORE_SHARDS"); value != "" {
+		var err error
+		if shards, err = strconv.Atoi(value); err != nil || shards < 1 {
+			log.Fatalf("invalid STORE_SHARDS %q", value)
+		}
+	}
+	var store UsersStore = NewShardedUsersStore(shards)
+
+	// Friend lists and user existence are cached if a cache size is given (useful with a persistent store)
+	if value := os.Getenv("STORE_CACHE_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			log.Fatalf("invalid STORE_CACHE_SIZE %q", value)
+		}
+		store = NewCachingUsersStore(store, size)
+	}
+
+	// Primaries log their mutations (in memory, up to REPLICATION_LOG_SIZE entries) so that replicas can follow them.
+	// Replicas apply them to their own in-memory store, which is not cached, serve reads of users and friends and
+	// redirect other requests to the primary
+	var replicationLog *MutationLog
+	var replica *Replica
+	switch value := os.Getenv("REPLICATION_ROLE"); value {
+	case "":
+	case "primary":
+		capacity := DefaultMutationLogCapacity
+		if value := os.Getenv("REPLICATION_LOG_SIZE"); value != "" {
+			var err error
+			if capacity, err = strconv.Atoi(value); err != nil || capacity < 1 {
+				log.Fatalf("invalid REPLICATION_LOG_SIZE %q", value)
+			}
+		}
+		replicationLog = NewBoundedMutationLog(capacity)
+		store = NewReplicatedUsersStore(store, replicationLog)
+	case "replica":
+		primary := os.Getenv("PRIMARY_URL")
+		if primary == "" {
+			log.Fatal("replicas require PRIMARY_URL")
+		}
+		store = EmptyUsersStore()
+		replica = NewReplica(primary, os.Getenv("ADMIN_TOKEN"), store)
+		go func() {
+			log.Fatalf("replication stopped: %v", replica.Run(context.Background()))
+		}()
+	default:
+		log.Fatalf("invalid REPLICATION_ROLE %q", value)
+	}
+
+	// Every operation goes through the transactional store, so that /batch transactions are isolated from them.
+	// Replicas have no transactions, since they redirect /batch to the primary
+	var transactions *TransactionalUsersStore
+	if replica == nil {
+		transactions = NewTransactionalUsersStore(store)
+		store = transactions
+	}
+	events := NewEventBus(1000, 100)
+	webhooks := NewWebhookDispatcher()
+
+	// Password reset tokens are logged unless a file is given (there is no email delivery yet)
+	var notifier Notifier = &LogNotifier{Logger: log.Default()}
+	if path := os.Getenv("NOTIFICATIONS_FILE"); path != "" {
+		notifier = &FileNotifier{Path: path}
+	}
+
+	// Audit log is kept in memory unless a file is given
+	audit := NewAuditLog()
+	if path := os.Getenv("AUDIT_LOG"); path != "" {
+		var err error
+		if audit, err = OpenAuditLog(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	server := &UsersServer{
+		store:          store,
+		transactions:   transactions,
+		replicationLog: replicationLog,
+		replica:        replica,
+		events:         events,
+		webhooks:       webhooks,
+		adminToken:     os.Getenv("ADMIN_TOKEN"),
+		messages:       EmptyMessageStore(),
+		passwordResets: NewPasswordResetTokens(DefaultPasswordResetTTL),
+		notifier:       notifier,
+		audit:          audit,
+	}
+
+	// Responses to POST requests with an Idempotency-Key are replayed to retries during a window (0 disables it)
+	window := DefaultIdempotencyWindow
+	if value := os.Getenv("IDEMPOTENCY_WINDOW"); value != "" {
+		var err error
+		if window, err = time.ParseDuration(value); err != nil || window < 0 {
+			log.Fatalf("invalid IDEMPOTENCY_WINDOW %q", value)
+		}
+	}
+	if window > 0 {
+		server.idempotency = NewIdempotencyKeys(window)
+	}
+
+	// Requests and store calls are traced if an exporter or a slow call threshold is given
+	var exporter SpanExporter
+	switch value := os.Getenv("TRACE_EXPORTER"); value {
+	case "":
+	case "stdout":
+		exporter = &WriterSpanExporter{Writer: os.Stdout}
+	case "otlp":
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+		if endpoint == "" {
+			endpoint = DefaultOTLPEndpoint
+		}
+		exporter = &OTLPSpanExporter{Endpoint: endpoint}
+	default:
+		log.Fatalf("invalid TRACE_EXPORTER %q", value)
+	}
+	threshold := time.Duration(0)
+	if value := os.Getenv("TRACE_SLOW_THRESHOLD"); value != "" {
+		var err error
+		if threshold, err = time.ParseDuration(value); err != nil || threshold <= 0 {
+			log.Fatalf("invalid TRACE_SLOW_THRESHOLD %q", value)
+		}
+	}
+	if exporter != nil || threshold > 0 {
+		server.tracer = NewTracer(exporter, "goserver")
+		server.tracer.SlowThreshold = threshold
+		go func() {
+			for range time.Tick(time.Second) {
+				if err := server.tracer.Flush(); err != nil {
+					log.Printf("could not export spans: %v", err)
+				}
+			}
+		}()
+	}
+
+	// Janitor: permanently remove deleted accounts once their grace period is over (replicas follow the primary)
+	if replica == nil {
+		go func() {
+			for range time.Tick(time.Hour) {
+				purged, err := server.PurgeExpiredAccounts(context.Background())
+				if err != nil {
+					log.Printf("could not purge deleted accounts: %v", err)
+				} else if len(purged) > 0 {
+					log.Printf("purged %d deleted accounts", len(purged))
+				}
+			}
+		}()
+	}
 
 	if err := http.ListenAndServe(":5000", server); err != nil {
 		log.Fatalf("could not listen on port 5000 %v", err)
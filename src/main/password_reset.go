@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier delivers notifications to users outside the application (eg by email)
+type Notifier interface {
+	NotifyPasswordReset(user, token string) error
+}
+
+// PasswordResetTokens issues single-use, time-limited password reset tokens. Only the hash of each token is kept.
+// It is safe for concurrent use.
+type PasswordResetTokens struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	tokens map[string]passwordResetToken // by user, issuing a new token replaces the previous one
+}
+
+// passwordResetToken is a token issued to a user
+type passwordResetToken struct {
+	hash    [sha256.Size]byte
+	expires time.Time
+}
+
+// Issue returns a new reset token for user, which replaces any token previously issued to them
+func (t *PasswordResetTokens) Issue(user string) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens[user] = passwordResetToken{hash: sha256.Sum256([]byte(token)), expires: time.Now().Add(t.ttl)}
+	return token, nil
+}
+
+// Redeem consumes the reset token of user.
+// Returns false iff token is not the last one issued to user, has expired or has already been redeemed
+func (t *PasswordResetTokens) Redeem(user, token string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	issued, ok := t.tokens[user]
+	if !ok {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(hash[:], issued.hash[:]) != 1 {
+		return false
+	}
+
+	delete(t.tokens, user)
+	return time.Now().Before(issued.expires)
+}
+
+// Revoke invalidates the reset token of user, if any
+func (t *PasswordResetTokens) Revoke(user string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tokens, user)
+}
+
+// LogNotifier is a Notifier which writes notifications to a log (for development)
+type LogNotifier struct {
+	Logger *log.Logger
+}
+
+// NotifyPasswordReset logs the reset token of user
+func (n *LogNotifier) NotifyPasswordReset(user, token string) error {
+	n.Logger.Printf("password reset token for %s: %s", user, token)
+	return nil
+}
+
+// FileNotifier is a Notifier which appends notifications to a file as JSON lines (for development and tests)
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// FileNotification is a line written by FileNotifier
+type FileNotification struct {
+	Type  string    `json:"type"`
+	User  string    `json:"user"`
+	Token string    `json:"token"`
+	Time  time.Time `json:"time"`
+}
+
+// NotifyPasswordReset appends the reset token of user to the file
+func (n *FileNotifier) NotifyPasswordReset(user, token string) error {
+	line, _ := json.Marshal(FileNotification{Type: "passwordReset", User: user, Token: token, Time: time.Now().UTC()})
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	file, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// --- INITIALIZER ---
+
+// NewPasswordResetTokens returns a PasswordResetTokens whose tokens expire after ttl
+func NewPasswordResetTokens(ttl time.Duration) *PasswordResetTokens {
+	tokens := PasswordResetTokens{
+		ttl:    ttl,
+		tokens: map[string]passwordResetToken{},
+	}
+	return &tokens
+}
@@ -0,0 +1,74 @@
+package main
+
+// Who can see the friends list of a user
+const (
+	FriendsVisibleToEveryone = "everyone"
+	FriendsVisibleToFriends  = "friends"
+	FriendsVisibleToMe       = "me"
+)
+
+// Who can send friendship requests to a user
+const (
+	RequestsFromEveryone         = "everyone"
+	RequestsFromFriendsOfFriends = "friendsOfFriends"
+	RequestsFromNobody           = "nobody"
+)
+
+// PrivacySettings control what other users can see of a user and do with them
+type PrivacySettings struct {
+	FriendsVisibility  string `json:"friendsVisibility"`
+	FriendshipRequests string `json:"friendshipRequests"`
+}
+
+// PrivacySettingsUpdate holds the new values of PrivacySettings. Nil fields are left unchanged
+type PrivacySettingsUpdate struct {
+	FriendsVisibility  *string
+	FriendshipRequests *string
+}
+
+// DefaultPrivacySettings returns the privacy settings of new users: everything is public
+func DefaultPrivacySettings() PrivacySettings {
+	return PrivacySettings{FriendsVisibility: FriendsVisibleToEveryone, FriendshipRequests: RequestsFromEveryone}
+}
+
+// Apply modifies settings p with the non-nil fields of update
+func (update PrivacySettingsUpdate) Apply(p *PrivacySettings) {
+	if update.FriendsVisibility != nil {
+		p.FriendsVisibility = *update.FriendsVisibility
+	}
+	if update.FriendshipRequests != nil {
+		p.FriendshipRequests = *update.FriendshipRequests
+	}
+}
+
+// Update returns the PrivacySettingsUpdate which sets all fields of p
+func (p PrivacySettings) Update() PrivacySettingsUpdate {
+	return PrivacySettingsUpdate{FriendsVisibility: &p.FriendsVisibility, FriendshipRequests: &p.FriendshipRequests}
+}
+
+// CheckPrivacySettingsUpdate returns true iff all fields of update have one of their allowed values.
+// If conditions are not fulfilled, msg holds an error message
+func CheckPrivacySettingsUpdate(update PrivacySettingsUpdate) (bool, string) {
+	ok := true
+	msg := ""
+
+	if update.FriendsVisibility != nil {
+		switch *update.FriendsVisibility {
+		case FriendsVisibleToEveryone, FriendsVisibleToFriends, FriendsVisibleToMe:
+		default:
+			msg += "Invalid friends visibility! It must be either everyone, friends or me."
+			ok = false
+		}
+	}
+
+	if update.FriendshipRequests != nil {
+		switch *update.FriendshipRequests {
+		case RequestsFromEveryone, RequestsFromFriendsOfFriends, RequestsFromNobody:
+		default:
+			msg += "Invalid friendship requests setting! It must be either everyone, friendsOfFriends or nobody."
+			ok = false
+		}
+	}
+
+	return ok, msg
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/url"
+	"time"
+	"unicode/utf8"
+)
+
+// Maximum lengths (in characters) of the editable profile fields
+const (
+	MaxDisplayNameLength = 50
+	MaxBioLength         = 280
+	MaxAvatarURLLength   = 2048
+)
+
+// Profile is the public information about a user
+type Profile struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	DisplayName string    `json:"displayName"`
+	Bio         string    `json:"bio"`
+	AvatarURL   string    `json:"avatarUrl"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// ProfileSummary is the part of a Profile included in lists of users
+type ProfileSummary struct {
+	ID          string `json:"id"`
+	User        string `json:"user"`
+	DisplayName string `json:"displayName"`
+	AvatarURL   string `json:"avatarUrl"`
+}
+
+// ProfileUpdate holds the new values of the editable fields of a Profile. Nil fields are left unchanged
+type ProfileUpdate struct {
+	DisplayName *string
+	Bio         *string
+	AvatarURL   *string
+}
+
+// Summary returns the summary of profile p
+func (p Profile) Summary() ProfileSummary {
+	return ProfileSummary{ID: p.ID, User: p.User, DisplayName: p.DisplayName, AvatarURL: p.AvatarURL}
+}
+
+// Apply modifies profile p with the non-nil fields of update
+func (update ProfileUpdate) Apply(p *Profile) {
+	if update.DisplayName != nil {
+		p.DisplayName = *update.DisplayName
+	}
+	if update.Bio != nil {
+		p.Bio = *update.Bio
+	}
+	if update.AvatarURL != nil {
+		p.AvatarURL = *update.AvatarURL
+	}
+}
+
+// CheckProfileUpdate returns true iff all fields of update are valid: display name and bio not longer than
+// MaxDisplayNameLength and MaxBioLength characters, and avatar URL either empty or an absolute http(s) URL not longer
+// than MaxAvatarURLLength characters. If conditions are not fulfilled, msg holds an error message
+func CheckProfileUpdate(update ProfileUpdate) (bool, string) {
+	ok := true
+	msg := ""
+
+	if update.DisplayName != nil && utf8.RuneCountInString(*update.DisplayName) > MaxDisplayNameLength {
+		msg += "Display name too long! Display name must have at most 50 characters."
+		ok = false
+	}
+
+	if update.Bio != nil && utf8.RuneCountInString(*update.Bio) > MaxBioLength {
+		msg += "Bio too long! Bio must have at most 280 characters."
+		ok = false
+	}
+
+	if update.AvatarURL != nil && *update.AvatarURL != "" {
+		avatar, err := url.Parse(*update.AvatarURL)
+		if utf8.RuneCountInString(*update.AvatarURL) > MaxAvatarURLLength {
+			msg += "Avatar URL too long! Avatar URL must have at most 2048 characters."
+			ok = false
+		} else if err != nil || (avatar.Scheme != "http" && avatar.Scheme != "https") || avatar.Host == "" {
+			msg += "Invalid avatar URL! Avatar URL must be an absolute http or https URL."
+			ok = false
+		}
+	}
+
+	return ok, msg
+}
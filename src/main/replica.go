@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicationLogIDHeader is the header with which a primary sends the ID of its log (see MutationLog)
+const ReplicationLogIDHeader = "Replication-Log-Id"
+
+// ErrReplicaDiverged is returned by Replica.Run when the store of the replica can no longer follow the log of the
+// primary: the primary was restarted with a new log, or an entry could not be applied
+var ErrReplicaDiverged = errors.New("replica diverged from the primary")
+
+// ReplicationMessage is a message of the stream of /replication/log: an entry of the log, or a heartbeat if Entry is
+// nil, with the head of the log when it was sent
+type ReplicationMessage struct {
+	Entry *MutationLogEntry `json:"entry,omitempty"`
+	Head  uint64            `json:"head"`
+}
+
+// ReplicationSnapshot is the response of /replication/snapshot: a snapshot of the store of a primary after the
+// entries of its log up to Seq were applied
+type ReplicationSnapshot struct {
+	LogID string             `json:"logId"`
+	Seq   uint64             `json:"seq"`
+	Store UsersStoreSnapshot `json:"store"`
+}
+
+// ReplicationStatus is the replication status of a server. Primaries only report their role, log ID and head
+type ReplicationStatus struct {
+	Role        string     `json:"role"` // "primary" or "replica"
+	LogID       string     `json:"logId,omitempty"`
+	Primary     string     `json:"primary,omitempty"`
+	Connected   bool       `json:"connected"`
+	Head        uint64     `json:"head"`       // last entry of the log of the primary (known by the replica)
+	Applied     uint64     `json:"applied"`    // last entry applied by the replica
+	LagEntries  uint64     `json:"lagEntries"` // entries of the log not applied yet
+	LagSeconds  float64    `json:"lagSeconds"` // time since the replica was last known to be up to date, 0 if it is
+	LastContact *time.Time `json:"lastContact,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// Replica follows the log of a primary (see ReplicatedUsersStore), streamed from its /replication/log endpoint, and
+// applies it to a local store, which must not be modified otherwise. When the stream breaks, it reconnects and goes on
+// from the last entry applied. If the primary no longer has that entry (see MutationLog), the store is replaced with
+// a snapshot from /replication/snapshot, which requires an InMemoryUsersStore. It is safe for concurrent use
+type Replica struct {
+	Primary       string        // URL of the primary, eg http://primary:5000
+	Token         string        // admin token of the primary
+	Client        *http.Client  // without timeout, since the log is streamed
+	RetryInterval time.Duration // wait before reconnecting
+	Timeout       time.Duration // time without messages (not even heartbeats) after which the replica reconnects
+
+	store       UsersStore
+	mu          sync.Mutex
+	logID       string
+	connected   bool
+	head        uint64
+	applied     uint64
+	lastContact time.Time
+	upToDateAt  time.Time // last time the replica was known to be up to date (or when it was created)
+	err         error     // error which stopped Run
+}
+
+// Run follows the log of the primary until ctx is done (returning its error) or the replica diverges (returning an
+// ErrReplicaDiverged), in which case the store must be discarded
+func (r *Replica) Run(ctx context.Context) error {
+	for {
+		err := r.follow(ctx)
+		r.mu.Lock()
+		r.connected = false
+		if errors.Is(err, ErrReplicaDiverged) {
+			r.err = err
+		}
+		r.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrReplicaDiverged) {
+			return err
+		}
+		if err == nil {
+			continue // a snapshot was loaded, so the log is followed from it right away
+		}
+		log.Printf("replication from %s interrupted: %v", r.Primary, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.RetryInterval):
+		}
+	}
+}
+
+// Status returns the replication status of the replica
+func (r *Replica) Status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := ReplicationStatus{
+		Role:      "replica",
+		LogID:     r.logID,
+		Primary:   r.Primary,
+		Connected: r.connected,
+		Head:      r.head,
+		Applied:   r.applied,
+	}
+	if r.head > r.applied {
+		status.LagEntries = r.head - r.applied
+	}
+	if !r.connected || status.LagEntries > 0 {
+		status.LagSeconds = time.Since(r.upToDateAt).Seconds()
+	}
+	if !r.lastContact.IsZero() {
+		lastContact := r.lastContact
+		status.LastContact = &lastContact
+	}
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	return status
+}
+
+// Redirect populates the ResponseWriter (w) with a redirection of request req to the primary, which keeps its method
+// and body (307 Temporary Redirect)
+func (r *Replica) Redirect(w http.ResponseWriter, req *http.Request) {
+	http.Redirect(w, req, strings.TrimSuffix(r.Primary, "/")+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// follow streams the log of the primary from the last entry applied and applies it until the stream breaks. If the
+// primary no longer has the entry which follows, it loads a snapshot instead and returns nil
+func (r *Replica) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timeout := time.AfterFunc(r.Timeout, cancel)
+	defer timeout.Stop()
+
+	r.mu.Lock()
+	path := fmt.Sprintf("/replication/log?after=%d", r.applied)
+	r.mu.Unlock()
+	response, err := r.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusGone {
+		timeout.Stop() // snapshots may take longer than the timeout to download
+		return r.loadSnapshot(ctx)
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d", response.StatusCode)
+	}
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message ReplicationMessage
+		if err := decoder.Decode(&message); err != nil {
+			return err
+		}
+		timeout.Reset(r.Timeout)
+		if err := r.receive(message); err != nil {
+			return err
+		}
+	}
+}
+
+// loadSnapshot replaces the store with a snapshot of the primary, and records that it has the entries up to the one
+// of the snapshot applied
+func (r *Replica) loadSnapshot(ctx context.Context) error {
+	store, ok := r.store.(*InMemoryUsersStore)
+	if !ok {
+		return fmt.Errorf("%w: the primary dropped the entries the replica needs and the store can't load snapshots",
+			ErrReplicaDiverged)
+	}
+
+	response, err := r.get(ctx, "/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d for the snapshot", response.StatusCode)
+	}
+	var snapshot ReplicationSnapshot
+	if err := json.NewDecoder(response.Body).Decode(&snapshot); err != nil {
+		return err
+	}
+	if err := r.checkLogID(snapshot.LogID); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	store.LoadSnapshot(snapshot.Store)
+	r.applied = snapshot.Seq
+	if r.head < r.applied {
+		r.head = r.applied
+	}
+	log.Printf("replication from %s loaded a snapshot at entry %d", r.Primary, snapshot.Seq)
+	return nil
+}
+
+// get sends a GET request for path to the primary, authenticated with its admin token, and checks the ID of its log
+// if the response has one (see checkLogID)
+func (r *Replica) get(ctx context.Context, path string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(r.Primary, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+
+	response, err := r.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkLogID(response.Header.Get(ReplicationLogIDHeader)); err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return response, nil
+}
+
+// checkLogID records that the replica follows the log with ID logID, if given. Returns an ErrReplicaDiverged if it
+// was following a different one
+func (r *Replica) checkLogID(logID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if logID == "" {
+		return nil
+	}
+	if r.logID != "" && r.logID != logID {
+		return fmt.Errorf("%w: the log of the primary changed from %s to %s", ErrReplicaDiverged, r.logID, logID)
+	}
+	r.logID = logID
+	return nil
+}
+
+// receive applies the entry of message, if any, and records the head of the log
+func (r *Replica) receive(message ReplicationMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry := message.Entry; entry != nil {
+		switch {
+		case entry.Seq <= r.applied:
+			// already applied
+		case entry.Seq != r.applied+1:
+			return fmt.Errorf("got entry %d after entry %d", entry.Seq, r.applied)
+		case !ApplyMutation(r.store, *entry):
+			return fmt.Errorf("%w: could not apply entry %d (%s)", ErrReplicaDiverged, entry.Seq, entry.Op)
+		default:
+			r.applied = entry.Seq
+		}
+	}
+
+	now := time.Now()
+	r.connected = true
+	r.head = message.Head
+	r.lastContact = now
+	if r.applied >= r.head {
+		r.upToDateAt = now
+	}
+	return nil
+}
+
+// --- INITIALIZER ---
+
+// NewReplica returns a Replica of the primary at URL primary, authenticated with its admin token, which applies its
+// log to store. It reconnects after 1s, and when nothing is received for 1m
+func NewReplica(primary, token string, store UsersStore) *Replica {
+	return &Replica{
+		Primary:       primary,
+		Token:         token,
+		Client:        &http.Client{},
+		RetryInterval: time.Second,
+		Timeout:       time.Minute,
+		store:         store,
+		upToDateAt:    time.Now(),
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// MutationLogEntry is a mutation applied to the store of a primary, which replicas apply to theirs in the same order.
+// Op is the name of the UsersStore method, and the other fields are its arguments:
+// - AddUserWithID: ID, User, Password
+// - RequestFriendship: User (from), OtherUser (to)
+// - RespondToFriendshipRequest: User, OtherUser, Accept
+// - RemoveFriendship: User, OtherUser
+// - ChangePassword: User, Password
+// - UpdateProfile: User, Profile
+// - UpdatePrivacySettings: User, Privacy
+// - SetRole: User, Role
+// - RenameUser: User (old name), OtherUser (new name)
+// - DeleteUser: User
+// - RestoreUser: User, Password
+// - PurgeDeletedUser: User
+type MutationLogEntry struct {
+	Seq       uint64                 `json:"seq"`  // position in the log, starting at 1
+	Time      time.Time              `json:"time"` // when it was applied by the primary
+	Op        string                 `json:"op"`
+	ID        string                 `json:"id,omitempty"`
+	User      string                 `json:"user,omitempty"`
+	OtherUser string                 `json:"otherUser,omitempty"`
+	Password  string                 `json:"password,omitempty"`
+	Role      string                 `json:"role,omitempty"`
+	Accept    bool                   `json:"accept,omitempty"`
+	Profile   *ProfileUpdate         `json:"profile,omitempty"`
+	Privacy   *PrivacySettingsUpdate `json:"privacy,omitempty"`
+}
+
+// MaxMutationLogRead is the maximum number of entries returned by MutationLog.Read
+const MaxMutationLogRead = 1000
+
+// DefaultMutationLogCapacity is the number of entries kept by a MutationLog by default
+const DefaultMutationLogCapacity = 100000
+
+// MutationLog is the ordered log of the mutations applied to the store of a primary (see ReplicatedUsersStore).
+// It is kept in memory, and has a random ID which tells apart the logs of different runs of the primary.
+// Only its last entries are kept, up to its capacity: older ones are dropped (along with the passwords in them) and
+// applied to a checkpoint, a copy of the store as it was after the last entry dropped, so that replicas which are
+// too far behind (or new) can start from a snapshot of it (see Snapshot). It is safe for concurrent use
+type MutationLog struct {
+	ID         string
+	capacity   int
+	mu         sync.Mutex
+	entries    []MutationLogEntry  // the last ones, up to capacity
+	tail       uint64              // sequence number of the last entry dropped, 0 if none
+	checkpoint *InMemoryUsersStore // with the entries up to tail applied
+	changed    chan struct{}       // closed (and replaced) when an entry is appended
+}
+
+// Append appends entry to the log, setting its sequence number and time. If the log is full, its first entry is
+// dropped and applied to the checkpoint
+func (l *MutationLog) Append(entry MutationLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Seq = l.tail + uint64(len(l.entries)) + 1
+	entry.Time = time.Now()
+	l.entries = append(l.entries, entry)
+	for len(l.entries) > l.capacity {
+		ApplyMutation(l.checkpoint, l.entries[0])
+		l.entries[0] = MutationLogEntry{}
+		l.entries = l.entries[1:]
+		l.tail++
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Read returns up to MaxMutationLogRead entries which follow sequence number `after`, the sequence number of the
+// last entry of the log (its head), and a channel which is closed when an entry is appended. No entries are returned
+// if the entry which follows `after` was dropped (see Tail)
+func (l *MutationLog) Read(after uint64) (entries []MutationLogEntry, head uint64, changed <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	head = l.tail + uint64(len(l.entries))
+	if after >= l.tail && after < head {
+		end := after + MaxMutationLogRead
+		if end > head {
+			end = head
+		}
+		entries = append(entries, l.entries[after-l.tail:end-l.tail]...)
+	}
+	return entries, head, l.changed
+}
+
+// Head returns the sequence number of the last entry of the log, 0 if it is empty
+func (l *MutationLog) Head() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tail + uint64(len(l.entries))
+}
+
+// Tail returns the sequence number of the last entry dropped, 0 if none: only the entries which follow it can be
+// read
+func (l *MutationLog) Tail() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tail
+}
+
+// Snapshot returns a snapshot of the checkpoint, ie of the store after the entries up to tail were applied, and tail
+func (l *MutationLog) Snapshot() (snapshot UsersStoreSnapshot, tail uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.checkpoint.Snapshot(), l.tail
+}
+
+// ReplicatedUsersStore is a UsersStore which wraps another one, appending every mutation which succeeds to a
+// MutationLog, so that replicas can apply them (see ApplyMutation). Mutations are serialized, so that the log has the
+// order in which they were applied; reads are not. TouchUser is not replicated. The mutations of a transaction are
+// only logged when it is committed (see TransactionParticipant).
+// The wrapped store must not be modified directly
+type ReplicatedUsersStore struct {
+	UsersStore
+	log     *MutationLog
+	mu      sync.Mutex         // held by each mutation until it is logged
+	pending []MutationLogEntry // mutations of the transaction in progress, nil if there is none
+}
+
+// AddUser adds a user with given username and password (see UsersStore)
+func (s *ReplicatedUsersStore) AddUser(name string, password string) bool {
+	return s.AddUserWithID(NewUserID(), name, password)
+}
+
+// AddUserWithID adds a user with given ID, username and password (see UsersStore)
+func (s *ReplicatedUsersStore) AddUserWithID(id, name, password string) bool {
+	return s.apply(func() bool { return s.UsersStore.AddUserWithID(id, name, password) },
+		MutationLogEntry{Op: "AddUserWithID", ID: id, User: name, Password: password})
+}
+
+// RequestFriendship adds a friendship request from user `from` to user `to` (see UsersStore)
+func (s *ReplicatedUsersStore) RequestFriendship(from, to string) bool {
+	return s.apply(func() bool { return s.UsersStore.RequestFriendship(from, to) },
+		MutationLogEntry{Op: "RequestFriendship", User: from, OtherUser: to})
+}
+
+// RequestFriendshipIf adds a friendship request from user `from` to user `to` iff condition returns true (see
+// UsersStore). Replicas apply it unconditionally
+func (s *ReplicatedUsersStore) RequestFriendshipIf(from, to string, condition func(versions UserVersions) bool) bool {
+	return s.apply(func() bool { return s.UsersStore.RequestFriendshipIf(from, to, condition) },
+		MutationLogEntry{Op: "RequestFriendship", User: from, OtherUser: to})
+}
+
+// ChangePassword sets the password of user to newPassword (see UsersStore)
+func (s *ReplicatedUsersStore) ChangePassword(user, newPassword string) bool {
+	return s.apply(func() bool { return s.UsersStore.ChangePassword(user, newPassword) },
+		MutationLogEntry{Op: "ChangePassword", User: user, Password: newPassword})
+}
+
+// RespondToFriendshipRequest responds to a friendship request from otherUser made to user (see UsersStore)
+func (s *ReplicatedUsersStore) RespondToFriendshipRequest(user, otherUser string, acceptRequest bool) bool {
+	return s.apply(func() bool { return s.UsersStore.RespondToFriendshipRequest(user, otherUser, acceptRequest) },
+		MutationLogEntry{Op: "RespondToFriendshipRequest", User: user, OtherUser: otherUser, Accept: acceptRequest})
+}
+
+// RespondToFriendshipRequestIf responds to a friendship request from otherUser made to user iff condition returns true
+// (see UsersStore). Replicas apply it unconditionally
+func (s *ReplicatedUsersStore) RespondToFriendshipRequestIf(user, otherUser string, acceptRequest bool, condition func(versions UserVersions) bool) bool {
+	return s.apply(func() bool {
+		return s.UsersStore.RespondToFriendshipRequestIf(user, otherUser, acceptRequest, condition)
+	}, MutationLogEntry{Op: "RespondToFriendshipRequest", User: user, OtherUser: otherUser, Accept: acceptRequest})
+}
+
+// RemoveFriendship removes the friendship between user and otherUser (see UsersStore)
+func (s *ReplicatedUsersStore) RemoveFriendship(user, otherUser string) bool {
+	return s.apply(func() bool { return s.UsersStore.RemoveFriendship(user, otherUser) },
+		MutationLogEntry{Op: "RemoveFriendship", User: user, OtherUser: otherUser})
+}
+
+// UpdateProfile modifies the profile of user (see UsersStore)
+func (s *ReplicatedUsersStore) UpdateProfile(user string, update ProfileUpdate) bool {
+	return s.apply(func() bool { return s.UsersStore.UpdateProfile(user, update) },
+		MutationLogEntry{Op: "UpdateProfile", User: user, Profile: &update})
+}
+
+// UpdatePrivacySettings modifies the privacy settings of user (see UsersStore)
+func (s *ReplicatedUsersStore) UpdatePrivacySettings(user string, update PrivacySettingsUpdate) bool {
+	return s.apply(func() bool { return s.UsersStore.UpdatePrivacySettings(user, update) },
+		MutationLogEntry{Op: "UpdatePrivacySettings", User: user, Privacy: &update})
+}
+
+// SetRole sets the role of user (see UsersStore)
+func (s *ReplicatedUsersStore) SetRole(user, role string) bool {
+	return s.apply(func() bool { return s.UsersStore.SetRole(user, role) },
+		MutationLogEntry{Op: "SetRole", User: user, Role: role})
+}
+
+// RenameUser changes the username of user oldName to newName (see UsersStore)
+func (s *ReplicatedUsersStore) RenameUser(oldName, newName string) bool {
+	return s.apply(func() bool { return s.UsersStore.RenameUser(oldName, newName) },
+		MutationLogEntry{Op: "RenameUser", User: oldName, OtherUser: newName})
+}
+
+// DeleteUser soft-deletes user `name` (see UsersStore)
+func (s *ReplicatedUsersStore) DeleteUser(name string) bool {
+	return s.apply(func() bool { return s.UsersStore.DeleteUser(name) },
+		MutationLogEntry{Op: "DeleteUser", User: name})
+}
+
+// RestoreUser restores the deleted user `name` (see UsersStore)
+func (s *ReplicatedUsersStore) RestoreUser(name, password string) bool {
+	return s.apply(func() bool { return s.UsersStore.RestoreUser(name, password) },
+		MutationLogEntry{Op: "RestoreUser", User: name, Password: password})
+}
+
+// PurgeDeletedUsers permanently removes the users deleted before deletedBefore (see UsersStore). Each purged user is
+// logged as a PurgeDeletedUser, since replicas do not know when users were deleted in the primary
+func (s *ReplicatedUsersStore) PurgeDeletedUsers(deletedBefore time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := s.UsersStore.PurgeDeletedUsers(deletedBefore)
+	for _, name := range purged {
+		s.append(MutationLogEntry{Op: "PurgeDeletedUser", User: name})
+	}
+	return purged
+}
+
+// PurgeDeletedUser permanently removes the deleted user `name` (see UsersStore)
+func (s *ReplicatedUsersStore) PurgeDeletedUser(name string) bool {
+	return s.apply(func() bool { return s.UsersStore.PurgeDeletedUser(name) },
+		MutationLogEntry{Op: "PurgeDeletedUser", User: name})
+}
+
+// apply runs mutation, appending entry to the log iff it succeeds. Returns the result of mutation
+func (s *ReplicatedUsersStore) apply(mutation func() bool, entry MutationLogEntry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok := mutation()
+	if ok {
+		s.append(entry)
+	}
+	return ok
+}
+
+// append appends entry to the log, or to the pending entries if a transaction is in progress. Caller must hold s.mu
+func (s *ReplicatedUsersStore) append(entry MutationLogEntry) {
+	if s.pending != nil {
+		s.pending = append(s.pending, entry)
+	} else {
+		s.log.Append(entry)
+	}
+}
+
+// BeginTransaction starts keeping the mutations which follow out of the log until the transaction ends (see
+// TransactionParticipant)
+func (s *ReplicatedUsersStore) BeginTransaction() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = []MutationLogEntry{}
+	BeginTransaction(s.UsersStore)
+}
+
+// EndTransaction appends the mutations of the transaction to the log if it was committed, or discards them (along
+// with the ones which reverted them) otherwise (see TransactionParticipant)
+func (s *ReplicatedUsersStore) EndTransaction(commit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := s.pending
+	s.pending = nil
+	if commit {
+		for _, entry := range pending {
+			s.log.Append(entry)
+		}
+	}
+	EndTransaction(s.UsersStore, commit)
+}
+
+// ApplyMutation applies the mutation of entry to store. Returns false iff the mutation failed, which means that store
+// has diverged from the store of the primary (in this case no modifications are made)
+func ApplyMutation(store UsersStore, entry MutationLogEntry) bool {
+	switch entry.Op {
+	case "AddUserWithID":
+		return store.AddUserWithID(entry.ID, entry.User, entry.Password)
+	case "RequestFriendship":
+		return store.RequestFriendship(entry.User, entry.OtherUser)
+	case "RespondToFriendshipRequest":
+		return store.RespondToFriendshipRequest(entry.User, entry.OtherUser, entry.Accept)
+	case "RemoveFriendship":
+		return store.RemoveFriendship(entry.User, entry.OtherUser)
+	case "ChangePassword":
+		return store.ChangePassword(entry.User, entry.Password)
+	case "UpdateProfile":
+		return entry.Profile != nil && store.UpdateProfile(entry.User, *entry.Profile)
+	case "UpdatePrivacySettings":
+		return entry.Privacy != nil && store.UpdatePrivacySettings(entry.User, *entry.Privacy)
+	case "SetRole":
+		return store.SetRole(entry.User, entry.Role)
+	case "RenameUser":
+		return store.RenameUser(entry.User, entry.OtherUser)
+	case "DeleteUser":
+		return store.DeleteUser(entry.User)
+	case "RestoreUser":
+		return store.RestoreUser(entry.User, entry.Password)
+	case "PurgeDeletedUser":
+		return store.PurgeDeletedUser(entry.User)
+	default:
+		return false
+	}
+}
+
+// --- INITIALIZER ---
+
+// NewMutationLog returns an empty MutationLog with a random ID, which keeps DefaultMutationLogCapacity entries
+func NewMutationLog() *MutationLog {
+	return NewBoundedMutationLog(DefaultMutationLogCapacity)
+}
+
+// NewBoundedMutationLog returns an empty MutationLog with a random ID, which keeps capacity entries (at least 1)
+func NewBoundedMutationLog(capacity int) *MutationLog {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &MutationLog{ID: NewUserID(), capacity: capacity, checkpoint: EmptyUsersStore(), changed: make(chan struct{})}
+}
+
+// NewReplicatedUsersStore returns a ReplicatedUsersStore wrapping store, which appends its mutations to log
+func NewReplicatedUsersStore(store UsersStore, log *MutationLog) *ReplicatedUsersStore {
+	return &ReplicatedUsersStore{UsersStore: store, log: log}
+}
@@ -0,0 +1,26 @@
+package main
+
+// Roles of users, from least to most privileged. Each role has all the permissions of the previous ones
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// roleRanks orders roles by privilege
+var roleRanks = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// IsValidRole returns true iff role is one of RoleUser, RoleModerator or RoleAdmin
+func IsValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// HasRole returns true iff role has at least the permissions of required role
+func HasRole(role, required string) bool {
+	return IsValidRole(role) && roleRanks[role] >= roleRanks[required]
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// Models of the friendship graph generated by SeedUsersStore
+const (
+	SeedModelErdosRenyi     = "er"         // every pair of users are friends with the same probability
+	SeedModelBarabasiAlbert = "ba"         // preferential attachment, the number of friends follows a power law
+	SeedModelWattsStrogatz  = "smallworld" // ring lattice with randomly rewired friendships (Watts-Strogatz)
+)
+
+// MaxSeedUsers is the maximum number of users added by SeedUsersStore, because usernames are "u" followed by the
+// index of the user and can't be longer than 10 characters
+const MaxSeedUsers = 999999999
+
+const (
+	seedUsernameMinDigits = 4 // so that usernames have at least 5 characters
+	seedPasswordLength    = 12
+	seedPasswordAlphabet  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// SeedModels are all models of the friendship graph generated by SeedUsersStore
+var SeedModels = []string{SeedModelErdosRenyi, SeedModelBarabasiAlbert, SeedModelWattsStrogatz}
+
+// SeedConfig describes the synthetic data generated by SeedUsersStore. The same configuration (including Seed)
+// always generates the same data
+type SeedConfig struct {
+	Users    int     // number of users
+	Model    string  // one of SeedModels
+	Degree   int     // mean number of friendships (and pending requests) per user
+	Rewire   float64 // probability of rewiring each friendship of the small-world model
+	Requests float64 // fraction of the generated friendships left as pending friendship requests
+	Seed     int64   // seed of the random generator
+}
+
+// DefaultSeedConfig returns the default configuration of SeedUsersStore
+func DefaultSeedConfig() SeedConfig {
+	return SeedConfig{Users: 1000, Model: SeedModelBarabasiAlbert, Degree: 10, Rewire: 0.1, Requests: 0.05, Seed: 1}
+}
+
+// Check returns an error iff config is not valid
+func (config SeedConfig) Check() error {
+	switch {
+	case config.Users < 0 || config.Users > MaxSeedUsers:
+		return fmt.Errorf("number of users must be between 0 and %d", MaxSeedUsers)
+	case !Contains(SeedModels, config.Model):
+		return fmt.Errorf("model must be one of %s", strings.Join(SeedModels, ", "))
+	case config.Degree < 0:
+		return errors.New("degree must not be negative")
+	case config.Users > 0 && config.Degree >= config.Users:
+		return errors.New("degree must be less than the number of users")
+	case config.Rewire < 0 || config.Rewire > 1:
+		return errors.New("rewire probability must be between 0 and 1")
+	case config.Requests < 0 || config.Requests > 1:
+		return errors.New("fraction of requests must be between 0 and 1")
+	}
+	return nil
+}
+
+// SeedUsersStore adds to store the users and the friendship graph described by config, using only the UsersStore
+// interface. Usernames are "u0000", "u0001"... and must not exist in store. Friendships are made by sending and
+// accepting a friendship request; a fraction of them (config.Requests) is left as pending requests, in a random
+// direction. Returns the number of users, friendships and requests added
+func SeedUsersStore(store UsersStore, config SeedConfig) (GraphReport, error) {
+	report := GraphReport{}
+	if err := config.Check(); err != nil {
+		return report, err
+	}
+
+	random := rand.New(rand.NewSource(config.Seed))
+	users := make([]string, config.Users)
+	for i := range users {
+		users[i] = GetSeedUsername(i, config.Users)
+		password := NewSeedPassword(random)
+		if ok, msg := CheckUsernameAndPassword(users[i], password); !ok {
+			return report, fmt.Errorf("user %s: %s", users[i], msg)
+		}
+		if !store.AddUserWithID(NewUserIDFrom(random), users[i], password) {
+			return report, fmt.Errorf("user %s: User already exists", users[i])
+		}
+		report.Users++
+	}
+
+	for _, edge := range GenerateSeedGraph(config, random) {
+		from, to := users[edge[0]], users[edge[1]]
+		if random.Intn(2) == 1 {
+			from, to = to, from
+		}
+		if !store.RequestFriendship(from, to) {
+			return report, fmt.Errorf("request %s->%s: Friendship request already exists", from, to)
+		}
+		if random.Float64() < config.Requests {
+			report.Requests++
+			continue
+		}
+		if !store.RespondToFriendshipRequest(to, from, true) {
+			return report, fmt.Errorf("friendship %s&%s: Users are already friends", from, to)
+		}
+		report.Friendships++
+	}
+
+	return report, nil
+}
+
+// GenerateSeedGraph returns the edges of an undirected graph of config.Users nodes generated with config.Model, in the
+// order they are generated. Each edge is a pair of node indices, the smallest first, and appears only once
+func GenerateSeedGraph(config SeedConfig, random *rand.Rand) [][2]int {
+	switch config.Model {
+	case SeedModelErdosRenyi:
+		return GenerateErdosRenyiGraph(config.Users, config.Degree, random)
+	case SeedModelBarabasiAlbert:
+		return GenerateBarabasiAlbertGraph(config.Users, config.Degree, random)
+	case SeedModelWattsStrogatz:
+		return GenerateWattsStrogatzGraph(config.Users, config.Degree, config.Rewire, random)
+	}
+	return nil
+}
+
+// GenerateErdosRenyiGraph returns a G(n, p) random graph with mean degree degree, ie each of the n*(n-1)/2 pairs of
+// nodes is an edge with probability p = degree/(n-1). Non-edges are skipped with geometric jumps, so it takes time
+// proportional to the number of edges (Batagelj and Brandes, 2005)
+func GenerateErdosRenyiGraph(n, degree int, random *rand.Rand) [][2]int {
+	edges := make([][2]int, 0)
+	if n < 2 || degree <= 0 {
+		return edges
+	}
+	p := float64(degree) / float64(n-1)
+	if p >= 1 {
+		for v := 1; v < n; v++ {
+			for w := 0; w < v; w++ {
+				edges = append(edges, [2]int{w, v})
+			}
+		}
+		return edges
+	}
+
+	logq := math.Log(1 - p)
+	for v, w := 1, -1; v < n; {
+		w += 1 + int(math.Log(1-random.Float64())/logq)
+		for w >= v && v < n {
+			w -= v
+			v++
+		}
+		if v < n {
+			edges = append(edges, [2]int{w, v})
+		}
+	}
+	return edges
+}
+
+// GenerateBarabasiAlbertGraph returns a scale-free graph of n nodes with mean degree about degree: it starts with a
+// complete graph of m+1 nodes (m = degree/2, at least 1) and each following node is linked to m distinct existing
+// nodes chosen with probability proportional to their degree
+func GenerateBarabasiAlbertGraph(n, degree int, random *rand.Rand) [][2]int {
+	edges := make([][2]int, 0)
+	m := degree / 2
+	if m < 1 {
+		m = 1
+	}
+	if degree <= 0 || n < 2 {
+		return edges
+	}
+
+	// Each node appears in endpoints once per edge, so picking uniformly from it is preferential attachment
+	endpoints := make([]int, 0, 2*m*n)
+	initial := m + 1
+	if initial > n {
+		initial = n
+	}
+	for v := 1; v < initial; v++ {
+		for w := 0; w < v; w++ {
+			edges = append(edges, [2]int{w, v})
+			endpoints = append(endpoints, w, v)
+		}
+	}
+
+	for v := initial; v < n; v++ {
+		targets := map[int]bool{}
+		order := make([]int, 0, m)
+		for len(order) < m {
+			w := endpoints[random.Intn(len(endpoints))]
+			if !targets[w] {
+				targets[w] = true
+				order = append(order, w)
+			}
+		}
+		for _, w := range order {
+			edges = append(edges, [2]int{w, v})
+			endpoints = append(endpoints, w, v)
+		}
+	}
+	return edges
+}
+
+// GenerateWattsStrogatzGraph returns a small-world graph of n nodes: a ring where each node is linked to its
+// degree/2 nearest neighbours on each side, where the far end of each edge is then rewired with probability rewire to
+// a random node (avoiding self-loops and duplicate edges)
+func GenerateWattsStrogatzGraph(n, degree int, rewire float64, random *rand.Rand) [][2]int {
+	k := degree / 2
+	edges := make([][2]int, 0, n*k)
+	if n < 2 || k < 1 {
+		return edges
+	}
+
+	existing := map[[2]int]bool{}
+	for v := 0; v < n; v++ {
+		for j := 1; j <= k; j++ {
+			edge := NewSeedEdge(v, (v+j)%n)
+			existing[edge] = true
+			edges = append(edges, edge)
+		}
+	}
+
+	for i := range edges {
+		if random.Float64() >= rewire {
+			continue
+		}
+		v := i / k // edges were generated in order, k per node
+		for attempt := 0; attempt < n; attempt++ {
+			candidate := NewSeedEdge(v, random.Intn(n))
+			if candidate[0] != candidate[1] && !existing[candidate] {
+				delete(existing, edges[i])
+				existing[candidate] = true
+				edges[i] = candidate
+				break
+			}
+		}
+	}
+	return edges
+}
+
+// NewSeedEdge returns the edge between nodes a and b, the smallest first
+func NewSeedEdge(a, b int) [2]int {
+	if a > b {
+		return [2]int{b, a}
+	}
+	return [2]int{a, b}
+}
+
+// GetSeedUsername returns the username of the i-th of n seeded users: "u" followed by i, padded with zeros so that
+// all usernames have the same length (and at least seedUsernameMinDigits digits, to be long enough)
+func GetSeedUsername(i, n int) string {
+	digits := len(fmt.Sprint(n - 1))
+	if digits < seedUsernameMinDigits {
+		digits = seedUsernameMinDigits
+	}
+	return fmt.Sprintf("u%0*d", digits, i)
+}
+
+// NewSeedPassword returns a valid random password
+func NewSeedPassword(random *rand.Rand) string {
+	b := make([]byte, seedPasswordLength)
+	for i := range b {
+		b[i] = seedPasswordAlphabet[random.Intn(len(seedPasswordAlphabet))]
+	}
+	return string(b)
+}
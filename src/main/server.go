@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 )
 
 // UsersStore is an interface for a DB in which we can add and retrieve users
@@ -14,29 +16,98 @@ import (
 type UsersStore interface {
 	GetUsers() []string
 	AddUser(name string, password string) bool
+	AddUserWithID(id, name, password string) bool
 	UserExists(name string) bool
+	GetUserID(name string) (string, bool)
+	GetUsername(id string) (string, bool)
+	IsDeletedUser(name string) bool
+	IsDeletedID(id string) bool
 	RequestFriendship(from, to string) bool
+	RequestFriendshipIf(from, to string, condition func(versions UserVersions) bool) bool
+	GetPassword(user string) (string, bool)
 	CheckUsersPassword(user, password string) bool
+	ChangePassword(user, newPassword string) bool
 	RespondToFriendshipRequest(user, otherUser string, acceptRequest bool) bool
+	RespondToFriendshipRequestIf(user, otherUser string, acceptRequest bool, condition func(versions UserVersions) bool) bool
 	GetFriends(user string) []string
+	GetFriendshipRequests(user string) (sent, received []string, ok bool)
+	AreFriends(user, otherUser string) bool
+	HasFriendshipRequest(from, to string) bool
+	HaveCommonFriend(user, otherUser string) bool
+	GetVersions(user string) (UserVersions, bool)
+	RemoveFriendship(user, otherUser string) bool
+	GetProfile(user string) (Profile, bool)
+	UpdateProfile(user string, update ProfileUpdate) bool
+	GetPrivacySettings(user string) (PrivacySettings, bool)
+	UpdatePrivacySettings(user string, update PrivacySettingsUpdate) bool
+	GetRole(user string) (string, bool)
+	SetRole(user, role string) bool
+	TouchUser(user string)
+	RenameUser(oldName, newName string) bool
+	DeleteUser(name string) bool
+	RestoreUser(name, password string) bool
+	PurgeDeletedUsers(deletedBefore time.Time) []string
+	PurgeDeletedUser(name string) bool
+}
+
+// MessageStore is an interface for a DB in which we can store direct messages between users
+// See in_memory_message_store.go implementation for interface specifications
+type MessageStore interface {
+	AddMessage(from, to, body string) Message
+	GetConversation(user, otherUser string, before, limit int) []Message
+	MarkConversationRead(user, otherUser string)
+	GetUnreadCounts(user string) map[string]int
+	RenameUser(oldName, newName string, rename func() error) error
+	DeleteUser(user string)
 }
 
 // UsersServer is a strcuture which contains an interface to interact with the users DB
 type UsersServer struct {
-	store UsersStore
+	store               UsersStore
+	events              *EventBus                // optional, if nil no events are published and /events is not available
+	heartbeatInterval   time.Duration            // interval between /events heartbeats and /ws pings, DefaultHeartbeatInterval if 0
+	webhooks            *WebhookDispatcher       // optional, if nil no webhooks are sent and /webhooks is not available
+	adminToken          string                   // token which grants the admin role (see RequireRole), disabled if empty
+	messages            MessageStore             // optional, if nil messaging endpoints are not available
+	deletionGracePeriod time.Duration            // time during which deleted accounts can be restored, DefaultDeletionGracePeriod if 0
+	passwordResets      *PasswordResetTokens     // optional, if nil (or notifier is nil) passwords can't be reset
+	notifier            Notifier                 // delivers password reset tokens
+	audit               *AuditLog                // optional, if nil admin actions are not recorded and /admin/audit is not available
+	tracer              *Tracer                  // optional, if nil requests and store calls are not traced
+	idempotency         *IdempotencyKeys         // optional, if nil Idempotency-Key headers are ignored
+	transactions        *TransactionalUsersStore // optional, store (or the store it wraps) if it supports transactions; if nil /batch is not available
+	replicationLog      *MutationLog             // optional, log of the mutations of store if the server is a primary; if nil /replication/log is not available
+	replica             *Replica                 // optional, if not nil the server is a replica which keeps store up to date, and requests it doesn't serve are redirected to the primary (see IsServedByReplicas)
 }
 
 // ServeHTTP serves HTTP requests
 func (s *UsersServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	SetRequestID(w, r)
+	if s.tracer != nil {
+		s.tracer.ServeTracedHTTP(s, w, r)
+		return
+	}
+	if s.replica != nil && !IsServedByReplicas(r) {
+		s.replica.Redirect(w, r)
+		return
+	}
+	if s.idempotency != nil && r.Method == http.MethodPost && r.Header.Get(IdempotencyKeyHeader) != "" {
+		s.idempotency.ServeIdempotentHTTP(s, w, r)
+		return
+	}
+
 	option := strings.Split(r.URL.Path, "/")[1]
 	switch option {
 
 	case "getUsers":
-		fmt.Fprint(w, s.store.GetUsers())
+		s.GetUsers(&w, r)
 
 	case "signUp":
 		s.SignUp(&w, r)
 
+	case "lookupUser":
+		s.LookupUser(&w, r)
+
 	case "requestFriendship":
 		s.RequestFriendship(&w, r)
 
@@ -46,12 +117,90 @@ func (s *UsersServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "getFriends":
 		s.GetFriends(&w, r)
 
+	case "getFriendshipRequests":
+		s.GetFriendshipRequests(&w, r)
+
+	case "batch":
+		s.Batch(&w, r)
+
+	case "replication":
+		s.Replication(&w, r)
+
+	case "events":
+		s.Events(&w, r)
+
+	case "ws":
+		s.WebSocket(&w, r)
+
+	case "webhooks":
+		s.RequireRole(RoleAdmin, s.Webhooks)(&w, r)
+
+	case "admin":
+		s.Admin(&w, r)
+
+	case "profile":
+		s.Profile(&w, r)
+
+	case "privacySettings":
+		s.PrivacySettings(&w, r)
+
+	case "changePassword":
+		s.ChangePassword(&w, r)
+
+	case "requestPasswordReset":
+		s.RequestPasswordReset(&w, r)
+
+	case "resetPassword":
+		s.ResetPassword(&w, r)
+
+	case "changeUsername":
+		s.ChangeUsername(&w, r)
+
+	case "deleteAccount":
+		s.DeleteAccount(&w, r)
+
+	case "restoreAccount":
+		s.RestoreAccount(&w, r)
+
+	case "sendMessage":
+		s.SendMessage(&w, r)
+
+	case "getConversation":
+		s.GetConversation(&w, r)
+
+	case "getUnreadCounts":
+		s.GetUnreadCounts(&w, r)
+
 	default:
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
+// GetUsers takes a getUsers HTTP request (r) to the UsersServer (s), processes it and populates the ResponseWriter (w).
+// If the profiles query parameter is 1, a JSON list of profile summaries is returned instead of the usernames
+func (s *UsersServer) GetUsers(w *http.ResponseWriter, r *http.Request) {
+	users, err := s.storeV2().GetUsers(r.Context())
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("profiles") == "1" {
+		s.writeProfileSummaries(w, r, users)
+		return
+	}
+
+	fmt.Fprint(*w, users)
+}
+
+// UserIdentity is the ID and current username of a user
+type UserIdentity struct {
+	ID   string `json:"id"`
+	User string `json:"user"`
+}
+
 // SignUp takes a signUp HTTP request (r) to the UsersServer (s), processes it and populates the ResponseWriter (w)
+// with the identity of the new user
 func (s *UsersServer) SignUp(w *http.ResponseWriter, r *http.Request) {
 	info, ok := GetRequestInfo(w, r)
 	if !ok {
@@ -67,15 +216,45 @@ func (s *UsersServer) SignUp(w *http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if ok := s.store.AddUser(user, pass); ok {
-		(*w).WriteHeader(http.StatusOK)
-	} else {
+	id := NewUserID()
+	if err := s.storeV2().AddUserWithID(r.Context(), id, user, pass); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	s.webhooks.Notify(WebhookUserSignedUp, map[string]string{"user": user, "id": id})
+	s.RecordAudit(r, user, AuditUserSignedUp, user, map[string]string{"id": id})
+	WriteJSON(w, http.StatusOK, UserIdentity{ID: id, User: user})
+}
+
+// LookupUser takes a lookupUser HTTP request (r) to the UsersServer (s), processes it and populates the ResponseWriter
+// (w) with the identity of the user given either by username (user query parameter) or by ID (id query parameter)
+func (s *UsersServer) LookupUser(w *http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	user, id := query.Get("user"), query.Get("id")
+
+	var err error
+	switch {
+	case user != "" && id == "":
+		id, err = s.storeV2().GetUserID(r.Context(), user)
+	case id != "" && user == "":
+		user, err = s.storeV2().GetUsername(r.Context(), id)
+	default:
 		(*w).WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(*w, "User already exists")
+		fmt.Fprint(*w, "Exactly one of user and id must be given")
+		return
+	}
+
+	if err != nil {
+		WriteStoreError(w, err)
+		return
 	}
+
+	WriteJSON(w, http.StatusOK, UserIdentity{ID: id, User: user})
 }
 
 // RequestFriendship takes a requestFriendship HTTP request (r) to the UsersServer (s), processes it and populates the ResponseWriter (w)
+// The request is conditional if it has an If-Match header (see runIfMatch)
 func (s *UsersServer) RequestFriendship(w *http.ResponseWriter, r *http.Request) {
 	info, ok := GetRequestInfo(w, r)
 	if !ok {
@@ -84,32 +263,66 @@ func (s *UsersServer) RequestFriendship(w *http.ResponseWriter, r *http.Request)
 
 	user := info["user"]
 	pass := info["pass"]
-	userTo := info["userTo"]
 
 	// Check credentials
-	if !s.store.CheckUsersPassword(user, pass) {
-		(*w).WriteHeader(http.StatusUnauthorized)
+	if err := s.CheckCredentials(r.Context(), user, pass); err != nil {
+		WriteStoreError(w, err)
 		return
 	}
 
-	// Check if other user exists
-	if !s.store.UserExists(userTo) {
-		(*w).WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(*w, "User does not exist")
+	userTo, err := s.resolveUser(r.Context(), info, "userTo")
+	if err != nil {
+		WriteStoreError(w, err)
 		return
 	}
 
+	status, msg := s.runIfMatch(r, user, false, func(s *UsersServer) (int, string) {
+		return s.requestFriendship(r.Context(), user, userTo)
+	})
+	if status == http.StatusOK {
+		s.friendshipRequested(r, user, userTo)
+	}
+	WriteStatus(w, status, msg)
+}
+
+// requestFriendship sends a friendship request from user (who must have been authenticated already) to userTo.
+// Returns the HTTP status and error message (empty if none) of the operation. Nobody is notified (see
+// friendshipRequested)
+func (s *UsersServer) requestFriendship(ctx context.Context, user, userTo string) (int, string) {
+	// Check if other user exists
+	exists, err := s.storeV2().UserExists(ctx, userTo)
+	if err == nil && !exists {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return GetStoreErrorStatus(err)
+	}
+
+	allowed, err := s.canRequestFriendship(ctx, user, userTo)
+	if err != nil {
+		return GetStoreErrorStatus(err)
+	}
+	if !allowed {
+		return http.StatusForbidden, "User does not accept friendship requests from you"
+	}
+
 	// Add request to the DB
-	if ok := s.store.RequestFriendship(user, userTo); ok {
-		(*w).WriteHeader(http.StatusOK)
-	} else {
-		(*w).WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(*w, "Friendship request already exists")
+	if err = s.storeV2().RequestFriendship(ctx, user, userTo); err != nil {
+		return GetStoreErrorStatus(err)
 	}
+	return http.StatusOK, ""
+}
+
+// friendshipRequested notifies that user sent a friendship request to userTo through request r
+func (s *UsersServer) friendshipRequested(r *http.Request, user, userTo string) {
+	s.events.Publish(EventFriendshipRequestReceived, userTo, map[string]string{"from": user})
+	s.webhooks.Notify(WebhookFriendshipRequested, map[string]string{"from": user, "to": userTo})
+	s.RecordAudit(r, user, AuditFriendshipRequested, userTo, nil)
 }
 
 // RespondToFriendshipRequest takes a respondToFriendshipRequest HTTP request (r) to the UsersServer (s),
-// processes it and populates the ResponseWriter (w)
+// processes it and populates the ResponseWriter (w). The request is conditional if it has an If-Match header (see
+// runIfMatch), which may also be the version of the friends list of the user if the request is accepted
 func (s *UsersServer) RespondToFriendshipRequest(w *http.ResponseWriter, r *http.Request) {
 	info, ok := GetRequestInfo(w, r)
 	if !ok {
@@ -118,50 +331,261 @@ func (s *UsersServer) RespondToFriendshipRequest(w *http.ResponseWriter, r *http
 
 	user := info["user"]
 	pass := info["pass"]
-	otherUser := info["otherUser"]
-	accept := false
-	if info["acceptRequest"] == "1" {
-		accept = true
-	} else if info["acceptRequest"] != "0" {
+	accept, ok := ParseAcceptRequest(info["acceptRequest"])
+	if !ok {
 		(*w).WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(*w, "acceptRequest field must be either 1 or 0")
+		return
 	}
 
 	// Check credentials
-	if !s.store.CheckUsersPassword(user, pass) {
-		(*w).WriteHeader(http.StatusUnauthorized)
+	if err := s.CheckCredentials(r.Context(), user, pass); err != nil {
+		WriteStoreError(w, err)
 		return
 	}
 
-	// Check if other user exists
-	if !s.store.UserExists(otherUser) {
-		(*w).WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(*w, "User does not exist")
+	otherUser, err := s.resolveUser(r.Context(), info, "otherUser")
+	if err != nil {
+		WriteStoreError(w, err)
 		return
 	}
 
+	status, msg := s.runIfMatch(r, user, accept, func(s *UsersServer) (int, string) {
+		return s.respondToFriendshipRequest(r.Context(), user, otherUser, accept)
+	})
+	if status == http.StatusOK {
+		s.friendshipResponded(r, user, otherUser, accept)
+	}
+	WriteStatus(w, status, msg)
+}
+
+// respondToFriendshipRequest responds to the friendship request sent by otherUser to user (who must have been
+// authenticated already). Returns the HTTP status and error message (empty if none) of the operation. Nobody is
+// notified (see friendshipResponded)
+func (s *UsersServer) respondToFriendshipRequest(ctx context.Context, user, otherUser string, accept bool) (int, string) {
 	// Respond to friendship request
-	if ok := s.store.RespondToFriendshipRequest(user, otherUser, accept); ok {
-		(*w).WriteHeader(http.StatusOK)
+	if err := s.storeV2().RespondToFriendshipRequest(ctx, user, otherUser, accept); err != nil {
+		return GetStoreErrorStatus(err)
+	}
+	return http.StatusOK, ""
+}
+
+// friendshipResponded notifies that user accepted (accept) or declined the friendship request of otherUser through
+// request r
+func (s *UsersServer) friendshipResponded(r *http.Request, user, otherUser string, accept bool) {
+	if accept {
+		s.events.Publish(EventFriendshipRequestAccepted, otherUser, map[string]string{"by": user})
+		s.webhooks.Notify(WebhookFriendshipAccepted, map[string]string{"from": otherUser, "to": user})
 	} else {
-		(*w).WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(*w, "Cannot respond to friendship request because request does not exist")
+		s.events.Publish(EventFriendshipRequestDeclined, otherUser, map[string]string{"by": user})
+		s.webhooks.Notify(WebhookFriendshipDeclined, map[string]string{"from": otherUser, "to": user})
 	}
+	s.RecordAudit(r, user, GetFriendshipResponseAuditAction(accept), otherUser, nil)
 }
 
 // GetFriends takes a getFriends HTTP request (r) to the UsersServer (s), processes it and populates the ResponseWriter (w)
+// If the profiles query parameter is 1, a JSON list of profile summaries is returned instead of the usernames.
+// Authentication is optional, but it is needed to see friends lists which are not public.
+// The list of usernames has the version of the friends list as ETag, and 304 Not Modified is returned if it matches
+// the If-None-Match header
 func (s *UsersServer) GetFriends(w *http.ResponseWriter, r *http.Request) {
-	user := strings.Split(r.URL.Path, "/")[2] // if index breaks request is bad formatted
+	viewer, err := s.GetOptionallyAuthenticatedUser(r)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
 
-	// Check if user exists
-	if !s.store.UserExists(user) {
-		(*w).WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(*w, "User does not exist")
+	user, err := s.resolvePathUser(r, strings.Split(r.URL.Path, "/")[2]) // if index breaks request is bad formatted
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	// The version is read before the list, so that it is never newer than the list
+	versions, versionsErr := s.storeV2().GetVersions(r.Context(), user)
+	friends, status, msg := s.getFriends(r.Context(), viewer, user)
+	if status != http.StatusOK {
+		WriteStatus(w, status, msg)
+		return
+	}
+
+	// Profiles change without changing the version of the list, so they have no ETag
+	if r.URL.Query().Get("profiles") == "1" {
+		s.writeProfileSummaries(w, r, friends)
+		return
+	}
+
+	if versionsErr == nil && WriteETag(w, r, versions.Friends) {
 		return
 	}
 
 	(*w).WriteHeader(http.StatusOK)
-	fmt.Fprint(*w, s.store.GetFriends(user))
+	fmt.Fprint(*w, friends)
+}
+
+// GetFriendshipRequests takes a getFriendshipRequests HTTP request (r) to the UsersServer (s), processes it and
+// populates the ResponseWriter (w) with the pending friendship requests sent and received by the user, who must
+// authenticate using HTTP basic authentication. The requests have their version as ETag, and 304 Not Modified is
+// returned if it matches the If-None-Match header
+func (s *UsersServer) GetFriendshipRequests(w *http.ResponseWriter, r *http.Request) {
+	user, err := s.GetAuthenticatedUser(r)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	// The version is read before the requests, so that it is never newer than them
+	versions, err := s.storeV2().GetVersions(r.Context(), user)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+	sent, received, err := s.storeV2().GetFriendshipRequests(r.Context(), user)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	if WriteETag(w, r, versions.Requests) {
+		return
+	}
+	WriteJSON(w, http.StatusOK, FriendshipRequestQueue{User: user, Sent: sent, Received: received})
+}
+
+// getFriends returns the list of friends of user as seen by viewer (who must have been authenticated already, or be
+// empty if anonymous), along with the HTTP status and error message (empty if none) of the operation
+func (s *UsersServer) getFriends(ctx context.Context, viewer, user string) ([]string, int, string) {
+	// Check if user exists
+	exists, err := s.storeV2().UserExists(ctx, user)
+	if err == nil && !exists {
+		err = ErrNotFound
+	}
+	if err != nil {
+		status, msg := GetStoreErrorStatus(err)
+		return nil, status, msg
+	}
+
+	visible, err := s.canSeeFriends(ctx, viewer, user)
+	if err != nil {
+		status, msg := GetStoreErrorStatus(err)
+		return nil, status, msg
+	}
+	if !visible {
+		return nil, http.StatusForbidden, "Friends list is private"
+	}
+
+	friends, err := s.storeV2().GetFriends(ctx, user)
+	if err != nil {
+		status, msg := GetStoreErrorStatus(err)
+		return nil, status, msg
+	}
+	return friends, http.StatusOK, ""
+}
+
+// runIfMatch runs operation, which requests or responds to a friendship as user, with s iff the If-Match header of
+// request r (if any) matches the version of the friendship requests of user (see GetFriendshipRequests) or, if
+// friends (ie operation changes the friends list of user too), the version of their friends list (see GetFriends).
+// Returns the HTTP status and error message of operation, or 412 Precondition Failed if the version does not match.
+// The version is checked first, and then again by the store when the request or response is made (see
+// RequestFriendshipIf), with only the users involved locked, so that nothing can change in between.
+// Other mutations (eg removing friendships, deleting accounts or batches) ignore If-Match
+func (s *UsersServer) runIfMatch(r *http.Request, user string, friends bool, operation func(s *UsersServer) (int, string)) (int, string) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return operation(s)
+	}
+
+	matches := func(versions UserVersions) bool {
+		return MatchesETag(ifMatch, FormatETag(versions.Requests), false) ||
+			friends && MatchesETag(ifMatch, FormatETag(versions.Friends), false)
+	}
+	versions, err := s.storeV2().GetVersions(r.Context(), user)
+	if err != nil {
+		return GetStoreErrorStatus(err)
+	}
+	if !matches(versions) {
+		return http.StatusPreconditionFailed, "Friendship requests have changed"
+	}
+
+	changed := false
+	conditional := *s
+	conditional.store = &conditionalUsersStore{UsersStore: s.store, condition: func(versions UserVersions) bool {
+		changed = !matches(versions)
+		return !changed
+	}}
+	status, msg := operation(&conditional)
+	if changed {
+		return http.StatusPreconditionFailed, "Friendship requests have changed"
+	}
+	return status, msg
+}
+
+// conditionalUsersStore is a UsersStore which wraps another one, making the friendship requests and responses made
+// through it conditional on condition (see RequestFriendshipIf)
+type conditionalUsersStore struct {
+	UsersStore
+	condition func(versions UserVersions) bool
+}
+
+// RequestFriendship adds a friendship request from user `from` to user `to` iff the condition of the store returns
+// true (see UsersStore)
+func (s *conditionalUsersStore) RequestFriendship(from, to string) bool {
+	return s.UsersStore.RequestFriendshipIf(from, to, s.condition)
+}
+
+// RespondToFriendshipRequest responds to a friendship request from otherUser made to user iff the condition of the
+// store returns true (see UsersStore)
+func (s *conditionalUsersStore) RespondToFriendshipRequest(user, otherUser string, acceptRequest bool) bool {
+	return s.UsersStore.RespondToFriendshipRequestIf(user, otherUser, acceptRequest, s.condition)
+}
+
+// beginTransaction begins a transaction in s.transactions. If the store of s traces its calls (see
+// Tracer.ServeTracedHTTP), so does the transaction
+func (s *UsersServer) beginTransaction() *UsersTransaction {
+	tx := s.transactions.Begin()
+	if traced, ok := s.store.(*TracingUsersStore); ok {
+		tx.UsersStore = NewTracingUsersStore(tx.UsersStore, traced.tracer, traced.parent)
+	}
+	return tx
+}
+
+// withTransaction returns a copy of s which uses transaction tx (which must have been begun with beginTransaction) as
+// its store
+func (s *UsersServer) withTransaction(tx *UsersTransaction) *UsersServer {
+	inTx := *s
+	inTx.store = tx
+	return &inTx
+}
+
+// storeV2 returns the store of the server as a UsersStoreV2
+func (s *UsersServer) storeV2() UsersStoreV2 {
+	return NewUsersStoreAdapter(s.store)
+}
+
+// resolveUser returns the username of the user referenced by field in the information of a request, which holds
+// either their username (field) or their ID (field + "Id"). Returns ErrNotFound if the ID does not exist
+func (s *UsersServer) resolveUser(ctx context.Context, info map[string]string, field string) (string, error) {
+	if id := info[field+"Id"]; id != "" {
+		return s.storeV2().GetUsername(ctx, id)
+	}
+	return info[field], nil
+}
+
+// resolvePathUser returns the username of the user in the path of request r, which is their ID if the byId query
+// parameter is 1. Returns ErrNotFound if the ID does not exist
+func (s *UsersServer) resolvePathUser(r *http.Request, pathUser string) (string, error) {
+	if r.URL.Query().Get("byId") != "1" {
+		return pathUser, nil
+	}
+	return s.storeV2().GetUsername(r.Context(), pathUser)
+}
+
+// GetFriendshipResponseAuditAction returns the audit action of accepting (accept) or declining a friendship request
+func GetFriendshipResponseAuditAction(accept bool) string {
+	if accept {
+		return AuditFriendshipAccepted
+	}
+	return AuditFriendshipDeclined
 }
 
 // CheckUsernameAndPassword returns true iff username has 5-10 alphanum characters and password has 8-12 alphanum chars.
@@ -203,6 +627,77 @@ func CheckUsernameAndPassword(username, password string) (bool, string) {
 	return ok, msg
 }
 
+// CheckCredentials returns nil if user exists and has this password, in which case the user is marked as seen now,
+// and otherwise ErrWrongPassword or the error which prevented checking it
+func (s *UsersServer) CheckCredentials(ctx context.Context, user, pass string) error {
+	if err := s.storeV2().CheckUsersPassword(ctx, user, pass); err != nil {
+		return err
+	}
+	return s.storeV2().TouchUser(ctx, user)
+}
+
+// GetAuthenticatedUser returns the user authenticated with HTTP basic authentication in request r, or
+// ErrWrongPassword if there are no credentials or they are not valid (see CheckCredentials)
+func (s *UsersServer) GetAuthenticatedUser(r *http.Request) (string, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", ErrWrongPassword
+	}
+	if err := s.CheckCredentials(r.Context(), user, pass); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+// GetOptionallyAuthenticatedUser returns the user authenticated with HTTP basic authentication in request r, or an
+// empty string if there are no credentials. Returns an error iff there are credentials but they are not valid (see
+// GetAuthenticatedUser)
+func (s *UsersServer) GetOptionallyAuthenticatedUser(r *http.Request) (string, error) {
+	if _, _, hasCredentials := r.BasicAuth(); !hasCredentials {
+		return "", nil
+	}
+	return s.GetAuthenticatedUser(r)
+}
+
+// ParseAcceptRequest parses the acceptRequest field of a request, which must be either "1" or "0".
+// ok is false iff the field has any other value
+func ParseAcceptRequest(field string) (accept bool, ok bool) {
+	switch field {
+	case "1":
+		return true, true
+	case "0":
+		return false, true
+	}
+	return false, false
+}
+
+// WriteStatus populates w with HTTP status and, if not empty, message msg
+func WriteStatus(w *http.ResponseWriter, status int, msg string) {
+	(*w).WriteHeader(status)
+	if msg != "" {
+		fmt.Fprint(*w, msg)
+	}
+}
+
+// WriteETag sets the ETag of the response (w) to the one of version and, if it matches the If-None-Match header of
+// request r, populates w with 304 Not Modified and returns true
+func WriteETag(w *http.ResponseWriter, r *http.Request, version uint64) bool {
+	etag := FormatETag(version)
+	(*w).Header().Set("ETag", etag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && MatchesETag(ifNoneMatch, etag, true) {
+		(*w).WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// WriteStoreError populates the ResponseWriter (w) with the HTTP status and error message of err, returned by a
+// UsersStoreV2 (see GetStoreErrorStatus)
+func WriteStoreError(w *http.ResponseWriter, err error) {
+	status, msg := GetStoreErrorStatus(err)
+	WriteStatus(w, status, msg)
+}
+
 // GetRequestInfo returns the JSON information in the request r in a map format
 // Iff an error happens, w will be populated and ok will be false
 func GetRequestInfo(w *http.ResponseWriter, r *http.Request) (map[string]string, bool) {
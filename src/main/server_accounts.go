@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultDeletionGracePeriod is the time during which deleted accounts can be restored
+const DefaultDeletionGracePeriod = 30 * 24 * time.Hour
+
+// ChangeUsername takes a changeUsername HTTP request (r) to the UsersServer (s), processes it and populates the
+// ResponseWriter (w). The user keeps their ID, so friendships and requests are kept as they are; messages are
+// rewritten along with the username (see MessageStore.RenameUser) and open /events and /ws connections of the user
+// are closed.
+func (s *UsersServer) ChangeUsername(w *http.ResponseWriter, r *http.Request) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	pass := info["pass"]
+	newUser := info["newUser"]
+
+	// Check credentials
+	if err := s.CheckCredentials(r.Context(), user, pass); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	if ok, msg := CheckUsernameAndPassword(newUser, pass); !ok {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(*w, msg)
+		return
+	}
+
+	rename := func() error {
+		return s.storeV2().RenameUser(r.Context(), user, newUser)
+	}
+	var err error
+	if s.messages != nil {
+		err = s.messages.RenameUser(user, newUser, rename)
+	} else {
+		err = rename()
+	}
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	if s.passwordResets != nil {
+		s.passwordResets.Revoke(user)
+	}
+	s.events.ForgetUser(user)
+	s.RecordAudit(r, user, AuditUsernameChanged, newUser, map[string]string{"from": user})
+	(*w).WriteHeader(http.StatusOK)
+}
+
+// DeleteAccount takes a deleteAccount HTTP request (r) to the UsersServer (s), processes it and populates the
+// ResponseWriter (w). The account can be restored (see RestoreAccount) during the deletion grace period.
+func (s *UsersServer) DeleteAccount(w *http.ResponseWriter, r *http.Request) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	pass := info["pass"]
+
+	// Check credentials
+	if err := s.CheckCredentials(r.Context(), user, pass); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	if err := s.storeV2().DeleteUser(r.Context(), user); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	if s.passwordResets != nil {
+		s.passwordResets.Revoke(user) // so that it can't be used after a restore, or by a new user with the username
+	}
+	s.events.ForgetUser(user) // disconnect the user's streaming clients
+	s.RecordAudit(r, user, AuditAccountDeleted, user, nil)
+	(*w).WriteHeader(http.StatusOK)
+}
+
+// RestoreAccount takes a restoreAccount HTTP request (r) to the UsersServer (s), processes it and populates the
+// ResponseWriter (w)
+func (s *UsersServer) RestoreAccount(w *http.ResponseWriter, r *http.Request) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	// Accounts past their grace period can't be restored even if the janitor did not run yet
+	if _, err := s.PurgeExpiredAccounts(r.Context()); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	if err := s.storeV2().RestoreUser(r.Context(), info["user"], info["pass"]); errors.Is(err, ErrNotFound) {
+		(*w).WriteHeader(http.StatusUnauthorized) // wrong password, or the user is not deleted
+		return
+	} else if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	s.RecordAudit(r, info["user"], AuditAccountRestored, info["user"], nil)
+
+	(*w).WriteHeader(http.StatusOK)
+}
+
+// PurgeExpiredAccounts permanently removes the accounts deleted longer than the deletion grace period ago, along with
+// their messages (so that they are not inherited by a new user with the same username). Returns the purged users
+func (s *UsersServer) PurgeExpiredAccounts(ctx context.Context) ([]string, error) {
+	gracePeriod := s.deletionGracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = DefaultDeletionGracePeriod
+	}
+
+	purged, err := s.storeV2().PurgeDeletedUsers(ctx, time.Now().Add(-gracePeriod))
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range purged {
+		if s.messages != nil {
+			s.messages.DeleteUser(user)
+		}
+		s.RecordAudit(nil, SystemActor, AuditAccountPurged, user, nil)
+	}
+	return purged, nil
+}
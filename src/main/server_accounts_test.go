@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "berta", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "marta", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "berta", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "marta", "arnau", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "sergi", "berta", "12345678", http.StatusOK)
+	arnauID, _ := store.GetUserID("arnau")
+	martaID, _ := store.GetUserID("marta")
+
+	// Friends: arnau&sergi
+	// Requests: arnau->berta; marta->arnau; sergi->berta
+
+	RunAccountTest(t, server, "delete account (wrong password)", "/deleteAccount", "arnau", "wrongPass", http.StatusUnauthorized)
+	RunAccountTest(t, server, "delete account", "/deleteAccount", "arnau", "12345678", http.StatusOK)
+
+	RunGetUsersTest(t, server, "deleted user is not listed", "[berta marta sergi]")
+	RunListFriends(t, server, "deleted user is removed from friends lists", "sergi", "[]", http.StatusOK)
+	RunListFriends(t, server, "friends of deleted user", "arnau", "", http.StatusBadRequest)
+	RunFriendshipRequestTest(t, server, "deleted user can't log in", "arnau", "sergi", "12345678", http.StatusUnauthorized)
+	RunRespondToFriendshipTest(t, server, "requests sent by deleted user are removed", "berta", "arnau", "12345678", true, http.StatusBadRequest)
+	t.Run("requests received by deleted user are removed", func(t *testing.T) {
+		if requests := store.sentRequests[martaID]; len(requests) != 0 {
+			t.Errorf("got requests sent by marta %v, want none", requests)
+		}
+	})
+	RunSignUpTest(t, server, "username is reserved during grace period", "arnau", "password", http.StatusBadRequest)
+	RunRespondToFriendshipTest(t, server, "other requests are kept", "berta", "sergi", "12345678", false, http.StatusOK)
+
+	// Requests: -
+
+	RunAccountTest(t, server, "restore account (wrong password)", "/restoreAccount", "arnau", "wrongPass", http.StatusUnauthorized)
+	RunAccountTest(t, server, "restore account", "/restoreAccount", "arnau", "12345678", http.StatusOK)
+	RunAccountTest(t, server, "restore account (already restored)", "/restoreAccount", "arnau", "12345678", http.StatusUnauthorized)
+
+	RunGetUsersTest(t, server, "restored user is listed", "[arnau berta marta sergi]")
+	RunListFriends(t, server, "friendships are restored", "sergi", "[arnau]", http.StatusOK)
+	RunListFriends(t, server, "friendships are restored", "arnau", "[sergi]", http.StatusOK)
+	t.Run("restored user keeps their ID", func(t *testing.T) {
+		if id, _ := store.GetUserID("arnau"); id != arnauID {
+			t.Errorf("got ID %q, want %q", id, arnauID)
+		}
+	})
+	RunRespondToFriendshipTest(t, server, "received requests are restored", "arnau", "marta", "12345678", false, http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "sent requests are restored", "berta", "arnau", "12345678", false, http.StatusOK)
+}
+
+func TestDeleteAccountGracePeriod(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, deletionGracePeriod: time.Millisecond}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+
+	RunAccountTest(t, server, "delete account", "/deleteAccount", "arnau", "12345678", http.StatusOK)
+	time.Sleep(2 * time.Millisecond)
+
+	RunAccountTest(t, server, "restore account (grace period is over)", "/restoreAccount", "arnau", "12345678", http.StatusUnauthorized)
+	RunSignUpTest(t, server, "username is available after grace period", "arnau", "password", http.StatusOK)
+	RunListFriends(t, server, "new user has no friends", "arnau", "[]", http.StatusOK)
+	RunListFriends(t, server, "friendships with old user are gone", "sergi", "[]", http.StatusOK)
+}
+
+func RunAccountTest(t *testing.T, s *UsersServer, testName, url, user, password string, expectedHTTPStatus int) {
+	requestBody, err := json.Marshal(map[string]string{
+		"user": user,
+		"pass": password,
+	})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(requestBody))
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); !ok {
+			t.Errorf("Got body: %q", response.Body.String())
+		}
+	})
+}
+
+func TestChangeUsername(t *testing.T) {
+	store := EmptyUsersStore()
+	messages := EmptyMessageStore()
+	server := &UsersServer{store: store, messages: messages}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "berta", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "marta", "12345678", http.StatusOK)
+	arnauID, _ := store.GetUserID("arnau")
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "berta", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "marta", "arnau", "12345678", http.StatusOK)
+	RunSendMessageTest(t, server, "send message", "sergi", "12345678", "arnau", "hi!", http.StatusOK)
+
+	// Friends: arnau&sergi
+	// Requests: arnau->berta; marta->arnau
+
+	RunPostTest(t, server, "change username (wrong password)", "/changeUsername",
+		map[string]string{"user": "arnau", "pass": "wrongPass", "newUser": "arnau2"}, http.StatusUnauthorized)
+	RunPostTest(t, server, "change username (invalid username)", "/changeUsername",
+		map[string]string{"user": "arnau", "pass": "12345678", "newUser": "arnau!"}, http.StatusBadRequest)
+	RunPostTest(t, server, "change username (already exists)", "/changeUsername",
+		map[string]string{"user": "arnau", "pass": "12345678", "newUser": "sergi"}, http.StatusBadRequest)
+	t.Run("messages are kept when the rename fails", func(t *testing.T) {
+		if counts := messages.GetUnreadCounts("arnau"); counts["sergi"] != 1 {
+			t.Errorf("got unread counts %v, want 1 from sergi", counts)
+		}
+	})
+	RunPostTest(t, server, "change username", "/changeUsername",
+		map[string]string{"user": "arnau", "pass": "12345678", "newUser": "arnau2"}, http.StatusOK)
+
+	RunGetUsersTest(t, server, "renamed user is listed with new name", "[arnau2 berta marta sergi]")
+	RunListFriends(t, server, "friends of renamed user", "arnau2", "[sergi]", http.StatusOK)
+	RunListFriends(t, server, "friends lists are rewritten", "sergi", "[arnau2]", http.StatusOK)
+	RunGetProfileTest(t, server, "profile is renamed", "arnau2", Profile{ID: arnauID, User: "arnau2"}, http.StatusOK)
+	RunFriendshipRequestTest(t, server, "old username can't log in", "arnau", "berta", "12345678", http.StatusUnauthorized)
+	RunRespondToFriendshipTest(t, server, "sent requests are rewritten", "berta", "arnau2", "12345678", true, http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "received requests are kept", "arnau2", "marta", "12345678", true, http.StatusOK)
+	RunGetUnreadCountsTest(t, server, "unread messages are rewritten", "arnau2", `{"sergi":1}`, http.StatusOK)
+	RunGetConversationTest(t, server, "messages are rewritten", "sergi", "arnau2", "", []string{"hi!"}, http.StatusOK)
+	RunSignUpTest(t, server, "old username is available", "arnau", "12345678", http.StatusOK)
+	RunListFriends(t, server, "new user with old username has no friends", "arnau", "[]", http.StatusOK)
+	t.Run("new user with old username gets a new ID", func(t *testing.T) {
+		if id, _ := store.GetUserID("arnau"); id == arnauID {
+			t.Errorf("got ID %q of the renamed user", id)
+		}
+	})
+}
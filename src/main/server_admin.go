@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminTokenActor is the actor recorded in the audit trail for requests authenticated with the admin token.
+// It can't clash with a username because usernames are alphanumeric
+const AdminTokenActor = "@adminToken"
+
+// AdminHandler handles a request (r) to an admin endpoint made by actor, who has already been authorized
+type AdminHandler func(w *http.ResponseWriter, r *http.Request, actor string)
+
+// AdminUserInfo is the information about a user shown to operators
+type AdminUserInfo struct {
+	ID               string    `json:"id"`
+	User             string    `json:"user"`
+	Role             string    `json:"role"`
+	CreatedAt        time.Time `json:"createdAt"`
+	LastSeen         time.Time `json:"lastSeen"`
+	Friends          int       `json:"friends"`
+	SentRequests     int       `json:"sentRequests"`
+	ReceivedRequests int       `json:"receivedRequests"`
+}
+
+// FriendshipRequestQueue holds the pending friendship requests sent and received by a user
+type FriendshipRequestQueue struct {
+	User     string   `json:"user"`
+	Sent     []string `json:"sent"`
+	Received []string `json:"received"`
+}
+
+// RequireRole returns a handler which runs handler iff the request (r) is made by a user with at least role, who
+// must authenticate using HTTP basic authentication, or carries the server's admin token in an
+// "Authorization: Bearer <token>" header (which grants the admin role).
+// Otherwise it populates the ResponseWriter (w) with 401 Unauthorized or 403 Forbidden
+func (s *UsersServer) RequireRole(role string, handler AdminHandler) func(w *http.ResponseWriter, r *http.Request) {
+	return func(w *http.ResponseWriter, r *http.Request) {
+		if s.CheckAdminToken(r) {
+			handler(w, r, AdminTokenActor)
+			return
+		}
+
+		user, err := s.GetAuthenticatedUser(r)
+		if err != nil {
+			WriteStoreError(w, err)
+			return
+		}
+
+		if status, msg := s.checkRole(r.Context(), user, role); status != http.StatusOK {
+			WriteStatus(w, status, msg)
+			return
+		}
+
+		handler(w, r, user)
+	}
+}
+
+// checkRole returns 200 OK if user has at least role, and otherwise 403 Forbidden or the status of the error which
+// prevented checking it, with its message
+func (s *UsersServer) checkRole(ctx context.Context, user, role string) (int, string) {
+	userRole, err := s.storeV2().GetRole(ctx, user)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return GetStoreErrorStatus(err)
+	}
+	if !HasRole(userRole, role) {
+		return http.StatusForbidden, fmt.Sprintf("This operation requires the %s role", role)
+	}
+	return http.StatusOK, ""
+}
+
+// Admin takes an admin HTTP request (r) to the UsersServer (s), processes it and populates the ResponseWriter (w).
+// The operation is given by the second element of the path:
+// - GET /admin/users lists all users with their metadata (moderator)
+// - GET /admin/friendshipRequests?user=<user> lists the pending friendship requests of user (moderator)
+// - POST /admin/removeFriendship removes a friendship (moderator)
+// - POST /admin/deleteUser permanently deletes a user (admin)
+// - POST /admin/resetPassword sets the password of a user (admin)
+// - POST /admin/setRole sets the role of a user (admin)
+// - GET /admin/audit lists the audit trail (admin)
+// - GET /admin/export exports the social graph (admin)
+// - POST /admin/import imports a social graph (admin)
+// - GET /admin/graph?format=<format> exports the friendship graph for analysis (moderator)
+// - GET /admin/cacheStats returns the hit/miss statistics of the store caches (moderator)
+func (s *UsersServer) Admin(w *http.ResponseWriter, r *http.Request) {
+	path := strings.Split(r.URL.Path, "/")
+	operation := ""
+	if len(path) > 2 {
+		operation = path[2]
+	}
+
+	var method, role string
+	var handler AdminHandler
+	switch operation {
+	case "users":
+		method, role, handler = http.MethodGet, RoleModerator, s.AdminListUsers
+	case "friendshipRequests":
+		method, role, handler = http.MethodGet, RoleModerator, s.AdminGetFriendshipRequests
+	case "removeFriendship":
+		method, role, handler = http.MethodPost, RoleModerator, s.AdminRemoveFriendship
+	case "deleteUser":
+		method, role, handler = http.MethodPost, RoleAdmin, s.AdminDeleteUser
+	case "resetPassword":
+		method, role, handler = http.MethodPost, RoleAdmin, s.AdminResetPassword
+	case "setRole":
+		method, role, handler = http.MethodPost, RoleAdmin, s.AdminSetRole
+	case "audit":
+		method, role, handler = http.MethodGet, RoleAdmin, s.AdminGetAuditTrail
+	case "export":
+		method, role, handler = http.MethodGet, RoleAdmin, s.AdminExportGraph
+	case "import":
+		method, role, handler = http.MethodPost, RoleAdmin, s.AdminImportGraph
+	case "graph":
+		method, role, handler = http.MethodGet, RoleModerator, s.AdminGetSocialGraph
+	case "cacheStats":
+		method, role, handler = http.MethodGet, RoleModerator, s.AdminGetCacheStats
+	default:
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != method {
+		(*w).WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.RequireRole(role, handler)(w, r)
+}
+
+// AdminListUsers populates the ResponseWriter (w) with the information of all users, sorted by username
+func (s *UsersServer) AdminListUsers(w *http.ResponseWriter, r *http.Request, actor string) {
+	store := s.storeV2()
+	users, err := store.GetUsers(r.Context())
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	infos := make([]AdminUserInfo, 0, len(users))
+	for _, user := range users {
+		info, err := getAdminUserInfo(r.Context(), store, user)
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted since listed
+		}
+		if err != nil {
+			WriteStoreError(w, err)
+			return
+		}
+		infos = append(infos, info)
+	}
+
+	WriteJSON(w, http.StatusOK, infos)
+}
+
+// getAdminUserInfo returns the information of user in store, or the error of the first query which failed
+func getAdminUserInfo(ctx context.Context, store UsersStoreV2, user string) (AdminUserInfo, error) {
+	profile, err := store.GetProfile(ctx, user)
+	if err != nil {
+		return AdminUserInfo{}, err
+	}
+	role, err := store.GetRole(ctx, user)
+	if err != nil {
+		return AdminUserInfo{}, err
+	}
+	sent, received, err := store.GetFriendshipRequests(ctx, user)
+	if err != nil {
+		return AdminUserInfo{}, err
+	}
+	friends, err := store.GetFriends(ctx, user)
+	if err != nil {
+		return AdminUserInfo{}, err
+	}
+
+	return AdminUserInfo{
+		ID:               profile.ID,
+		User:             user,
+		Role:             role,
+		CreatedAt:        profile.CreatedAt,
+		LastSeen:         profile.LastSeen,
+		Friends:          len(friends),
+		SentRequests:     len(sent),
+		ReceivedRequests: len(received),
+	}, nil
+}
+
+// AdminGetFriendshipRequests populates the ResponseWriter (w) with the pending friendship requests of the user given
+// by the user query parameter
+func (s *UsersServer) AdminGetFriendshipRequests(w *http.ResponseWriter, r *http.Request, actor string) {
+	user := r.URL.Query().Get("user")
+	sent, received, err := s.storeV2().GetFriendshipRequests(r.Context(), user)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, FriendshipRequestQueue{User: user, Sent: sent, Received: received})
+}
+
+// AdminRemoveFriendship removes the friendship between the users given in the body of request (r), and populates
+// the ResponseWriter (w)
+func (s *UsersServer) AdminRemoveFriendship(w *http.ResponseWriter, r *http.Request, actor string) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	otherUser := info["otherUser"]
+
+	if err := s.storeV2().RemoveFriendship(r.Context(), user, otherUser); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	s.friendshipRemoved(r, actor, user, otherUser)
+	(*w).WriteHeader(http.StatusOK)
+}
+
+// friendshipRemoved records that actor removed the friendship between user and otherUser through request r
+func (s *UsersServer) friendshipRemoved(r *http.Request, actor, user, otherUser string) {
+	s.RecordAudit(r, actor, AuditFriendshipRemoved, user, map[string]string{"otherUser": otherUser})
+}
+
+// AdminDeleteUser permanently deletes the user given in the body of request (r), with no grace period, and populates
+// the ResponseWriter (w)
+func (s *UsersServer) AdminDeleteUser(w *http.ResponseWriter, r *http.Request, actor string) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	if err := s.storeV2().DeleteUser(r.Context(), user); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	status, msg := s.userDeleted(r, actor, user)
+	WriteStatus(w, status, msg)
+}
+
+// userDeleted permanently deletes user, who has been deleted by actor through request r, forgets everything else
+// about them and records it. Returns the HTTP status and message of the request
+func (s *UsersServer) userDeleted(r *http.Request, actor, user string) (int, string) {
+	// The context is not passed, so that the user is not left deleted but not purged if the client disconnects
+	if err := s.storeV2().PurgeDeletedUser(context.Background(), user); err != nil {
+		return GetStoreErrorStatus(err)
+	}
+
+	if s.messages != nil {
+		s.messages.DeleteUser(user)
+	}
+	if s.passwordResets != nil {
+		s.passwordResets.Revoke(user)
+	}
+	s.events.ForgetUser(user)
+
+	s.RecordAudit(r, actor, AuditUserDeleted, user, nil)
+	return http.StatusOK, ""
+}
+
+// AdminResetPassword sets the password of the user given in the body of request (r), and populates the
+// ResponseWriter (w). Open /events and /ws connections of the user are closed.
+func (s *UsersServer) AdminResetPassword(w *http.ResponseWriter, r *http.Request, actor string) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	status, msg := s.changePassword(r.Context(), user, info["newPass"])
+	if status == http.StatusOK {
+		s.RecordAudit(r, actor, AuditPasswordReset, user, nil)
+	}
+	WriteStatus(w, status, msg)
+}
+
+// AdminSetRole sets the role of the user given in the body of request (r), and populates the ResponseWriter (w)
+func (s *UsersServer) AdminSetRole(w *http.ResponseWriter, r *http.Request, actor string) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	role := info["role"]
+
+	oldRole, status, msg := s.setRole(r.Context(), user, role)
+	if status == http.StatusOK {
+		s.roleChanged(r, actor, user, oldRole, role)
+	}
+	WriteStatus(w, status, msg)
+}
+
+// setRole sets the role of user. Returns their previous role, and the HTTP status and message of the request
+func (s *UsersServer) setRole(ctx context.Context, user, role string) (oldRole string, status int, msg string) {
+	if !IsValidRole(role) {
+		return "", http.StatusBadRequest, "Role must be either user, moderator or admin"
+	}
+
+	oldRole, err := s.storeV2().GetRole(ctx, user)
+	if err == nil {
+		err = s.storeV2().SetRole(ctx, user, role)
+	}
+	if err != nil {
+		status, msg = GetStoreErrorStatus(err)
+		return "", status, msg
+	}
+	return oldRole, http.StatusOK, ""
+}
+
+// roleChanged records that actor changed the role of user from oldRole to role through request r
+func (s *UsersServer) roleChanged(r *http.Request, actor, user, oldRole, role string) {
+	s.RecordAudit(r, actor, AuditRoleChanged, user, map[string]string{"from": oldRole, "to": role})
+}
+
+// AdminGetAuditTrail populates the ResponseWriter (w) with all entries of the audit trail, oldest first
+func (s *UsersServer) AdminGetAuditTrail(w *http.ResponseWriter, r *http.Request, actor string) {
+	if s.audit == nil {
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, s.audit.GetEntries())
+}
+
+// AdminExportGraph populates the ResponseWriter (w) with all users, friendships and pending friendship requests as
+// JSON Lines (see ExportGraph). Passwords are included unless the "passwords" query parameter is false
+func (s *UsersServer) AdminExportGraph(w *http.ResponseWriter, r *http.Request, actor string) {
+	passwords := true
+	if value := r.URL.Query().Get("passwords"); value != "" {
+		var err error
+		if passwords, err = strconv.ParseBool(value); err != nil {
+			(*w).WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(*w, "passwords must be true or false")
+			return
+		}
+	}
+
+	(*w).Header().Set("Content-Type", "application/x-ndjson")
+	report, err := ExportGraph(s.store, *w, passwords)
+	if err != nil {
+		return // the response has already started, the client will get a truncated export
+	}
+
+	details := report.Details()
+	details["passwords"] = strconv.FormatBool(passwords)
+	s.RecordAudit(r, actor, AuditGraphExported, "", details)
+}
+
+// AdminImportGraph imports the users, friendships and pending friendship requests in the body of request (r)
+// (see ImportGraph), and populates the ResponseWriter (w) with the report of the import
+func (s *UsersServer) AdminImportGraph(w *http.ResponseWriter, r *http.Request, actor string) {
+	var report GraphReport
+	var err error
+	if s.transactions != nil {
+		report, err = importGraph(s.beginTransaction, r.Body) // so that nothing else modifies the store during the import
+	} else {
+		report, err = ImportGraph(s.store, r.Body)
+	}
+	if err != nil {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(*w, err.Error())
+		return
+	}
+
+	if len(report.Conflicts) > 0 {
+		WriteJSON(w, http.StatusConflict, report)
+		return
+	}
+
+	s.RecordAudit(r, actor, AuditGraphImported, "", report.Details())
+	WriteJSON(w, http.StatusOK, report)
+}
+
+// AdminGetSocialGraph populates the ResponseWriter (w) with the friendship graph in the format given by the "format"
+// query parameter (dot, graphml or gexf; see WriteSocialGraph). Pending friendship requests are included as directed
+// edges if "requests" is true, and if "user" is given only its ego network up to "hops" friendships away (1 by
+// default) is included
+func (s *UsersServer) AdminGetSocialGraph(w *http.ResponseWriter, r *http.Request, actor string) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if !IsValidGraphFormat(format) {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(*w, "format must be one of %s", strings.Join(GraphFormats, ", "))
+		return
+	}
+
+	options := SocialGraphOptions{Ego: query.Get("user"), Hops: 1}
+	if requests := query.Get("requests"); requests != "" {
+		include, err := strconv.ParseBool(requests)
+		if err != nil {
+			(*w).WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(*w, "requests must be true or false")
+			return
+		}
+		options.Requests = include
+	}
+	if hops := query.Get("hops"); hops != "" {
+		n, err := strconv.Atoi(hops)
+		if err != nil || n < 0 || options.Ego == "" {
+			(*w).WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(*w, "hops must be a non-negative integer and requires user")
+			return
+		}
+		options.Hops = n
+	}
+
+	graph, ok := BuildSocialGraph(s.store, options)
+	if !ok {
+		(*w).WriteHeader(http.StatusNotFound)
+		fmt.Fprint(*w, "User does not exist")
+		return
+	}
+
+	(*w).Header().Set("Content-Type", GetGraphContentType(format))
+	WriteSocialGraph(*w, graph, format)
+}
+
+// AdminGetCacheStats populates the ResponseWriter (w) with the statistics of the caches of the store (see
+// CachingUsersStore), or 404 if the store is not cached
+func (s *UsersServer) AdminGetCacheStats(w *http.ResponseWriter, r *http.Request, actor string) {
+	store, isCached := GetCachingUsersStore(s.store)
+	if !isCached {
+		(*w).WriteHeader(http.StatusNotFound)
+		fmt.Fprint(*w, "Store is not cached")
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, store.Stats())
+}
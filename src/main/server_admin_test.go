@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminRoles(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, adminToken: "secretToken", audit: NewAuditLog()}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "berta", "12345678", http.StatusOK)
+
+	RunAdminTest(t, server, "list users (no credentials)", http.MethodGet, "/admin/users", "", "", nil, http.StatusUnauthorized)
+	RunAdminTest(t, server, "list users (wrong password)", http.MethodGet, "/admin/users", "arnau", "wrongPass", nil, http.StatusUnauthorized)
+	RunAdminTest(t, server, "list users (user role)", http.MethodGet, "/admin/users", "arnau", "12345678", nil, http.StatusForbidden)
+	RunAdminTest(t, server, "unknown operation", http.MethodGet, "/admin/foo", "arnau", "12345678", nil, http.StatusNotFound)
+	RunAdminTest(t, server, "wrong method", http.MethodGet, "/admin/setRole", "arnau", "12345678", nil, http.StatusMethodNotAllowed)
+
+	RunAdminTest(t, server, "set role (invalid role)", http.MethodPost, "/admin/setRole", "", "secretToken",
+		map[string]string{"user": "arnau", "role": "root"}, http.StatusBadRequest)
+	RunAdminTest(t, server, "set role (user does not exist)", http.MethodPost, "/admin/setRole", "", "secretToken",
+		map[string]string{"user": "peter", "role": "admin"}, http.StatusBadRequest)
+	RunAdminTest(t, server, "set role with admin token", http.MethodPost, "/admin/setRole", "", "secretToken",
+		map[string]string{"user": "arnau", "role": "admin"}, http.StatusOK)
+	RunAdminTest(t, server, "set role as admin", http.MethodPost, "/admin/setRole", "arnau", "12345678",
+		map[string]string{"user": "sergi", "role": "moderator"}, http.StatusOK)
+
+	RunAdminTest(t, server, "list users (moderator)", http.MethodGet, "/admin/users", "sergi", "12345678", nil, http.StatusOK)
+	RunAdminTest(t, server, "set role (moderator)", http.MethodPost, "/admin/setRole", "sergi", "12345678",
+		map[string]string{"user": "sergi", "role": "admin"}, http.StatusForbidden)
+	RunAdminTest(t, server, "get audit trail (moderator)", http.MethodGet, "/admin/audit", "sergi", "12345678", nil, http.StatusForbidden)
+
+	t.Run("user metadata", func(t *testing.T) {
+		var infos []AdminUserInfo
+		body := RunAdminTest(t, server, "list users (admin)", http.MethodGet, "/admin/users", "arnau", "12345678", nil, http.StatusOK)
+		json.Unmarshal([]byte(body), &infos)
+		roles := map[string]string{}
+		for _, info := range infos {
+			roles[info.User] = info.Role
+		}
+		want := map[string]string{"arnau": RoleAdmin, "berta": RoleUser, "sergi": RoleModerator}
+		if len(roles) != len(want) {
+			t.Fatalf("got users %v, want %v", roles, want)
+		}
+		for user, role := range want {
+			if roles[user] != role {
+				t.Errorf("got role %q for %s, want %q", roles[user], user, role)
+			}
+		}
+	})
+
+	t.Run("audit trail", func(t *testing.T) {
+		entries := FilterAuditEntries(server.audit.GetEntries(), AuditRoleChanged)
+		if len(entries) != 2 {
+			t.Fatalf("got %d audit entries, want 2: %+v", len(entries), entries)
+		}
+		if entries[0].Actor != AdminTokenActor || entries[0].Target != "arnau" || entries[0].Details["to"] != RoleAdmin {
+			t.Errorf("got entry %+v, want admin token making arnau admin", entries[0])
+		}
+		if entries[1].Actor != "arnau" || entries[1].Action != AuditRoleChanged || entries[1].Target != "sergi" {
+			t.Errorf("got entry %+v, want arnau changing the role of sergi", entries[1])
+		}
+	})
+}
+
+func TestAdminOperations(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, messages: EmptyMessageStore(), audit: NewAuditLog()}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "berta", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "marta", "12345678", http.StatusOK)
+	store.SetRole("arnau", RoleAdmin)
+	store.SetRole("sergi", RoleModerator)
+	RunFriendshipRequestTest(t, server, "request friendship", "berta", "marta", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "marta", "berta", "12345678", true, http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "berta", "sergi", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "berta", "12345678", http.StatusOK)
+
+	// Friends: berta&marta
+	// Requests: berta->sergi; arnau->berta
+
+	RunAdminTest(t, server, "view request queue (user does not exist)", http.MethodGet, "/admin/friendshipRequests?user=peter",
+		"sergi", "12345678", nil, http.StatusBadRequest)
+	RunAdminTestWithBody(t, server, "view request queue", http.MethodGet, "/admin/friendshipRequests?user=berta",
+		"sergi", "12345678", `{"user":"berta","sent":["sergi"],"received":["arnau"]}`)
+
+	RunAdminTest(t, server, "remove friendship (not friends)", http.MethodPost, "/admin/removeFriendship", "sergi", "12345678",
+		map[string]string{"user": "berta", "otherUser": "arnau"}, http.StatusBadRequest)
+	RunAdminTest(t, server, "remove friendship", http.MethodPost, "/admin/removeFriendship", "sergi", "12345678",
+		map[string]string{"user": "berta", "otherUser": "marta"}, http.StatusOK)
+	RunListFriends(t, server, "friendship is removed", "berta", "[]", http.StatusOK)
+	RunListFriends(t, server, "friendship is removed", "marta", "[]", http.StatusOK)
+
+	RunAdminTest(t, server, "reset password (moderator)", http.MethodPost, "/admin/resetPassword", "sergi", "12345678",
+		map[string]string{"user": "berta", "newPass": "newPassword"}, http.StatusForbidden)
+	RunAdminTest(t, server, "reset password (invalid password)", http.MethodPost, "/admin/resetPassword", "arnau", "12345678",
+		map[string]string{"user": "berta", "newPass": "short"}, http.StatusBadRequest)
+	RunAdminTest(t, server, "reset password", http.MethodPost, "/admin/resetPassword", "arnau", "12345678",
+		map[string]string{"user": "berta", "newPass": "newPassword"}, http.StatusOK)
+	RunFriendshipRequestTest(t, server, "old password is no longer valid", "berta", "marta", "12345678", http.StatusUnauthorized)
+	RunFriendshipRequestTest(t, server, "new password is valid", "berta", "marta", "newPassword", http.StatusOK)
+
+	RunAdminTest(t, server, "delete user (moderator)", http.MethodPost, "/admin/deleteUser", "sergi", "12345678",
+		map[string]string{"user": "berta"}, http.StatusForbidden)
+	RunAdminTest(t, server, "delete user (does not exist)", http.MethodPost, "/admin/deleteUser", "arnau", "12345678",
+		map[string]string{"user": "peter"}, http.StatusBadRequest)
+	RunAdminTest(t, server, "delete user", http.MethodPost, "/admin/deleteUser", "arnau", "12345678",
+		map[string]string{"user": "berta"}, http.StatusOK)
+	RunGetUsersTest(t, server, "deleted user is not listed", "[arnau marta sergi]")
+	RunAccountTest(t, server, "force-deleted user can't be restored", "/restoreAccount", "berta", "newPassword", http.StatusUnauthorized)
+	RunSignUpTest(t, server, "username of force-deleted user is available", "berta", "12345678", http.StatusOK)
+
+	t.Run("audit trail", func(t *testing.T) {
+		var actions []string
+		for _, entry := range FilterAuditEntries(server.audit.GetEntries(), AuditFriendshipRemoved, AuditPasswordReset, AuditUserDeleted) {
+			actions = append(actions, entry.Actor+" "+entry.Action+" "+entry.Target)
+		}
+		want := []string{"sergi friendshipRemoved berta", "arnau passwordReset berta", "arnau userDeleted berta"}
+		AssertResponseBody(t, toString(actions), toString(want))
+	})
+}
+
+// RunAdminTest sends a request to an admin endpoint authenticated as user, or with password as admin token if user is
+// empty (with no credentials if both are empty), and returns the response body
+func RunAdminTest(t *testing.T, s *UsersServer, testName, method, url, user, password string, body map[string]string, expectedHTTPStatus int) string {
+	requestBody, _ := json.Marshal(body)
+	request, _ := http.NewRequest(method, url, bytes.NewBuffer(requestBody))
+	if user != "" {
+		request.SetBasicAuth(user, password)
+	} else if password != "" {
+		request.Header.Set("Authorization", "Bearer "+password)
+	}
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); !ok {
+			t.Errorf("Got body: %q", response.Body.String())
+		}
+	})
+	return response.Body.String()
+}
+
+func RunAdminTestWithBody(t *testing.T, s *UsersServer, testName, method, url, user, password, expectedBody string) {
+	body := RunAdminTest(t, s, testName, method, url, user, password, nil, http.StatusOK)
+	t.Run(testName, func(t *testing.T) {
+		AssertResponseBody(t, body, expectedBody)
+	})
+}
+
+// FilterAuditEntries returns the entries whose action is one of actions
+func FilterAuditEntries(entries []AuditEntry, actions ...string) []AuditEntry {
+	filtered := make([]AuditEntry, 0)
+	for _, entry := range entries {
+		if Contains(actions, entry.Action) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+func toString(list []string) string {
+	body, _ := json.Marshal(list)
+	return string(body)
+}
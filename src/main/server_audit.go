@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+)
+
+// RequestIDHeader is the header holding the ID of a request, which is recorded in the audit trail. Clients may send
+// their own (at most MaxRequestIDLength characters), otherwise the server generates one. It is sent back in responses
+const RequestIDHeader = "X-Request-ID"
+
+// MaxRequestIDLength is the maximum length of request IDs sent by clients
+const MaxRequestIDLength = 64
+
+// SystemActor is the actor recorded in the audit trail for actions not requested by anyone (eg purging accounts)
+const SystemActor = "@system"
+
+// RecordAudit records in the audit trail that actor performed action on target through request r (nil if the action
+// was not requested through HTTP)
+func (s *UsersServer) RecordAudit(r *http.Request, actor, action, target string, details map[string]string) {
+	ctx := AuditContext{Actor: actor}
+	if r != nil {
+		ctx.SourceIP = GetSourceIP(r)
+		ctx.RequestID = r.Header.Get(RequestIDHeader)
+	}
+	s.audit.Record(ctx, action, target, details)
+}
+
+// SetRequestID makes sure that request r has a valid request ID, generating one if needed, and sends it back in w
+func SetRequestID(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > MaxRequestIDLength {
+		id = NewRequestID()
+		r.Header.Set(RequestIDHeader, id)
+	}
+	w.Header().Set(RequestIDHeader, id)
+}
+
+// NewRequestID returns a new random request ID
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// GetSourceIP returns the IP address from which request r was sent
+func GetSourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditTrail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, audit: audit}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up an already existing user", "arnau", "12345678", http.StatusBadRequest)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "decline friendship", "sergi", "arnau", "12345678", false, http.StatusOK)
+
+	requestBody, _ := json.Marshal(map[string]string{"user": "arnau", "pass": "12345678", "newUser": "arnau2"})
+	request := httptest.NewRequest(http.MethodPost, "/changeUsername", bytes.NewBuffer(requestBody))
+	request.Header.Set(RequestIDHeader, "rename-1")
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+
+	t.Run("request ID is sent back", func(t *testing.T) {
+		AssertStatus(t, response.Code, http.StatusOK)
+		if got := response.Header().Get(RequestIDHeader); got != "rename-1" {
+			t.Errorf("got request ID %q, want %q", got, "rename-1")
+		}
+	})
+
+	t.Run("successful mutations are recorded", func(t *testing.T) {
+		var actions []string
+		for _, entry := range audit.GetEntries() {
+			actions = append(actions, entry.Actor+" "+entry.Action+" "+entry.Target)
+		}
+		want := []string{
+			"arnau userSignedUp arnau",
+			"sergi userSignedUp sergi",
+			"arnau friendshipRequested sergi",
+			"sergi friendshipDeclined arnau",
+			"arnau usernameChanged arnau2",
+		}
+		AssertResponseBody(t, toString(actions), toString(want))
+	})
+
+	t.Run("entries have source IP and request ID", func(t *testing.T) {
+		entries := audit.GetEntries()
+		last := entries[len(entries)-1]
+		if last.SourceIP != "192.0.2.1" || last.RequestID != "rename-1" {
+			t.Errorf("got source IP %q and request ID %q, want %q and %q", last.SourceIP, last.RequestID, "192.0.2.1", "rename-1")
+		}
+		if entries[0].RequestID == "" || entries[0].RequestID == entries[1].RequestID {
+			t.Errorf("got request IDs %q and %q, want two different generated IDs", entries[0].RequestID, entries[1].RequestID)
+		}
+	})
+
+	t.Run("log file is valid", func(t *testing.T) {
+		entries, err := VerifyAuditLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 5 {
+			t.Errorf("got %d entries, want 5", len(entries))
+		}
+	})
+
+	t.Run("reopened log continues the chain", func(t *testing.T) {
+		audit.Close()
+		reopened, err := OpenAuditLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reopened.Close()
+
+		entry := reopened.Record(AuditContext{Actor: SystemActor}, AuditAccountPurged, "arnau", nil)
+		if entry.Seq != 6 {
+			t.Errorf("got sequence number %d, want 6", entry.Seq)
+		}
+		if _, err := VerifyAuditLog(path); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAuditLogMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	logs := map[string]func() *AuditLog{
+		"in memory": NewAuditLog,
+		"backed by a file": func() *AuditLog {
+			audit, err := OpenAuditLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { audit.Close() })
+			return audit
+		},
+	}
+	for name, open := range logs {
+		t.Run(name, func(t *testing.T) {
+			audit := open()
+			audit.maxEntries = 3
+			for i := 0; i < 5; i++ {
+				audit.Record(AuditContext{Actor: SystemActor}, AuditAccountPurged, fmt.Sprintf("user%d", i), nil)
+			}
+
+			t.Run("only the last entries are kept in memory", func(t *testing.T) {
+				if len(audit.entries) != 3 || audit.entries[0].Seq != 3 {
+					t.Errorf("got %d entries in memory, starting at %d", len(audit.entries), audit.entries[0].Seq)
+				}
+			})
+			t.Run("entries are still chained", func(t *testing.T) {
+				entries := audit.GetEntries()
+				for i := 1; i < len(entries); i++ {
+					if entries[i].PrevHash != entries[i-1].Hash {
+						t.Errorf("entry %d is not chained to the previous one", entries[i].Seq)
+					}
+				}
+			})
+
+			want := 3
+			if audit.file != nil {
+				want = 5 // read from the file
+			}
+			if got := len(audit.GetEntries()); got != want {
+				t.Errorf("got %d entries, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestAuditLogConcurrentReads(t *testing.T) {
+	audit, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	// Entries are read while others are being appended, and each read is a valid prefix of the log
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			audit.Record(AuditContext{Actor: SystemActor}, AuditAccountPurged, fmt.Sprintf("user%d", i), nil)
+		}
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		entries := audit.GetEntries()
+		for i, entry := range entries {
+			if entry.Seq != uint64(i+1) {
+				t.Fatalf("got entry %d at position %d", entry.Seq, i+1)
+			}
+		}
+	}
+	if got := len(audit.GetEntries()); got != 50 {
+		t.Errorf("got %d entries, want 50", got)
+	}
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	// NewTamperedLog writes a valid log with 3 entries, lets tamper modify its lines and returns its path
+	NewTamperedLog := func(t *testing.T, tamper func(lines []string) []string) string {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		audit, err := OpenAuditLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range []string{"arnau", "sergi", "berta"} {
+			audit.Record(AuditContext{Actor: user}, AuditUserSignedUp, user, nil)
+		}
+		audit.Close()
+
+		data, _ := ioutil.ReadFile(path)
+		lines := strings.SplitAfter(string(data), "\n")
+		lines = lines[:len(lines)-1] // last element is empty
+		ioutil.WriteFile(path, []byte(strings.Join(tamper(lines), "")), 0600)
+		return path
+	}
+
+	cases := []struct {
+		name   string
+		tamper func(lines []string) []string
+		want   string // expected error, empty if valid
+	}{
+		{"untouched", func(lines []string) []string { return lines }, ""},
+		{"modified entry", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"actor":"sergi"`, `"actor":"marta"`, 1)
+			return lines
+		}, "line 2: entry has been modified"},
+		{"removed entry", func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}, "line 2: got sequence number 3, want 2"},
+		{"truncated log", func(lines []string) []string { return lines[:2] }, "truncated"},
+		{"half-written entry", func(lines []string) []string {
+			lines[2] = lines[2][:10]
+			return lines
+		}, "line 3: incomplete entry"},
+	}
+
+	for _, c := range cases {
+		path := NewTamperedLog(t, c.tamper)
+		t.Run(c.name, func(t *testing.T) {
+			_, err := VerifyAuditLog(path)
+			switch {
+			case c.want == "" && err != nil:
+				t.Errorf("got error %v, want log to be valid", err)
+			case c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)):
+				t.Errorf("got error %v, want %q", err, c.want)
+			}
+		})
+	}
+
+	t.Run("tampered log can't be reopened", func(t *testing.T) {
+		path := NewTamperedLog(t, func(lines []string) []string { return lines[:2] })
+		if _, err := OpenAuditLog(path); err == nil {
+			t.Errorf("got no error opening a truncated log")
+		}
+	})
+}
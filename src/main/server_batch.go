@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// MaxBatchOperations is the maximum number of operations of a /batch request
+const MaxBatchOperations = 100
+
+// BatchRequest is the body of a /batch request: Operations are run in order as User, who authenticates with Pass.
+// If Atomic, either all of them are applied or none is
+type BatchRequest struct {
+	User       string           `json:"user"`
+	Pass       string           `json:"pass"`
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is an operation of a /batch request. Op is the name of the HTTP endpoint it mirrors
+// (requestFriendship, respondToFriendshipRequest, or the admin endpoints removeFriendship, setRole and deleteUser)
+// and the other fields are the ones the endpoint takes, except for the credentials which are the ones of the batch.
+// Admin operations require the batch user to have the role the endpoint requires
+type BatchOperation struct {
+	Op            string `json:"op"`
+	User          string `json:"user,omitempty"`
+	Role          string `json:"role,omitempty"`
+	UserTo        string `json:"userTo,omitempty"`
+	UserToID      string `json:"userToId,omitempty"`
+	OtherUser     string `json:"otherUser,omitempty"`
+	OtherUserID   string `json:"otherUserId,omitempty"`
+	AcceptRequest string `json:"acceptRequest,omitempty"`
+}
+
+// BatchResult is the result of an operation of a /batch request: the HTTP status and message that the equivalent
+// HTTP endpoint would have returned
+type BatchResult struct {
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// BatchResponse is the response to a /batch request. Committed is false iff the batch was atomic and an operation
+// failed, in which case Results ends with the failed operation and the operations before it were rolled back
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// Batch takes a batch HTTP request (r) to the UsersServer (s), processes it and populates the ResponseWriter (w) with
+// a BatchResponse, or 409 Conflict if the batch was atomic and was rolled back.
+// The operations of an atomic batch are run in a transaction, so other requests see either none or all of their
+// changes, and notifications (events, webhooks and audit records) are only sent for the operations which were
+// committed. The operations of other batches are run one by one, as if they were separate requests
+func (s *UsersServer) Batch(w *http.ResponseWriter, r *http.Request) {
+	if s.transactions == nil {
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		(*w).WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		(*w).WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(*w, "Couldn't read the data")
+		return
+	}
+
+	var batch BatchRequest
+	if err := json.Unmarshal(body, &batch); err != nil {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(*w, "Body must be a JSON object")
+		return
+	}
+
+	// Check credentials
+	if err := s.CheckCredentials(r.Context(), batch.User, batch.Pass); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	if len(batch.Operations) == 0 || len(batch.Operations) > MaxBatchOperations {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(*w, "A batch must have from 1 to %d operations", MaxBatchOperations)
+		return
+	}
+
+	response, notifications := s.runBatch(r, batch)
+	if !response.Committed {
+		WriteJSON(w, http.StatusConflict, response)
+		return
+	}
+
+	for _, notify := range notifications {
+		notify(s)
+	}
+	WriteJSON(w, http.StatusOK, response)
+}
+
+// runBatch runs the operations of batch, sent in request r, in a transaction if it is atomic. Returns the response
+// for the client and the notifications of the operations which were applied, which must be sent iff the batch was
+// committed
+func (s *UsersServer) runBatch(r *http.Request, batch BatchRequest) (BatchResponse, []func(*UsersServer)) {
+	response := BatchResponse{Committed: true, Results: make([]BatchResult, 0, len(batch.Operations))}
+	notifications := make([]func(*UsersServer), 0, len(batch.Operations))
+
+	if !batch.Atomic {
+		for _, operation := range batch.Operations {
+			result, notify := s.runBatchOperation(r, batch.User, operation)
+			response.Results = append(response.Results, result)
+			if result.Status == http.StatusOK {
+				notifications = append(notifications, notify)
+			}
+		}
+		return response, notifications
+	}
+
+	tx := s.beginTransaction()
+	defer tx.Rollback()
+	inTx := s.withTransaction(tx)
+
+	for _, operation := range batch.Operations {
+		result, notify := inTx.runBatchOperation(r, batch.User, operation)
+		response.Results = append(response.Results, result)
+		if result.Status != http.StatusOK {
+			response.Committed = false
+			return response, nil
+		}
+		notifications = append(notifications, notify)
+	}
+
+	tx.Commit()
+	return response, notifications
+}
+
+// runBatchOperation runs operation, sent in request r by user (who must have been authenticated already). Returns
+// its result and the function which notifies it (see friendshipRequested) with the server the operation was
+// committed to, which must only be called once the operation is committed
+func (s *UsersServer) runBatchOperation(r *http.Request, user string, operation BatchOperation) (BatchResult, func(*UsersServer)) {
+	var result BatchResult
+	var notify func(*UsersServer)
+
+	switch operation.Op {
+	case "requestFriendship":
+		userTo, err := s.resolveUser(r.Context(), map[string]string{"userTo": operation.UserTo, "userToId": operation.UserToID}, "userTo")
+		if err != nil {
+			result.Status, result.Message = GetStoreErrorStatus(err)
+			break
+		}
+		result.Status, result.Message = s.requestFriendship(r.Context(), user, userTo)
+		notify = func(committed *UsersServer) { committed.friendshipRequested(r, user, userTo) }
+
+	case "respondToFriendshipRequest":
+		accept, ok := ParseAcceptRequest(operation.AcceptRequest)
+		if !ok {
+			result.Status, result.Message = http.StatusBadRequest, "acceptRequest field must be either 1 or 0"
+			break
+		}
+		otherUser, err := s.resolveUser(r.Context(), map[string]string{"otherUser": operation.OtherUser, "otherUserId": operation.OtherUserID}, "otherUser")
+		if err != nil {
+			result.Status, result.Message = GetStoreErrorStatus(err)
+			break
+		}
+		result.Status, result.Message = s.respondToFriendshipRequest(r.Context(), user, otherUser, accept)
+		notify = func(committed *UsersServer) { committed.friendshipResponded(r, user, otherUser, accept) }
+
+	case "removeFriendship":
+		if result.Status, result.Message = s.checkRole(r.Context(), user, RoleModerator); result.Status != http.StatusOK {
+			break
+		}
+		if err := s.storeV2().RemoveFriendship(r.Context(), operation.User, operation.OtherUser); err != nil {
+			result.Status, result.Message = GetStoreErrorStatus(err)
+			break
+		}
+		notify = func(committed *UsersServer) {
+			committed.friendshipRemoved(r, user, operation.User, operation.OtherUser)
+		}
+
+	case "setRole":
+		if result.Status, result.Message = s.checkRole(r.Context(), user, RoleAdmin); result.Status != http.StatusOK {
+			break
+		}
+		var oldRole string
+		oldRole, result.Status, result.Message = s.setRole(r.Context(), operation.User, operation.Role)
+		notify = func(committed *UsersServer) {
+			committed.roleChanged(r, user, operation.User, oldRole, operation.Role)
+		}
+
+	case "deleteUser":
+		if result.Status, result.Message = s.checkRole(r.Context(), user, RoleAdmin); result.Status != http.StatusOK {
+			break
+		}
+		if err := s.storeV2().DeleteUser(r.Context(), operation.User); err != nil {
+			result.Status, result.Message = GetStoreErrorStatus(err)
+			break
+		}
+		// Transactions can't purge users, so they are purged once the deletion is committed
+		notify = func(committed *UsersServer) { committed.userDeleted(r, user, operation.User) }
+
+	default:
+		result.Status, result.Message = http.StatusNotFound, "Unknown operation"
+	}
+
+	return result, notify
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTransactionalUsersStore runs random transactions, committing or rolling them back at random, on a
+// TransactionalUsersStore and runs the committed ones on an InMemoryUsersStore, which must end up in the same state
+// with the same versions, as must a replica which applies the log of the transactional store
+func TestTransactionalUsersStore(t *testing.T) {
+	log := NewMutationLog()
+	want, got := EmptyUsersStore(), NewTransactionalUsersStore(NewReplicatedUsersStore(NewShardedUsersStore(4), log))
+	replica, applied := EmptyUsersStore(), uint64(0)
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		seeds := make([]int64, 1+random.Intn(10))
+		for j := range seeds {
+			seeds[j] = random.Int63()
+		}
+
+		tx := got.Begin()
+		operations, results := make([]string, len(seeds)), make([]string, len(seeds))
+		for j, seed := range seeds {
+			operations[j], results[j] = RunRandomStoreOperation(tx, seed)
+		}
+
+		if random.Intn(2) == 0 {
+			tx.Rollback()
+		} else {
+			tx.Commit()
+			for j, seed := range seeds {
+				wantResult := "false" // restores and purges are not allowed in transactions
+				if !strings.HasPrefix(operations[j], "RestoreUser") && !strings.HasPrefix(operations[j], "PurgeDeletedUser") {
+					_, wantResult = RunRandomStoreOperation(want, seed)
+				}
+				if results[j] != wantResult {
+					t.Fatalf("transaction %d operation %s: got %s, want %s", i, operations[j], results[j], wantResult)
+				}
+			}
+		}
+
+		for applied < log.Head() {
+			entries, _, _ := log.Read(applied)
+			for _, entry := range entries {
+				if !ApplyMutation(replica, entry) {
+					t.Fatalf("transaction %d: could not apply entry %d (%s %s)", i, entry.Seq, entry.Op, entry.User)
+				}
+			}
+			applied += uint64(len(entries))
+		}
+
+		for u := 0; u < 20; u++ {
+			user := fmt.Sprintf("u%02d", u)
+			wantState := GetUserState(want, user)
+			wantVersions, _ := want.GetVersions(user)
+			for name, store := range map[string]UsersStore{"store": got, "replica": replica} {
+				if gotState := GetUserState(store, user); gotState != wantState {
+					t.Fatalf("transaction %d %s of %s: got %s, want %s", i, user, name, gotState, wantState)
+				}
+				if gotVersions, _ := store.GetVersions(user); gotVersions != wantVersions {
+					t.Fatalf("transaction %d %s of %s: got versions %+v, want %+v", i, user, name, gotVersions,
+						wantVersions)
+				}
+			}
+		}
+	}
+}
+
+// TestTransactionEndsOnPanic checks that a deferred Rollback ends a transaction whose caller panics, reverting it and
+// releasing the store
+func TestTransactionEndsOnPanic(t *testing.T) {
+	store := NewTransactionalUsersStore(EmptyUsersStore())
+	func() {
+		defer func() { recover() }()
+		tx := store.Begin()
+		defer tx.Rollback()
+		tx.AddUser("arnau", "12345678")
+		panic("operation failed")
+	}()
+
+	done := make(chan bool)
+	go func() { done <- store.UserExists("arnau") }()
+	select {
+	case exists := <-done:
+		if exists {
+			t.Error("user added by the transaction was not rolled back")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("store is still locked by the transaction")
+	}
+
+	tx := store.Begin()
+	defer tx.Rollback()
+	tx.AddUser("arnau", "12345678")
+	tx.Commit()
+	if !store.UserExists("arnau") {
+		t.Error("committed user was rolled back")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	store := NewTransactionalUsersStore(EmptyUsersStore())
+	server := &UsersServer{store: store, transactions: store, audit: NewAuditLog()}
+	for _, user := range []string{"arnau", "sergi", "berta", "marta"} {
+		RunSignUpTest(t, server, "sign up a new user", user, "12345678", http.StatusOK)
+	}
+	RunFriendshipRequestTest(t, server, "request friendship", "sergi", "arnau", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "berta", "arnau", "12345678", http.StatusOK)
+	martaID, _ := store.GetUserID("marta")
+	entries := len(server.audit.GetEntries())
+
+	response := RunBatchTest(t, server, "atomic batch which fails", `{"user": "arnau", "pass": "12345678",
+		"atomic": true, "operations": [
+			{"op": "respondToFriendshipRequest", "otherUser": "sergi", "acceptRequest": "1"},
+			{"op": "requestFriendship", "userToId": "`+martaID+`"},
+			{"op": "requestFriendship", "userTo": "sergi"},
+			{"op": "respondToFriendshipRequest", "otherUser": "berta", "acceptRequest": "0"}
+		]}`, http.StatusConflict)
+	t.Run("atomic batch stops at the first failed operation", func(t *testing.T) {
+		want := "{false [{200 } {200 } {400 Users are already friends}]}"
+		AssertResponseBody(t, fmt.Sprint(response), want)
+	})
+	t.Run("operations of a failed atomic batch are rolled back", func(t *testing.T) {
+		AssertResponseBody(t, fmt.Sprint(store.GetFriends("arnau")), "[]")
+		sent, received, _ := store.GetFriendshipRequests("arnau")
+		AssertResponseBody(t, fmt.Sprint(sent, received), "[] [berta sergi]")
+		if got := len(server.audit.GetEntries()); got != entries {
+			t.Errorf("got %d audit entries, want %d", got, entries)
+		}
+	})
+
+	response = RunBatchTest(t, server, "non-atomic batch", `{"user": "arnau", "pass": "12345678", "operations": [
+			{"op": "respondToFriendshipRequest", "otherUser": "sergi", "acceptRequest": "1"},
+			{"op": "requestFriendship", "userTo": "sergi"},
+			{"op": "respondToFriendshipRequest", "otherUser": "berta", "acceptRequest": "2"},
+			{"op": "removeFriendship", "otherUser": "sergi"},
+			{"op": "requestFriendship", "userTo": "marta"}
+		]}`, http.StatusOK)
+	t.Run("non-atomic batch runs every operation", func(t *testing.T) {
+		want := "{true [{200 } {400 Users are already friends} {400 acceptRequest field must be either 1 or 0} " +
+			"{403 This operation requires the moderator role} {200 }]}"
+		AssertResponseBody(t, fmt.Sprint(response), want)
+		AssertResponseBody(t, fmt.Sprint(store.GetFriends("arnau")), "[sergi]")
+		sent, received, _ := store.GetFriendshipRequests("arnau")
+		AssertResponseBody(t, fmt.Sprint(sent, received), "[marta] [berta]")
+	})
+	t.Run("committed operations are notified", func(t *testing.T) {
+		actions := make([]string, 0)
+		for _, entry := range server.audit.GetEntries()[entries:] {
+			actions = append(actions, entry.Action+" "+entry.Target)
+		}
+		want := fmt.Sprint([]string{AuditFriendshipAccepted + " sergi", AuditFriendshipRequested + " marta"})
+		AssertResponseBody(t, fmt.Sprint(actions), want)
+	})
+
+	RunBatchTest(t, server, "unknown operation", `{"user": "arnau", "pass": "12345678", "atomic": true,
+		"operations": [{"op": "resetPassword", "user": "marta"}]}`, http.StatusConflict)
+
+	RunBatchTest(t, server, "wrong password", `{"user": "arnau", "pass": "wrongPass",
+		"operations": [{"op": "requestFriendship", "userTo": "marta"}]}`, http.StatusUnauthorized)
+	RunBatchTest(t, server, "no operations", `{"user": "arnau", "pass": "12345678", "operations": []}`,
+		http.StatusBadRequest)
+	RunBatchTest(t, server, "not JSON", `operations`, http.StatusBadRequest)
+
+	server.transactions = nil
+	RunBatchTest(t, server, "store without transactions", `{"user": "arnau", "pass": "12345678",
+		"operations": [{"op": "requestFriendship", "userTo": "marta"}]}`, http.StatusNotFound)
+}
+
+func TestBatchAdminOperations(t *testing.T) {
+	store := NewTransactionalUsersStore(EmptyUsersStore())
+	server := &UsersServer{store: store, transactions: store, audit: NewAuditLog()}
+	for _, user := range []string{"arnau", "sergi", "berta", "marta"} {
+		RunSignUpTest(t, server, "sign up a new user", user, "12345678", http.StatusOK)
+	}
+	RunFriendshipRequestTest(t, server, "request friendship", "sergi", "marta", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "marta", "sergi", "12345678", true, http.StatusOK)
+	store.SetRole("arnau", RoleAdmin)
+	store.SetRole("sergi", RoleModerator)
+
+	response := RunBatchTest(t, server, "moderator can't set roles", `{"user": "sergi", "pass": "12345678",
+		"operations": [
+			{"op": "setRole", "user": "berta", "role": "moderator"},
+			{"op": "removeFriendship", "user": "marta", "otherUser": "sergi"}
+		]}`, http.StatusOK)
+	t.Run("admin operations require the role of their endpoint", func(t *testing.T) {
+		AssertResponseBody(t, fmt.Sprint(response), "{true [{403 This operation requires the admin role} {200 }]}")
+		AssertResponseBody(t, fmt.Sprint(store.GetFriends("marta")), "[]")
+	})
+
+	entries := len(server.audit.GetEntries())
+	RunBatchTest(t, server, "atomic admin batch which fails", `{"user": "arnau", "pass": "12345678",
+		"atomic": true, "operations": [
+			{"op": "setRole", "user": "berta", "role": "moderator"},
+			{"op": "deleteUser", "user": "marta"},
+			{"op": "deleteUser", "user": "nobody"}
+		]}`, http.StatusConflict)
+	t.Run("admin operations of a failed atomic batch are rolled back", func(t *testing.T) {
+		role, _ := store.GetRole("berta")
+		AssertResponseBody(t, role, RoleUser)
+		if !store.UserExists("marta") {
+			t.Error("deleted user was not restored")
+		}
+		if got := len(server.audit.GetEntries()); got != entries {
+			t.Errorf("got %d audit entries, want %d", got, entries)
+		}
+	})
+
+	RunBatchTest(t, server, "atomic admin batch", `{"user": "arnau", "pass": "12345678",
+		"atomic": true, "operations": [
+			{"op": "setRole", "user": "berta", "role": "moderator"},
+			{"op": "deleteUser", "user": "marta"}
+		]}`, http.StatusOK)
+	t.Run("admin operations are committed", func(t *testing.T) {
+		role, _ := store.GetRole("berta")
+		AssertResponseBody(t, role, RoleModerator)
+		if store.UserExists("marta") || store.IsDeletedUser("marta") {
+			t.Error("deleted user was not purged")
+		}
+		actions := make([]string, 0)
+		for _, entry := range server.audit.GetEntries()[entries:] {
+			actions = append(actions, entry.Actor+" "+entry.Action+" "+entry.Target)
+		}
+		want := fmt.Sprint([]string{"arnau " + AuditRoleChanged + " berta", "arnau " + AuditUserDeleted + " marta"})
+		AssertResponseBody(t, fmt.Sprint(actions), want)
+	})
+}
+
+// TestBatchConcurrency runs atomic batches which always roll back concurrently with other requests (run with -race),
+// which must never see their changes
+func TestBatchConcurrency(t *testing.T) {
+	store := NewTransactionalUsersStore(EmptyUsersStore())
+	server := &UsersServer{store: store, transactions: store}
+	for _, user := range []string{"arnau", "sergi", "berta"} {
+		RunSignUpTest(t, server, "sign up a new user", user, "12345678", http.StatusOK)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			RunBatchTest(t, server, "atomic batch which fails", `{"user": "arnau", "pass": "12345678",
+				"atomic": true, "operations": [
+					{"op": "requestFriendship", "userTo": "sergi"},
+					{"op": "requestFriendship", "userTo": "berta"},
+					{"op": "requestFriendship", "userTo": "nobody"}
+				]}`, http.StatusConflict)
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		if sent, _, _ := store.GetFriendshipRequests("arnau"); len(sent) != 0 {
+			t.Fatalf("got requests %v of a batch which was rolled back", sent)
+		}
+	}
+	wg.Wait()
+}
+
+// RunBatchTest sends a /batch request with body and checks its HTTP status. Returns the response, if any
+func RunBatchTest(t *testing.T, s *UsersServer, testName, body string, expectedHTTPStatus int) BatchResponse {
+	request, _ := http.NewRequest(http.MethodPost, "/batch", strings.NewReader(body))
+	response := httptest.NewRecorder()
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		AssertStatus(t, response.Code, expectedHTTPStatus)
+	})
+
+	var batch BatchResponse
+	json.Unmarshal(response.Body.Bytes(), &batch)
+	return batch
+}
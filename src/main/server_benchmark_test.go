@@ -0,0 +1,442 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run with: go test -run '^$' -bench . [-benchsizes 10000]
+var benchmarkSizes = flag.String("benchsizes", "10000,100000,1000000", "comma-separated numbers of users of the UsersStore benchmarks")
+
+// benchmarkStores caches the seeded store of each size, which takes a while to build
+var benchmarkStores = struct {
+	sync.Mutex
+	stores map[int]*InMemoryUsersStore
+}{stores: map[int]*InMemoryUsersStore{}}
+
+// storeBenchmark measures a UsersStore method. setup (if not nil) prepares the store before each call and undo (if
+// not nil) reverts the changes made by setup and the call, both without being measured; undo gets the value returned
+// by setup (eg the password of user before the call). Changes must be reverted, since the seeded store of each size
+// is shared by all benchmarks. user and other are two different users chosen for each call; if strangers is true they
+// are neither friends nor have a pending friendship request between them, otherwise they may be friends or not
+type storeBenchmark struct {
+	name      string
+	strangers bool
+	setup     func(store UsersStore, user, other string) string
+	run       func(store UsersStore, user, other string)
+	undo      func(store UsersStore, user, other, saved string)
+}
+
+var storeBenchmarks = []storeBenchmark{
+	{name: "GetUsers", run: func(store UsersStore, user, other string) { store.GetUsers() }},
+	{
+		name: "AddUser",
+		run:  func(store UsersStore, user, other string) { store.AddUser("bench", "12345678") },
+		undo: func(store UsersStore, user, other, saved string) {
+			store.DeleteUser("bench")
+			store.PurgeDeletedUser("bench")
+		},
+	},
+	{
+		name: "AddUserWithID",
+		run:  func(store UsersStore, user, other string) { store.AddUserWithID(NewUserID(), "bench", "12345678") },
+		undo: func(store UsersStore, user, other, saved string) {
+			store.DeleteUser("bench")
+			store.PurgeDeletedUser("bench")
+		},
+	},
+	{name: "UserExists", run: func(store UsersStore, user, other string) { store.UserExists(user) }},
+	{name: "GetUserID", run: func(store UsersStore, user, other string) { store.GetUserID(user) }},
+	{
+		name: "GetUsername",
+		run: func(store UsersStore, user, other string) {
+			id, _ := store.GetUserID(user)
+			store.GetUsername(id)
+		},
+	},
+	{
+		name:      "RequestFriendship",
+		strangers: true,
+		run:       func(store UsersStore, user, other string) { store.RequestFriendship(user, other) },
+		undo: func(store UsersStore, user, other, saved string) {
+			store.RespondToFriendshipRequest(other, user, false)
+		},
+	},
+	{name: "GetPassword", run: func(store UsersStore, user, other string) { store.GetPassword(user) }},
+	{name: "CheckUsersPassword", run: func(store UsersStore, user, other string) { store.CheckUsersPassword(user, "wrongPass") }},
+	{
+		name:  "ChangePassword",
+		setup: getBenchmarkPassword,
+		run:   func(store UsersStore, user, other string) { store.ChangePassword(user, "benchmark") },
+		undo:  func(store UsersStore, user, other, saved string) { store.ChangePassword(user, saved) },
+	},
+	{
+		name:      "RespondToFriendshipRequest",
+		strangers: true,
+		setup: func(store UsersStore, user, other string) string {
+			store.RequestFriendship(user, other)
+			return ""
+		},
+		run: func(store UsersStore, user, other string) { store.RespondToFriendshipRequest(other, user, false) },
+	},
+	{name: "GetFriends", run: func(store UsersStore, user, other string) { store.GetFriends(user) }},
+	{name: "GetFriendshipRequests", run: func(store UsersStore, user, other string) { store.GetFriendshipRequests(user) }},
+	{
+		name:      "RemoveFriendship",
+		strangers: true,
+		setup: func(store UsersStore, user, other string) string {
+			store.RequestFriendship(user, other)
+			store.RespondToFriendshipRequest(other, user, true)
+			return ""
+		},
+		run: func(store UsersStore, user, other string) { store.RemoveFriendship(user, other) },
+	},
+	{name: "GetProfile", run: func(store UsersStore, user, other string) { store.GetProfile(user) }},
+	{
+		name: "UpdateProfile",
+		setup: func(store UsersStore, user, other string) string {
+			profile, _ := store.GetProfile(user)
+			return profile.Bio
+		},
+		run: func(store UsersStore, user, other string) {
+			bio := "Benchmarking"
+			store.UpdateProfile(user, ProfileUpdate{Bio: &bio})
+		},
+		undo: func(store UsersStore, user, other, saved string) {
+			store.UpdateProfile(user, ProfileUpdate{Bio: &saved})
+		},
+	},
+	{name: "GetPrivacySettings", run: func(store UsersStore, user, other string) { store.GetPrivacySettings(user) }},
+	{
+		name: "UpdatePrivacySettings",
+		setup: func(store UsersStore, user, other string) string {
+			privacy, _ := store.GetPrivacySettings(user)
+			return privacy.FriendsVisibility
+		},
+		run: func(store UsersStore, user, other string) {
+			visibility := FriendsVisibleToEveryone
+			store.UpdatePrivacySettings(user, PrivacySettingsUpdate{FriendsVisibility: &visibility})
+		},
+		undo: func(store UsersStore, user, other, saved string) {
+			store.UpdatePrivacySettings(user, PrivacySettingsUpdate{FriendsVisibility: &saved})
+		},
+	},
+	{name: "GetRole", run: func(store UsersStore, user, other string) { store.GetRole(user) }},
+	{
+		name: "SetRole",
+		setup: func(store UsersStore, user, other string) string {
+			role, _ := store.GetRole(user)
+			return role
+		},
+		run:  func(store UsersStore, user, other string) { store.SetRole(user, RoleModerator) },
+		undo: func(store UsersStore, user, other, saved string) { store.SetRole(user, saved) },
+	},
+	{name: "TouchUser", run: func(store UsersStore, user, other string) { store.TouchUser(user) }},
+	{
+		name: "RenameUser",
+		run:  func(store UsersStore, user, other string) { store.RenameUser(user, "bench") },
+		undo: func(store UsersStore, user, other, saved string) { store.RenameUser("bench", user) },
+	},
+	{
+		name:  "DeleteUser",
+		setup: getBenchmarkPassword,
+		run:   func(store UsersStore, user, other string) { store.DeleteUser(user) },
+		undo:  func(store UsersStore, user, other, saved string) { store.RestoreUser(user, saved) },
+	},
+	{
+		name: "RestoreUser",
+		setup: func(store UsersStore, user, other string) string {
+			password := getBenchmarkPassword(store, user, other)
+			store.ChangePassword(user, "benchmark")
+			store.DeleteUser(user)
+			return password
+		},
+		run:  func(store UsersStore, user, other string) { store.RestoreUser(user, "benchmark") },
+		undo: func(store UsersStore, user, other, saved string) { store.ChangePassword(user, saved) },
+	},
+	{
+		name: "PurgeDeletedUsers",
+		setup: func(store UsersStore, user, other string) string {
+			store.AddUser("bench", "12345678")
+			store.DeleteUser("bench")
+			return ""
+		},
+		run: func(store UsersStore, user, other string) { store.PurgeDeletedUsers(time.Now().Add(time.Hour)) },
+	},
+	{
+		name: "PurgeDeletedUser",
+		setup: func(store UsersStore, user, other string) string {
+			store.AddUser("bench", "12345678")
+			store.DeleteUser("bench")
+			return ""
+		},
+		run: func(store UsersStore, user, other string) { store.PurgeDeletedUser("bench") },
+	},
+}
+
+// BenchmarkUsersStore measures every UsersStore method on stores of each size in -benchsizes, seeded with a
+// Barabási–Albert friendship graph (see SeedUsersStore) so that some users have many friends
+func BenchmarkUsersStore(b *testing.B) {
+	for _, size := range getBenchmarkSizes(b) {
+		for _, benchmark := range storeBenchmarks {
+			benchmark := benchmark
+			b.Run(fmt.Sprintf("%s/users=%d", benchmark.name, size), func(b *testing.B) {
+				store := getBenchmarkStore(b, size)
+				users := store.GetUsers()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if benchmark.strangers {
+						b.StopTimer() // looking for a stranger is not measured
+					}
+					user, other := getBenchmarkUsers(store, users, i, benchmark.strangers)
+					b.StartTimer()
+					saved := ""
+					if benchmark.setup != nil {
+						b.StopTimer()
+						saved = benchmark.setup(store, user, other)
+						b.StartTimer()
+					}
+					benchmark.run(store, user, other)
+					if benchmark.undo != nil {
+						b.StopTimer()
+						benchmark.undo(store, user, other, saved)
+						b.StartTimer()
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestStoreBenchmarks checks that the calls of each storeBenchmark leave the store as it was, since the seeded
+// stores are shared by all of them
+func TestStoreBenchmarks(t *testing.T) {
+	store := EmptyUsersStore()
+	if _, err := SeedUsersStore(store, SeedConfig{Users: 200, Model: SeedModelBarabasiAlbert, Degree: 10, Requests: 0.1, Seed: 1}); err != nil {
+		t.Fatal(err)
+	}
+	users := store.GetUsers()
+	want := make([]string, len(users))
+	for i, user := range users {
+		want[i] = GetUserState(store, user)
+	}
+
+	for _, benchmark := range storeBenchmarks {
+		for i := 0; i < 50; i++ {
+			user, other := getBenchmarkUsers(store, users, i, benchmark.strangers)
+			saved := ""
+			if benchmark.setup != nil {
+				saved = benchmark.setup(store, user, other)
+			}
+			benchmark.run(store, user, other)
+			if benchmark.undo != nil {
+				benchmark.undo(store, user, other, saved)
+			}
+		}
+
+		t.Run(benchmark.name, func(t *testing.T) {
+			for i, user := range users {
+				if got := GetUserState(store, user); got != want[i] {
+					t.Fatalf("%s: got %s, want %s", user, got, want[i])
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkHighDegreeUser measures the operations on the relationships of a user with many friends, which must not
+// depend on the number of friends
+func BenchmarkHighDegreeUser(b *testing.B) {
+	for _, degree := range []int{1000, 10000, 100000} {
+		store := EmptyUsersStore()
+		store.AddUser("hub00", "12345678")
+		store.AddUser("stranger", "12345678")
+		for i := 0; i < degree; i++ {
+			friend := fmt.Sprintf("f%07d", i)
+			store.AddUser(friend, "12345678")
+			store.RequestFriendship(friend, "hub00")
+			store.RespondToFriendshipRequest("hub00", friend, true)
+		}
+
+		benchmarks := []storeBenchmark{
+			{
+				name: "RequestFriendship",
+				run:  func(store UsersStore, user, other string) { store.RequestFriendship(user, other) },
+				undo: func(store UsersStore, user, other, saved string) {
+					store.RespondToFriendshipRequest(other, user, false)
+				},
+			},
+			{
+				name: "RespondToFriendshipRequest",
+				setup: func(store UsersStore, user, other string) string {
+					store.RequestFriendship(other, user)
+					return ""
+				},
+				run:  func(store UsersStore, user, other string) { store.RespondToFriendshipRequest(user, other, true) },
+				undo: func(store UsersStore, user, other, saved string) { store.RemoveFriendship(user, other) },
+			},
+			{
+				name: "RemoveFriendship",
+				setup: func(store UsersStore, user, other string) string {
+					store.RequestFriendship(other, user)
+					store.RespondToFriendshipRequest(user, other, true)
+					return ""
+				},
+				run: func(store UsersStore, user, other string) { store.RemoveFriendship(user, other) },
+			},
+			{name: "GetFriendshipRequests", run: func(store UsersStore, user, other string) { store.GetFriendshipRequests(other) }},
+			{name: "AreFriends", run: func(store UsersStore, user, other string) { store.AreFriends(user, other) }},
+			{name: "HaveCommonFriend", run: func(store UsersStore, user, other string) { store.HaveCommonFriend(user, other) }},
+		}
+		for _, benchmark := range benchmarks {
+			benchmark := benchmark
+			b.Run(fmt.Sprintf("%s/friends=%d", benchmark.name, degree), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					saved := ""
+					if benchmark.setup != nil {
+						b.StopTimer()
+						saved = benchmark.setup(store, "hub00", "stranger")
+						b.StartTimer()
+					}
+					benchmark.run(store, "hub00", "stranger")
+					if benchmark.undo != nil {
+						b.StopTimer()
+						benchmark.undo(store, "hub00", "stranger", saved)
+						b.StartTimer()
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkServer measures the HTTP API on a server with 10000 users, through RunLoadTest with a single client
+func BenchmarkServer(b *testing.B) {
+	for _, operation := range LoadTestOperations {
+		b.Run(operation, func(b *testing.B) {
+			store := EmptyUsersStore()
+			SeedUsersStore(store, SeedConfig{Users: 10000, Model: SeedModelBarabasiAlbert, Degree: 10, Seed: 1})
+			httpServer := httptest.NewServer(&UsersServer{store: store})
+			defer httpServer.Close()
+
+			mix := map[string]int{operation: 1}
+			if operation == LoadTestRespond {
+				mix[LoadTestRequestFriendship] = 1 // so that there are requests to respond
+			}
+			b.ResetTimer()
+			report, err := RunLoadTest(http.DefaultClient, LoadTestConfig{Server: httpServer.URL, Requests: b.N,
+				Concurrency: 1, Users: 100, Mix: mix, Seed: 1})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if report.Total.Failed > 0 {
+				b.Errorf("%d requests failed", report.Total.Failed)
+			}
+		})
+	}
+}
+
+// BenchmarkShardedUsersStore measures parallel writes (a friendship request and its rejection, and a profile update,
+// between random users) on a ShardedUsersStore with several numbers of shards, compared with an InMemoryUsersStore.
+// Run with -cpu 1,4,16 to see how they scale
+func BenchmarkShardedUsersStore(b *testing.B) {
+	stores := []struct {
+		name  string
+		store UsersStore
+	}{{"InMemoryUsersStore", EmptyUsersStore()}}
+	for _, shards := range []int{1, 4, 16, 64} {
+		stores = append(stores, struct {
+			name  string
+			store UsersStore
+		}{fmt.Sprintf("shards=%d", shards), NewShardedUsersStore(shards)})
+	}
+
+	for _, s := range stores {
+		store := s.store
+		if _, err := SeedUsersStore(store, SeedConfig{Users: 10000, Model: SeedModelBarabasiAlbert, Degree: 10, Seed: 1}); err != nil {
+			b.Fatal(err)
+		}
+		users := store.GetUsers()
+		b.Run(s.name, func(b *testing.B) {
+			var seed int64
+			var seedMu sync.Mutex
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				seedMu.Lock()
+				seed++
+				random := rand.New(rand.NewSource(seed))
+				seedMu.Unlock()
+				bio := "Benchmarking"
+				for pb.Next() {
+					user, other := users[random.Intn(len(users))], users[random.Intn(len(users))]
+					if store.RequestFriendship(user, other) {
+						store.RespondToFriendshipRequest(other, user, false)
+					}
+					store.UpdateProfile(user, ProfileUpdate{Bio: &bio})
+				}
+			})
+		})
+	}
+}
+
+// getBenchmarkStore returns the seeded store of size users, building it the first time
+func getBenchmarkStore(b *testing.B, size int) *InMemoryUsersStore {
+	benchmarkStores.Lock()
+	defer benchmarkStores.Unlock()
+
+	if store, ok := benchmarkStores.stores[size]; ok {
+		return store
+	}
+	store := EmptyUsersStore()
+	if _, err := SeedUsersStore(store, SeedConfig{Users: size, Model: SeedModelBarabasiAlbert, Degree: 10, Requests: 0.1, Seed: 1}); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkStores.stores[size] = store
+	return store
+}
+
+// getBenchmarkUsers returns the two different users of the i-th call of a storeBenchmark among users (the users of
+// store). If strangers is true, they are neither friends nor have a pending friendship request between them
+func getBenchmarkUsers(store UsersStore, users []string, i int, strangers bool) (user, other string) {
+	// Hubs of the graph have the lowest indices, so that the worst case is measured too
+	user = users[(i*7919)%len(users)]
+	friends, sent, received := NewStringSet(), []string{}, []string{}
+	if strangers {
+		friends = NewStringSet(store.GetFriends(user)...)
+		sent, received, _ = store.GetFriendshipRequests(user)
+	}
+	for j := (i*104729 + 1) % len(users); ; j = (j + 1) % len(users) {
+		other = users[j]
+		if other != user && !friends.Contains(other) && !Contains(sent, other) && !Contains(received, other) {
+			return user, other
+		}
+	}
+}
+
+// getBenchmarkPassword returns the password of user, so that it can be restored (see storeBenchmark)
+func getBenchmarkPassword(store UsersStore, user, other string) string {
+	password, _ := store.GetPassword(user)
+	return password
+}
+
+func getBenchmarkSizes(b *testing.B) []int {
+	sizes := make([]int, 0)
+	for _, s := range strings.Split(*benchmarkSizes, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || size < 2 {
+			b.Fatalf("invalid -benchsizes %q", *benchmarkSizes)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestLRUCache(t *testing.T) {
+	cache := NewLRUCache(2)
+	_, _, generation := cache.Get("a")
+	cache.Add("a", 1, generation)
+	cache.Add("b", 2, generation)
+	cache.Get("a") // so that b is the least recently used
+	cache.Add("c", 3, generation)
+
+	t.Run("least recently used is evicted", func(t *testing.T) {
+		if _, ok, _ := cache.Get("b"); ok {
+			t.Error("b is still cached")
+		}
+		for key, want := range map[string]int{"a": 1, "c": 3} {
+			if value, ok, _ := cache.Get(key); !ok || value.(int) != want {
+				t.Errorf("%s: got %v, want %d", key, value, want)
+			}
+		}
+	})
+
+	_, _, generation = cache.Get("d")
+	cache.Invalidate("a")
+	t.Run("values read before an invalidation are not cached", func(t *testing.T) {
+		if cache.Add("d", 4, generation) {
+			t.Error("stale value was cached")
+		}
+		if _, ok, _ := cache.Get("a"); ok {
+			t.Error("a is still cached")
+		}
+	})
+
+	cache.Clear()
+	t.Run("statistics", func(t *testing.T) {
+		want := CacheStats{Hits: 3, Misses: 4, Evictions: 1, Size: 0, Capacity: 2}
+		if got := cache.Stats(); got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+}
+
+// TestCachingUsersStore runs the same random operations on an InMemoryUsersStore and on a CachingUsersStore wrapping
+// another one with a small cache, which must return the same results
+func TestCachingUsersStore(t *testing.T) {
+	want, got := EmptyUsersStore(), NewCachingUsersStore(EmptyUsersStore(), 8)
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		seed := random.Int63()
+		operation, wantResult := RunRandomStoreOperation(want, seed)
+		_, gotResult := RunRandomStoreOperation(got, seed)
+		if gotResult != wantResult {
+			t.Fatalf("operation %d %s: got %s, want %s", i, operation, gotResult, wantResult)
+		}
+		user := GetRandomUser(random)
+		if gotExists, wantExists := got.UserExists(user), want.UserExists(user); gotExists != wantExists {
+			t.Fatalf("after operation %d %s: got %s exists %t, want %t", i, operation, user, gotExists, wantExists)
+		}
+	}
+
+	for _, user := range want.GetUsers() {
+		if gotState, wantState := GetUserState(got, user), GetUserState(want, user); gotState != wantState {
+			t.Errorf("%s: got %s, want %s", user, gotState, wantState)
+		}
+	}
+
+	stats := got.Stats()
+	t.Run("cache is used", func(t *testing.T) {
+		if stats.Friends.Hits == 0 || stats.Exists.Hits == 0 || stats.Friends.Size > 8 {
+			t.Errorf("got statistics %+v", stats)
+		}
+	})
+}
+
+// TestCachingUsersStoreConcurrency reads friend lists while they are modified (run with -race), and checks that the
+// cache does not keep stale lists afterwards
+func TestCachingUsersStoreConcurrency(t *testing.T) {
+	store := NewCachingUsersStore(NewShardedUsersStore(4), 100)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 5000; i++ {
+				if g%2 == 0 {
+					RunRandomStoreOperation(store, random.Int63())
+				} else {
+					store.GetFriends(GetRandomUser(random))
+					store.UserExists(GetRandomUser(random))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		user := GetRandomUser(rand.New(rand.NewSource(int64(i))))
+		if got, want := toString(store.GetFriends(user)), toString(store.UsersStore.GetFriends(user)); got != want {
+			t.Errorf("%s: got cached friends %s, want %s", user, got, want)
+		}
+		if got, want := store.UserExists(user), store.UsersStore.UserExists(user); got != want {
+			t.Errorf("%s: got cached existence %t, want %t", user, got, want)
+		}
+	}
+}
+
+func TestAdminGetCacheStats(t *testing.T) {
+	store := NewCachingUsersStore(EmptyUsersStore(), 10)
+	store.AddUser("arnau", "12345678")
+	store.AddUser("sergi", "12345678")
+	store.SetRole("sergi", RoleModerator)
+	server := &UsersServer{store: store, adminToken: "secretToken"}
+	store.GetFriends("arnau")
+	store.GetFriends("arnau")
+
+	RunAdminTest(t, server, "regular user", http.MethodGet, "/admin/cacheStats", "arnau", "12345678", nil, http.StatusForbidden)
+	RunAdminTest(t, server, "wrong method", http.MethodPost, "/admin/cacheStats", "", "secretToken", nil, http.StatusMethodNotAllowed)
+	body := RunAdminTest(t, server, "moderator", http.MethodGet, "/admin/cacheStats", "sergi", "12345678", nil, http.StatusOK)
+	var stats CachingStoreStats
+	err := json.Unmarshal([]byte(body), &stats)
+	t.Run("statistics", func(t *testing.T) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Friends.Hits != 1 || stats.Friends.Misses != 1 || stats.Friends.Capacity != 10 {
+			t.Errorf("got %+v", stats)
+		}
+	})
+
+	wrapped := &UsersServer{store: NewTransactionalUsersStore(store), adminToken: "secretToken"}
+	RunAdminTest(t, wrapped, "cached store wrapped in a transactional store", http.MethodGet, "/admin/cacheStats", "", "secretToken", nil, http.StatusOK)
+
+	uncached := &UsersServer{store: EmptyUsersStore(), adminToken: "secretToken"}
+	RunAdminTest(t, uncached, "store is not cached", http.MethodGet, "/admin/cacheStats", "", "secretToken", nil, http.StatusNotFound)
+}
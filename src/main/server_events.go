@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultHeartbeatInterval is the interval between heartbeat comments sent through /events
+const DefaultHeartbeatInterval = 15 * time.Second
+
+// Events takes an events HTTP request (r) to the UsersServer (s) and streams the events addressed to the user as
+// Server-Sent Events until the client disconnects. User must authenticate using HTTP basic authentication.
+// If the request has a Last-Event-ID header, events published after that one are sent first.
+func (s *UsersServer) Events(w *http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Check credentials
+	user, err := s.GetAuthenticatedUser(r)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	flusher, ok := (*w).(http.Flusher)
+	if !ok {
+		(*w).WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(*w, "Streaming is not supported")
+		return
+	}
+
+	lastEventID, ok := GetLastEventID(w, r)
+	if !ok {
+		return
+	}
+
+	sub, missed := s.events.Subscribe(user, lastEventID)
+	defer s.events.Unsubscribe(sub)
+
+	(*w).Header().Set("Content-Type", "text/event-stream")
+	(*w).Header().Set("Cache-Control", "no-cache")
+	(*w).Header().Set("Connection", "keep-alive")
+	(*w).WriteHeader(http.StatusOK)
+
+	for _, event := range missed {
+		WriteServerSentEvent(*w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.getHeartbeatInterval())
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-sub.Events:
+			if !ok {
+				return // subscription dropped, client will reconnect using Last-Event-ID
+			}
+			WriteServerSentEvent(*w, event)
+
+		case <-heartbeat.C:
+			fmt.Fprint(*w, ": heartbeat\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// getHeartbeatInterval returns the interval between heartbeats sent to streaming clients (/events and /ws)
+func (s *UsersServer) getHeartbeatInterval() time.Duration {
+	if s.heartbeatInterval == 0 {
+		return DefaultHeartbeatInterval
+	}
+	return s.heartbeatInterval
+}
+
+// GetLastEventID returns the value of the Last-Event-ID header of request r, or 0 if there is no such header.
+// Iff the header is not valid, w will be populated and ok will be false
+func GetLastEventID(w *http.ResponseWriter, r *http.Request) (uint64, bool) {
+	header := r.Header.Get("Last-Event-ID")
+	if header == "" {
+		return 0, true
+	}
+
+	id, err := strconv.ParseUint(header, 10, 64)
+	if err != nil {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(*w, "Last-Event-ID must be a positive integer")
+		return 0, false
+	}
+	return id, true
+}
+
+// WriteServerSentEvent writes event to w in the text/event-stream format
+func WriteServerSentEvent(w http.ResponseWriter, event Event) {
+	data, _ := json.Marshal(event.Data) // a map[string]string can always be marshalled
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, events: NewEventBus(100, 10)}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "berta", "12345678", http.StatusOK)
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close) // runs after the event streams are closed
+
+	RunEventsAuthTest(t, httpServer, "events (no credentials)", "", "", http.StatusUnauthorized)
+	RunEventsAuthTest(t, httpServer, "events (wrong password)", "sergi", "wrongPass", http.StatusUnauthorized)
+
+	sergi := OpenEventStream(t, httpServer, "sergi", "12345678", "")
+	arnau := OpenEventStream(t, httpServer, "arnau", "12345678", "")
+
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	AssertNextEvent(t, sergi, "id: 1", "event: friendshipRequestReceived", `data: {"from":"arnau"}`)
+
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+	AssertNextEvent(t, arnau, "id: 2", "event: friendshipRequestAccepted", `data: {"by":"sergi"}`)
+
+	RunFriendshipRequestTest(t, server, "request friendship", "berta", "arnau", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "decline friendship", "arnau", "berta", "12345678", false, http.StatusOK)
+	AssertNextEvent(t, arnau, "id: 3", "event: friendshipRequestReceived", `data: {"from":"berta"}`)
+
+	// Failed mutations should not publish anything: berta resumes and only gets the decline
+	RunFriendshipRequestTest(t, server, "request friendship (already friends)", "arnau", "sergi", "12345678", http.StatusBadRequest)
+	berta := OpenEventStream(t, httpServer, "berta", "12345678", "3")
+	AssertNextEvent(t, berta, "id: 4", "event: friendshipRequestDeclined", `data: {"by":"arnau"}`)
+}
+
+func TestEventsHeartbeat(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, events: NewEventBus(100, 10), heartbeatInterval: 10 * time.Millisecond}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close) // runs after the event streams are closed
+
+	stream := OpenEventStream(t, httpServer, "arnau", "12345678", "")
+	AssertNextEvent(t, stream, ": heartbeat")
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := NewEventBus(100, 1)
+	sub, _ := bus.Subscribe("arnau", 0)
+
+	bus.Publish(EventFriendshipRequestReceived, "arnau", nil)
+	bus.Publish(EventFriendshipRequestReceived, "arnau", nil) // buffer is full, sub is dropped
+
+	if event := <-sub.Events; event.ID != 1 {
+		t.Errorf("got event %d, want 1", event.ID)
+	}
+	if _, ok := <-sub.Events; ok {
+		t.Errorf("subscription should have been closed")
+	}
+
+	// Resume from the last event received
+	sub, missed := bus.Subscribe("arnau", 1)
+	defer bus.Unsubscribe(sub)
+	if len(missed) != 1 || missed[0].ID != 2 {
+		t.Errorf("got missed events %v, want event 2", missed)
+	}
+}
+
+func TestEventBusForgetUser(t *testing.T) {
+	bus := NewEventBus(100, 10)
+	sub, _ := bus.Subscribe("arnau", 0)
+	bus.Publish(EventFriendshipRequestReceived, "arnau", map[string]string{"from": "sergi"})
+	bus.Publish(EventFriendshipRequestReceived, "berta", map[string]string{"from": "sergi"})
+
+	bus.ForgetUser("arnau")
+	<-sub.Events
+	if _, ok := <-sub.Events; ok {
+		t.Errorf("subscription should have been closed")
+	}
+
+	// Whoever takes the username next does not get the events of the previous user
+	sub, missed := bus.Subscribe("arnau", 1)
+	defer bus.Unsubscribe(sub)
+	if len(missed) != 0 {
+		t.Errorf("got missed events %v, want none", missed)
+	}
+	if _, missed := bus.Subscribe("berta", 1); len(missed) != 1 {
+		t.Errorf("got missed events %v of another user, want event 2", missed)
+	}
+}
+
+func RunEventsAuthTest(t *testing.T, s *httptest.Server, testName, user, password string, expectedHTTPStatus int) {
+	request, _ := http.NewRequest(http.MethodGet, s.URL+"/events", nil)
+	if user != "" {
+		request.SetBasicAuth(user, password)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	t.Run(testName, func(t *testing.T) {
+		AssertStatus(t, response.StatusCode, expectedHTTPStatus)
+	})
+}
+
+// OpenEventStream connects to /events and returns a channel with the non-empty lines of the stream
+func OpenEventStream(t *testing.T, s *httptest.Server, user, password, lastEventID string) <-chan string {
+	t.Helper()
+
+	request, _ := http.NewRequest(http.MethodGet, s.URL+"/events", nil)
+	request.SetBasicAuth(user, password)
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertStatus(t, response.StatusCode, http.StatusOK)
+	t.Cleanup(func() { response.Body.Close() })
+
+	lines := make(chan string, 100)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				lines <- line
+			}
+		}
+	}()
+	return lines
+}
+
+// AssertNextEvent checks that the next lines received through stream are the expected ones
+func AssertNextEvent(t *testing.T, stream <-chan string, want ...string) {
+	t.Helper()
+	for _, wantLine := range want {
+		select {
+		case got := <-stream:
+			if got != wantLine {
+				t.Errorf("got line %q, want %q", got, wantLine)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", strings.Join(want, "\n"))
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildSocialGraph(t *testing.T) {
+	store := NewSocialGraphTestStore()
+
+	cases := []struct {
+		name        string
+		options     SocialGraphOptions
+		users       string
+		friendships int
+		requests    int
+	}{
+		{"whole graph", SocialGraphOptions{}, "arnau berta marta sergi", 3, 0},
+		{"whole graph with requests", SocialGraphOptions{Requests: true}, "arnau berta marta sergi", 3, 1},
+		{"ego network (0 hops)", SocialGraphOptions{Requests: true, Ego: "arnau", Hops: 0}, "arnau", 0, 0},
+		{"ego network (1 hop)", SocialGraphOptions{Requests: true, Ego: "arnau", Hops: 1}, "arnau sergi", 1, 0},
+		{"ego network (2 hops)", SocialGraphOptions{Requests: true, Ego: "arnau", Hops: 2}, "arnau berta sergi", 2, 0},
+		{"ego network (3 hops)", SocialGraphOptions{Requests: true, Ego: "arnau", Hops: 3}, "arnau berta marta sergi", 3, 1},
+	}
+
+	for _, c := range cases {
+		graph, ok := BuildSocialGraph(store, c.options)
+		t.Run(c.name, func(t *testing.T) {
+			users := make([]string, 0)
+			for _, node := range graph.Nodes {
+				users = append(users, node.User)
+			}
+			switch {
+			case !ok:
+				t.Fatal("got ok = false")
+			case strings.Join(users, " ") != c.users:
+				t.Errorf("got users %v, want %s", users, c.users)
+			case len(graph.Friendships) != c.friendships:
+				t.Errorf("got friendships %v, want %d", graph.Friendships, c.friendships)
+			case len(graph.Requests) != c.requests:
+				t.Errorf("got requests %v, want %d", graph.Requests, c.requests)
+			}
+		})
+	}
+
+	_, ok := BuildSocialGraph(store, SocialGraphOptions{Ego: "peter", Hops: 1})
+	t.Run("ego network of a user that does not exist", func(t *testing.T) {
+		if ok {
+			t.Error("got ok = true")
+		}
+	})
+}
+
+func TestAdminGetSocialGraph(t *testing.T) {
+	store := NewSocialGraphTestStore()
+	store.SetRole("sergi", RoleModerator)
+	server := &UsersServer{store: store, adminToken: "secretToken"}
+
+	RunAdminTest(t, server, "no credentials", http.MethodGet, "/admin/graph?format=dot", "", "", nil, http.StatusUnauthorized)
+	RunAdminTest(t, server, "regular user", http.MethodGet, "/admin/graph?format=dot", "arnau", "12345678", nil, http.StatusForbidden)
+	RunAdminTest(t, server, "moderator", http.MethodGet, "/admin/graph?format=dot", "sergi", "12345678", nil, http.StatusOK)
+	RunAdminTest(t, server, "wrong method", http.MethodPost, "/admin/graph?format=dot", "", "secretToken", nil, http.StatusMethodNotAllowed)
+	RunAdminTest(t, server, "missing format", http.MethodGet, "/admin/graph", "", "secretToken", nil, http.StatusBadRequest)
+	RunAdminTest(t, server, "unknown format", http.MethodGet, "/admin/graph?format=csv", "", "secretToken", nil, http.StatusBadRequest)
+	RunAdminTest(t, server, "invalid requests", http.MethodGet, "/admin/graph?format=dot&requests=maybe", "", "secretToken", nil, http.StatusBadRequest)
+	RunAdminTest(t, server, "invalid hops", http.MethodGet, "/admin/graph?format=dot&user=arnau&hops=-1", "", "secretToken", nil, http.StatusBadRequest)
+	RunAdminTest(t, server, "hops without user", http.MethodGet, "/admin/graph?format=dot&hops=2", "", "secretToken", nil, http.StatusBadRequest)
+	RunAdminTest(t, server, "ego user does not exist", http.MethodGet, "/admin/graph?format=dot&user=peter", "", "secretToken", nil, http.StatusNotFound)
+
+	ids := map[string]string{}
+	for _, user := range store.GetUsers() {
+		ids[user], _ = store.GetUserID(user)
+	}
+
+	RunAdminTestWithBody(t, server, "DOT of an ego network", http.MethodGet, "/admin/graph?format=dot&user=arnau", "", "secretToken",
+		"graph social {\n"+
+			fmt.Sprintf("  \"arnau\" [id=\"%s\", label=\"Arnau\"];\n", ids["arnau"])+
+			fmt.Sprintf("  \"sergi\" [id=\"%s\", label=\"sergi\"];\n", ids["sergi"])+
+			"  \"arnau\" -- \"sergi\" [type=friendship];\n"+
+			"}\n")
+	RunAdminTestWithBody(t, server, "DOT of an ego network without friends", http.MethodGet, "/admin/graph?format=dot&requests=true&user=marta&hops=0", "", "secretToken",
+		"graph social {\n"+
+			fmt.Sprintf("  \"marta\" [id=\"%s\", label=\"marta\"];\n", ids["marta"])+
+			"}\n")
+
+	for _, format := range []string{GraphFormatGraphML, GraphFormatGEXF} {
+		body := RunAdminTest(t, server, format, http.MethodGet, "/admin/graph?requests=1&format="+format, "", "secretToken", nil, http.StatusOK)
+		t.Run(format+" is well-formed XML", func(t *testing.T) {
+			AssertWellFormedXML(t, body)
+			for _, user := range store.GetUsers() {
+				if !strings.Contains(body, `"`+ids[user]+`"`) {
+					t.Errorf("user %s is missing", user)
+				}
+			}
+			if got := strings.Count(body, "<edge "); got != 4 {
+				t.Errorf("got %d edges, want 4", got)
+			}
+		})
+	}
+}
+
+func TestGraphCommand(t *testing.T) {
+	store := NewSocialGraphTestStore()
+	server := &UsersServer{store: store, adminToken: "secretToken"}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	dir := t.TempDir()
+	export := filepath.Join(dir, "graph.jsonl")
+	var buffer bytes.Buffer
+	ExportGraph(store, &buffer, true)
+	ioutil.WriteFile(export, buffer.Bytes(), 0600)
+
+	fromServer, fromFile := filepath.Join(dir, "server.gexf"), filepath.Join(dir, "file.gexf")
+	RunCommandTest(t, "unknown format", RunGraphCommand, []string{"-format", "csv", "-from", export}, 2)
+	RunCommandTest(t, "wrong token", RunGraphCommand, []string{"-server", httpServer.URL, "-token", "wrongToken", fromServer}, 1)
+	RunCommandTest(t, "ego user does not exist", RunGraphCommand, []string{"-from", export, "-user", "peter", fromFile}, 1)
+	RunCommandTest(t, "from server", RunGraphCommand,
+		[]string{"-server", httpServer.URL, "-token", "secretToken", "-format", "gexf", "-requests", "-user", "arnau", "-hops", "3", fromServer}, 0)
+	RunCommandTest(t, "from export file", RunGraphCommand, []string{"-from", export, "-format", "gexf", "-requests", fromFile}, 0)
+
+	t.Run("both graphs are equal", func(t *testing.T) {
+		got, _ := ioutil.ReadFile(fromFile)
+		want, _ := ioutil.ReadFile(fromServer)
+		AssertWellFormedXML(t, string(got))
+		AssertResponseBody(t, string(got), string(want))
+	})
+}
+
+// NewSocialGraphTestStore returns a store where arnau, sergi, berta and marta are friends in a chain (in this order)
+// and marta has sent a friendship request to arnau. arnau's display name is Arnau
+func NewSocialGraphTestStore() *InMemoryUsersStore {
+	store := EmptyUsersStore()
+	users := []string{"arnau", "sergi", "berta", "marta"}
+	for _, user := range users {
+		store.AddUser(user, "12345678")
+	}
+	for i := 1; i < len(users); i++ {
+		store.RequestFriendship(users[i-1], users[i])
+		store.RespondToFriendshipRequest(users[i], users[i-1], true)
+	}
+	store.RequestFriendship("marta", "arnau")
+	displayName := "Arnau"
+	store.UpdateProfile("arnau", ProfileUpdate{DisplayName: &displayName})
+	return store
+}
+
+func AssertWellFormedXML(t *testing.T, body string) {
+	t.Helper()
+	decoder := xml.NewDecoder(strings.NewReader(body))
+	for {
+		_, err := decoder.Token()
+		if err != nil {
+			if err != io.EOF {
+				t.Errorf("got invalid XML: %v", err)
+			}
+			return
+		}
+	}
+}
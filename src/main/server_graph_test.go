@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportImportGraph(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "berta", "password", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "berta", "arnau", "password", http.StatusOK)
+	RunUpdateProfileTest(t, server, "update profile", "arnau", "arnau", "12345678", map[string]string{"bio": "Hi!"}, http.StatusOK)
+	RunUpdatePrivacySettingsTest(t, server, "update privacy settings", "sergi", "12345678",
+		map[string]string{"friendsVisibility": "me"}, http.StatusOK)
+	store.SetRole("arnau", RoleAdmin)
+
+	// Friends: arnau&sergi
+	// Requests: berta->arnau
+
+	var export bytes.Buffer
+	report, err := ExportGraph(store, &export, true)
+	t.Run("export", func(t *testing.T) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Users != 3 || report.Friendships != 1 || report.Requests != 1 {
+			t.Errorf("got report %+v, want 3 users, 1 friendship and 1 request", report)
+		}
+	})
+
+	imported := EmptyUsersStore()
+	report, err = ImportGraph(imported, bytes.NewReader(export.Bytes()))
+	t.Run("import into an empty store", func(t *testing.T) {
+		if err != nil || len(report.Conflicts) > 0 {
+			t.Fatalf("got error %v and conflicts %v", err, report.Conflicts)
+		}
+		if report.Users != 3 || report.Friendships != 1 || report.Requests != 1 {
+			t.Errorf("got report %+v, want 3 users, 1 friendship and 1 request", report)
+		}
+	})
+
+	t.Run("imported store is equal to the original one", func(t *testing.T) {
+		for _, user := range store.GetUsers() {
+			wantID, _ := store.GetUserID(user)
+			gotID, _ := imported.GetUserID(user)
+			wantRole, _ := store.GetRole(user)
+			gotRole, _ := imported.GetRole(user)
+			wantProfile, _ := store.GetProfile(user)
+			gotProfile, _ := imported.GetProfile(user)
+			wantPrivacy, _ := store.GetPrivacySettings(user)
+			gotPrivacy, _ := imported.GetPrivacySettings(user)
+			wantSent, _, _ := store.GetFriendshipRequests(user)
+			gotSent, _, _ := imported.GetFriendshipRequests(user)
+
+			switch {
+			case gotID != wantID:
+				t.Errorf("%s: got ID %q, want %q", user, gotID, wantID)
+			case gotRole != wantRole:
+				t.Errorf("%s: got role %q, want %q", user, gotRole, wantRole)
+			case gotProfile.Summary() != wantProfile.Summary() || gotProfile.Bio != wantProfile.Bio:
+				t.Errorf("%s: got profile %+v, want %+v", user, gotProfile, wantProfile)
+			case gotPrivacy != wantPrivacy:
+				t.Errorf("%s: got privacy settings %+v, want %+v", user, gotPrivacy, wantPrivacy)
+			case toString(imported.GetFriends(user)) != toString(store.GetFriends(user)):
+				t.Errorf("%s: got friends %v, want %v", user, imported.GetFriends(user), store.GetFriends(user))
+			case toString(gotSent) != toString(wantSent):
+				t.Errorf("%s: got sent requests %v, want %v", user, gotSent, wantSent)
+			case !imported.CheckUsersPassword(user, map[string]string{"arnau": "12345678", "sergi": "12345678", "berta": "password"}[user]):
+				t.Errorf("%s: password was not imported", user)
+			}
+		}
+	})
+
+	report, err = ImportGraph(imported, bytes.NewReader(export.Bytes()))
+	t.Run("import into a store with the same users", func(t *testing.T) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Conflicts) != 8 {
+			t.Errorf("got conflicts %v, want 8 (3 users with 2 conflicts each, 1 friendship and 1 request)", report.Conflicts)
+		}
+	})
+
+	export.Reset()
+	ExportGraph(store, &export, false)
+	t.Run("export without passwords", func(t *testing.T) {
+		if strings.Contains(export.String(), "password") {
+			t.Errorf("got export with passwords: %s", export.String())
+		}
+	})
+
+	imported = EmptyUsersStore()
+	report, err = ImportGraph(imported, bytes.NewReader(export.Bytes()))
+	t.Run("import without passwords", func(t *testing.T) {
+		if err != nil || len(report.Conflicts) > 0 {
+			t.Fatalf("got error %v and conflicts %v", err, report.Conflicts)
+		}
+		if report.Users != 3 || report.PasswordResets != 3 {
+			t.Errorf("got report %+v, want 3 users who must reset their password", report)
+		}
+		if imported.CheckUsersPassword("arnau", "12345678") || imported.CheckUsersPassword("arnau", "") {
+			t.Error("user can log in without resetting their password")
+		}
+	})
+}
+
+func TestImportGraphConflicts(t *testing.T) {
+	store := EmptyUsersStore()
+	store.AddUser("marta", "12345678")
+	store.AddUserWithID("j1", "jordi", "12345678")
+	store.DeleteUser("jordi")
+
+	cases := []struct {
+		name      string
+		records   []string
+		conflicts []string
+	}{
+		{"duplicate user", []string{
+			`{"type":"user","user":"arnau","password":"12345678"}`,
+			`{"type":"user","user":"arnau","password":"12345678"}`,
+		}, []string{"user arnau: User appears more than once"}},
+		{"existing user", []string{
+			`{"type":"user","user":"marta","password":"12345678"}`,
+		}, []string{"user marta: User already exists"}},
+		{"deleted user", []string{
+			`{"type":"user","user":"jordi","password":"12345678"}`,
+		}, []string{"user jordi: User belongs to a deleted user"}},
+		{"ID of a deleted user", []string{
+			`{"type":"user","id":"j1","user":"pauet","password":"12345678"}`,
+		}, []string{"user pauet: ID j1 belongs to a deleted user"}},
+		{"invalid user", []string{
+			`{"type":"user","user":"arnau","password":"12345678","role":"root"}`,
+		}, []string{`user arnau: Invalid role "root"`}},
+		{"duplicate friendship", []string{
+			`{"type":"user","user":"arnau","password":"12345678"}`,
+			`{"type":"friendship","users":["arnau","marta"]}`,
+			`{"type":"friendship","users":["marta","arnau"]}`,
+		}, []string{"friendship marta&arnau: Users are already friends"}},
+		{"request between friends", []string{
+			`{"type":"user","user":"arnau","password":"12345678"}`,
+			`{"type":"friendship","users":["arnau","marta"]}`,
+			`{"type":"request","from":"marta","to":"arnau"}`,
+		}, []string{"request marta->arnau: Users are already friends"}},
+		{"requests in both directions", []string{
+			`{"type":"user","user":"arnau","password":"12345678"}`,
+			`{"type":"request","from":"arnau","to":"marta"}`,
+			`{"type":"request","from":"marta","to":"arnau"}`,
+		}, []string{"request marta->arnau: Friendship request already exists"}},
+		{"unknown user", []string{
+			`{"type":"request","from":"marta","to":"peter"}`,
+		}, []string{"request marta->peter: User does not exist"}},
+	}
+
+	for _, c := range cases {
+		input := `{"type":"header","version":1}` + "\n" + strings.Join(c.records, "\n") + "\n"
+		report, err := ImportGraph(store, strings.NewReader(input))
+		t.Run(c.name, func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			AssertResponseBody(t, toString(report.Conflicts), toString(c.conflicts))
+			RunGetUsersTest(t, &UsersServer{store: store}, "nothing is imported", "[marta]")
+		})
+	}
+
+	invalid := []struct{ name, input, err string }{
+		{"empty file", "", "missing header"},
+		{"no header", `{"type":"user","user":"arnau","password":"12345678"}` + "\n", "line 1: missing header"},
+		{"unsupported version", `{"type":"header","version":2}` + "\n", "line 1: unsupported version 2"},
+		{"unknown record", `{"type":"header","version":1}` + "\n" + `{"type":"group"}` + "\n", `line 2: unknown record type "group"`},
+		{"not JSON", `{"type":"header","version":1}` + "\n" + "arnau\n", "line 2: "},
+	}
+	for _, c := range invalid {
+		_, err := ImportGraph(store, strings.NewReader(c.input))
+		t.Run(c.name, func(t *testing.T) {
+			if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+				t.Errorf("got error %v, want %q", err, c.err)
+			}
+		})
+	}
+}
+
+// modifiedUsersStore is a UsersStore whose friendship requests fail, like a store modified by someone else
+type modifiedUsersStore struct {
+	UsersStore
+}
+
+func (s *modifiedUsersStore) RequestFriendship(from, to string) bool {
+	return false
+}
+
+func TestImportGraphRollback(t *testing.T) {
+	store := EmptyUsersStore()
+	store.AddUser("marta", "12345678")
+
+	input := `{"type":"header","version":1}` + "\n" +
+		`{"type":"user","user":"arnau","password":"12345678"}` + "\n" +
+		`{"type":"friendship","users":["arnau","marta"]}` + "\n"
+	report, err := ImportGraph(&modifiedUsersStore{store}, strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("import fails", func(t *testing.T) {
+		AssertResponseBody(t, toString(report.Conflicts),
+			toString([]string{"friendship arnau&marta: could not be added because the store has been modified"}))
+	})
+	RunGetUsersTest(t, &UsersServer{store: store}, "users added are removed", "[marta]")
+	t.Run("username can be taken again", func(t *testing.T) {
+		if store.IsDeletedUser("arnau") || !store.AddUser("arnau", "12345678") {
+			t.Error("username of the rolled back user is taken")
+		}
+	})
+}
+
+func TestExportImportCommands(t *testing.T) {
+	source := &UsersServer{store: EmptyUsersStore(), adminToken: "secretToken", audit: NewAuditLog()}
+	RunSignUpTest(t, source, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, source, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, source, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	target := &UsersServer{store: EmptyUsersStore(), adminToken: "secretToken", audit: NewAuditLog()}
+
+	sourceServer := httptest.NewServer(source)
+	defer sourceServer.Close()
+	targetServer := httptest.NewServer(target)
+	defer targetServer.Close()
+
+	path := filepath.Join(t.TempDir(), "graph.jsonl")
+	RunCommandTest(t, "export (wrong token)", RunExportCommand, []string{"-server", sourceServer.URL, "-token", "wrongToken", path}, 1)
+	RunCommandTest(t, "export", RunExportCommand, []string{"-server", sourceServer.URL, "-token", "secretToken", path}, 0)
+	RunCommandTest(t, "import", RunImportCommand, []string{"-server", targetServer.URL, "-token", "secretToken", path}, 0)
+	RunCommandTest(t, "import again (conflicts)", RunImportCommand, []string{"-server", targetServer.URL, "-token", "secretToken", path}, 1)
+
+	RunGetUsersTest(t, target, "users are imported", "[arnau sergi]")
+	RunRespondToFriendshipTest(t, target, "requests are imported", "sergi", "arnau", "12345678", true, http.StatusOK)
+
+	withoutPasswords := filepath.Join(t.TempDir(), "graph.jsonl")
+	RunCommandTest(t, "export without passwords", RunExportCommand, []string{"-server", sourceServer.URL, "-token", "secretToken",
+		"-passwords=false", withoutPasswords}, 0)
+	t.Run("passwords are not exported", func(t *testing.T) {
+		if export, _ := ioutil.ReadFile(withoutPasswords); strings.Contains(string(export), "password") {
+			t.Errorf("got export with passwords: %s", export)
+		}
+	})
+
+	t.Run("export and import are audited", func(t *testing.T) {
+		if entries := FilterAuditEntries(source.audit.GetEntries(), AuditGraphExported); len(entries) != 2 {
+			t.Errorf("got %d export entries, want 2", len(entries))
+		}
+		if entries := FilterAuditEntries(target.audit.GetEntries(), AuditGraphImported); len(entries) != 1 {
+			t.Errorf("got %d import entries, want 1", len(entries))
+		}
+	})
+}
+
+func RunCommandTest(t *testing.T, testName string, command func(args []string) int, args []string, expectedExitCode int) {
+	code := command(args)
+	t.Run(testName, func(t *testing.T) {
+		if code != expectedExitCode {
+			t.Errorf("got exit code %d, want %d", code, expectedExitCode)
+		}
+	})
+}
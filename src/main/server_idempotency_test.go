@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	server := &UsersServer{store: EmptyUsersStore(), idempotency: NewIdempotencyKeys(time.Hour)}
+
+	signUp := `{"user": "arnau", "pass": "12345678"}`
+	first := RunIdempotentTest(t, server, "sign up", "/signUp", "key1", signUp, http.StatusOK)
+	retry := RunIdempotentTest(t, server, "retry sign up", "/signUp", "key1", signUp, http.StatusOK)
+	t.Run("retry gets the first response", func(t *testing.T) {
+		AssertResponseBody(t, retry.Body.String(), first.Body.String())
+		AssertResponseBody(t, retry.Header().Get("Content-Type"), "application/json")
+		AssertResponseBody(t, retry.Header().Get(IdempotentReplayedHeader), "true")
+		AssertResponseBody(t, first.Header().Get(IdempotentReplayedHeader), "")
+	})
+	t.Run("retry has its own request ID", func(t *testing.T) {
+		if retry.Header().Get(RequestIDHeader) == first.Header().Get(RequestIDHeader) {
+			t.Errorf("got request ID %s in both responses", retry.Header().Get(RequestIDHeader))
+		}
+	})
+
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	request := `{"user": "arnau", "userTo": "sergi", "pass": "12345678"}`
+	RunIdempotentTest(t, server, "request friendship", "/requestFriendship", "key2", request, http.StatusOK)
+	RunIdempotentTest(t, server, "retry request friendship", "/requestFriendship", "key2", request, http.StatusOK)
+	response := RunIdempotentTest(t, server, "request friendship with a new key", "/requestFriendship", "key3",
+		request, http.StatusBadRequest)
+	t.Run("requests with a new key are processed", func(t *testing.T) {
+		AssertResponseBody(t, response.Body.String(), "Friendship request already exists")
+	})
+
+	response = RunIdempotentTest(t, server, "same key with a different body", "/requestFriendship", "key2",
+		`{"user": "arnau", "userTo": "marta", "pass": "12345678"}`, http.StatusUnprocessableEntity)
+	t.Run("keys can't be reused for different requests", func(t *testing.T) {
+		AssertResponseBody(t, response.Body.String(), "Idempotency-Key was already used with a different request")
+	})
+	RunIdempotentTest(t, server, "same key in a different endpoint", "/respondToFriendshipRequest", "key2", request,
+		http.StatusUnprocessableEntity)
+
+	wrongPass := `{"user": "sergi", "userTo": "arnau", "pass": "wrongPass"}`
+	RunIdempotentTest(t, server, "wrong password", "/requestFriendship", "key4", wrongPass, http.StatusUnauthorized)
+	RunIdempotentTest(t, server, "retry wrong password", "/requestFriendship", "key4", wrongPass, http.StatusUnauthorized)
+
+	RunSignUpTest(t, server, "sign up another user", "marta", "12345678", http.StatusOK)
+	RunIdempotentTest(t, server, "same key by another user", "/requestFriendship", "key2",
+		`{"user": "sergi", "userTo": "marta", "pass": "12345678"}`, http.StatusOK)
+
+	RunIdempotentTest(t, server, "key too long", "/requestFriendship", strings.Repeat("k", MaxIdempotencyKeyLength+1),
+		request, http.StatusBadRequest)
+	RunIdempotentTest(t, server, "body too large", "/signUp", "key5", strings.Repeat(" ", MaxIdempotentBodySize+1),
+		http.StatusRequestEntityTooLarge)
+	RunFriendshipRequestTest(t, server, "request without a key", "arnau", "sergi", "12345678", http.StatusBadRequest)
+}
+
+func TestIdempotencyKeysExpire(t *testing.T) {
+	server := &UsersServer{store: EmptyUsersStore(), idempotency: NewIdempotencyKeys(time.Millisecond)}
+
+	signUp := `{"user": "arnau", "pass": "12345678"}`
+	RunIdempotentTest(t, server, "sign up", "/signUp", "key1", signUp, http.StatusOK)
+	time.Sleep(2 * time.Millisecond)
+	RunIdempotentTest(t, server, "retry sign up after the window", "/signUp", "key1", signUp, http.StatusBadRequest)
+	t.Run("expired keys are forgotten", func(t *testing.T) {
+		server.idempotency.mu.Lock()
+		defer server.idempotency.mu.Unlock()
+		if len(server.idempotency.responses) != 1 || len(server.idempotency.order) != 1 {
+			t.Errorf("got %d responses and %d keys", len(server.idempotency.responses), len(server.idempotency.order))
+		}
+	})
+}
+
+func TestIdempotencyKeysCapacity(t *testing.T) {
+	server := &UsersServer{store: EmptyUsersStore(), idempotency: NewBoundedIdempotencyKeys(time.Hour, 2)}
+
+	RunIdempotentTest(t, server, "sign up arnau", "/signUp", "key1", `{"user": "arnau", "pass": "12345678"}`,
+		http.StatusOK)
+	RunIdempotentTest(t, server, "sign up sergi", "/signUp", "key2", `{"user": "sergi", "pass": "12345678"}`,
+		http.StatusOK)
+	RunIdempotentTest(t, server, "sign up marta", "/signUp", "key3", `{"user": "marta", "pass": "12345678"}`,
+		http.StatusOK)
+	RunIdempotentTest(t, server, "retry the oldest key", "/signUp", "key1", `{"user": "arnau", "pass": "12345678"}`,
+		http.StatusBadRequest)
+	RunIdempotentTest(t, server, "retry the newest key", "/signUp", "key3", `{"user": "marta", "pass": "12345678"}`,
+		http.StatusOK)
+}
+
+func TestIdempotencyKeysConcurrency(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, idempotency: NewIdempotencyKeys(time.Hour)}
+
+	// Concurrent retries are either processed once, replayed, or rejected while the first one is processed
+	signUp := `{"user": "arnau", "pass": "12345678"}`
+	statuses := make([]int, 10)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request, _ := http.NewRequest(http.MethodPost, "/signUp", strings.NewReader(signUp))
+			request.Header.Set(IdempotencyKeyHeader, "key1")
+			response := httptest.NewRecorder()
+			server.ServeHTTP(response, request)
+			statuses[i] = response.Code
+		}(i)
+	}
+	wg.Wait()
+
+	for _, status := range statuses {
+		if status != http.StatusOK && status != http.StatusConflict {
+			t.Errorf("got status %d, want %d or %d", status, http.StatusOK, http.StatusConflict)
+		}
+	}
+	AssertResponseBody(t, toString(store.GetUsers()), toString([]string{"arnau"}))
+}
+
+// RunIdempotentTest sends a POST request to url with body and idempotency key, and checks its HTTP status
+func RunIdempotentTest(t *testing.T, s *UsersServer, testName, url, key, body string, expectedHTTPStatus int) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	request.Header.Set(IdempotencyKeyHeader, key)
+	response := httptest.NewRecorder()
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		AssertStatus(t, response.Code, expectedHTTPStatus)
+	})
+	return response
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunLoadTest(t *testing.T) {
+	store := EmptyUsersStore()
+	httpServer := httptest.NewServer(&UsersServer{store: store})
+	t.Cleanup(httpServer.Close)
+
+	mix := map[string]int{LoadTestSignUp: 1, LoadTestRequestFriendship: 4, LoadTestRespond: 2, LoadTestGetFriends: 10}
+	report, err := RunLoadTest(http.DefaultClient, LoadTestConfig{Server: httpServer.URL, Requests: 300, Concurrency: 4,
+		Users: 20, Mix: mix, Seed: 1})
+	t.Run("load test", func(t *testing.T) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Total.Requests != 300 || report.Total.Failed != 0 {
+			t.Errorf("got %d requests and %d failures, want 300 and 0", report.Total.Requests, report.Total.Failed)
+		}
+
+		requests := 0
+		for _, stats := range report.Operations {
+			requests += stats.Requests
+			if stats.P50 > stats.P90 || stats.P90 > stats.P99 || stats.P99 > stats.Max {
+				t.Errorf("%s: percentiles are not sorted: %+v", stats.Operation, stats)
+			}
+		}
+		if requests != 300 || len(report.Operations) != len(LoadTestOperations) {
+			t.Errorf("got %d requests in %d operations, want 300 in %d", requests, len(report.Operations), len(LoadTestOperations))
+		}
+		if users := len(store.GetUsers()); users < 20 {
+			t.Errorf("got %d users, want at least 20", users)
+		}
+	})
+
+	_, err = RunLoadTest(http.DefaultClient, LoadTestConfig{Server: httpServer.URL, Requests: 10, Concurrency: 4,
+		Users: 20, Mix: mix, Seed: 1})
+	t.Run("second load test with the same seed", func(t *testing.T) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("load test prefix", func(t *testing.T) {
+		prefix := NewLoadTestPrefix()
+		if ok, msg := CheckUsernameAndPassword(prefix+"zzzzz", LoadTestPassword); !ok {
+			t.Errorf("prefix %s: %s", prefix, msg)
+		}
+	})
+
+	invalid := []LoadTestConfig{
+		{Server: httpServer.URL, Requests: 10, Concurrency: 0, Users: 2, Mix: mix},
+		{Server: httpServer.URL, Requests: 0, Concurrency: 1, Users: 2, Mix: mix},
+		{Server: httpServer.URL, Requests: 10, Concurrency: 1, Users: 2, Mix: map[string]int{"deleteAccount": 1}},
+		{Server: httpServer.URL, Requests: 10, Concurrency: 1, Users: 2, Mix: map[string]int{LoadTestGetFriends: 0}},
+		{Server: httpServer.URL, Requests: 10, Concurrency: 1, Users: 1, Mix: map[string]int{LoadTestGetFriends: 1}},
+	}
+	for _, config := range invalid {
+		_, err := RunLoadTest(http.DefaultClient, config)
+		t.Run("invalid configuration", func(t *testing.T) {
+			if err == nil {
+				t.Errorf("%+v: got no error", config)
+			}
+		})
+	}
+}
+
+func TestLoadTestCommand(t *testing.T) {
+	httpServer := httptest.NewServer(&UsersServer{store: EmptyUsersStore()})
+	t.Cleanup(httpServer.Close)
+
+	RunCommandTest(t, "invalid mix", RunLoadTestCommand, []string{"-server", httpServer.URL, "-mix", "getFriends"}, 2)
+	RunCommandTest(t, "unknown operation", RunLoadTestCommand, []string{"-server", httpServer.URL, "-mix", "sendMessage=1"}, 2)
+	RunCommandTest(t, "server is down", RunLoadTestCommand, []string{"-server", "http://127.0.0.1:1", "-requests", "10"}, 1)
+	RunCommandTest(t, "load test", RunLoadTestCommand,
+		[]string{"-server", httpServer.URL, "-requests", "100", "-users", "10", "-concurrency", "2"}, 0)
+}
+
+func TestGetPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	cases := []struct {
+		p    float64
+		want time.Duration
+	}{{0, time.Millisecond}, {50, 50 * time.Millisecond}, {99, 99 * time.Millisecond}, {100, 100 * time.Millisecond}}
+	for _, c := range cases {
+		got := GetPercentile(latencies, c.p)
+		t.Run("percentile", func(t *testing.T) {
+			if got != c.want {
+				t.Errorf("p%v: got %s, want %s", c.p, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxMessageLength is the maximum number of characters of a direct message
+const MaxMessageLength = 1000
+
+// Page sizes of /getConversation
+const (
+	DefaultConversationPageSize = 20
+	MaxConversationPageSize     = 100
+)
+
+// SendMessage takes a sendMessage HTTP request (r) to the UsersServer (s), processes it and populates the ResponseWriter (w)
+func (s *UsersServer) SendMessage(w *http.ResponseWriter, r *http.Request) {
+	if s.messages == nil {
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	pass := info["pass"]
+	body := info["message"]
+
+	// Check credentials
+	if err := s.CheckCredentials(r.Context(), user, pass); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	userTo, err := s.resolveUser(r.Context(), info, "userTo")
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	if body == "" || utf8.RuneCountInString(body) > MaxMessageLength {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(*w, "Message must have from 1 to %d characters", MaxMessageLength)
+		return
+	}
+
+	if status, msg := s.checkCanMessage(r.Context(), user, userTo); status != http.StatusOK {
+		WriteStatus(w, status, msg)
+		return
+	}
+
+	message := s.messages.AddMessage(user, userTo, body)
+	s.events.Publish(EventMessageReceived, userTo, map[string]string{"from": user, "id": strconv.Itoa(message.ID)})
+	s.RecordAudit(r, user, AuditMessageSent, userTo, map[string]string{"id": strconv.Itoa(message.ID)})
+	(*w).WriteHeader(http.StatusOK)
+}
+
+// GetConversation takes a getConversation HTTP request (r) to the UsersServer (s), processes it and populates the
+// ResponseWriter (w) with a page of messages between the authenticated user and the user in the path, newest first.
+// Messages sent to the authenticated user are marked as read.
+func (s *UsersServer) GetConversation(w *http.ResponseWriter, r *http.Request) {
+	if s.messages == nil {
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	user, err := s.GetAuthenticatedUser(r)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) < 3 {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(*w, "Missing user")
+		return
+	}
+	otherUser, err := s.resolvePathUser(r, path[2])
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	before, limit, ok := GetPageParameters(w, r)
+	if !ok {
+		return
+	}
+
+	if status, msg := s.checkCanMessage(r.Context(), user, otherUser); status != http.StatusOK {
+		WriteStatus(w, status, msg)
+		return
+	}
+
+	messages := s.messages.GetConversation(user, otherUser, before, limit)
+	s.messages.MarkConversationRead(user, otherUser)
+	WriteJSON(w, http.StatusOK, messages)
+}
+
+// GetUnreadCounts takes a getUnreadCounts HTTP request (r) to the UsersServer (s), processes it and populates the
+// ResponseWriter (w) with the number of unread messages of the authenticated user by sender
+func (s *UsersServer) GetUnreadCounts(w *http.ResponseWriter, r *http.Request) {
+	if s.messages == nil {
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	user, err := s.GetAuthenticatedUser(r)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, s.messages.GetUnreadCounts(user))
+}
+
+// checkCanMessage checks that user (who must have been authenticated already) and otherUser can exchange messages,
+// ie they are friends. Returns the HTTP status and error message (empty if none)
+func (s *UsersServer) checkCanMessage(ctx context.Context, user, otherUser string) (int, string) {
+	areFriends, err := s.storeV2().AreFriends(ctx, user, otherUser)
+	if err != nil {
+		return GetStoreErrorStatus(err)
+	}
+
+	if !areFriends {
+		return http.StatusForbidden, "Users can only exchange messages with their friends"
+	}
+
+	return http.StatusOK, ""
+}
+
+// GetPageParameters returns the `before` and `limit` query parameters of request r (0 and
+// DefaultConversationPageSize if missing). Iff they are not valid, w will be populated and ok will be false
+func GetPageParameters(w *http.ResponseWriter, r *http.Request) (before, limit int, ok bool) {
+	query := r.URL.Query()
+	before, limit = 0, DefaultConversationPageSize
+
+	if query.Get("before") != "" {
+		value, err := strconv.Atoi(query.Get("before"))
+		if err != nil || value < 0 {
+			(*w).WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(*w, "before must be a positive integer")
+			return 0, 0, false
+		}
+		before = value
+	}
+
+	if query.Get("limit") != "" {
+		value, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || value < 1 || value > MaxConversationPageSize {
+			(*w).WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(*w, "limit must be an integer from 1 to %d", MaxConversationPageSize)
+			return 0, 0, false
+		}
+		limit = value
+	}
+
+	return before, limit, true
+}
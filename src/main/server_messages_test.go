@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMessages(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, messages: EmptyMessageStore()}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "berta", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "berta", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+
+	// Friends: arnau&sergi
+	// Requests: arnau->berta
+
+	RunSendMessageTest(t, server, "send message (wrong password)", "arnau", "wrongPass", "sergi", "hi!", http.StatusUnauthorized)
+	RunSendMessageTest(t, server, "send message (user does not exist)", "arnau", "12345678", "peter", "hi!", http.StatusBadRequest)
+	RunSendMessageTest(t, server, "send message (not friends)", "berta", "12345678", "sergi", "hi!", http.StatusForbidden)
+	RunSendMessageTest(t, server, "send message (pending request)", "arnau", "12345678", "berta", "hi!", http.StatusForbidden)
+	RunSendMessageTest(t, server, "send message (empty)", "arnau", "12345678", "sergi", "", http.StatusBadRequest)
+	RunSendMessageTest(t, server, "send message (too long)", "arnau", "12345678", "sergi", strings.Repeat("a", 1001), http.StatusBadRequest)
+
+	RunSendMessageTest(t, server, "send message", "arnau", "12345678", "sergi", "hi!", http.StatusOK)
+	RunSendMessageTest(t, server, "send message", "arnau", "12345678", "sergi", "how are you?", http.StatusOK)
+	RunSendMessageTest(t, server, "send message", "sergi", "12345678", "arnau", "fine", http.StatusOK)
+
+	RunGetUnreadCountsTest(t, server, "unread counts of sergi", "sergi", `{"arnau":2}`, http.StatusOK)
+	RunGetUnreadCountsTest(t, server, "unread counts of arnau", "arnau", `{"sergi":1}`, http.StatusOK)
+	RunGetUnreadCountsTest(t, server, "unread counts of berta", "berta", `{}`, http.StatusOK)
+
+	RunGetConversationTest(t, server, "conversation (not friends)", "berta", "sergi", "", nil, http.StatusForbidden)
+	RunGetConversationTest(t, server, "conversation (invalid limit)", "sergi", "arnau", "?limit=0", nil, http.StatusBadRequest)
+	RunGetConversationTest(t, server, "conversation (first page)", "sergi", "arnau", "?limit=2", []string{"fine", "how are you?"}, http.StatusOK)
+	RunGetConversationTest(t, server, "conversation (second page)", "sergi", "arnau", "?limit=2&before=2", []string{"hi!"}, http.StatusOK)
+	RunGetConversationTest(t, server, "conversation (whole)", "arnau", "sergi", "", []string{"fine", "how are you?", "hi!"}, http.StatusOK)
+
+	RunGetUnreadCountsTest(t, server, "unread counts of sergi after reading", "sergi", `{}`, http.StatusOK)
+	RunGetUnreadCountsTest(t, server, "unread counts of arnau after reading", "arnau", `{}`, http.StatusOK)
+}
+
+func RunSendMessageTest(t *testing.T, s *UsersServer, testName, user, password, userTo, message string, expectedHTTPStatus int) {
+	requestBody, err := json.Marshal(map[string]string{
+		"user":    user,
+		"pass":    password,
+		"userTo":  userTo,
+		"message": message,
+	})
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, "/sendMessage", bytes.NewBuffer(requestBody))
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); !ok {
+			t.Errorf("Got body: %q", response.Body.String())
+		}
+	})
+}
+
+func RunGetConversationTest(t *testing.T, s *UsersServer, testName, user, otherUser, query string, expectedBodies []string, expectedHTTPStatus int) {
+	request, _ := http.NewRequest(http.MethodGet, "/getConversation/"+otherUser+query, nil)
+	request.SetBasicAuth(user, "12345678")
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); !ok {
+			t.Errorf("Got body: %q", response.Body.String())
+			return
+		}
+
+		if expectedHTTPStatus == http.StatusOK {
+			var messages []Message
+			json.Unmarshal(response.Body.Bytes(), &messages)
+
+			bodies := make([]string, len(messages))
+			for i, message := range messages {
+				bodies[i] = message.Body
+			}
+			AssertResponseBody(t, strings.Join(bodies, "|"), strings.Join(expectedBodies, "|"))
+		}
+	})
+}
+
+func RunGetUnreadCountsTest(t *testing.T, s *UsersServer, testName, user, expectedBody string, expectedHTTPStatus int) {
+	request, _ := http.NewRequest(http.MethodGet, "/getUnreadCounts", nil)
+	request.SetBasicAuth(user, "12345678")
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		AssertStatus(t, response.Code, expectedHTTPStatus)
+		AssertResponseBody(t, response.Body.String(), expectedBody)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DefaultPasswordResetTTL is the time during which a password reset token can be used
+const DefaultPasswordResetTTL = 15 * time.Minute
+
+// ChangePassword takes a changePassword HTTP request (r) to the UsersServer (s), processes it and populates the
+// ResponseWriter (w). Open /events and /ws connections of the user are closed.
+func (s *UsersServer) ChangePassword(w *http.ResponseWriter, r *http.Request) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	pass := info["pass"]
+	newPass := info["newPass"]
+
+	// Check credentials
+	if err := s.CheckCredentials(r.Context(), user, pass); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	status, msg := s.changePassword(r.Context(), user, newPass)
+	if status == http.StatusOK {
+		s.RecordAudit(r, user, AuditPasswordChanged, user, nil)
+	}
+	WriteStatus(w, status, msg)
+}
+
+// RequestPasswordReset takes a requestPasswordReset HTTP request (r) to the UsersServer (s), processes it and
+// populates the ResponseWriter (w). If the user exists, a reset token is sent to them through the server's notifier.
+// In order not to reveal which users exist, the response is the same whether they exist or not.
+func (s *UsersServer) RequestPasswordReset(w *http.ResponseWriter, r *http.Request) {
+	if s.passwordResets == nil || s.notifier == nil {
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	exists, err := s.storeV2().UserExists(r.Context(), user)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+	if exists {
+		token, err := s.passwordResets.Issue(user)
+		if err == nil {
+			err = s.notifier.NotifyPasswordReset(user, token)
+		}
+		if err != nil {
+			log.Printf("could not send password reset token to %s: %v", user, err)
+			(*w).WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.RecordAudit(r, user, AuditPasswordResetRequested, user, nil)
+	}
+
+	(*w).WriteHeader(http.StatusOK)
+}
+
+// ResetPassword takes a resetPassword HTTP request (r) to the UsersServer (s), processes it and populates the
+// ResponseWriter (w). Open /events and /ws connections of the user are closed.
+func (s *UsersServer) ResetPassword(w *http.ResponseWriter, r *http.Request) {
+	if s.passwordResets == nil || s.notifier == nil {
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	token := info["token"]
+	newPass := info["newPass"]
+
+	// Check the new password before redeeming the token, so that the user can retry with the same token
+	if ok, msg := CheckUsernameAndPassword(user, newPass); !ok {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(*w, msg)
+		return
+	}
+
+	if !s.passwordResets.Redeem(user, token) {
+		(*w).WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(*w, "Invalid or expired reset token")
+		return
+	}
+
+	status, msg := s.changePassword(r.Context(), user, newPass)
+	if status == http.StatusOK {
+		s.RecordAudit(r, user, AuditPasswordReset, user, nil)
+	}
+	WriteStatus(w, status, msg)
+}
+
+// changePassword sets the password of user (who must have been authenticated already) to newPass, invalidating
+// their reset tokens and open connections. Returns the HTTP status and error message (empty if none)
+func (s *UsersServer) changePassword(ctx context.Context, user, newPass string) (int, string) {
+	if ok, msg := CheckUsernameAndPassword(user, newPass); !ok {
+		return http.StatusBadRequest, msg
+	}
+
+	if err := s.storeV2().ChangePassword(ctx, user, newPass); err != nil {
+		return GetStoreErrorStatus(err)
+	}
+
+	if s.passwordResets != nil {
+		s.passwordResets.Revoke(user)
+	}
+	s.events.CloseUser(user)
+	return http.StatusOK, ""
+}
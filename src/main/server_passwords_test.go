@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChangePassword(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, events: NewEventBus(100, 10)}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	stream := OpenEventStream(t, httpServer, "arnau", "12345678", "")
+
+	RunPostTest(t, server, "change password (wrong password)", "/changePassword",
+		map[string]string{"user": "arnau", "pass": "wrongPass", "newPass": "newPassword"}, http.StatusUnauthorized)
+	RunPostTest(t, server, "change password (new password too short)", "/changePassword",
+		map[string]string{"user": "arnau", "pass": "12345678", "newPass": "1234"}, http.StatusBadRequest)
+	RunPostTest(t, server, "change password (new password not alphanumeric)", "/changePassword",
+		map[string]string{"user": "arnau", "pass": "12345678", "newPass": "p@ssw0rd!"}, http.StatusBadRequest)
+	RunPostTest(t, server, "change password", "/changePassword",
+		map[string]string{"user": "arnau", "pass": "12345678", "newPass": "newPassword"}, http.StatusOK)
+
+	t.Run("open connections are closed", func(t *testing.T) {
+		select {
+		case line, ok := <-stream:
+			if ok {
+				t.Errorf("got line %q, want stream to be closed", line)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for the stream to be closed")
+		}
+	})
+
+	RunFriendshipRequestTest(t, server, "old password is no longer valid", "arnau", "sergi", "12345678", http.StatusUnauthorized)
+	RunFriendshipRequestTest(t, server, "new password is valid", "arnau", "sergi", "newPassword", http.StatusOK)
+}
+
+func TestResetPassword(t *testing.T) {
+	notifications := filepath.Join(t.TempDir(), "notifications.jsonl")
+	store := EmptyUsersStore()
+	server := &UsersServer{
+		store:          store,
+		passwordResets: NewPasswordResetTokens(time.Minute),
+		notifier:       &FileNotifier{Path: notifications},
+	}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+
+	RunPostTest(t, server, "request reset (user does not exist)", "/requestPasswordReset",
+		map[string]string{"user": "peter"}, http.StatusOK)
+	RunPostTest(t, server, "request reset", "/requestPasswordReset",
+		map[string]string{"user": "arnau"}, http.StatusOK)
+	token := ReadLastResetToken(t, notifications, "arnau")
+
+	RunPostTest(t, server, "reset password (wrong token)", "/resetPassword",
+		map[string]string{"user": "arnau", "token": "0123456789abcdef", "newPass": "newPassword"}, http.StatusUnauthorized)
+	RunPostTest(t, server, "reset password (token of another user)", "/resetPassword",
+		map[string]string{"user": "sergi", "token": token, "newPass": "newPassword"}, http.StatusUnauthorized)
+	RunPostTest(t, server, "reset password (invalid new password)", "/resetPassword",
+		map[string]string{"user": "arnau", "token": token, "newPass": "short"}, http.StatusBadRequest)
+	RunPostTest(t, server, "reset password", "/resetPassword",
+		map[string]string{"user": "arnau", "token": token, "newPass": "newPassword"}, http.StatusOK)
+	RunPostTest(t, server, "reset password (token already used)", "/resetPassword",
+		map[string]string{"user": "arnau", "token": token, "newPass": "otherPass"}, http.StatusUnauthorized)
+
+	RunFriendshipRequestTest(t, server, "new password is valid", "arnau", "sergi", "newPassword", http.StatusOK)
+
+	// A password change invalidates pending reset tokens
+	RunPostTest(t, server, "request reset", "/requestPasswordReset",
+		map[string]string{"user": "arnau"}, http.StatusOK)
+	token = ReadLastResetToken(t, notifications, "arnau")
+	RunPostTest(t, server, "change password", "/changePassword",
+		map[string]string{"user": "arnau", "pass": "newPassword", "newPass": "12345678"}, http.StatusOK)
+	RunPostTest(t, server, "reset password (token revoked by password change)", "/resetPassword",
+		map[string]string{"user": "arnau", "token": token, "newPass": "otherPass"}, http.StatusUnauthorized)
+
+	// So does deleting the account
+	RunPostTest(t, server, "request reset", "/requestPasswordReset",
+		map[string]string{"user": "arnau"}, http.StatusOK)
+	token = ReadLastResetToken(t, notifications, "arnau")
+	RunPostTest(t, server, "delete account", "/deleteAccount",
+		map[string]string{"user": "arnau", "pass": "12345678"}, http.StatusOK)
+	RunPostTest(t, server, "restore account", "/restoreAccount",
+		map[string]string{"user": "arnau", "pass": "12345678"}, http.StatusOK)
+	RunPostTest(t, server, "reset password (token revoked by account deletion)", "/resetPassword",
+		map[string]string{"user": "arnau", "token": token, "newPass": "otherPass"}, http.StatusUnauthorized)
+}
+
+func TestResetPasswordExpiredToken(t *testing.T) {
+	notifications := filepath.Join(t.TempDir(), "notifications.jsonl")
+	store := EmptyUsersStore()
+	server := &UsersServer{
+		store:          store,
+		passwordResets: NewPasswordResetTokens(time.Millisecond),
+		notifier:       &FileNotifier{Path: notifications},
+	}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunPostTest(t, server, "request reset", "/requestPasswordReset",
+		map[string]string{"user": "arnau"}, http.StatusOK)
+	token := ReadLastResetToken(t, notifications, "arnau")
+
+	time.Sleep(2 * time.Millisecond)
+	RunPostTest(t, server, "reset password (token expired)", "/resetPassword",
+		map[string]string{"user": "arnau", "token": token, "newPass": "newPassword"}, http.StatusUnauthorized)
+}
+
+func RunPostTest(t *testing.T, s *UsersServer, testName, url string, body map[string]string, expectedHTTPStatus int) {
+	requestBody, err := json.Marshal(body)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(requestBody))
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); !ok {
+			t.Errorf("Got body: %q", response.Body.String())
+		}
+	})
+}
+
+// ReadLastResetToken returns the last password reset token sent to user by a FileNotifier writing to path
+func ReadLastResetToken(t *testing.T, path, user string) string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	token := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var notification FileNotification
+		json.Unmarshal(scanner.Bytes(), &notification)
+		if notification.Type == "passwordReset" && notification.User == user {
+			token = notification.Token
+		}
+	}
+
+	if token == "" {
+		t.Fatalf("no reset token was sent to %s", user)
+	}
+	return token
+}
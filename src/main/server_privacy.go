@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// PrivacySettings takes a privacySettings HTTP request (r) to the UsersServer (s), processes it and populates the
+// ResponseWriter (w). GET /privacySettings returns the privacy settings of the authenticated user and
+// PATCH /privacySettings modifies them
+func (s *UsersServer) PrivacySettings(w *http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.GetPrivacySettings(w, r)
+	case http.MethodPatch:
+		s.UpdatePrivacySettings(w, r)
+	default:
+		(*w).WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// GetPrivacySettings takes a GET privacySettings HTTP request (r) to the UsersServer (s), processes it and populates
+// the ResponseWriter (w) with the privacy settings of the user, who must authenticate using HTTP basic authentication
+func (s *UsersServer) GetPrivacySettings(w *http.ResponseWriter, r *http.Request) {
+	user, err := s.GetAuthenticatedUser(r)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	s.writePrivacySettings(w, r, user)
+}
+
+// UpdatePrivacySettings takes a PATCH privacySettings HTTP request (r) to the UsersServer (s), processes it and
+// populates the ResponseWriter (w) with the updated privacy settings
+func (s *UsersServer) UpdatePrivacySettings(w *http.ResponseWriter, r *http.Request) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	user := info["user"]
+	pass := info["pass"]
+
+	// Check credentials
+	if err := s.CheckCredentials(r.Context(), user, pass); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	update := PrivacySettingsUpdate{}
+	if friendsVisibility, ok := info["friendsVisibility"]; ok {
+		update.FriendsVisibility = &friendsVisibility
+	}
+	if friendshipRequests, ok := info["friendshipRequests"]; ok {
+		update.FriendshipRequests = &friendshipRequests
+	}
+
+	if ok, msg := CheckPrivacySettingsUpdate(update); !ok {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(*w, msg)
+		return
+	}
+
+	if err := s.storeV2().UpdatePrivacySettings(r.Context(), user, update); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	s.RecordAudit(r, user, AuditPrivacySettingsUpdated, user, nil)
+
+	s.writePrivacySettings(w, r, user)
+}
+
+// writePrivacySettings populates the ResponseWriter (w) with the privacy settings of user, read for request r
+func (s *UsersServer) writePrivacySettings(w *http.ResponseWriter, r *http.Request, user string) {
+	settings, err := s.storeV2().GetPrivacySettings(r.Context(), user)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, settings)
+}
+
+// canSeeFriends returns true iff viewer (empty if anonymous) can see the friends list of user according to user's
+// privacy settings. Users can always see their own friends list
+func (s *UsersServer) canSeeFriends(ctx context.Context, viewer, user string) (bool, error) {
+	if viewer == user {
+		return true, nil
+	}
+
+	settings, err := s.storeV2().GetPrivacySettings(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	switch settings.FriendsVisibility {
+	case FriendsVisibleToEveryone:
+		return true, nil
+	case FriendsVisibleToFriends:
+		if viewer == "" {
+			return false, nil
+		}
+		return s.storeV2().AreFriends(ctx, user, viewer)
+	}
+	return false, nil
+}
+
+// canRequestFriendship returns true iff user can send a friendship request to userTo according to userTo's privacy
+// settings
+func (s *UsersServer) canRequestFriendship(ctx context.Context, user, userTo string) (bool, error) {
+	settings, err := s.storeV2().GetPrivacySettings(ctx, userTo)
+	if err != nil {
+		return false, err
+	}
+	switch settings.FriendshipRequests {
+	case RequestsFromEveryone:
+		return true, nil
+	case RequestsFromFriendsOfFriends:
+		return s.storeV2().HaveCommonFriend(ctx, user, userTo)
+	}
+	return false, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFriendsVisibility(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "berta", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+
+	// Friends: arnau&sergi
+
+	RunGetPrivacySettingsTest(t, server, "get privacy settings (wrong password)", "arnau", "wrongPass", "", http.StatusUnauthorized)
+	RunGetPrivacySettingsTest(t, server, "get default privacy settings", "arnau", "12345678",
+		`{"friendsVisibility":"everyone","friendshipRequests":"everyone"}`, http.StatusOK)
+	RunUpdatePrivacySettingsTest(t, server, "update privacy settings (wrong password)", "arnau", "wrongPass",
+		map[string]string{"friendsVisibility": "friends"}, http.StatusUnauthorized)
+	RunUpdatePrivacySettingsTest(t, server, "update privacy settings (invalid value)", "arnau", "12345678",
+		map[string]string{"friendsVisibility": "nobody"}, http.StatusBadRequest)
+
+	RunListFriendsAs(t, server, "public friends list (anonymous)", "", "", "arnau", "[sergi]", http.StatusOK)
+	RunListFriendsAs(t, server, "get friends (wrong password)", "berta", "wrongPass", "arnau", "", http.StatusUnauthorized)
+
+	RunUpdatePrivacySettingsTest(t, server, "friends list visible to friends", "arnau", "12345678",
+		map[string]string{"friendsVisibility": "friends"}, http.StatusOK)
+	RunListFriendsAs(t, server, "friends-only list (anonymous)", "", "", "arnau", "", http.StatusForbidden)
+	RunListFriendsAs(t, server, "friends-only list (not a friend)", "berta", "12345678", "arnau", "", http.StatusForbidden)
+	RunListFriendsAs(t, server, "friends-only list (friend)", "sergi", "12345678", "arnau", "[sergi]", http.StatusOK)
+	RunListFriendsAs(t, server, "friends-only list (own)", "arnau", "12345678", "arnau", "[sergi]", http.StatusOK)
+
+	RunUpdatePrivacySettingsTest(t, server, "friends list visible to me only", "arnau", "12345678",
+		map[string]string{"friendsVisibility": "me"}, http.StatusOK)
+	RunListFriendsAs(t, server, "private list (friend)", "sergi", "12345678", "arnau", "", http.StatusForbidden)
+	RunListFriendsAs(t, server, "private list (own)", "arnau", "12345678", "arnau", "[sergi]", http.StatusOK)
+	RunGetPrivacySettingsTest(t, server, "other settings are unchanged", "arnau", "12345678",
+		`{"friendsVisibility":"me","friendshipRequests":"everyone"}`, http.StatusOK)
+}
+
+func TestFriendshipRequestsPolicy(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "berta", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "marta", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "berta", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "berta", "12345678", true, http.StatusOK)
+
+	// Friends: arnau&sergi; berta&sergi
+
+	RunUpdatePrivacySettingsTest(t, server, "requests from friends of friends", "arnau", "12345678",
+		map[string]string{"friendshipRequests": "friendsOfFriends"}, http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship (no friends in common)", "marta", "arnau", "12345678", http.StatusForbidden)
+	RunFriendshipRequestTest(t, server, "request friendship (friend of a friend)", "berta", "arnau", "12345678", http.StatusOK)
+
+	RunUpdatePrivacySettingsTest(t, server, "requests from nobody", "sergi", "12345678",
+		map[string]string{"friendshipRequests": "nobody"}, http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship (nobody)", "marta", "sergi", "12345678", http.StatusForbidden)
+	RunFriendshipRequestTest(t, server, "request friendship (everyone)", "sergi", "marta", "12345678", http.StatusOK)
+}
+
+func RunGetPrivacySettingsTest(t *testing.T, s *UsersServer, testName, user, password, expectedBody string, expectedHTTPStatus int) {
+	request, _ := http.NewRequest(http.MethodGet, "/privacySettings", nil)
+	request.SetBasicAuth(user, password)
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); ok && expectedHTTPStatus == http.StatusOK {
+			AssertResponseBody(t, response.Body.String(), expectedBody)
+		}
+	})
+}
+
+func RunUpdatePrivacySettingsTest(t *testing.T, s *UsersServer, testName, user, password string, fields map[string]string, expectedHTTPStatus int) {
+	body := map[string]string{"user": user, "pass": password}
+	for field, value := range fields {
+		body[field] = value
+	}
+
+	requestBody, _ := json.Marshal(body)
+	request, _ := http.NewRequest(http.MethodPatch, "/privacySettings", bytes.NewBuffer(requestBody))
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); !ok {
+			t.Errorf("Got body: %q", response.Body.String())
+		}
+	})
+}
+
+// RunListFriendsAs lists the friends of user authenticated as viewer, or anonymously if viewer is empty
+func RunListFriendsAs(t *testing.T, s *UsersServer, testName, viewer, password, user, expectedBody string, expectedHTTPStatus int) {
+	request, _ := http.NewRequest(http.MethodGet, "/getFriends/"+user, nil)
+	if viewer != "" {
+		request.SetBasicAuth(viewer, password)
+	}
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); ok && expectedHTTPStatus == http.StatusOK {
+			AssertResponseBody(t, response.Body.String(), expectedBody)
+		}
+	})
+}
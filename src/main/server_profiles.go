@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Profile takes a profile HTTP request (r) to the UsersServer (s), processes it and populates the ResponseWriter (w).
+// GET /profile/<user> returns the profile of user and PATCH /profile/<user> modifies it
+func (s *UsersServer) Profile(w *http.ResponseWriter, r *http.Request) {
+	path := strings.Split(r.URL.Path, "/")
+	if len(path) < 3 || path[2] == "" {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(*w, "Missing user")
+		return
+	}
+	user, err := s.resolvePathUser(r, path[2])
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.GetProfile(w, r, user)
+	case http.MethodPatch:
+		s.UpdateProfile(w, r, user)
+	default:
+		(*w).WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// GetProfile populates the ResponseWriter (w) with the profile of user, read for request r
+func (s *UsersServer) GetProfile(w *http.ResponseWriter, r *http.Request, user string) {
+	profile, err := s.storeV2().GetProfile(r.Context(), user)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, profile)
+}
+
+// UpdateProfile takes a PATCH profile HTTP request (r) to the UsersServer (s) which modifies the profile of user,
+// processes it and populates the ResponseWriter (w) with the updated profile
+func (s *UsersServer) UpdateProfile(w *http.ResponseWriter, r *http.Request, user string) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	// Check credentials
+	if err := s.CheckCredentials(r.Context(), info["user"], info["pass"]); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	if info["user"] != user {
+		(*w).WriteHeader(http.StatusForbidden)
+		fmt.Fprint(*w, "Users can only modify their own profile")
+		return
+	}
+
+	update := ProfileUpdate{}
+	if displayName, ok := info["displayName"]; ok {
+		update.DisplayName = &displayName
+	}
+	if bio, ok := info["bio"]; ok {
+		update.Bio = &bio
+	}
+	if avatarURL, ok := info["avatarUrl"]; ok {
+		update.AvatarURL = &avatarURL
+	}
+
+	if ok, msg := CheckProfileUpdate(update); !ok {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(*w, msg)
+		return
+	}
+
+	if err := s.storeV2().UpdateProfile(r.Context(), user, update); err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	s.RecordAudit(r, user, AuditProfileUpdated, user, nil)
+
+	s.GetProfile(w, r, user)
+}
+
+// writeProfileSummaries populates the ResponseWriter (w) with the profile summaries of users, read for request r,
+// skipping users which do not exist
+func (s *UsersServer) writeProfileSummaries(w *http.ResponseWriter, r *http.Request, users []string) {
+	summaries := make([]ProfileSummary, 0, len(users))
+	for _, user := range users {
+		profile, err := s.storeV2().GetProfile(r.Context(), user)
+		if errors.Is(err, ErrNotFound) {
+			continue // deleted since listed
+		}
+		if err != nil {
+			WriteStoreError(w, err)
+			return
+		}
+		summaries = append(summaries, profile.Summary())
+	}
+	WriteJSON(w, http.StatusOK, summaries)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	arnauID, _ := store.GetUserID("arnau")
+	sergiID, _ := store.GetUserID("sergi")
+
+	RunGetProfileTest(t, server, "get profile (user does not exist)", "peter", Profile{}, http.StatusBadRequest)
+	RunGetProfileTest(t, server, "get profile of a new user", "arnau", Profile{ID: arnauID, User: "arnau"}, http.StatusOK)
+
+	RunUpdateProfileTest(t, server, "update profile (wrong password)", "arnau", "arnau", "wrongPass",
+		map[string]string{"bio": "Hi!"}, http.StatusUnauthorized)
+	RunUpdateProfileTest(t, server, "update profile (someone else's)", "sergi", "arnau", "12345678",
+		map[string]string{"bio": "Hi!"}, http.StatusForbidden)
+	RunUpdateProfileTest(t, server, "update profile (display name too long)", "arnau", "arnau", "12345678",
+		map[string]string{"displayName": strings.Repeat("a", 51)}, http.StatusBadRequest)
+	RunUpdateProfileTest(t, server, "update profile (bio too long)", "arnau", "arnau", "12345678",
+		map[string]string{"bio": strings.Repeat("ñ", 281)}, http.StatusBadRequest)
+	RunUpdateProfileTest(t, server, "update profile (avatar is not a URL)", "arnau", "arnau", "12345678",
+		map[string]string{"avatarUrl": "avatar.png"}, http.StatusBadRequest)
+	RunUpdateProfileTest(t, server, "update profile (avatar URL too long)", "arnau", "arnau", "12345678",
+		map[string]string{"avatarUrl": "https://example.com/" + strings.Repeat("a", 2048)}, http.StatusBadRequest)
+
+	RunUpdateProfileTest(t, server, "update profile", "arnau", "arnau", "12345678",
+		map[string]string{"displayName": "Arnau", "bio": strings.Repeat("ñ", 280), "avatarUrl": "https://example.com/a.png"}, http.StatusOK)
+	RunUpdateProfileTest(t, server, "update profile (only bio)", "arnau", "arnau", "12345678",
+		map[string]string{"bio": "Hi!"}, http.StatusOK)
+	RunGetProfileTest(t, server, "get updated profile", "arnau",
+		Profile{ID: arnauID, User: "arnau", DisplayName: "Arnau", Bio: "Hi!", AvatarURL: "https://example.com/a.png"}, http.StatusOK)
+
+	t.Run("last seen is updated when user authenticates", func(t *testing.T) {
+		profile, _ := store.GetProfile("arnau")
+		if !profile.LastSeen.After(profile.CreatedAt) {
+			t.Errorf("got last seen %v, want after %v", profile.LastSeen, profile.CreatedAt)
+		}
+	})
+
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+
+	RunTestWithBody(t, server, "list users with profiles", "/getUsers?profiles=1",
+		`[{"id":"`+arnauID+`","user":"arnau","displayName":"Arnau","avatarUrl":"https://example.com/a.png"},{"id":"`+sergiID+`","user":"sergi","displayName":"","avatarUrl":""}]`)
+	RunTestWithBody(t, server, "list friends with profiles", "/getFriends/sergi?profiles=1",
+		`[{"id":"`+arnauID+`","user":"arnau","displayName":"Arnau","avatarUrl":"https://example.com/a.png"}]`)
+	RunListFriends(t, server, "list friends without profiles", "sergi", "[arnau]", http.StatusOK)
+}
+
+func RunGetProfileTest(t *testing.T, s *UsersServer, testName, user string, expectedProfile Profile, expectedHTTPStatus int) {
+	request, _ := http.NewRequest(http.MethodGet, "/profile/"+user, nil)
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); !ok || expectedHTTPStatus != http.StatusOK {
+			return
+		}
+
+		var got Profile
+		json.Unmarshal(response.Body.Bytes(), &got)
+		if got.CreatedAt.IsZero() || got.LastSeen.IsZero() {
+			t.Errorf("profile should have created at and last seen times, got %+v", got)
+		}
+
+		got.CreatedAt, got.LastSeen = expectedProfile.CreatedAt, expectedProfile.LastSeen
+		if got != expectedProfile {
+			t.Errorf("got profile %+v, want %+v", got, expectedProfile)
+		}
+	})
+}
+
+func RunUpdateProfileTest(t *testing.T, s *UsersServer, testName, user, profileUser, password string, fields map[string]string, expectedHTTPStatus int) {
+	body := map[string]string{"user": user, "pass": password}
+	for field, value := range fields {
+		body[field] = value
+	}
+
+	requestBody, _ := json.Marshal(body)
+	request, _ := http.NewRequest(http.MethodPatch, "/profile/"+profileUser, bytes.NewBuffer(requestBody))
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); !ok {
+			t.Errorf("Got body: %q", response.Body.String())
+		}
+	})
+}
+
+func RunTestWithBody(t *testing.T, s *UsersServer, testName, url, expectedBody string) {
+	request, _ := http.NewRequest(http.MethodGet, url, nil)
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		AssertStatus(t, response.Code, http.StatusOK)
+		AssertResponseBody(t, response.Body.String(), expectedBody)
+	})
+}
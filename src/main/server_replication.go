@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Replication takes a replication HTTP request (r) to the UsersServer (s), processes it and populates the
+// ResponseWriter (w). The operation is given by the second element of the path:
+// - GET /replication/status returns the replication status of the server (see ReplicationStatus)
+// - GET /replication/log?after=<seq> streams the log of a primary from entry after+1 (admin)
+// - GET /replication/snapshot returns a snapshot of the store of a primary from which replicas can follow its log
+// (admin; see ReplicationSnapshot)
+func (s *UsersServer) Replication(w *http.ResponseWriter, r *http.Request) {
+	path := strings.Split(r.URL.Path, "/")
+	operation := ""
+	if len(path) > 2 {
+		operation = path[2]
+	}
+
+	switch {
+	case operation == "status" && (s.replica != nil || s.replicationLog != nil):
+	case operation == "log" && s.replicationLog != nil:
+	case operation == "snapshot" && s.replicationLog != nil:
+	default:
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		(*w).WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch operation {
+	case "status":
+		s.GetReplicationStatus(w, r)
+	case "snapshot":
+		s.RequireRole(RoleAdmin, s.GetReplicationSnapshot)(w, r)
+	default:
+		s.RequireRole(RoleAdmin, s.StreamReplicationLog)(w, r)
+	}
+}
+
+// GetReplicationStatus populates the ResponseWriter (w) with the replication status of the server: its lag if it is
+// a replica, or the head of its log if it is a primary
+func (s *UsersServer) GetReplicationStatus(w *http.ResponseWriter, r *http.Request) {
+	if s.replica != nil {
+		WriteJSON(w, http.StatusOK, s.replica.Status())
+		return
+	}
+
+	head := s.replicationLog.Head()
+	WriteJSON(w, http.StatusOK, ReplicationStatus{Role: "primary", LogID: s.replicationLog.ID, Head: head, Applied: head})
+}
+
+// GetReplicationSnapshot populates the ResponseWriter (w) with a snapshot of the checkpoint of the log (see
+// MutationLog.Snapshot), from which replicas which can't read the log from the entry they need can start
+func (s *UsersServer) GetReplicationSnapshot(w *http.ResponseWriter, r *http.Request, actor string) {
+	snapshot, seq := s.replicationLog.Snapshot()
+	(*w).Header().Set(ReplicationLogIDHeader, s.replicationLog.ID)
+	WriteJSON(w, http.StatusOK, ReplicationSnapshot{LogID: s.replicationLog.ID, Seq: seq, Store: snapshot})
+}
+
+// StreamReplicationLog streams the entries of the log which follow the one given by the after query parameter (0
+// by default) as JSON lines (see ReplicationMessage), and then the ones appended, until the client disconnects.
+// A heartbeat is sent when there are no entries to send, first right away and then every heartbeat interval.
+// If the entry which follows after was dropped (see MutationLog.Tail) 410 Gone is returned, or the stream ends if
+// it is dropped while streaming, and the client must start from a snapshot (see GetReplicationSnapshot)
+func (s *UsersServer) StreamReplicationLog(w *http.ResponseWriter, r *http.Request, actor string) {
+	(*w).Header().Set(ReplicationLogIDHeader, s.replicationLog.ID)
+
+	after := uint64(0)
+	if value := r.URL.Query().Get("after"); value != "" {
+		var err error
+		if after, err = strconv.ParseUint(value, 10, 64); err != nil {
+			(*w).WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(*w, "after must be a sequence number")
+			return
+		}
+	}
+	if after > s.replicationLog.Head() {
+		(*w).WriteHeader(http.StatusConflict)
+		fmt.Fprint(*w, "after is ahead of the log")
+		return
+	}
+	if after < s.replicationLog.Tail() {
+		(*w).WriteHeader(http.StatusGone)
+		fmt.Fprint(*w, "after is behind the log, start from /replication/snapshot")
+		return
+	}
+
+	flusher, ok := (*w).(http.Flusher)
+	if !ok {
+		(*w).WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(*w, "Streaming is not supported")
+		return
+	}
+
+	(*w).Header().Set("Content-Type", "application/x-ndjson")
+	(*w).Header().Set("Cache-Control", "no-cache")
+	(*w).WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(*w)
+	heartbeat := time.NewTicker(s.getHeartbeatInterval())
+	defer heartbeat.Stop()
+	for {
+		entries, head, changed := s.replicationLog.Read(after)
+		if len(entries) == 0 && after < head {
+			return // the entry which follows after was dropped
+		}
+		if len(entries) == 0 {
+			if encoder.Encode(ReplicationMessage{Head: head}) != nil {
+				return
+			}
+		}
+		for i := range entries {
+			if encoder.Encode(ReplicationMessage{Entry: &entries[i], Head: head}) != nil {
+				return
+			}
+		}
+		after += uint64(len(entries))
+		flusher.Flush()
+		if after < head {
+			continue // more than MaxMutationLogRead entries to send
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-heartbeat.C:
+		}
+	}
+}
+
+// IsServedByReplicas returns true iff request r is served by replicas, instead of being redirected to the primary:
+// reads of users and friends, and the replication status
+func IsServedByReplicas(r *http.Request) bool {
+	switch strings.Split(r.URL.Path, "/")[1] {
+	case "getUsers", "getFriends", "replication":
+		return r.Method == http.MethodGet
+	default:
+		return false
+	}
+}
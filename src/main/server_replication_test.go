@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReplicatedUsersStore runs random operations on a ReplicatedUsersStore and applies its log to an
+// InMemoryUsersStore, which must end up in the same state (with the same versions)
+func TestReplicatedUsersStore(t *testing.T) {
+	log := NewMutationLog()
+	primary, replica := NewReplicatedUsersStore(NewShardedUsersStore(4), log), EmptyUsersStore()
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		if random.Intn(100) == 0 {
+			primary.PurgeDeletedUsers(time.Now())
+		} else {
+			RunRandomStoreOperation(primary, random.Int63())
+		}
+	}
+
+	entries, head, _ := log.Read(0)
+	for after := uint64(len(entries)); after < head; after = uint64(len(entries)) {
+		more, _, _ := log.Read(after)
+		entries = append(entries, more...)
+	}
+	for i, entry := range entries {
+		if entry.Seq != uint64(i)+1 {
+			t.Fatalf("got entry %d at position %d", entry.Seq, i)
+		}
+		if !ApplyMutation(replica, entry) {
+			t.Fatalf("could not apply entry %d (%s %s)", entry.Seq, entry.Op, entry.User)
+		}
+	}
+
+	AssertResponseBody(t, fmt.Sprint(replica.GetUsers()), fmt.Sprint(primary.GetUsers()))
+	for u := 0; u < 20; u++ {
+		user := fmt.Sprintf("u%02d", u)
+		if got, want := GetUserState(replica, user), GetUserState(primary, user); got != want {
+			t.Errorf("%s: got %s, want %s", user, got, want)
+		}
+		gotVersions, _ := replica.GetVersions(user)
+		wantVersions, _ := primary.GetVersions(user)
+		if gotVersions != wantVersions {
+			t.Errorf("%s: got versions %+v, want %+v", user, gotVersions, wantVersions)
+		}
+	}
+}
+
+// TestBoundedMutationLog runs random operations on a ReplicatedUsersStore with a bounded log, and loads the snapshot
+// of the log into an InMemoryUsersStore and applies the entries which were not dropped, which must end up in the
+// same state (with the same versions)
+func TestBoundedMutationLog(t *testing.T) {
+	log := NewBoundedMutationLog(50)
+	primary := NewReplicatedUsersStore(NewShardedUsersStore(4), log)
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		RunRandomStoreOperation(primary, random.Int63())
+	}
+
+	snapshot, tail := log.Snapshot()
+	t.Run("log keeps its last entries", func(t *testing.T) {
+		AssertResponseBody(t, fmt.Sprint(log.Head()-tail), "50")
+		if entries, _, _ := log.Read(0); len(entries) != 0 {
+			t.Errorf("got %d dropped entries", len(entries))
+		}
+	})
+
+	// The snapshot goes through JSON, like in /replication/snapshot
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	var decoded UsersStoreSnapshot
+	if err := json.NewDecoder(&body).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	replica := EmptyUsersStore()
+	replica.LoadSnapshot(decoded)
+	entries, head, _ := log.Read(tail)
+	for _, entry := range entries {
+		if !ApplyMutation(replica, entry) {
+			t.Fatalf("could not apply entry %d (%s %s)", entry.Seq, entry.Op, entry.User)
+		}
+	}
+	AssertResponseBody(t, fmt.Sprint(tail+uint64(len(entries))), fmt.Sprint(head))
+
+	// The replica goes on like the primary, eg restoring the users deleted in the snapshot
+	for i := 0; i < 1000; i++ {
+		seed := random.Int63()
+		operation, want := RunRandomStoreOperation(primary, seed)
+		if _, got := RunRandomStoreOperation(replica, seed); got != want {
+			t.Fatalf("%s after the snapshot: got %s, want %s", operation, got, want)
+		}
+	}
+	AssertResponseBody(t, fmt.Sprint(replica.GetUsers()), fmt.Sprint(primary.GetUsers()))
+	for u := 0; u < 20; u++ {
+		user := fmt.Sprintf("u%02d", u)
+		if got, want := GetUserState(replica, user), GetUserState(primary, user); got != want {
+			t.Errorf("%s: got %s, want %s", user, got, want)
+		}
+		gotVersions, _ := replica.GetVersions(user)
+		wantVersions, _ := primary.GetVersions(user)
+		if gotVersions != wantVersions {
+			t.Errorf("%s: got versions %+v, want %+v", user, gotVersions, wantVersions)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	replicationLog := NewMutationLog()
+	primary := &UsersServer{
+		store:             NewReplicatedUsersStore(EmptyUsersStore(), replicationLog),
+		replicationLog:    replicationLog,
+		adminToken:        "secret",
+		heartbeatInterval: 10 * time.Millisecond,
+	}
+	primaryServer := httptest.NewServer(primary)
+	defer primaryServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replicaServers := make([]*httptest.Server, 3)
+	for i := range replicaServers {
+		replica := NewReplica(primaryServer.URL, "secret", EmptyUsersStore())
+		replica.RetryInterval = 10 * time.Millisecond
+		go replica.Run(ctx)
+		replicaServers[i] = httptest.NewServer(&UsersServer{store: replica.store, replica: replica})
+		defer replicaServers[i].Close()
+	}
+
+	for _, user := range []string{"arnau", "sergi", "berta"} {
+		RunHTTPTest(t, "sign up a new user", http.MethodPost, primaryServer.URL+"/signUp",
+			`{"user": "`+user+`", "pass": "12345678"}`, http.StatusOK)
+	}
+	RunHTTPTest(t, "request friendship", http.MethodPost, primaryServer.URL+"/requestFriendship",
+		`{"user": "sergi", "userTo": "arnau", "pass": "12345678"}`, http.StatusOK)
+	RunHTTPTest(t, "respond to friendship request", http.MethodPost, primaryServer.URL+"/respondToFriendshipRequest",
+		`{"user": "arnau", "otherUser": "sergi", "pass": "12345678", "acceptRequest": "1"}`, http.StatusOK)
+	RunHTTPTest(t, "request friendship", http.MethodPost, primaryServer.URL+"/requestFriendship",
+		`{"user": "berta", "userTo": "arnau", "pass": "12345678"}`, http.StatusOK)
+
+	primaryStatus := GetReplicationStatusTest(t, primaryServer.URL)
+	t.Run("primary reports its log", func(t *testing.T) {
+		AssertResponseBody(t, primaryStatus.Role, "primary")
+		AssertResponseBody(t, primaryStatus.LogID, replicationLog.ID)
+		AssertResponseBody(t, fmt.Sprint(primaryStatus.Head), "6")
+	})
+
+	users := RunHTTPTest(t, "get users", http.MethodGet, primaryServer.URL+"/getUsers", "", http.StatusOK)
+	friends := RunHTTPTest(t, "get friends", http.MethodGet, primaryServer.URL+"/getFriends/arnau", "", http.StatusOK)
+	for i, replicaServer := range replicaServers {
+		t.Run(fmt.Sprintf("replica %d", i), func(t *testing.T) {
+			status := WaitForReplica(t, replicaServer.URL, primaryStatus.Head)
+			t.Run("replica reports no lag", func(t *testing.T) {
+				AssertResponseBody(t, fmt.Sprintf("%s %s %t %d %d %d %g", status.Role, status.LogID, status.Connected,
+					status.Head, status.Applied, status.LagEntries, status.LagSeconds),
+					fmt.Sprintf("replica %s true 6 6 0 0", replicationLog.ID))
+			})
+
+			replicaUsers := RunHTTPTest(t, "get users", http.MethodGet, replicaServer.URL+"/getUsers", "", http.StatusOK)
+			replicaFriends := RunHTTPTest(t, "get friends", http.MethodGet, replicaServer.URL+"/getFriends/arnau", "",
+				http.StatusOK)
+			t.Run("replica serves the reads of the primary", func(t *testing.T) {
+				AssertResponseBody(t, replicaUsers.body, users.body)
+				AssertResponseBody(t, replicaFriends.body, friends.body)
+				AssertResponseBody(t, replicaFriends.Header.Get("ETag"), friends.Header.Get("ETag"))
+			})
+
+			response := RunHTTPTest(t, "write to a replica", http.MethodPost, replicaServer.URL+"/requestFriendship",
+				`{"user": "arnau", "userTo": "berta", "pass": "12345678"}`, http.StatusTemporaryRedirect)
+			t.Run("writes are redirected to the primary", func(t *testing.T) {
+				AssertResponseBody(t, response.Header.Get("Location"), primaryServer.URL+"/requestFriendship")
+			})
+			RunHTTPTest(t, "read not served by replicas", http.MethodGet,
+				replicaServer.URL+"/lookupUser?user=arnau", "", http.StatusTemporaryRedirect)
+			RunHTTPTest(t, "log of a replica", http.MethodGet, replicaServer.URL+"/replication/log", "",
+				http.StatusNotFound)
+		})
+	}
+
+	// Clients which follow redirects write through replicas
+	request, _ := http.NewRequest(http.MethodPost, replicaServers[0].URL+"/signUp",
+		strings.NewReader(`{"user": "marta", "pass": "12345678"}`))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	t.Run("sign up through a replica", func(t *testing.T) {
+		AssertStatus(t, response.StatusCode, http.StatusOK)
+		if !primary.store.UserExists("marta") {
+			t.Error("user was not added to the primary")
+		}
+	})
+	for _, replicaServer := range replicaServers {
+		WaitForReplica(t, replicaServer.URL, replicationLog.Head())
+		RunHTTPTest(t, "get friends of replicated user", http.MethodGet, replicaServer.URL+"/getFriends/marta", "",
+			http.StatusOK)
+	}
+
+	RunHTTPTest(t, "log without token", http.MethodGet, primaryServer.URL+"/replication/log", "",
+		http.StatusUnauthorized)
+	server := httptest.NewServer(&UsersServer{store: EmptyUsersStore()})
+	defer server.Close()
+	RunHTTPTest(t, "status of a server without replication", http.MethodGet, server.URL+"/replication/status", "",
+		http.StatusNotFound)
+}
+
+func TestReplicaReconnects(t *testing.T) {
+	replicationLog := NewMutationLog()
+	store := NewReplicatedUsersStore(EmptyUsersStore(), replicationLog)
+	for i := 0; i < 2*MaxMutationLogRead+10; i++ {
+		store.AddUser(fmt.Sprintf("user%d", i), "12345678")
+	}
+	primary := &UsersServer{store: store, replicationLog: replicationLog, adminToken: "secret",
+		heartbeatInterval: 10 * time.Millisecond}
+	primaryServer := httptest.NewServer(primary)
+	defer primaryServer.Close()
+
+	replica := NewReplica(primaryServer.URL, "secret", EmptyUsersStore())
+	replica.RetryInterval = 10 * time.Millisecond
+	replicaServer := httptest.NewServer(&UsersServer{store: replica.store, replica: replica})
+	defer replicaServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- replica.Run(ctx) }()
+	WaitForReplica(t, replicaServer.URL, replicationLog.Head())
+	cancel()
+	<-stopped
+
+	store.AddUser("arnau", "12345678")
+	status := GetReplicationStatusTest(t, replicaServer.URL)
+	t.Run("stopped replica reports lag", func(t *testing.T) {
+		if status.Connected || status.LagSeconds == 0 {
+			t.Errorf("got status %+v", status)
+		}
+	})
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { stopped <- replica.Run(ctx) }()
+	WaitForReplica(t, replicaServer.URL, replicationLog.Head())
+	t.Run("replica goes on from the last entry applied", func(t *testing.T) {
+		AssertResponseBody(t, fmt.Sprint(len(replica.store.GetUsers())), fmt.Sprint(2*MaxMutationLogRead+11))
+	})
+	cancel()
+	<-stopped
+
+	// The primary is restarted: the replica can't follow its new log
+	restartedLog := NewMutationLog()
+	restartedServer := httptest.NewServer(&UsersServer{store: NewReplicatedUsersStore(EmptyUsersStore(), restartedLog),
+		replicationLog: restartedLog, adminToken: "secret"})
+	defer restartedServer.Close()
+	replica.Primary = restartedServer.URL
+	err := replica.Run(context.Background())
+	t.Run("replica diverges from a restarted primary", func(t *testing.T) {
+		if !errors.Is(err, ErrReplicaDiverged) {
+			t.Errorf("got error %v, want %v", err, ErrReplicaDiverged)
+		}
+		if status := GetReplicationStatusTest(t, replicaServer.URL); status.Error == "" {
+			t.Errorf("got status %+v without error", status)
+		}
+	})
+}
+
+func TestReplicaLoadsSnapshot(t *testing.T) {
+	replicationLog := NewBoundedMutationLog(20)
+	store := NewReplicatedUsersStore(EmptyUsersStore(), replicationLog)
+	for i := 0; i < 50; i++ {
+		store.AddUser(fmt.Sprintf("user%d", i), "12345678")
+		if i > 0 {
+			store.RequestFriendship(fmt.Sprintf("user%d", i), "user0")
+		}
+	}
+	primary := &UsersServer{store: store, replicationLog: replicationLog, adminToken: "secret",
+		heartbeatInterval: 10 * time.Millisecond}
+	primaryServer := httptest.NewServer(primary)
+	defer primaryServer.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, primaryServer.URL+"/replication/log?after=0", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	t.Run("log is gone from a dropped entry", func(t *testing.T) {
+		AssertStatus(t, response.StatusCode, http.StatusGone)
+	})
+	RunHTTPTest(t, "snapshot without token", http.MethodGet, primaryServer.URL+"/replication/snapshot", "",
+		http.StatusUnauthorized)
+
+	replica := NewReplica(primaryServer.URL, "secret", EmptyUsersStore())
+	replica.RetryInterval = 10 * time.Millisecond
+	replicaServer := httptest.NewServer(&UsersServer{store: replica.store, replica: replica})
+	defer replicaServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- replica.Run(ctx) }()
+	WaitForReplica(t, replicaServer.URL, replicationLog.Head())
+	cancel()
+	<-stopped
+	t.Run("new replica starts from a snapshot", func(t *testing.T) {
+		AssertResponseBody(t, fmt.Sprint(replica.store.GetUsers()), fmt.Sprint(store.GetUsers()))
+		AssertResponseBody(t, GetUserState(replica.store, "user0"), GetUserState(store, "user0"))
+		replicaFriends := RunHTTPTest(t, "get friends", http.MethodGet, replicaServer.URL+"/getFriends/user0", "",
+			http.StatusOK)
+		friends := RunHTTPTest(t, "get friends", http.MethodGet, primaryServer.URL+"/getFriends/user0", "",
+			http.StatusOK)
+		AssertResponseBody(t, replicaFriends.Header.Get("ETag"), friends.Header.Get("ETag"))
+	})
+
+	// The replica falls behind the log while it is stopped
+	for i := 0; i < 30; i++ {
+		store.RespondToFriendshipRequest("user0", fmt.Sprintf("user%d", i+1), true)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() { stopped <- replica.Run(ctx) }()
+	WaitForReplica(t, replicaServer.URL, replicationLog.Head())
+	t.Run("stopped replica goes on from a snapshot", func(t *testing.T) {
+		AssertResponseBody(t, GetUserState(replica.store, "user0"), GetUserState(store, "user0"))
+	})
+}
+
+// HTTPTestResponse is a response received by RunHTTPTest, with its body
+type HTTPTestResponse struct {
+	*http.Response
+	body string
+}
+
+// RunHTTPTest sends a request with method and body (if not empty) to url, without following redirections, and
+// checks its HTTP status
+func RunHTTPTest(t *testing.T, testName, method, url, body string, expectedHTTPStatus int) HTTPTestResponse {
+	request, _ := http.NewRequest(method, url, strings.NewReader(body))
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	responseBody, _ := ioutil.ReadAll(response.Body)
+
+	t.Run(testName, func(t *testing.T) {
+		AssertStatus(t, response.StatusCode, expectedHTTPStatus)
+	})
+	return HTTPTestResponse{Response: response, body: string(responseBody)}
+}
+
+// GetReplicationStatusTest returns the replication status of the server at url
+func GetReplicationStatusTest(t *testing.T, url string) ReplicationStatus {
+	response, err := http.Get(url + "/replication/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var status ReplicationStatus
+	if err := json.NewDecoder(response.Body).Decode(&status); err != nil {
+		t.Fatalf("could not get replication status (%d): %v", response.StatusCode, err)
+	}
+	return status
+}
+
+// WaitForReplica waits until the replica at url has applied the log up to entry head, and returns its status
+func WaitForReplica(t *testing.T, url string, head uint64) ReplicationStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := GetReplicationStatusTest(t, url)
+		if status.Applied >= head && status.Head >= head {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replica did not apply entry %d: got status %+v", head, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
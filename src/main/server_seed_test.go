@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeedUsersStore(t *testing.T) {
+	cases := []struct {
+		name   string
+		config SeedConfig
+		edges  func(n int) int // expected number of friendships plus requests (nil if random)
+	}{
+		{"Erdős–Rényi", SeedConfig{Users: 500, Model: SeedModelErdosRenyi, Degree: 10, Requests: 0.1, Seed: 7}, nil},
+		{"Barabási–Albert", SeedConfig{Users: 500, Model: SeedModelBarabasiAlbert, Degree: 10, Requests: 0.1, Seed: 7},
+			func(n int) int { return 6*5/2 + (n-6)*5 }},
+		{"small world", SeedConfig{Users: 500, Model: SeedModelWattsStrogatz, Degree: 10, Rewire: 0.2, Requests: 0.1, Seed: 7},
+			func(n int) int { return n * 5 }},
+	}
+
+	for _, c := range cases {
+		store := EmptyUsersStore()
+		report, err := SeedUsersStore(store, c.config)
+		t.Run(c.name, func(t *testing.T) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Users != c.config.Users || len(store.GetUsers()) != c.config.Users {
+				t.Errorf("got %d users (report %+v), want %d", len(store.GetUsers()), report, c.config.Users)
+			}
+
+			edges := report.Friendships + report.Requests
+			if c.edges != nil && edges != c.edges(c.config.Users) {
+				t.Errorf("got %d friendships and requests, want %d", edges, c.edges(c.config.Users))
+			}
+			if degree := 2 * float64(edges) / float64(c.config.Users); math.Abs(degree-float64(c.config.Degree)) > 1.5 {
+				t.Errorf("got mean degree %.2f, want about %d", degree, c.config.Degree)
+			}
+			if fraction := float64(report.Requests) / float64(edges); math.Abs(fraction-c.config.Requests) > 0.03 {
+				t.Errorf("got fraction of requests %.3f, want about %.3f", fraction, c.config.Requests)
+			}
+
+			friendships := 0
+			for _, user := range store.GetUsers() {
+				friendships += len(store.GetFriends(user))
+			}
+			if friendships != 2*report.Friendships {
+				t.Errorf("store has %d friendships, report says %d", friendships/2, report.Friendships)
+			}
+		})
+
+		again := EmptyUsersStore()
+		SeedUsersStore(again, c.config)
+		t.Run(c.name+" is deterministic", func(t *testing.T) {
+			for _, user := range store.GetUsers() {
+				wantID, _ := store.GetUserID(user)
+				gotID, _ := again.GetUserID(user)
+				wantPassword, _ := store.GetPassword(user)
+				gotPassword, _ := again.GetPassword(user)
+				wantSent, _, _ := store.GetFriendshipRequests(user)
+				gotSent, _, _ := again.GetFriendshipRequests(user)
+				switch {
+				case gotID != wantID || gotPassword != wantPassword:
+					t.Fatalf("%s: got ID %s and password %s, want %s and %s", user, gotID, gotPassword, wantID, wantPassword)
+				case toString(again.GetFriends(user)) != toString(store.GetFriends(user)):
+					t.Fatalf("%s: got friends %v, want %v", user, again.GetFriends(user), store.GetFriends(user))
+				case toString(gotSent) != toString(wantSent):
+					t.Fatalf("%s: got sent requests %v, want %v", user, gotSent, wantSent)
+				}
+			}
+		})
+
+		_, err = SeedUsersStore(store, c.config)
+		t.Run(c.name+" twice in the same store", func(t *testing.T) {
+			if err == nil || err.Error() != "user u0000: User already exists" {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+
+	invalid := []SeedConfig{
+		{Users: -1, Model: SeedModelErdosRenyi},
+		{Users: MaxSeedUsers + 1, Model: SeedModelErdosRenyi},
+		{Users: 10, Model: "tree"},
+		{Users: 10, Model: SeedModelErdosRenyi, Degree: 10},
+		{Users: 10, Model: SeedModelErdosRenyi, Degree: -1},
+		{Users: 10, Model: SeedModelWattsStrogatz, Rewire: 1.5},
+		{Users: 10, Model: SeedModelErdosRenyi, Requests: -0.5},
+	}
+	for _, config := range invalid {
+		store := EmptyUsersStore()
+		_, err := SeedUsersStore(store, config)
+		t.Run("invalid configuration", func(t *testing.T) {
+			if err == nil || len(store.GetUsers()) > 0 {
+				t.Errorf("%+v: got error %v and users %v", config, err, store.GetUsers())
+			}
+		})
+	}
+}
+
+func TestGetSeedUsername(t *testing.T) {
+	cases := []struct {
+		i, n int
+		want string
+	}{
+		{0, 1, "u0000"},
+		{42, 1000, "u0042"},
+		{42, 100000, "u00042"},
+		{MaxSeedUsers - 1, MaxSeedUsers, "u999999998"},
+	}
+	for _, c := range cases {
+		got := GetSeedUsername(c.i, c.n)
+		t.Run(c.want, func(t *testing.T) {
+			AssertResponseBody(t, got, c.want)
+			if ok, msg := CheckUsernameAndPassword(got, "12345678"); !ok {
+				t.Error(msg)
+			}
+		})
+	}
+}
+
+func TestSeedCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seed.jsonl")
+	RunCommandTest(t, "invalid model", RunSeedCommand, []string{"-model", "tree", path}, 2)
+	RunCommandTest(t, "seed", RunSeedCommand, []string{"-users", "50", "-model", "smallworld", "-degree", "4", "-requests", "0", path}, 0)
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	store := EmptyUsersStore()
+	report, err := ImportGraph(store, file)
+	t.Run("seed file can be imported", func(t *testing.T) {
+		if err != nil || len(report.Conflicts) > 0 {
+			t.Fatalf("got error %v and conflicts %v", err, report.Conflicts)
+		}
+		if report.Users != 50 || report.Friendships != 100 || report.Requests != 0 {
+			t.Errorf("got report %+v, want 50 users and 100 friendships", report)
+		}
+	})
+}
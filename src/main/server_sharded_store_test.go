@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestShardedUsersStore runs the same random operations on an InMemoryUsersStore and on ShardedUsersStores with
+// several numbers of shards, which must return the same results
+func TestShardedUsersStore(t *testing.T) {
+	for _, shards := range []int{1, 4, 64} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			want, got := EmptyUsersStore(), NewShardedUsersStore(shards)
+			random := rand.New(rand.NewSource(int64(shards)))
+			for i := 0; i < 20000; i++ {
+				seed := random.Int63()
+				operation, wantResult := RunRandomStoreOperation(want, seed)
+				_, gotResult := RunRandomStoreOperation(got, seed)
+				if gotResult != wantResult {
+					t.Fatalf("operation %d %s: got %s, want %s", i, operation, gotResult, wantResult)
+				}
+			}
+
+			for _, user := range want.GetUsers() {
+				if gotState, wantState := GetUserState(got, user), GetUserState(want, user); gotState != wantState {
+					t.Errorf("%s: got %s, want %s", user, gotState, wantState)
+				}
+				gotVersions, _ := got.GetVersions(user)
+				if wantVersions, _ := want.GetVersions(user); gotVersions != wantVersions {
+					t.Errorf("%s: got versions %+v, want %+v", user, gotVersions, wantVersions)
+				}
+			}
+		})
+	}
+}
+
+// TestShardedUsersStoreConcurrency runs random operations concurrently (run with -race) and checks that relationships
+// are consistent afterwards: friendships are symmetric and each sent request is received by the other user
+func TestShardedUsersStoreConcurrency(t *testing.T) {
+	store := NewShardedUsersStore(8)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 5000; i++ {
+				RunRandomStoreOperation(store, random.Int63())
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, user := range store.GetUsers() {
+		for _, friend := range store.GetFriends(user) {
+			if IndexOf(store.GetFriends(friend), user) < 0 {
+				t.Errorf("%s is friend of %s but not the other way around", friend, user)
+			}
+		}
+		sent, received, _ := store.GetFriendshipRequests(user)
+		for _, to := range sent {
+			if _, otherReceived, _ := store.GetFriendshipRequests(to); IndexOf(otherReceived, user) < 0 {
+				t.Errorf("%s sent a request to %s which was not received", user, to)
+			}
+		}
+		for _, from := range received {
+			if otherSent, _, _ := store.GetFriendshipRequests(from); IndexOf(otherSent, user) < 0 {
+				t.Errorf("%s received a request from %s which was not sent", user, from)
+			}
+		}
+	}
+}
+
+// RunRandomStoreOperation runs on store an operation chosen by seed among a small set of users, so that they often
+// collide. Returns a description of the operation and its result
+func RunRandomStoreOperation(store UsersStore, seed int64) (operation, result string) {
+	random := rand.New(rand.NewSource(seed))
+	user, other := GetRandomUser(random), GetRandomUser(random)
+	password := fmt.Sprintf("password%d", random.Intn(2))
+	evenRequests := func(versions UserVersions) bool { return versions.Requests%2 == 0 }
+
+	switch random.Intn(13) {
+	case 0:
+		return "AddUserWithID " + user, fmt.Sprint(store.AddUserWithID(fmt.Sprintf("id-%s-%d", user, random.Intn(3)), user, password))
+	case 1:
+		if random.Intn(2) == 0 {
+			return "RequestFriendshipIf " + user + " " + other, fmt.Sprint(store.RequestFriendshipIf(user, other, evenRequests))
+		}
+		return "RequestFriendship " + user + " " + other, fmt.Sprint(store.RequestFriendship(user, other))
+	case 2, 3:
+		accept := random.Intn(2) == 0
+		if random.Intn(2) == 0 {
+			return fmt.Sprintf("RespondToFriendshipRequestIf %s %s %t", user, other, accept),
+				fmt.Sprint(store.RespondToFriendshipRequestIf(user, other, accept, evenRequests))
+		}
+		return fmt.Sprintf("RespondToFriendshipRequest %s %s %t", user, other, accept),
+			fmt.Sprint(store.RespondToFriendshipRequest(user, other, accept))
+	case 4:
+		return "RemoveFriendship " + user + " " + other, fmt.Sprint(store.RemoveFriendship(user, other))
+	case 5:
+		return "ChangePassword " + user, fmt.Sprint(store.ChangePassword(user, password))
+	case 6:
+		bio := fmt.Sprintf("Bio %d", random.Intn(10))
+		return "UpdateProfile " + user, fmt.Sprint(store.UpdateProfile(user, ProfileUpdate{Bio: &bio}))
+	case 7:
+		return "SetRole " + user, fmt.Sprint(store.SetRole(user, RoleModerator))
+	case 8:
+		return "RenameUser " + user + " " + other, fmt.Sprint(store.RenameUser(user, other))
+	case 9:
+		return "DeleteUser " + user, fmt.Sprint(store.DeleteUser(user))
+	case 10:
+		return "RestoreUser " + user, fmt.Sprint(store.RestoreUser(user, password))
+	case 11:
+		switch random.Intn(4) {
+		case 0:
+			return "AreFriends " + user + " " + other, fmt.Sprint(store.AreFriends(user, other))
+		case 1:
+			return "HasFriendshipRequest " + user + " " + other, fmt.Sprint(store.HasFriendshipRequest(user, other))
+		case 2:
+			return "HaveCommonFriend " + user + " " + other, fmt.Sprint(store.HaveCommonFriend(user, other))
+		default:
+			return "GetFriends " + user, fmt.Sprint(store.GetFriends(user))
+		}
+	default:
+		return "PurgeDeletedUser " + user, fmt.Sprint(store.PurgeDeletedUser(user))
+	}
+}
+
+// GetRandomUser returns one of the users of RunRandomStoreOperation
+func GetRandomUser(random *rand.Rand) string {
+	return fmt.Sprintf("u%02d", random.Intn(20))
+}
+
+// GetUserState returns everything store knows about user except timestamps
+func GetUserState(store UsersStore, user string) string {
+	id, exists := store.GetUserID(user)
+	name, _ := store.GetUsername(id)
+	password, _ := store.GetPassword(user)
+	sent, received, _ := store.GetFriendshipRequests(user)
+	profile, _ := store.GetProfile(user)
+	profile.CreatedAt, profile.LastSeen = time.Time{}, time.Time{}
+	settings, _ := store.GetPrivacySettings(user)
+	role, _ := store.GetRole(user)
+	return fmt.Sprint(exists, id, name, password, store.GetFriends(user), sent, received, profile,
+		settings, role)
+}
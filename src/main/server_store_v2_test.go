@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUsersStoreAdapter(t *testing.T) {
+	ctx := context.Background()
+	store := NewUsersStoreAdapter(EmptyUsersStore())
+	store.AddUser(ctx, "arnau", "12345678")
+	store.AddUser(ctx, "sergi", "12345678")
+	store.AddUser(ctx, "berta", "12345678")
+	store.RequestFriendship(ctx, "arnau", "sergi")
+	store.RespondToFriendshipRequest(ctx, "sergi", "arnau", true)
+	store.RequestFriendship(ctx, "berta", "arnau")
+
+	cases := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{"add existing user", func() error { return store.AddUser(ctx, "arnau", "12345678") }, ErrUserExists},
+		{"get ID of user who does not exist", func() error { _, err := store.GetUserID(ctx, "peter"); return err }, ErrNotFound},
+		{"get username of ID which does not exist", func() error { _, err := store.GetUsername(ctx, "id"); return err }, ErrNotFound},
+		{"request friendship to user who does not exist", func() error { return store.RequestFriendship(ctx, "arnau", "peter") }, ErrNotFound},
+		{"request friendship to a friend", func() error { return store.RequestFriendship(ctx, "sergi", "arnau") }, ErrAlreadyFriends},
+		{"request friendship (pending)", func() error { return store.RequestFriendship(ctx, "berta", "arnau") }, ErrRequestPending},
+		{"request friendship (pending the other way)", func() error { return store.RequestFriendship(ctx, "arnau", "berta") }, ErrRequestPending},
+		{"respond to request which does not exist", func() error { return store.RespondToFriendshipRequest(ctx, "berta", "arnau", true) }, ErrRequestNotFound},
+		{"respond to user who does not exist", func() error { return store.RespondToFriendshipRequest(ctx, "arnau", "peter", true) }, ErrNotFound},
+		{"check wrong password", func() error { return store.CheckUsersPassword(ctx, "arnau", "wrongPass") }, ErrWrongPassword},
+		{"check password of user who does not exist", func() error { return store.CheckUsersPassword(ctx, "peter", "12345678") }, ErrWrongPassword},
+		{"check password", func() error { return store.CheckUsersPassword(ctx, "arnau", "12345678") }, nil},
+		{"get friends of user who does not exist", func() error { _, err := store.GetFriends(ctx, "peter"); return err }, ErrNotFound},
+		{"remove friendship between users who are not friends", func() error { return store.RemoveFriendship(ctx, "berta", "arnau") }, ErrNotFriends},
+		{"remove friendship with user who does not exist", func() error { return store.RemoveFriendship(ctx, "peter", "arnau") }, ErrNotFound},
+		{"rename user to existing user", func() error { return store.RenameUser(ctx, "arnau", "sergi") }, ErrUserExists},
+		{"rename user who does not exist", func() error { return store.RenameUser(ctx, "peter", "pere0") }, ErrNotFound},
+		{"touch user who does not exist", func() error { return store.TouchUser(ctx, "peter") }, ErrNotFound},
+		{"delete user who does not exist", func() error { return store.DeleteUser(ctx, "peter") }, ErrNotFound},
+		{"restore user who is not deleted", func() error { return store.RestoreUser(ctx, "arnau", "12345678") }, ErrNotFound},
+		{"purge user who is not deleted", func() error { return store.PurgeDeletedUser(ctx, "arnau") }, ErrNotFound},
+		{"delete user", func() error { return store.DeleteUser(ctx, "berta") }, nil},
+		{"restore user", func() error { return store.RestoreUser(ctx, "berta", "12345678") }, nil},
+	}
+	for _, c := range cases {
+		err := c.run()
+		t.Run(c.name, func(t *testing.T) {
+			if err != c.want {
+				t.Errorf("got error %v, want %v", err, c.want)
+			}
+		})
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err := store.AddUser(cancelled, "marta", "12345678")
+	t.Run("cancelled operations are not carried out", func(t *testing.T) {
+		if err != context.Canceled {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+		if exists, _ := store.UserExists(ctx, "marta"); exists {
+			t.Error("user was added")
+		}
+	})
+}
+
+func TestGetStoreErrorStatus(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		msg    string
+	}{
+		{ErrNotFound, http.StatusBadRequest, "User does not exist"},
+		{fmt.Errorf("user peter: %w", ErrNotFound), http.StatusBadRequest, "User does not exist"},
+		{ErrAlreadyFriends, http.StatusBadRequest, "Users are already friends"},
+		{ErrWrongPassword, http.StatusUnauthorized, ""},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable, "Request was cancelled"},
+		{errors.New("disk is full"), http.StatusInternalServerError, "Internal server error"},
+	}
+	for _, c := range cases {
+		status, msg := GetStoreErrorStatus(c.err)
+		t.Run(c.err.Error(), func(t *testing.T) {
+			AssertStatus(t, status, c.status)
+			AssertResponseBody(t, msg, c.msg)
+		})
+	}
+}
+
+func TestStoreErrorsInHandlers(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+
+	body := `{"user": "arnau", "userTo": "sergi", "pass": "12345678"}`
+	request, _ := http.NewRequest(http.MethodPost, "/requestFriendship", strings.NewReader(body))
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	t.Run("request friendship to a friend", func(t *testing.T) {
+		AssertStatus(t, response.Code, http.StatusBadRequest)
+		AssertResponseBody(t, response.Body.String(), "Users are already friends")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, url := range []string{"/getFriends/arnau", "/profile/arnau", "/getFriendshipRequests"} {
+		request, _ = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		request.SetBasicAuth("arnau", "12345678")
+		response = httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+		t.Run("client went away from "+url, func(t *testing.T) {
+			AssertStatus(t, response.Code, http.StatusServiceUnavailable)
+		})
+	}
+}
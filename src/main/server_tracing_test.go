@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	cases := []struct {
+		header string
+		want   SpanContext
+		ok     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}, true},
+		{"", SpanContext{}, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", SpanContext{}, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", SpanContext{}, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", SpanContext{}, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", SpanContext{}, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01", SpanContext{}, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", SpanContext{}, false},
+	}
+	for _, c := range cases {
+		got, ok := ParseTraceParent(c.header)
+		t.Run(c.header, func(t *testing.T) {
+			if got != c.want || ok != c.ok {
+				t.Errorf("got %+v, %t, want %+v, %t", got, ok, c.want, c.ok)
+			}
+		})
+	}
+
+	span := SpanContext{TraceID: NewTraceID(16), SpanID: NewTraceID(8)}
+	t.Run("format and parse", func(t *testing.T) {
+		if got, ok := ParseTraceParent(FormatTraceParent(span)); !ok || got != span {
+			t.Errorf("got %+v, want %+v", got, span)
+		}
+	})
+}
+
+func TestTracedRequests(t *testing.T) {
+	store := EmptyUsersStore()
+	store.AddUser("arnau", "12345678")
+	store.AddUser("sergi", "12345678")
+	output := &bytes.Buffer{}
+	server := &UsersServer{store: store, tracer: NewTracer(&WriterSpanExporter{Writer: output}, "test")}
+
+	parent := SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}
+	body := `{"user": "arnau", "userTo": "sergi", "pass": "12345678"}`
+	request, _ := http.NewRequest(http.MethodPost, "/requestFriendship", strings.NewReader(body))
+	request.Header.Set(TraceParentHeader, FormatTraceParent(parent))
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	AssertStatus(t, response.Code, http.StatusOK)
+
+	request, _ = http.NewRequest(http.MethodGet, "/getFriends/nobody", nil)
+	server.ServeHTTP(httptest.NewRecorder(), request)
+
+	if err := server.tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	spans := DecodeSpans(t, output)
+
+	t.Run("request span continues the trace of the client", func(t *testing.T) {
+		root := FindSpan(t, spans, "POST /requestFriendship")
+		if root.TraceID != parent.TraceID || root.ParentSpanID != parent.SpanID || root.Kind != SpanKindServer {
+			t.Fatalf("got %+v", root)
+		}
+		if got := GetSpanAttribute(root, "http.response.status_code"); got != "200" {
+			t.Errorf("got status code %q, want 200", got)
+		}
+
+		call := FindSpan(t, spans, "UsersStore.RequestFriendship")
+		if call.TraceID != parent.TraceID || call.ParentSpanID != root.SpanID || call.Kind != SpanKindInternal {
+			t.Errorf("got store call %+v, want child of %s", call, root.SpanID)
+		}
+		if GetSpanAttribute(call, "store.user") != "arnau" || GetSpanAttribute(call, "store.other_user") != "sergi" ||
+			GetSpanAttribute(call, "store.result") != "true" {
+			t.Errorf("got store call attributes %+v", call.Attributes)
+		}
+	})
+
+	t.Run("request without trace context starts a new trace", func(t *testing.T) {
+		root := FindSpan(t, spans, "GET /getFriends")
+		if root.TraceID == parent.TraceID || root.ParentSpanID != "" {
+			t.Errorf("got %+v", root)
+		}
+		for _, call := range spans {
+			if GetSpanAttribute(call, "store.user") == "nobody" && (call.TraceID != root.TraceID || call.ParentSpanID != root.SpanID) {
+				t.Errorf("got store call %+v, want child of %s", call, root.SpanID)
+			}
+		}
+	})
+
+	t.Run("passwords are not recorded", func(t *testing.T) {
+		if strings.Contains(output.String(), "12345678") {
+			t.Errorf("got %s", output.String())
+		}
+	})
+}
+
+func TestTracedTransactions(t *testing.T) {
+	store := NewTransactionalUsersStore(EmptyUsersStore())
+	store.AddUser("arnau", "12345678")
+	store.AddUser("sergi", "12345678")
+	output := &bytes.Buffer{}
+	server := &UsersServer{store: store, transactions: store, adminToken: "secretToken", audit: NewAuditLog(),
+		tracer: NewTracer(&WriterSpanExporter{Writer: output}, "test")}
+
+	RunBatchTest(t, server, "atomic batch", `{"user": "arnau", "pass": "12345678", "atomic": true, "operations": [
+		{"op": "requestFriendship", "userTo": "sergi"}
+	]}`, http.StatusOK)
+
+	request, _ := http.NewRequest(http.MethodPost, "/admin/import", strings.NewReader(
+		`{"type":"header","version":1}`+"\n"+`{"type":"user","user":"berta","password":"12345678"}`+"\n"))
+	request.Header.Set("Authorization", "Bearer secretToken")
+	response := httptest.NewRecorder()
+	server.ServeHTTP(response, request)
+	AssertStatus(t, response.Code, http.StatusOK)
+
+	if err := server.tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	spans := DecodeSpans(t, output)
+
+	cases := []struct{ request, call string }{
+		{"POST /batch", "UsersStore.RequestFriendship"},
+		{"POST /admin", "UsersStore.AddUserWithID"},
+	}
+	for _, c := range cases {
+		t.Run("store calls in the transaction of "+c.request+" are traced", func(t *testing.T) {
+			root := FindSpan(t, spans, c.request)
+			call := FindSpan(t, spans, c.call)
+			if call.TraceID != root.TraceID || call.ParentSpanID != root.SpanID {
+				t.Errorf("got store call %+v, want child of %s", call, root.SpanID)
+			}
+		})
+	}
+}
+
+func TestTracedStreams(t *testing.T) {
+	store := EmptyUsersStore()
+	store.AddUser("arnau", "12345678")
+	server := &UsersServer{store: store, events: NewEventBus(100, 10), heartbeatInterval: 10 * time.Millisecond,
+		tracer: NewTracer(nil, "test")}
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	stream := OpenEventStream(t, httpServer, "arnau", "12345678", "")
+	AssertNextEvent(t, stream, ": heartbeat")
+
+	client, status := DialWebSocket(t, httpServer, "arnau", "12345678")
+	AssertStatus(t, status, http.StatusSwitchingProtocols)
+	t.Run("websocket connection is hijacked", func(t *testing.T) {
+		if opcode, _ := client.ReadFrame(t); opcode != OpPing {
+			t.Errorf("got opcode %d, want ping", opcode)
+		}
+	})
+}
+
+func TestSlowStoreCalls(t *testing.T) {
+	logs := &bytes.Buffer{}
+	tracer := NewTracer(nil, "test")
+	tracer.Logger = log.New(logs, "", 0)
+	tracer.SlowThreshold = time.Nanosecond
+	store := NewTracingUsersStore(EmptyUsersStore(), tracer, SpanContext{})
+	store.AddUser("arnau", "12345678")
+
+	t.Run("slow calls are logged", func(t *testing.T) {
+		if !strings.HasPrefix(logs.String(), "slow store call UsersStore.AddUser map[store.result:true store.user:arnau] took") {
+			t.Errorf("got %q", logs.String())
+		}
+	})
+
+	logs.Reset()
+	tracer.SlowThreshold = time.Hour
+	store.GetFriends("arnau")
+	t.Run("fast calls are not logged", func(t *testing.T) {
+		AssertResponseBody(t, logs.String(), "")
+	})
+}
+
+func TestOTLPSpanExporter(t *testing.T) {
+	var received OTLPTraceRequest
+	var contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(&OTLPSpanExporter{Endpoint: collector.URL + "/v1/traces"}, "test")
+	tracer.EndSpan(tracer.StartSpan(SpanContext{}, "span", SpanKindInternal))
+	err := tracer.Flush()
+	t.Run("spans are posted to the collector", func(t *testing.T) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		AssertResponseBody(t, contentType, "application/json")
+		if len(received.ResourceSpans) != 1 || received.ResourceSpans[0].Resource.Attributes[0].Value.StringValue != "test" ||
+			len(received.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+			t.Errorf("got %+v", received)
+		}
+	})
+
+	tracer = NewTracer(&OTLPSpanExporter{Endpoint: collector.URL + "/wrong"}, "test")
+	tracer.EndSpan(tracer.StartSpan(SpanContext{}, "span", SpanKindInternal))
+	t.Run("collector errors are returned", func(t *testing.T) {
+		if err := tracer.Flush(); err == nil || err.Error() != "collector returned status 404" {
+			t.Errorf("got error %v", err)
+		}
+	})
+}
+
+// DecodeSpans returns the spans of the OTLP JSON lines written by a WriterSpanExporter
+func DecodeSpans(t *testing.T, output *bytes.Buffer) []OTLPSpan {
+	spans := make([]OTLPSpan, 0)
+	decoder := json.NewDecoder(bytes.NewReader(output.Bytes()))
+	for decoder.More() {
+		var request OTLPTraceRequest
+		if err := decoder.Decode(&request); err != nil {
+			t.Fatal(err)
+		}
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				spans = append(spans, scopeSpans.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+// FindSpan returns the first span named name
+func FindSpan(t *testing.T, spans []OTLPSpan, name string) OTLPSpan {
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no span %s in %+v", name, spans)
+	return OTLPSpan{}
+}
+
+// GetSpanAttribute returns the value of attribute key of span, or "" if it does not have it
+func GetSpanAttribute(span OTLPSpan, key string) string {
+	for _, attribute := range span.Attributes {
+		if attribute.Key == key {
+			return attribute.Value.StringValue
+		}
+	}
+	return ""
+}
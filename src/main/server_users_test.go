@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestUserIDs(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, messages: EmptyMessageStore()}
+
+	arnau := RunSignUpWithIDTest(t, server, "sign up returns the new user's identity", "arnau", "12345678")
+	sergi := RunSignUpWithIDTest(t, server, "sign up returns the new user's identity", "sergi", "12345678")
+
+	t.Run("IDs are UUIDs", func(t *testing.T) {
+		isUUID := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString
+		if !isUUID(arnau.ID) || arnau.ID == sergi.ID {
+			t.Errorf("got IDs %q and %q, want two different UUIDs", arnau.ID, sergi.ID)
+		}
+	})
+
+	RunTestWithBody(t, server, "look up user by username", "/lookupUser?user=arnau", `{"id":"`+arnau.ID+`","user":"arnau"}`)
+	RunTestWithBody(t, server, "look up user by ID", "/lookupUser?id="+sergi.ID, `{"id":"`+sergi.ID+`","user":"sergi"}`)
+	RunLookupUserTest(t, server, "look up user (does not exist)", "/lookupUser?user=peter", http.StatusBadRequest)
+	RunLookupUserTest(t, server, "look up user (ID does not exist)", "/lookupUser?id=peter", http.StatusBadRequest)
+	RunLookupUserTest(t, server, "look up user (no user nor ID)", "/lookupUser", http.StatusBadRequest)
+	RunLookupUserTest(t, server, "look up user (both user and ID)", "/lookupUser?user=arnau&id="+arnau.ID, http.StatusBadRequest)
+
+	RunPostTest(t, server, "request friendship by ID (ID does not exist)", "/requestFriendship",
+		map[string]string{"user": "arnau", "pass": "12345678", "userToId": "peter"}, http.StatusBadRequest)
+	RunPostTest(t, server, "request friendship by ID", "/requestFriendship",
+		map[string]string{"user": "arnau", "pass": "12345678", "userToId": sergi.ID}, http.StatusOK)
+	RunPostTest(t, server, "accept friendship by ID", "/respondToFriendshipRequest",
+		map[string]string{"user": "sergi", "pass": "12345678", "otherUserId": arnau.ID, "acceptRequest": "1"}, http.StatusOK)
+	RunTestWithBody(t, server, "get friends by ID", "/getFriends/"+sergi.ID+"?byId=1", "[arnau]")
+	RunPostTest(t, server, "send message by ID", "/sendMessage",
+		map[string]string{"user": "sergi", "pass": "12345678", "userToId": arnau.ID, "message": "hi!"}, http.StatusOK)
+	RunGetConversationTest(t, server, "get conversation by ID", "arnau", sergi.ID, "?byId=1", []string{"hi!"}, http.StatusOK)
+
+	RunPostTest(t, server, "change username", "/changeUsername",
+		map[string]string{"user": "arnau", "pass": "12345678", "newUser": "arnau2"}, http.StatusOK)
+	RunTestWithBody(t, server, "ID does not change when username does", "/lookupUser?id="+arnau.ID, `{"id":"`+arnau.ID+`","user":"arnau2"}`)
+	RunGetProfileTest(t, server, "get profile by ID", arnau.ID+"?byId=1", Profile{ID: arnau.ID, User: "arnau2"}, http.StatusOK)
+	RunGetProfileTest(t, server, "get profile by ID (ID does not exist)", "peter?byId=1", Profile{}, http.StatusBadRequest)
+}
+
+// RunSignUpWithIDTest signs up a user and returns the identity in the response
+func RunSignUpWithIDTest(t *testing.T, s *UsersServer, testName, username, password string) UserIdentity {
+	requestBody, _ := json.Marshal(map[string]string{"user": username, "pass": password})
+	request, _ := http.NewRequest(http.MethodPost, "/signUp", bytes.NewBuffer(requestBody))
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	var identity UserIdentity
+	json.Unmarshal(response.Body.Bytes(), &identity)
+
+	t.Run(testName, func(t *testing.T) {
+		AssertStatus(t, response.Code, http.StatusOK)
+		if identity.User != username || identity.ID == "" {
+			t.Errorf("got identity %+v, want user %q with an ID", identity, username)
+		}
+	})
+	return identity
+}
+
+func RunLookupUserTest(t *testing.T, s *UsersServer, testName, url string, expectedHTTPStatus int) {
+	request, _ := http.NewRequest(http.MethodGet, url, nil)
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		AssertStatus(t, response.Code, expectedHTTPStatus)
+	})
+}
+
+func TestFriendshipIndexes(t *testing.T) {
+	store := NewSocialGraphTestStore() // arnau-sergi-berta-marta, marta->arnau
+	store.AddUser("peter", "12345678")
+	store.RequestFriendship("peter", "arnau")
+	store.RequestFriendship("sergi", "marta")
+	store.DeleteUser("arnau")
+	store.RemoveFriendship("berta", "marta")
+	store.RestoreUser("arnau", "12345678")
+	store.RespondToFriendshipRequest("arnau", "peter", true)
+
+	t.Run("store behaves as before", func(t *testing.T) {
+		AssertResponseBody(t, toString(store.GetFriends("arnau")), `["peter","sergi"]`)
+		AssertResponseBody(t, toString(store.GetFriends("berta")), `["sergi"]`)
+		sent, received, _ := store.GetFriendshipRequests("marta")
+		AssertResponseBody(t, toString(sent), `["arnau"]`)
+		AssertResponseBody(t, toString(received), `["sergi"]`)
+	})
+
+	t.Run("membership queries", func(t *testing.T) {
+		AssertResponseBody(t, fmt.Sprint(store.AreFriends("arnau", "peter"), store.AreFriends("peter", "arnau"),
+			store.AreFriends("berta", "marta"), store.AreFriends("arnau", "nobody")), "true true false false")
+		AssertResponseBody(t, fmt.Sprint(store.HasFriendshipRequest("marta", "arnau"), store.HasFriendshipRequest("arnau", "marta"),
+			store.HasFriendshipRequest("sergi", "marta"), store.HasFriendshipRequest("peter", "arnau")), "true false true false")
+		AssertResponseBody(t, fmt.Sprint(store.HaveCommonFriend("peter", "sergi"), store.HaveCommonFriend("berta", "arnau"),
+			store.HaveCommonFriend("marta", "arnau")), "true true false")
+	})
+
+	t.Run("indexes are consistent", func(t *testing.T) {
+		for id := range store.usernames {
+			for friend := range store.friends[id] {
+				if !store.friends[friend].Contains(id) {
+					t.Errorf("%s is a friend of %s but not the other way around", store.usernames[friend], store.usernames[id])
+				}
+			}
+			for to := range store.sentRequests[id] {
+				if !store.receivedRequests[to].Contains(id) {
+					t.Errorf("request %s->%s is not received", store.usernames[id], store.usernames[to])
+				}
+			}
+			for from := range store.receivedRequests[id] {
+				if !store.sentRequests[from].Contains(id) {
+					t.Errorf("request %s->%s is not sent", store.usernames[from], store.usernames[id])
+				}
+			}
+		}
+	})
+}
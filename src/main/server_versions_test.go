@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUserVersions(t *testing.T) {
+	stores := map[string]UsersStore{"in memory": EmptyUsersStore(), "sharded": NewShardedUsersStore(4)}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			store.AddUser("arnau", "12345678")
+			store.AddUser("sergi", "12345678")
+			store.AddUser("berta", "12345678")
+
+			cases := []struct {
+				name    string
+				run     func() bool       // returns false iff the case could not be set up
+				changed map[string]string // lists of each user which must change
+			}{
+				{"request friendship", func() bool { return store.RequestFriendship("arnau", "sergi") },
+					map[string]string{"arnau": "requests", "sergi": "requests"}},
+				{"request friendship which already exists", func() bool { return !store.RequestFriendship("arnau", "sergi") },
+					map[string]string{}},
+				{"accept friendship", func() bool { return store.RespondToFriendshipRequest("sergi", "arnau", true) },
+					map[string]string{"arnau": "both", "sergi": "both"}},
+				{"decline friendship", func() bool {
+					return store.RequestFriendship("berta", "arnau") && store.RespondToFriendshipRequest("arnau", "berta", false)
+				}, map[string]string{"arnau": "requests", "berta": "requests"}},
+				{"set role", func() bool { return store.SetRole("arnau", RoleModerator) }, map[string]string{}},
+				{"rename user", func() bool { return store.RenameUser("arnau", "arnau0") },
+					map[string]string{"sergi": "friends"}},
+				{"delete user", func() bool { return store.DeleteUser("sergi") }, map[string]string{"arnau0": "friends"}},
+				{"restore user", func() bool { return store.RestoreUser("sergi", "12345678") },
+					map[string]string{"arnau0": "friends", "sergi": "both"}},
+				{"remove friendship", func() bool { return store.RemoveFriendship("sergi", "arnau0") },
+					map[string]string{"arnau0": "friends", "sergi": "friends"}},
+			}
+			for _, c := range cases {
+				before := map[string]UserVersions{} // by ID, since users may be renamed
+				for _, user := range store.GetUsers() {
+					id, _ := store.GetUserID(user)
+					before[id], _ = store.GetVersions(user)
+				}
+				if !c.run() {
+					t.Fatalf("%s failed", c.name)
+				}
+				t.Run(c.name, func(t *testing.T) {
+					for _, user := range store.GetUsers() {
+						id, _ := store.GetUserID(user)
+						after, _ := store.GetVersions(user)
+						friends, requests := after.Friends != before[id].Friends, after.Requests != before[id].Requests
+						want := c.changed[user]
+						if friends != (want == "friends" || want == "both") || requests != (want == "requests" || want == "both") {
+							t.Errorf("%s: got versions %+v, were %+v", user, after, before[id])
+						}
+						if after.Friends < before[id].Friends || after.Requests < before[id].Requests {
+							t.Errorf("%s: versions decreased from %+v to %+v", user, before[id], after)
+						}
+					}
+				})
+			}
+
+			t.Run("versions of users who do not exist", func(t *testing.T) {
+				if _, ok := store.GetVersions("peter"); ok {
+					t.Error("got versions of user who does not exist")
+				}
+			})
+		})
+	}
+}
+
+func TestMatchesETag(t *testing.T) {
+	cases := []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{`"7"`, false, true},
+		{`"8"`, false, false},
+		{`*`, false, true},
+		{`"5", "7"`, false, true},
+		{`"5","6"`, false, false},
+		{`W/"7"`, false, false},
+		{`W/"7"`, true, true},
+		{`7`, true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.header, func(t *testing.T) {
+			if got := MatchesETag(c.header, FormatETag(7), c.weak); got != c.want {
+				t.Errorf("got %t, want %t", got, c.want)
+			}
+		})
+	}
+}
+
+func TestETags(t *testing.T) {
+	for name, transactional := range map[string]bool{"with transactions": true, "without transactions": false} {
+		t.Run(name, func(t *testing.T) {
+			server := &UsersServer{store: EmptyUsersStore()}
+			if transactional {
+				server.transactions = NewTransactionalUsersStore(server.store)
+				server.store = server.transactions
+			}
+			for _, user := range []string{"arnau", "sergi", "berta"} {
+				RunSignUpTest(t, server, "sign up a new user", user, "12345678", http.StatusOK)
+			}
+			RunFriendshipRequestTest(t, server, "request friendship", "sergi", "arnau", "12345678", http.StatusOK)
+
+			friends := RunConditionalGetTest(t, server, "get friends", "/getFriends/arnau", "", "", "", http.StatusOK)
+			etag := friends.Header().Get("ETag")
+			RunConditionalGetTest(t, server, "friends have not changed", "/getFriends/arnau", "", "", etag,
+				http.StatusNotModified)
+			profiles := RunConditionalGetTest(t, server, "get friends profiles", "/getFriends/arnau?profiles=1", "", "",
+				etag, http.StatusOK)
+			t.Run("profiles have no ETag", func(t *testing.T) {
+				AssertResponseBody(t, profiles.Header().Get("ETag"), "")
+			})
+
+			requests := RunConditionalGetTest(t, server, "get requests", "/getFriendshipRequests", "arnau", "12345678", "",
+				http.StatusOK)
+			t.Run("requests are returned", func(t *testing.T) {
+				AssertResponseBody(t, requests.Body.String(), `{"user":"arnau","sent":[],"received":["sergi"]}`)
+			})
+			requestsETag := requests.Header().Get("ETag")
+			RunConditionalGetTest(t, server, "requests have not changed", "/getFriendshipRequests", "arnau", "12345678",
+				requestsETag, http.StatusNotModified)
+			RunConditionalGetTest(t, server, "get requests with wrong password", "/getFriendshipRequests", "arnau",
+				"wrongPass", "", http.StatusUnauthorized)
+
+			// Another device sends a request: the requests of arnau change
+			RunFriendshipRequestTest(t, server, "request friendship", "berta", "arnau", "12345678", http.StatusOK)
+			response := RunConditionalPostTest(t, server, "respond with outdated requests", "/respondToFriendshipRequest",
+				`{"user": "arnau", "otherUser": "sergi", "pass": "12345678", "acceptRequest": "1"}`, requestsETag,
+				http.StatusPreconditionFailed)
+			t.Run("outdated responses are not applied", func(t *testing.T) {
+				AssertResponseBody(t, response.Body.String(), "Friendship requests have changed")
+				RunListFriends(t, server, "friends not changed", "arnau", "[]", http.StatusOK)
+			})
+
+			requests = RunConditionalGetTest(t, server, "get changed requests", "/getFriendshipRequests", "arnau",
+				"12345678", requestsETag, http.StatusOK)
+			RunConditionalPostTest(t, server, "respond with current requests", "/respondToFriendshipRequest",
+				`{"user": "arnau", "otherUser": "sergi", "pass": "12345678", "acceptRequest": "1"}`,
+				requests.Header().Get("ETag"), http.StatusOK)
+			RunConditionalGetTest(t, server, "friends have changed", "/getFriends/arnau", "", "", etag, http.StatusOK)
+
+			RunConditionalPostTest(t, server, "request with any version", "/requestFriendship",
+				`{"user": "arnau", "userTo": "berta", "pass": "12345678"}`, "*", http.StatusBadRequest)
+
+			// Accepting a request changes the friends list too, so its version is accepted (once the requests have
+			// changed again, so that the versions of both lists differ)
+			friends = RunConditionalGetTest(t, server, "get changed friends", "/getFriends/arnau", "", "", "",
+				http.StatusOK)
+			RunSignUpTest(t, server, "sign up a new user", "marta", "12345678", http.StatusOK)
+			RunFriendshipRequestTest(t, server, "request friendship", "marta", "arnau", "12345678", http.StatusOK)
+			RunConditionalPostTest(t, server, "reject with the friends version", "/respondToFriendshipRequest",
+				`{"user": "arnau", "otherUser": "berta", "pass": "12345678", "acceptRequest": "0"}`,
+				friends.Header().Get("ETag"), http.StatusPreconditionFailed)
+			RunConditionalPostTest(t, server, "accept with the friends version", "/respondToFriendshipRequest",
+				`{"user": "arnau", "otherUser": "berta", "pass": "12345678", "acceptRequest": "1"}`,
+				friends.Header().Get("ETag"), http.StatusOK)
+			RunListFriends(t, server, "friend added", "arnau", "[berta sergi]", http.StatusOK)
+			RunConditionalPostTest(t, server, "request with wrong password", "/requestFriendship",
+				`{"user": "arnau", "userTo": "berta", "pass": "wrongPass"}`, `"1"`, http.StatusUnauthorized)
+		})
+	}
+}
+
+// TestIfMatchRace checks that conditional requests fail if the version changes between the first check and the
+// mutation, which checks it again
+func TestIfMatchRace(t *testing.T) {
+	store := &racingUsersStore{UsersStore: EmptyUsersStore()}
+	server := &UsersServer{store: store}
+	for _, user := range []string{"arnau", "sergi", "berta"} {
+		RunSignUpTest(t, server, "sign up a new user", user, "12345678", http.StatusOK)
+	}
+	RunFriendshipRequestTest(t, server, "request friendship", "sergi", "arnau", "12345678", http.StatusOK)
+	requests := RunConditionalGetTest(t, server, "get requests", "/getFriendshipRequests", "arnau", "12345678", "",
+		http.StatusOK)
+
+	// Another device sends a request right after the version is checked
+	store.race = func() { store.UsersStore.RequestFriendship("berta", "arnau") }
+	response := RunConditionalPostTest(t, server, "respond while requests change", "/respondToFriendshipRequest",
+		`{"user": "arnau", "otherUser": "sergi", "pass": "12345678", "acceptRequest": "1"}`,
+		requests.Header().Get("ETag"), http.StatusPreconditionFailed)
+	t.Run("response is not applied", func(t *testing.T) {
+		AssertResponseBody(t, response.Body.String(), "Friendship requests have changed")
+		RunListFriends(t, server, "friends not changed", "arnau", "[]", http.StatusOK)
+	})
+}
+
+// racingUsersStore is a UsersStore which runs race (if not nil) right before each conditional response to a
+// friendship request
+type racingUsersStore struct {
+	UsersStore
+	race func()
+}
+
+func (s *racingUsersStore) RespondToFriendshipRequestIf(user, otherUser string, acceptRequest bool, condition func(versions UserVersions) bool) bool {
+	if s.race != nil {
+		s.race()
+	}
+	return s.UsersStore.RespondToFriendshipRequestIf(user, otherUser, acceptRequest, condition)
+}
+
+// RunConditionalGetTest sends a GET request to url, with HTTP basic authentication if user is not empty and with
+// ifNoneMatch as If-None-Match header if not empty, and checks its HTTP status
+func RunConditionalGetTest(t *testing.T, s *UsersServer, testName, url, user, password, ifNoneMatch string, expectedHTTPStatus int) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodGet, url, nil)
+	if user != "" {
+		request.SetBasicAuth(user, password)
+	}
+	if ifNoneMatch != "" {
+		request.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	response := httptest.NewRecorder()
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		AssertStatus(t, response.Code, expectedHTTPStatus)
+	})
+	return response
+}
+
+// RunConditionalPostTest sends a POST request to url with body and ifMatch as If-Match header, and checks its HTTP
+// status
+func RunConditionalPostTest(t *testing.T, s *UsersServer, testName, url, body, ifMatch string, expectedHTTPStatus int) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	request.Header.Set("If-Match", ifMatch)
+	response := httptest.NewRecorder()
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		AssertStatus(t, response.Code, expectedHTTPStatus)
+	})
+	return response
+}
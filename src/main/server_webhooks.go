@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WebhookEvents are the events to which a webhook can subscribe
+var WebhookEvents = []string{
+	WebhookUserSignedUp,
+	WebhookFriendshipRequested,
+	WebhookFriendshipAccepted,
+	WebhookFriendshipDeclined,
+}
+
+// Webhooks takes a webhooks HTTP request (r) made by actor, who must have the admin role (see RequireRole), to the
+// UsersServer (s), processes it and populates the ResponseWriter (w):
+// - GET /webhooks lists all subscriptions, without their secrets
+// - POST /webhooks adds a subscription, and returns it with its secret
+// - DELETE /webhooks/<id> removes a subscription
+// - GET /webhooks/deadLetters lists the payloads which could not be delivered
+func (s *UsersServer) Webhooks(w *http.ResponseWriter, r *http.Request, actor string) {
+	if s.webhooks == nil {
+		(*w).WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	path := strings.Split(r.URL.Path, "/")
+	id := ""
+	if len(path) > 2 {
+		id = path[2]
+	}
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		WriteJSON(w, http.StatusOK, s.webhooks.GetSubscriptions())
+
+	case r.Method == http.MethodGet && id == "deadLetters":
+		WriteJSON(w, http.StatusOK, s.webhooks.GetDeadLetters())
+
+	case r.Method == http.MethodPost && id == "":
+		s.AddWebhook(w, r, actor)
+
+	case r.Method == http.MethodDelete && id != "":
+		if !s.webhooks.Unsubscribe(id) {
+			(*w).WriteHeader(http.StatusNotFound)
+			fmt.Fprint(*w, "Webhook does not exist")
+			return
+		}
+		s.RecordAudit(r, actor, AuditWebhookRemoved, id, nil)
+		(*w).WriteHeader(http.StatusOK)
+
+	default:
+		(*w).WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// AddWebhook takes a POST webhooks HTTP request (r) made by actor to the UsersServer (s), processes it and populates
+// the ResponseWriter (w) with the new subscription
+func (s *UsersServer) AddWebhook(w *http.ResponseWriter, r *http.Request, actor string) {
+	info, ok := GetRequestInfo(w, r)
+	if !ok {
+		return
+	}
+
+	target, err := url.Parse(info["url"])
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		(*w).WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(*w, "url must be an absolute http or https URL")
+		return
+	}
+
+	events := make([]string, 0)
+	if info["events"] != "" {
+		for _, event := range strings.Split(info["events"], ",") {
+			if !Contains(WebhookEvents, event) {
+				(*w).WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(*w, "Unknown event %q", event)
+				return
+			}
+			events = append(events, event)
+		}
+	}
+
+	subscription := s.webhooks.Subscribe(target.String(), info["secret"], events)
+	s.RecordAudit(r, actor, AuditWebhookAdded, subscription.ID, map[string]string{"url": subscription.URL})
+	WriteJSON(w, http.StatusOK, subscription)
+}
+
+// CheckAdminToken returns true iff request r carries the server's admin token.
+// If the server has no admin token, it always returns false
+func (s *UsersServer) CheckAdminToken(r *http.Request) bool {
+	if s.adminToken == "" {
+		return false
+	}
+
+	got := []byte(r.Header.Get("Authorization"))
+	want := []byte("Bearer " + s.adminToken)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// WriteJSON populates w with HTTP status and v encoded as JSON
+func WriteJSON(w *http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		(*w).WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(status)
+	(*w).Write(body)
+}
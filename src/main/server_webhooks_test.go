@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	receiver := NewWebhookReceiver(http.StatusOK)
+	defer receiver.Close()
+
+	server := NewWebhookTestServer(t)
+
+	// Admin endpoints
+	RunWebhookAdminTest(t, server, "add webhook (no admin token)", http.MethodPost, "/webhooks", "",
+		map[string]string{"url": receiver.URL}, http.StatusUnauthorized)
+	RunWebhookAdminTest(t, server, "add webhook (invalid url)", http.MethodPost, "/webhooks", "secretToken",
+		map[string]string{"url": "ftp://example.com"}, http.StatusBadRequest)
+	RunWebhookAdminTest(t, server, "add webhook (unknown event)", http.MethodPost, "/webhooks", "secretToken",
+		map[string]string{"url": receiver.URL, "events": "userSignedUp,userLoggedIn"}, http.StatusBadRequest)
+	added := RunWebhookAdminTest(t, server, "add webhook", http.MethodPost, "/webhooks", "secretToken",
+		map[string]string{"url": receiver.URL, "secret": "s3cr3t"}, http.StatusOK)
+	RunWebhookAdminTest(t, server, "add webhook (only sign ups)", http.MethodPost, "/webhooks", "secretToken",
+		map[string]string{"url": receiver.URL + "/signUps", "secret": "s3cr3t", "events": "userSignedUp"}, http.StatusOK)
+	listed := RunWebhookAdminTest(t, server, "list webhooks", http.MethodGet, "/webhooks", "secretToken", nil, http.StatusOK)
+	t.Run("secrets are only returned when added", func(t *testing.T) {
+		if !strings.Contains(added, "s3cr3t") || strings.Contains(listed, "s3cr3t") {
+			t.Errorf("got %s when adding and %s when listing", added, listed)
+		}
+	})
+
+	// Lifecycle events
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up an already existing user", "arnau", "12345678", http.StatusBadRequest)
+	RunFriendshipRequestTest(t, server, "request friendship", "arnau", "sergi", "12345678", http.StatusOK)
+	RunRespondToFriendshipTest(t, server, "accept friendship", "sergi", "arnau", "12345678", true, http.StatusOK)
+	server.webhooks.Wait()
+
+	t.Run("deliveries", func(t *testing.T) {
+		got := receiver.Received()
+		want := map[string]int{
+			"/ " + WebhookUserSignedUp:              2,
+			"/signUps " + WebhookUserSignedUp:       2,
+			"/ " + WebhookFriendshipRequested:       1,
+			"/ " + WebhookFriendshipAccepted:        1,
+			"/signUps " + WebhookFriendshipAccepted: 0,
+		}
+		for key, count := range want {
+			if got[key] != count {
+				t.Errorf("got %d deliveries of %q, want %d (all deliveries: %v)", got[key], key, count, got)
+			}
+		}
+		if receiver.BadSignatures() > 0 {
+			t.Errorf("got %d deliveries with a bad signature", receiver.BadSignatures())
+		}
+	})
+
+	RunWebhookAdminTest(t, server, "remove webhook (does not exist)", http.MethodDelete, "/webhooks/42", "secretToken", nil, http.StatusNotFound)
+	RunWebhookAdminTest(t, server, "remove webhook", http.MethodDelete, "/webhooks/2", "secretToken", nil, http.StatusOK)
+}
+
+func TestWebhooksDeadLetters(t *testing.T) {
+	receiver := NewWebhookReceiver(http.StatusInternalServerError)
+	defer receiver.Close()
+
+	server := NewWebhookTestServer(t)
+	server.webhooks.Subscribe(receiver.URL, "s3cr3t", nil)
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	server.webhooks.Wait()
+
+	t.Run("delivery is retried", func(t *testing.T) {
+		if got := receiver.Received()["/ "+WebhookUserSignedUp]; got != 3 {
+			t.Errorf("got %d delivery attempts, want 3", got)
+		}
+	})
+
+	t.Run("failed delivery is dead-lettered", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/webhooks/deadLetters", nil)
+		request.Header.Set("Authorization", "Bearer secretToken")
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, request)
+
+		var deadLetters []WebhookDeadLetter
+		json.Unmarshal(response.Body.Bytes(), &deadLetters)
+		if len(deadLetters) != 1 || deadLetters[0].Attempts != 3 || deadLetters[0].LastError != "unexpected HTTP status 500" {
+			t.Errorf("got dead letters %+v, want one after 3 attempts", deadLetters)
+		}
+	})
+
+	server.webhooks.maxDeadLetters = 2
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "berta", "12345678", http.StatusOK)
+	server.webhooks.Wait()
+	t.Run("only the last dead letters are kept", func(t *testing.T) {
+		deadLetters := server.webhooks.GetDeadLetters()
+		if len(deadLetters) != 2 || strings.Contains(deadLetters[0].Payload+deadLetters[1].Payload, "arnau") {
+			t.Errorf("got dead letters %+v, want the last 2", deadLetters)
+		}
+	})
+}
+
+func TestWebhooksClose(t *testing.T) {
+	receiver := NewWebhookReceiver(http.StatusInternalServerError)
+	defer receiver.Close()
+
+	server := NewWebhookTestServer(t)
+	server.webhooks.BaseBackoff = time.Hour
+	server.webhooks.MaxBackoff = time.Hour
+	server.webhooks.Subscribe(receiver.URL, "s3cr3t", nil)
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	for receiver.Received()["/ "+WebhookUserSignedUp] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	server.webhooks.Close()
+	server.webhooks.Wait()
+
+	t.Run("retries are cancelled", func(t *testing.T) {
+		deadLetters := server.webhooks.GetDeadLetters()
+		if len(deadLetters) != 1 || deadLetters[0].Attempts != 1 {
+			t.Errorf("got dead letters %+v, want one after 1 attempt", deadLetters)
+		}
+	})
+	RunSignUpTest(t, server, "sign up after closing", "sergi", "12345678", http.StatusOK)
+	t.Run("nothing is delivered once closed", func(t *testing.T) {
+		if got := receiver.Received()["/ "+WebhookUserSignedUp]; got != 1 {
+			t.Errorf("got %d delivery attempts, want 1", got)
+		}
+	})
+}
+
+func NewWebhookTestServer(t *testing.T) *UsersServer {
+	webhooks := NewWebhookDispatcher()
+	t.Cleanup(webhooks.Close)
+	webhooks.MaxAttempts = 3
+	webhooks.BaseBackoff = time.Millisecond
+	webhooks.MaxBackoff = 2 * time.Millisecond
+
+	return &UsersServer{store: EmptyUsersStore(), webhooks: webhooks, adminToken: "secretToken"}
+}
+
+// WebhookReceiver is an HTTP server which counts the webhook deliveries it receives by "<path> <event>"
+// and checks their signatures (assuming secret "s3cr3t")
+type WebhookReceiver struct {
+	*httptest.Server
+	mu            sync.Mutex
+	received      map[string]int
+	badSignatures int
+}
+
+func NewWebhookReceiver(status int) *WebhookReceiver {
+	receiver := &WebhookReceiver{received: map[string]int{}}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var payload WebhookPayload
+		json.Unmarshal(body, &payload)
+
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.received[r.URL.Path+" "+payload.Event]++
+		if r.Header.Get(WebhookSignatureHeader) != SignWebhookPayload("s3cr3t", body) {
+			receiver.badSignatures++
+		}
+		w.WriteHeader(status)
+	}))
+	return receiver
+}
+
+func (r *WebhookReceiver) Received() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	received := map[string]int{}
+	for key, count := range r.received {
+		received[key] = count
+	}
+	return received
+}
+
+func (r *WebhookReceiver) BadSignatures() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.badSignatures
+}
+
+func RunWebhookAdminTest(t *testing.T, s *UsersServer, testName, method, url, adminToken string, body map[string]string, expectedHTTPStatus int) string {
+	requestBody, _ := json.Marshal(body)
+	request, _ := http.NewRequest(method, url, bytes.NewBuffer(requestBody))
+	if adminToken != "" {
+		request.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	response := httptest.NewRecorder()
+
+	s.ServeHTTP(response, request)
+
+	t.Run(testName, func(t *testing.T) {
+		if ok := AssertStatus(t, response.Code, expectedHTTPStatus); !ok {
+			t.Errorf("Got body: %q", response.Body.String())
+		}
+	})
+	return response.Body.String()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// WebSocketRequest is a message sent by a client through /ws. Type is the name of the HTTP endpoint it mirrors
+// (requestFriendship, respondToFriendshipRequest or getFriends) or "ping". The other fields are the ones the
+// endpoint takes, except for the credentials which are only checked when the connection is opened.
+// ID is chosen by the client and is sent back in the response so that both can be matched.
+type WebSocketRequest struct {
+	Type          string `json:"type"`
+	ID            string `json:"id,omitempty"`
+	User          string `json:"user,omitempty"`
+	UserID        string `json:"userId,omitempty"`
+	UserTo        string `json:"userTo,omitempty"`
+	UserToID      string `json:"userToId,omitempty"`
+	OtherUser     string `json:"otherUser,omitempty"`
+	OtherUserID   string `json:"otherUserId,omitempty"`
+	AcceptRequest string `json:"acceptRequest,omitempty"`
+}
+
+// WebSocketResponse is a message sent by the server through /ws. It is either the "result" of a request (with the
+// HTTP status and message that the equivalent HTTP endpoint would have returned), a "pong" answering a "ping",
+// or an "event" (see EventBus).
+type WebSocketResponse struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Friends []string          `json:"friends"` // null unless the response lists friends, [] if there are none
+	EventID uint64            `json:"eventId,omitempty"`
+	Event   string            `json:"event,omitempty"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// WebSocket takes a ws HTTP request (r) to the UsersServer (s) and upgrades it to a WebSocket connection through
+// which the user can send requests and receive events until either side closes it. User must authenticate using
+// HTTP basic authentication when opening the connection. If the request has a Last-Event-ID header, events published
+// after that one are sent first (as in /events).
+func (s *UsersServer) WebSocket(w *http.ResponseWriter, r *http.Request) {
+	// Check credentials
+	user, err := s.GetAuthenticatedUser(r)
+	if err != nil {
+		WriteStoreError(w, err)
+		return
+	}
+
+	lastEventID, ok := GetLastEventID(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := UpgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	interval := s.getHeartbeatInterval()
+	conn.ReadTimeout = 2 * interval // client must answer at least one of our pings
+
+	var events <-chan Event // nil (ie never ready) if there is no event bus
+	if s.events != nil {
+		sub, missed := s.events.Subscribe(user, lastEventID)
+		defer s.events.Unsubscribe(sub)
+		events = sub.Events
+
+		for _, event := range missed {
+			WriteWebSocketJSON(conn, EventToWebSocketResponse(event))
+		}
+	}
+
+	done := make(chan bool)
+	defer close(done)
+
+	// Writer: forwards events and pings the client periodically
+	go func() {
+		ping := time.NewTicker(interval)
+		defer ping.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+
+			case event, ok := <-events:
+				if !ok {
+					conn.Close() // subscription dropped, client will reconnect using Last-Event-ID
+					return
+				}
+				WriteWebSocketJSON(conn, EventToWebSocketResponse(event))
+
+			case <-ping.C:
+				conn.WriteMessage(OpPing, nil)
+			}
+		}
+	}()
+
+	// Reader: processes requests until the connection is closed
+	for {
+		opcode, payload, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var request WebSocketRequest
+		if opcode != OpText || json.Unmarshal(payload, &request) != nil {
+			WriteWebSocketJSON(conn, WebSocketResponse{
+				Type:    "result",
+				Status:  http.StatusBadRequest,
+				Message: "Messages must be JSON objects",
+			})
+			continue
+		}
+
+		WriteWebSocketJSON(conn, s.HandleWebSocketRequest(r, user, request))
+	}
+}
+
+// HandleWebSocketRequest processes a request sent through the /ws connection opened by request r by user (who must
+// have been authenticated already) and returns the response for the client
+func (s *UsersServer) HandleWebSocketRequest(r *http.Request, user string, request WebSocketRequest) WebSocketResponse {
+	response := WebSocketResponse{Type: "result", ID: request.ID}
+
+	switch request.Type {
+	case "ping":
+		response.Type = "pong"
+
+	case "requestFriendship":
+		userTo, err := s.resolveUser(r.Context(), map[string]string{"userTo": request.UserTo, "userToId": request.UserToID}, "userTo")
+		if err != nil {
+			response.Status, response.Message = GetStoreErrorStatus(err)
+			break
+		}
+		response.Status, response.Message = s.requestFriendship(r.Context(), user, userTo)
+		if response.Status == http.StatusOK {
+			s.friendshipRequested(r, user, userTo)
+		}
+
+	case "respondToFriendshipRequest":
+		accept, ok := ParseAcceptRequest(request.AcceptRequest)
+		if !ok {
+			response.Status, response.Message = http.StatusBadRequest, "acceptRequest field must be either 1 or 0"
+			break
+		}
+		otherUser, err := s.resolveUser(r.Context(), map[string]string{"otherUser": request.OtherUser, "otherUserId": request.OtherUserID}, "otherUser")
+		if err != nil {
+			response.Status, response.Message = GetStoreErrorStatus(err)
+			break
+		}
+		response.Status, response.Message = s.respondToFriendshipRequest(r.Context(), user, otherUser, accept)
+		if response.Status == http.StatusOK {
+			s.friendshipResponded(r, user, otherUser, accept)
+		}
+
+	case "getFriends":
+		friend, err := s.resolveUser(r.Context(), map[string]string{"user": request.User, "userId": request.UserID}, "user")
+		if err != nil {
+			response.Status, response.Message = GetStoreErrorStatus(err)
+			break
+		}
+		response.Friends, response.Status, response.Message = s.getFriends(r.Context(), user, friend)
+		if response.Status == http.StatusOK && response.Friends == nil {
+			response.Friends = []string{}
+		}
+
+	default:
+		response.Status, response.Message = http.StatusNotFound, "Unknown message type"
+	}
+
+	return response
+}
+
+// EventToWebSocketResponse returns the message that notifies event to a /ws client
+func EventToWebSocketResponse(event Event) WebSocketResponse {
+	return WebSocketResponse{Type: "event", EventID: event.ID, Event: event.Type, Data: event.Data}
+}
+
+// WriteWebSocketJSON sends v encoded as JSON in a text message through conn
+func WriteWebSocketJSON(conn *WebSocketConn, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(OpText, payload)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, events: NewEventBus(100, 10)}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+	RunSignUpTest(t, server, "sign up a new user", "sergi", "12345678", http.StatusOK)
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close) // runs after the connections are closed
+
+	t.Run("connect (wrong password)", func(t *testing.T) {
+		_, status := DialWebSocket(t, httpServer, "arnau", "wrongPass")
+		AssertStatus(t, status, http.StatusUnauthorized)
+	})
+
+	arnau, _ := DialWebSocket(t, httpServer, "arnau", "12345678")
+	sergi, _ := DialWebSocket(t, httpServer, "sergi", "12345678")
+
+	RunWebSocketTest(t, arnau, "ping", WebSocketRequest{Type: "ping", ID: "1"}, WebSocketResponse{Type: "pong", ID: "1"})
+	RunWebSocketTest(t, arnau, "unknown message type", WebSocketRequest{Type: "signUp", ID: "2"},
+		WebSocketResponse{Type: "result", ID: "2", Status: http.StatusNotFound, Message: "Unknown message type"})
+
+	arnau.WriteFrame(t, OpText, []byte(`{"type": "getFriends", "id": "list", "user": "arnau"}`))
+	_, payload := arnau.ReadFrame(t)
+	t.Run("list friends (no friends)", func(t *testing.T) {
+		AssertResponseBody(t, string(payload), `{"type":"result","id":"list","status":200,"friends":[]}`)
+	})
+
+	RunWebSocketTest(t, arnau, "request friendship (to user does not exist)",
+		WebSocketRequest{Type: "requestFriendship", ID: "3", UserTo: "peter"},
+		WebSocketResponse{Type: "result", ID: "3", Status: http.StatusBadRequest, Message: "User does not exist"})
+	RunWebSocketTest(t, arnau, "request friendship",
+		WebSocketRequest{Type: "requestFriendship", ID: "4", UserTo: "sergi"},
+		WebSocketResponse{Type: "result", ID: "4", Status: http.StatusOK})
+	RunWebSocketTest(t, arnau, "request friendship (request is in pending status)",
+		WebSocketRequest{Type: "requestFriendship", ID: "5", UserTo: "sergi"},
+		WebSocketResponse{Type: "result", ID: "5", Status: http.StatusBadRequest, Message: "Friendship request already exists"})
+
+	AssertWebSocketMessage(t, sergi, "sergi gets the request", WebSocketResponse{
+		Type: "event", EventID: 1, Event: EventFriendshipRequestReceived, Data: map[string]string{"from": "arnau"},
+	})
+
+	RunWebSocketTest(t, sergi, "accept friendship (wrong acceptRequest)",
+		WebSocketRequest{Type: "respondToFriendshipRequest", ID: "a", OtherUser: "arnau", AcceptRequest: "yes"},
+		WebSocketResponse{Type: "result", ID: "a", Status: http.StatusBadRequest, Message: "acceptRequest field must be either 1 or 0"})
+	RunWebSocketTest(t, sergi, "accept friendship",
+		WebSocketRequest{Type: "respondToFriendshipRequest", ID: "b", OtherUser: "arnau", AcceptRequest: "1"},
+		WebSocketResponse{Type: "result", ID: "b", Status: http.StatusOK})
+
+	AssertWebSocketMessage(t, arnau, "arnau gets the acceptance", WebSocketResponse{
+		Type: "event", EventID: 2, Event: EventFriendshipRequestAccepted, Data: map[string]string{"by": "sergi"},
+	})
+
+	RunWebSocketTest(t, arnau, "list friends", WebSocketRequest{Type: "getFriends", ID: "6", User: "sergi"},
+		WebSocketResponse{Type: "result", ID: "6", Status: http.StatusOK, Friends: []string{"arnau"}})
+	RunListFriends(t, server, "list friends through HTTP", "arnau", "[sergi]", http.StatusOK)
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	store := EmptyUsersStore()
+	server := &UsersServer{store: store, heartbeatInterval: 10 * time.Millisecond}
+
+	RunSignUpTest(t, server, "sign up a new user", "arnau", "12345678", http.StatusOK)
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	client, _ := DialWebSocket(t, httpServer, "arnau", "12345678")
+
+	t.Run("server pings the client", func(t *testing.T) {
+		if opcode, _ := client.ReadFrame(t); opcode != OpPing {
+			t.Errorf("got opcode %d, want ping", opcode)
+		}
+	})
+
+	t.Run("server answers client pings", func(t *testing.T) {
+		client.WriteFrame(t, OpPing, []byte("hello"))
+		for {
+			opcode, payload := client.ReadFrame(t)
+			if opcode == OpPing {
+				continue
+			}
+			if opcode != OpPong || string(payload) != "hello" {
+				t.Errorf("got opcode %d with payload %q, want pong with %q", opcode, payload, "hello")
+			}
+			return
+		}
+	})
+
+	t.Run("server closes the connection of unresponsive clients", func(t *testing.T) {
+		client.conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.Copy(io.Discard, client.reader); err != nil {
+			t.Errorf("connection should have been closed by the server, got %v", err)
+		}
+	})
+}
+
+// WebSocketTestClient is a minimal WebSocket client used to test /ws
+type WebSocketTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// DialWebSocket opens a WebSocket connection to s/ws. If the handshake fails, the HTTP status is returned instead
+func DialWebSocket(t *testing.T, s *httptest.Server, user, password string) (*WebSocketTestClient, int) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	request, _ := http.NewRequest(http.MethodGet, s.URL+"/ws", nil)
+	request.SetBasicAuth(user, password)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")))
+	if err := request.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, response.StatusCode
+	}
+
+	return &WebSocketTestClient{conn: conn, reader: reader}, response.StatusCode
+}
+
+// WriteFrame sends a masked frame to the server
+func (c *WebSocketTestClient) WriteFrame(t *testing.T, opcode byte, payload []byte) {
+	t.Helper()
+
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))} // test payloads are always shorter than 126 bytes
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ReadFrame reads an unmasked, unfragmented frame sent by the server
+func (c *WebSocketTestClient) ReadFrame(t *testing.T) (byte, []byte) {
+	t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		t.Fatal(err)
+	}
+
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		extended := make([]byte, 2)
+		io.ReadFull(c.reader, extended)
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+// ReadJSON returns the next text message sent by the server, skipping control frames
+func (c *WebSocketTestClient) ReadJSON(t *testing.T) WebSocketResponse {
+	t.Helper()
+
+	for {
+		opcode, payload := c.ReadFrame(t)
+		if opcode != OpText {
+			continue
+		}
+
+		var response WebSocketResponse
+		if err := json.Unmarshal(payload, &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+}
+
+func RunWebSocketTest(t *testing.T, c *WebSocketTestClient, testName string, request WebSocketRequest, want WebSocketResponse) {
+	payload, _ := json.Marshal(request)
+	c.WriteFrame(t, OpText, payload)
+
+	AssertWebSocketMessage(t, c, testName, want)
+}
+
+func AssertWebSocketMessage(t *testing.T, c *WebSocketTestClient, testName string, want WebSocketResponse) {
+	got := c.ReadJSON(t)
+
+	t.Run(testName, func(t *testing.T) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("got message %s, want %s", gotJSON, wantJSON)
+		}
+	})
+}
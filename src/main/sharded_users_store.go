@@ -0,0 +1,875 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultStoreShards is the default number of shards of a ShardedUsersStore
+const DefaultStoreShards = 16
+
+// ShardedUsersStore collects data about users in memory, like InMemoryUsersStore, but partitioned in shards with
+// their own locks so that operations on different users can run in parallel.
+// Usernames (and deleted users) are partitioned by username in name shards, and the data of each user by ID in user
+// shards. Operations involving several users (eg accepting a friendship or deleting a user with friends) lock all the
+// shards involved, and to avoid deadlocks locks are always acquired in the same order: name shards before user
+// shards, and shards of the same kind by ascending index.
+// It is safe for concurrent use.
+type ShardedUsersStore struct {
+	lastVersion uint64 // last version given to a list (see UserVersions), accessed atomically
+	names       []*nameShard
+	shards      []*userShard
+	backup      versionsBackup // of the versions changed by the transaction in progress, if any
+}
+
+// nameShard holds the usernames whose hash falls in the shard
+type nameShard struct {
+	mu           sync.RWMutex
+	users        map[string]string      // users["john0"] is the ID of john0
+	deletedUsers map[string]deletedUser // by username, soft-deleted users which can still be restored (see DeleteUser)
+}
+
+// userShard holds the data of the users whose ID hash falls in the shard. Relationships are kept as in
+// InMemoryUsersStore, and may point to users in other shards
+type userShard struct {
+	mu               sync.RWMutex
+	usernames        map[string]string          // usernames[id] is the username of user with this ID
+	passwords        map[string]string          // by ID
+	sentRequests     map[string]StringSet       // by ID
+	receivedRequests map[string]StringSet       // by ID
+	friends          map[string]StringSet       // by ID
+	profiles         map[string]Profile         // by ID
+	privacy          map[string]PrivacySettings // by ID
+	roles            map[string]string          // by ID
+	deletedIDs       StringSet                  // IDs of deleted users which have not been purged yet
+	versions         map[string]UserVersions    // by ID
+}
+
+// GetUsers retrieves a list of all users, sorted alphabetically
+func (s *ShardedUsersStore) GetUsers() []string {
+	usernames := make([]string, 0)
+	for _, names := range s.names {
+		names.mu.RLock()
+		for name := range names.users {
+			usernames = append(usernames, name)
+		}
+		names.mu.RUnlock()
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// AddUser adds a user with given username and password, and a newly generated ID (see InMemoryUsersStore.AddUser)
+func (s *ShardedUsersStore) AddUser(name string, password string) bool {
+	return s.AddUserWithID(NewUserID(), name, password)
+}
+
+// AddUserWithID adds a user with given ID, username and password (see InMemoryUsersStore.AddUserWithID)
+func (s *ShardedUsersStore) AddUserWithID(id, name, password string) bool {
+	names := s.getNameShard(name)
+	names.mu.Lock()
+	defer names.mu.Unlock()
+	shard := s.getUserShard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, alreadyExists := names.users[name]; alreadyExists {
+		return false
+	}
+	if _, isDeleted := names.deletedUsers[name]; isDeleted {
+		return false
+	}
+	if _, idExists := shard.usernames[id]; idExists || shard.deletedIDs.Contains(id) {
+		return false
+	}
+
+	now := time.Now().UTC()
+	names.users[name] = id
+	shard.usernames[id] = name
+	shard.passwords[id] = password
+	shard.sentRequests[id] = NewStringSet()
+	shard.receivedRequests[id] = NewStringSet()
+	shard.friends[id] = NewStringSet()
+	shard.profiles[id] = Profile{ID: id, User: name, CreatedAt: now, LastSeen: now}
+	shard.privacy[id] = DefaultPrivacySettings()
+	shard.roles[id] = RoleUser
+	version := s.newVersion()
+	s.backupVersions(shard, id)
+	shard.versions[id] = UserVersions{Friends: version, Requests: version}
+	return true
+}
+
+// UserExists returns true iff user with name `name` exists
+func (s *ShardedUsersStore) UserExists(name string) bool {
+	_, exists := s.GetUserID(name)
+	return exists
+}
+
+// GetUserID returns the ID of user with name `name`.
+// ok is false iff user does not exist
+func (s *ShardedUsersStore) GetUserID(name string) (string, bool) {
+	names := s.getNameShard(name)
+	names.mu.RLock()
+	defer names.mu.RUnlock()
+
+	id, ok := names.users[name]
+	return id, ok
+}
+
+// GetUsername returns the username of user with ID `id`.
+// ok is false iff user does not exist
+func (s *ShardedUsersStore) GetUsername(id string) (string, bool) {
+	shard := s.getUserShard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	name, ok := shard.usernames[id]
+	return name, ok
+}
+
+// IsDeletedUser returns true iff `name` is the username of a deleted user which has not been purged yet (see
+// InMemoryUsersStore.IsDeletedUser)
+func (s *ShardedUsersStore) IsDeletedUser(name string) bool {
+	names := s.getNameShard(name)
+	names.mu.RLock()
+	defer names.mu.RUnlock()
+
+	_, isDeleted := names.deletedUsers[name]
+	return isDeleted
+}
+
+// IsDeletedID returns true iff `id` is the ID of a deleted user which has not been purged yet (see
+// InMemoryUsersStore.IsDeletedID)
+func (s *ShardedUsersStore) IsDeletedID(id string) bool {
+	shard := s.getUserShard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	return shard.deletedIDs.Contains(id)
+}
+
+// RequestFriendship adds a friendship request from user `from` to user `to` (see InMemoryUsersStore.RequestFriendship)
+func (s *ShardedUsersStore) RequestFriendship(from, to string) bool {
+	return s.RequestFriendshipIf(from, to, nil)
+}
+
+// RequestFriendshipIf adds a friendship request from user `from` to user `to` iff condition returns true (see
+// InMemoryUsersStore.RequestFriendshipIf). It is called with the shards of both users locked
+func (s *ShardedUsersStore) RequestFriendshipIf(from, to string, condition func(versions UserVersions) bool) bool {
+	ok := false
+	s.withUsers(from, to, func(fromShard *userShard, fromID string, toShard *userShard, toID string) {
+		if condition != nil && !condition(fromShard.versions[fromID]) {
+			return
+		}
+		if fromShard.sentRequests[fromID].Contains(toID) || toShard.sentRequests[toID].Contains(fromID) ||
+			fromShard.friends[fromID].Contains(toID) {
+			return
+		}
+		fromShard.sentRequests[fromID].Add(toID)
+		toShard.receivedRequests[toID].Add(fromID)
+		s.setRequestsVersion(s.newVersion(), fromID, toID)
+		ok = true
+	})
+	return ok
+}
+
+// GetPassword returns the password of user (eg to export users).
+// ok is false iff user does not exist
+func (s *ShardedUsersStore) GetPassword(user string) (password string, ok bool) {
+	ok = s.withUser(user, false, func(shard *userShard, id string) {
+		password = shard.passwords[id]
+	})
+	return password, ok
+}
+
+// CheckUsersPassword returns true if user exists and has this password
+func (s *ShardedUsersStore) CheckUsersPassword(user, password string) bool {
+	got, exists := s.GetPassword(user)
+	return exists && got == password
+}
+
+// ChangePassword sets the password of user to newPassword (see InMemoryUsersStore.ChangePassword)
+func (s *ShardedUsersStore) ChangePassword(user, newPassword string) bool {
+	return s.withUser(user, true, func(shard *userShard, id string) {
+		shard.passwords[id] = newPassword
+	})
+}
+
+// RespondToFriendshipRequest responds to a friendship request from otherUser made to user (see
+// InMemoryUsersStore.RespondToFriendshipRequest). If they are in different shards, both are locked so that the
+// friendship is added to both users atomically
+func (s *ShardedUsersStore) RespondToFriendshipRequest(user, otherUser string, acceptRequest bool) bool {
+	return s.RespondToFriendshipRequestIf(user, otherUser, acceptRequest, nil)
+}
+
+// RespondToFriendshipRequestIf responds to a friendship request from otherUser made to user iff condition returns
+// true (see InMemoryUsersStore.RespondToFriendshipRequestIf). It is called with the shards of both users locked
+func (s *ShardedUsersStore) RespondToFriendshipRequestIf(user, otherUser string, acceptRequest bool, condition func(versions UserVersions) bool) bool {
+	ok := false
+	s.withUsers(user, otherUser, func(shard *userShard, id string, otherShard *userShard, otherID string) {
+		if !shard.receivedRequests[id].Contains(otherID) {
+			return
+		}
+		if condition != nil && !condition(shard.versions[id]) {
+			return
+		}
+		shard.receivedRequests[id].Remove(otherID)
+		otherShard.sentRequests[otherID].Remove(id)
+		version := s.newVersion()
+		s.setRequestsVersion(version, id, otherID)
+		if acceptRequest {
+			shard.friends[id].Add(otherID)
+			otherShard.friends[otherID].Add(id)
+			s.setFriendsVersion(version, id, otherID)
+		}
+		ok = true
+	})
+	return ok
+}
+
+// GetFriends returns the list of friends of a given user, sorted. The returned slice is a copy and can be modified
+// freely
+func (s *ShardedUsersStore) GetFriends(user string) []string {
+	friends := make([]string, 0)
+	s.withRelatedUsers(user, false, getFriendIDs, func(shard *userShard, id string) {
+		friends = s.getUsernames(shard.friends[id])
+	})
+	return friends
+}
+
+// GetFriendshipRequests returns the users to whom user has sent a friendship request which is still pending (sent)
+// and the users who have sent one to user (received), sorted. The returned slices are copies and can be modified
+// freely.
+// ok is false iff user does not exist
+func (s *ShardedUsersStore) GetFriendshipRequests(user string) (sent, received []string, ok bool) {
+	ok = s.withRelatedUsers(user, false, getRequestIDs, func(shard *userShard, id string) {
+		sent = s.getUsernames(shard.sentRequests[id])
+		received = s.getUsernames(shard.receivedRequests[id])
+	})
+	return sent, received, ok
+}
+
+// AreFriends returns true iff users user and otherUser exist and are friends (see InMemoryUsersStore.AreFriends)
+func (s *ShardedUsersStore) AreFriends(user, otherUser string) bool {
+	otherID, otherExists := s.GetUserID(otherUser)
+	areFriends := false
+	s.withUser(user, false, func(shard *userShard, id string) {
+		areFriends = otherExists && shard.friends[id].Contains(otherID)
+	})
+	return areFriends
+}
+
+// HasFriendshipRequest returns true iff users `from` and `to` exist and there is a pending friendship request from
+// `from` to `to` (see InMemoryUsersStore.HasFriendshipRequest)
+func (s *ShardedUsersStore) HasFriendshipRequest(from, to string) bool {
+	toID, toExists := s.GetUserID(to)
+	hasRequest := false
+	s.withUser(from, false, func(shard *userShard, id string) {
+		hasRequest = toExists && shard.sentRequests[id].Contains(toID)
+	})
+	return hasRequest
+}
+
+// HaveCommonFriend returns true iff users user and otherUser exist and have a friend in common (see
+// InMemoryUsersStore.HaveCommonFriend)
+func (s *ShardedUsersStore) HaveCommonFriend(user, otherUser string) bool {
+	id, exists := s.GetUserID(user)
+	otherID, otherExists := s.GetUserID(otherUser)
+	if !exists || !otherExists {
+		return false
+	}
+
+	_, unlock := s.lockUserShards(false, id, otherID)
+	defer unlock()
+	return s.getUserShard(id).friends[id].Intersects(s.getUserShard(otherID).friends[otherID])
+}
+
+// GetVersions returns the versions of the friends list and the friendship requests of user.
+// ok is false iff user does not exist
+func (s *ShardedUsersStore) GetVersions(user string) (versions UserVersions, ok bool) {
+	ok = s.withUser(user, false, func(shard *userShard, id string) {
+		versions = shard.versions[id]
+	})
+	return versions, ok
+}
+
+// RemoveFriendship removes the friendship between user and otherUser.
+// Returns false iff they are not friends (in this case no modifications are made)
+func (s *ShardedUsersStore) RemoveFriendship(user, otherUser string) bool {
+	ok := false
+	s.withUsers(user, otherUser, func(shard *userShard, id string, otherShard *userShard, otherID string) {
+		if shard.friends[id].Remove(otherID) {
+			otherShard.friends[otherID].Remove(id)
+			s.setFriendsVersion(s.newVersion(), id, otherID)
+			ok = true
+		}
+	})
+	return ok
+}
+
+// GetProfile returns the profile of user.
+// ok is false iff user does not exist
+func (s *ShardedUsersStore) GetProfile(user string) (profile Profile, ok bool) {
+	ok = s.withUser(user, false, func(shard *userShard, id string) {
+		profile = shard.profiles[id]
+	})
+	return profile, ok
+}
+
+// UpdateProfile modifies the profile of user with the non-nil fields of update (see InMemoryUsersStore.UpdateProfile)
+func (s *ShardedUsersStore) UpdateProfile(user string, update ProfileUpdate) bool {
+	return s.withUser(user, true, func(shard *userShard, id string) {
+		profile := shard.profiles[id]
+		update.Apply(&profile)
+		shard.profiles[id] = profile
+	})
+}
+
+// GetPrivacySettings returns the privacy settings of user.
+// ok is false iff user does not exist
+func (s *ShardedUsersStore) GetPrivacySettings(user string) (settings PrivacySettings, ok bool) {
+	ok = s.withUser(user, false, func(shard *userShard, id string) {
+		settings = shard.privacy[id]
+	})
+	return settings, ok
+}
+
+// UpdatePrivacySettings modifies the privacy settings of user with the non-nil fields of update (see
+// InMemoryUsersStore.UpdatePrivacySettings)
+func (s *ShardedUsersStore) UpdatePrivacySettings(user string, update PrivacySettingsUpdate) bool {
+	return s.withUser(user, true, func(shard *userShard, id string) {
+		settings := shard.privacy[id]
+		update.Apply(&settings)
+		shard.privacy[id] = settings
+	})
+}
+
+// GetRole returns the role of user.
+// ok is false iff user does not exist
+func (s *ShardedUsersStore) GetRole(user string) (role string, ok bool) {
+	ok = s.withUser(user, false, func(shard *userShard, id string) {
+		role = shard.roles[id]
+	})
+	return role, ok
+}
+
+// SetRole sets the role of user (see InMemoryUsersStore.SetRole)
+func (s *ShardedUsersStore) SetRole(user, role string) bool {
+	return s.withUser(user, true, func(shard *userShard, id string) {
+		shard.roles[id] = role
+	})
+}
+
+// TouchUser sets the last time user was seen to now. Does nothing if user does not exist
+func (s *ShardedUsersStore) TouchUser(user string) {
+	s.withUser(user, true, func(shard *userShard, id string) {
+		profile := shard.profiles[id]
+		profile.LastSeen = time.Now().UTC()
+		shard.profiles[id] = profile
+	})
+}
+
+// RenameUser changes the username of user oldName to newName (see InMemoryUsersStore.RenameUser). The shards of all
+// the users in whose lists they appear are locked, so that the versions of the lists change atomically
+func (s *ShardedUsersStore) RenameUser(oldName, newName string) bool {
+	unlockNames := s.lockNameShards(oldName, newName)
+	defer unlockNames()
+	oldNames, newNames := s.getNameShard(oldName), s.getNameShard(newName)
+
+	id, exists := oldNames.users[oldName]
+	if !exists {
+		return false
+	}
+	if _, alreadyExists := newNames.users[newName]; alreadyExists {
+		return false
+	}
+	if _, isDeleted := newNames.deletedUsers[newName]; isDeleted {
+		return false
+	}
+
+	unlock := s.lockRelatedUsers(id, true, getRelatedIDs)
+	defer unlock()
+	shard := s.getUserShard(id)
+
+	profile := shard.profiles[id]
+	profile.User = newName
+	shard.profiles[id] = profile
+	shard.usernames[id] = newName
+	newNames.users[newName] = id
+	delete(oldNames.users, oldName)
+
+	version := s.newVersion()
+	s.setFriendsVersion(version, shard.friends[id].Slice()...)
+	s.setRequestsVersion(version, shard.sentRequests[id].Slice()...)
+	s.setRequestsVersion(version, shard.receivedRequests[id].Slice()...)
+	return true
+}
+
+// DeleteUser soft-deletes user `name` (see InMemoryUsersStore.DeleteUser). The shards of all their friends and users
+// with whom they have pending friendship requests are locked, so that the user is removed from all of them atomically
+func (s *ShardedUsersStore) DeleteUser(name string) bool {
+	names := s.getNameShard(name)
+	names.mu.Lock()
+	defer names.mu.Unlock()
+
+	id, exists := names.users[name]
+	if !exists {
+		return false
+	}
+
+	unlock := s.lockRelatedUsers(id, true, getRelatedIDs)
+	defer unlock()
+	shard := s.getUserShard(id)
+
+	deleted := deletedUser{
+		id:               id,
+		password:         shard.passwords[id],
+		profile:          shard.profiles[id],
+		privacy:          shard.privacy[id],
+		role:             shard.roles[id],
+		friends:          shard.friends[id].Slice(),
+		sentRequests:     shard.sentRequests[id].Slice(),
+		receivedRequests: shard.receivedRequests[id].Slice(),
+		deletedAt:        time.Now().UTC(),
+	}
+
+	version := s.newVersion()
+	for friend := range shard.friends[id] {
+		s.getUserShard(friend).friends[friend].Remove(id)
+		s.setFriendsVersion(version, friend)
+	}
+	for to := range shard.sentRequests[id] {
+		s.getUserShard(to).receivedRequests[to].Remove(id)
+		s.setRequestsVersion(version, to)
+	}
+	for from := range shard.receivedRequests[id] {
+		s.getUserShard(from).sentRequests[from].Remove(id)
+		s.setRequestsVersion(version, from)
+	}
+
+	delete(names.users, name)
+	delete(shard.usernames, id)
+	delete(shard.passwords, id)
+	delete(shard.sentRequests, id)
+	delete(shard.receivedRequests, id)
+	delete(shard.friends, id)
+	delete(shard.profiles, id)
+	delete(shard.privacy, id)
+	delete(shard.roles, id)
+	s.backupVersions(shard, id)
+	delete(shard.versions, id)
+	names.deletedUsers[name] = deleted
+	shard.deletedIDs.Add(id)
+	return true
+}
+
+// RestoreUser restores the soft-deleted user `name` (see InMemoryUsersStore.RestoreUser)
+func (s *ShardedUsersStore) RestoreUser(name, password string) bool {
+	names := s.getNameShard(name)
+	names.mu.Lock()
+	defer names.mu.Unlock()
+
+	deleted, isDeleted := names.deletedUsers[name]
+	if !isDeleted || deleted.password != password {
+		return false
+	}
+
+	id := deleted.id
+	related := append(append(append([]string{id}, deleted.friends...), deleted.sentRequests...), deleted.receivedRequests...)
+	_, unlock := s.lockUserShards(true, related...)
+	defer unlock()
+	shard := s.getUserShard(id)
+
+	names.users[name] = id
+	delete(names.deletedUsers, name)
+	shard.deletedIDs.Remove(id)
+	shard.usernames[id] = name
+	shard.passwords[id] = password
+	shard.sentRequests[id] = NewStringSet()
+	shard.receivedRequests[id] = NewStringSet()
+	shard.friends[id] = NewStringSet()
+	shard.profiles[id] = deleted.profile
+	shard.privacy[id] = deleted.privacy
+	shard.roles[id] = deleted.role
+	version := s.newVersion()
+	s.backupVersions(shard, id)
+	shard.versions[id] = UserVersions{Friends: version, Requests: version}
+
+	for _, friend := range deleted.friends {
+		if friendShard := s.getUserShard(friend); friendShard.exists(friend) {
+			shard.friends[id].Add(friend)
+			friendShard.friends[friend].Add(id)
+			s.setFriendsVersion(version, friend)
+		}
+	}
+
+	for _, to := range deleted.sentRequests {
+		if toShard := s.getUserShard(to); toShard.exists(to) && !shard.friends[id].Contains(to) && !toShard.sentRequests[to].Contains(id) {
+			shard.sentRequests[id].Add(to)
+			toShard.receivedRequests[to].Add(id)
+			s.setRequestsVersion(version, to)
+		}
+	}
+
+	for _, from := range deleted.receivedRequests {
+		if fromShard := s.getUserShard(from); fromShard.exists(from) && !shard.friends[id].Contains(from) && !shard.sentRequests[id].Contains(from) {
+			fromShard.sentRequests[from].Add(id)
+			shard.receivedRequests[id].Add(from)
+			s.setRequestsVersion(version, from)
+		}
+	}
+
+	return true
+}
+
+// PurgeDeletedUsers permanently removes the users deleted before deletedBefore (see
+// InMemoryUsersStore.PurgeDeletedUsers). Returns the usernames of the purged users
+func (s *ShardedUsersStore) PurgeDeletedUsers(deletedBefore time.Time) []string {
+	purged := make([]string, 0)
+	for _, names := range s.names {
+		names.mu.Lock()
+		for name, deleted := range names.deletedUsers {
+			if deleted.deletedAt.Before(deletedBefore) {
+				s.purge(names, name)
+				purged = append(purged, name)
+			}
+		}
+		names.mu.Unlock()
+	}
+	return purged
+}
+
+// PurgeDeletedUser permanently removes the deleted user `name` regardless of when they were deleted.
+// Returns false iff there is no deleted user with this name
+func (s *ShardedUsersStore) PurgeDeletedUser(name string) bool {
+	names := s.getNameShard(name)
+	names.mu.Lock()
+	defer names.mu.Unlock()
+
+	if _, isDeleted := names.deletedUsers[name]; !isDeleted {
+		return false
+	}
+	s.purge(names, name)
+	return true
+}
+
+// purge removes the deleted user `name`. Caller must hold names.mu
+func (s *ShardedUsersStore) purge(names *nameShard, name string) {
+	id := names.deletedUsers[name].id
+	shard := s.getUserShard(id)
+	shard.mu.Lock()
+	shard.deletedIDs.Remove(id)
+	shard.mu.Unlock()
+	delete(names.deletedUsers, name)
+}
+
+// withUser calls fn with the shard of user `name` locked (for writing iff write) and the user's ID.
+// Returns false iff user does not exist, in which case fn is not called
+func (s *ShardedUsersStore) withUser(name string, write bool, fn func(shard *userShard, id string)) bool {
+	id, exists := s.GetUserID(name)
+	if !exists {
+		return false
+	}
+
+	shard := s.getUserShard(id)
+	if write {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	} else {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+	}
+	if shard.usernames[id] != name {
+		return false // renamed or deleted since resolved
+	}
+	fn(shard, id)
+	return true
+}
+
+// withUsers calls fn with the shards of users `name` and `otherName` locked for writing, and their IDs.
+// Returns false iff any of them does not exist, in which case fn is not called
+func (s *ShardedUsersStore) withUsers(name, otherName string, fn func(shard *userShard, id string, otherShard *userShard, otherID string)) bool {
+	id, exists := s.GetUserID(name)
+	otherID, otherExists := s.GetUserID(otherName)
+	if !exists || !otherExists {
+		return false
+	}
+
+	i, otherI := s.getUserShardIndex(id), s.getUserShardIndex(otherID)
+	shard, otherShard := s.shards[i], s.shards[otherI]
+	switch {
+	case i == otherI:
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	case i < otherI:
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		otherShard.mu.Lock()
+		defer otherShard.mu.Unlock()
+	default:
+		otherShard.mu.Lock()
+		defer otherShard.mu.Unlock()
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	}
+	if shard.usernames[id] != name || otherShard.usernames[otherID] != otherName {
+		return false // renamed or deleted since resolved
+	}
+	fn(shard, id, otherShard, otherID)
+	return true
+}
+
+// withRelatedUsers calls fn with the shards of user `name` and of the users returned by related locked (for writing
+// iff write), and the user's ID.
+// Returns false iff user does not exist, in which case fn is not called
+func (s *ShardedUsersStore) withRelatedUsers(name string, write bool, related func(shard *userShard, id string) []string, fn func(shard *userShard, id string)) bool {
+	id, exists := s.GetUserID(name)
+	if !exists {
+		return false
+	}
+
+	unlock := s.lockRelatedUsers(id, write, related)
+	defer unlock()
+	shard := s.getUserShard(id)
+	if shard.usernames[id] != name {
+		return false // renamed or deleted since resolved
+	}
+	fn(shard, id)
+	return true
+}
+
+// lockRelatedUsers locks (for writing iff write) the shard of user id and the shards of the users returned by related,
+// and returns the function which unlocks them. Since related users can only be known with the shard of id locked,
+// they are read first and then all shards are locked in order; if related users changed in between, it tries again
+func (s *ShardedUsersStore) lockRelatedUsers(id string, write bool, related func(shard *userShard, id string) []string) (unlock func()) {
+	shard := s.getUserShard(id)
+	for {
+		shard.mu.RLock()
+		ids := related(shard, id)
+		shard.mu.RUnlock()
+
+		locked, unlock := s.lockUserShards(write, append(ids, id)...)
+		allLocked := true
+		for _, relatedID := range related(shard, id) {
+			if !locked[s.getUserShardIndex(relatedID)] {
+				allLocked = false
+				break
+			}
+		}
+		if allLocked {
+			return unlock
+		}
+		unlock()
+	}
+}
+
+// lockUserShards locks (for writing iff write) the shards of the users with the given IDs, by ascending index. Returns
+// the indices of the locked shards and the function which unlocks them
+func (s *ShardedUsersStore) lockUserShards(write bool, ids ...string) (locked map[int]bool, unlock func()) {
+	locked = map[int]bool{}
+	for _, id := range ids {
+		locked[s.getUserShardIndex(id)] = true
+	}
+	indices := make([]int, 0, len(locked))
+	for i := range locked {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+
+	for _, i := range indices {
+		if write {
+			s.shards[i].mu.Lock()
+		} else {
+			s.shards[i].mu.RLock()
+		}
+	}
+	return locked, func() {
+		for _, i := range indices {
+			if write {
+				s.shards[i].mu.Unlock()
+			} else {
+				s.shards[i].mu.RUnlock()
+			}
+		}
+	}
+}
+
+// lockNameShards locks the name shards of the given usernames for writing, by ascending index, and returns the
+// function which unlocks them
+func (s *ShardedUsersStore) lockNameShards(names ...string) (unlock func()) {
+	indices := make([]int, 0, len(names))
+	for _, name := range names {
+		if i := GetShardIndex(name, len(s.names)); IndexOfInt(indices, i) < 0 {
+			indices = append(indices, i)
+		}
+	}
+	sort.Ints(indices)
+
+	for _, i := range indices {
+		s.names[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range indices {
+			s.names[i].mu.Unlock()
+		}
+	}
+}
+
+// newVersion returns a new version for the lists changed by an operation (see UserVersions)
+func (s *ShardedUsersStore) newVersion() uint64 {
+	return atomic.AddUint64(&s.lastVersion, 1)
+}
+
+// setFriendsVersion sets the version of the friends lists of the users with the given IDs. Caller must hold the locks
+// of the shards of all of them for writing
+func (s *ShardedUsersStore) setFriendsVersion(version uint64, ids ...string) {
+	for _, id := range ids {
+		shard := s.getUserShard(id)
+		s.backupVersions(shard, id)
+		versions := shard.versions[id]
+		versions.Friends = version
+		shard.versions[id] = versions
+	}
+}
+
+// setRequestsVersion sets the version of the friendship requests of the users with the given IDs. Caller must hold
+// the locks of the shards of all of them for writing
+func (s *ShardedUsersStore) setRequestsVersion(version uint64, ids ...string) {
+	for _, id := range ids {
+		shard := s.getUserShard(id)
+		s.backupVersions(shard, id)
+		versions := shard.versions[id]
+		versions.Requests = version
+		shard.versions[id] = versions
+	}
+}
+
+// backupVersions backs up the versions of the user with ID id, in shard, if a transaction is in progress (see
+// BeginTransaction). Caller must hold the lock of shard for writing
+func (s *ShardedUsersStore) backupVersions(shard *userShard, id string) {
+	versions, ok := shard.versions[id]
+	s.backup.save(id, versions, ok)
+}
+
+// BeginTransaction starts backing up the versions changed by the mutations which follow, until EndTransaction is
+// called (see TransactionParticipant). No mutations may be in progress
+func (s *ShardedUsersStore) BeginTransaction() {
+	s.backup.begin(atomic.LoadUint64(&s.lastVersion))
+}
+
+// EndTransaction stops backing up versions, restoring the ones backed up (and the last version given) unless the
+// transaction was committed (see TransactionParticipant). No mutations may be in progress
+func (s *ShardedUsersStore) EndTransaction(commit bool) {
+	versions, lastVersion := s.backup.end()
+	if commit {
+		return
+	}
+	for id, saved := range versions {
+		shard := s.getUserShard(id)
+		shard.mu.Lock()
+		if saved == nil {
+			delete(shard.versions, id)
+		} else {
+			shard.versions[id] = *saved
+		}
+		shard.mu.Unlock()
+	}
+	atomic.StoreUint64(&s.lastVersion, lastVersion)
+}
+
+// getUsernames returns the usernames of the users with the given IDs, sorted. Caller must hold the locks of the
+// shards of all of them
+func (s *ShardedUsersStore) getUsernames(ids StringSet) []string {
+	names := make([]string, 0, len(ids))
+	for id := range ids {
+		names = append(names, s.getUserShard(id).usernames[id])
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *ShardedUsersStore) getNameShard(name string) *nameShard {
+	return s.names[GetShardIndex(name, len(s.names))]
+}
+
+func (s *ShardedUsersStore) getUserShard(id string) *userShard {
+	return s.shards[s.getUserShardIndex(id)]
+}
+
+func (s *ShardedUsersStore) getUserShardIndex(id string) int {
+	return GetShardIndex(id, len(s.shards))
+}
+
+// exists returns true iff user with ID id is in the shard. Caller must hold shard.mu
+func (shard *userShard) exists(id string) bool {
+	_, exists := shard.usernames[id]
+	return exists
+}
+
+// getFriendIDs returns the IDs of the friends of user id. Caller must hold shard.mu
+func getFriendIDs(shard *userShard, id string) []string {
+	return shard.friends[id].Slice()
+}
+
+// getRequestIDs returns the IDs of the users with whom user id has pending friendship requests. Caller must hold
+// shard.mu
+func getRequestIDs(shard *userShard, id string) []string {
+	return append(shard.sentRequests[id].Slice(), shard.receivedRequests[id].Slice()...)
+}
+
+// getRelatedIDs returns the IDs of the friends of user id and of the users with whom it has pending friendship
+// requests. Caller must hold shard.mu
+func getRelatedIDs(shard *userShard, id string) []string {
+	return append(getFriendIDs(shard, id), getRequestIDs(shard, id)...)
+}
+
+// --- AUXILIARY FUNCTIONS ---
+
+// GetShardIndex returns the shard (out of n) of key
+func GetShardIndex(key string, n int) int {
+	// Inlined 32-bit FNV-1a, since hash/fnv allocates
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(n))
+}
+
+// IndexOfInt returns the position of element e in slice s, or -1 if s does not contain e
+func IndexOfInt(s []int, e int) int {
+	for i, a := range s {
+		if a == e {
+			return i
+		}
+	}
+	return -1
+}
+
+// --- INITIALIZER ---
+
+// NewShardedUsersStore returns a new empty ShardedUsersStore with the given number of shards (at least 1)
+func NewShardedUsersStore(shards int) *ShardedUsersStore {
+	if shards < 1 {
+		shards = 1
+	}
+	store := ShardedUsersStore{names: make([]*nameShard, shards), shards: make([]*userShard, shards)}
+	for i := 0; i < shards; i++ {
+		store.names[i] = &nameShard{users: map[string]string{}, deletedUsers: map[string]deletedUser{}}
+		store.shards[i] = &userShard{
+			usernames:        map[string]string{},
+			passwords:        map[string]string{},
+			sentRequests:     map[string]StringSet{},
+			receivedRequests: map[string]StringSet{},
+			friends:          map[string]StringSet{},
+			profiles:         map[string]Profile{},
+			privacy:          map[string]PrivacySettings{},
+			roles:            map[string]string{},
+			deletedIDs:       NewStringSet(),
+			versions:         map[string]UserVersions{},
+		}
+	}
+	return &store
+}
@@ -0,0 +1,65 @@
+package main
+
+import "sort"
+
+// StringSet is a set of strings with constant time membership, insertion and removal
+type StringSet map[string]struct{}
+
+// Add adds e to the set. Returns false iff e was already in it
+func (set StringSet) Add(e string) bool {
+	if _, exists := set[e]; exists {
+		return false
+	}
+	set[e] = struct{}{}
+	return true
+}
+
+// Remove removes e from the set. Returns false iff e was not in it
+func (set StringSet) Remove(e string) bool {
+	if _, exists := set[e]; !exists {
+		return false
+	}
+	delete(set, e)
+	return true
+}
+
+// Contains returns true iff e is in the set
+func (set StringSet) Contains(e string) bool {
+	_, exists := set[e]
+	return exists
+}
+
+// Intersects returns true iff the set and other have an element in common. It takes time proportional to the size of
+// the smallest of them
+func (set StringSet) Intersects(other StringSet) bool {
+	if len(set) > len(other) {
+		set, other = other, set
+	}
+	for e := range set {
+		if other.Contains(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Slice returns the elements of the set, sorted
+func (set StringSet) Slice() []string {
+	elements := make([]string, 0, len(set))
+	for e := range set {
+		elements = append(elements, e)
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+// --- INITIALIZER ---
+
+// NewStringSet returns a set with the given elements
+func NewStringSet(elements ...string) StringSet {
+	set := make(StringSet, len(elements))
+	for _, e := range elements {
+		set[e] = struct{}{}
+	}
+	return set
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader is the W3C Trace Context header which propagates the trace of a request
+const TraceParentHeader = "traceparent"
+
+// Kinds of spans (as in OTLP)
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+)
+
+// Span status codes (as in OTLP)
+const (
+	SpanStatusUnset = 0
+	SpanStatusError = 2
+)
+
+// MaxBufferedSpans is the maximum number of ended spans waiting to be exported. If the exporter does not keep up,
+// further spans are dropped
+const MaxBufferedSpans = 4096
+
+// DefaultOTLPEndpoint is the default URL of the OTLP/HTTP collector
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// SpanContext identifies a span and its trace. The zero value is not a valid span, and a span started with it as
+// parent starts a new trace
+type SpanContext struct {
+	TraceID string // 32 lowercase hex digits
+	SpanID  string // 16 lowercase hex digits
+}
+
+// Span is a timed operation, eg an HTTP request or a store call
+type Span struct {
+	SpanContext
+	ParentSpanID string // empty if root span of the trace
+	Name         string
+	Kind         int
+	Start, End   time.Time
+	Attributes   map[string]string
+	Status       int
+}
+
+// Duration returns the duration of the span (which must have ended)
+func (span *Span) Duration() time.Duration {
+	return span.End.Sub(span.Start)
+}
+
+// SpanExporter sends batches of ended spans to a tracing backend
+type SpanExporter interface {
+	ExportSpans(request OTLPTraceRequest) error
+}
+
+// Tracer starts spans and collects them when they end, to be exported in batches (see Flush).
+// It is safe for concurrent use
+type Tracer struct {
+	ServiceName   string
+	SlowThreshold time.Duration // store calls taking longer are logged (see TracingUsersStore), disabled if 0
+	Logger        *log.Logger   // logs slow store calls and dropped spans
+
+	exporter SpanExporter // optional, if nil spans are not exported
+	mu       sync.Mutex
+	ended    []Span
+	dropped  int
+}
+
+// StartSpan starts a span of the trace of parent, or of a new trace if parent is the zero SpanContext
+func (t *Tracer) StartSpan(parent SpanContext, name string, kind int) *Span {
+	span := &Span{
+		SpanContext:  SpanContext{TraceID: parent.TraceID, SpanID: NewTraceID(8)},
+		ParentSpanID: parent.SpanID,
+		Name:         name,
+		Kind:         kind,
+		Start:        time.Now(),
+		Attributes:   map[string]string{},
+	}
+	if span.TraceID == "" {
+		span.TraceID = NewTraceID(16)
+	}
+	return span
+}
+
+// EndSpan ends span, which will be exported by the next Flush
+func (t *Tracer) EndSpan(span *Span) {
+	span.End = time.Now()
+	if t.exporter == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.ended) >= MaxBufferedSpans {
+		t.dropped++
+		return
+	}
+	t.ended = append(t.ended, *span)
+}
+
+// Flush exports the spans ended since the last Flush. Spans which can't be exported are discarded
+func (t *Tracer) Flush() error {
+	t.mu.Lock()
+	spans, dropped := t.ended, t.dropped
+	t.ended, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.Logger.Printf("tracing: dropped %d spans", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	return t.exporter.ExportSpans(NewOTLPTraceRequest(t.ServiceName, spans))
+}
+
+// ServeTracedHTTP serves an HTTP request of server (s) in a span, child of the span given by the traceparent header
+// of the request if any. The store calls made while serving it, including the ones in transactions (/batch and
+// /admin/import), are recorded as children of this span (see TracingUsersStore)
+func (t *Tracer) ServeTracedHTTP(s *UsersServer, w http.ResponseWriter, r *http.Request) {
+	parent, _ := ParseTraceParent(r.Header.Get(TraceParentHeader))
+	span := t.StartSpan(parent, r.Method+" /"+strings.Split(r.URL.Path, "/")[1], SpanKindServer)
+	span.Attributes["http.request.method"] = r.Method
+	span.Attributes["url.path"] = r.URL.Path
+	span.Attributes["http.request.id"] = r.Header.Get(RequestIDHeader)
+
+	traced := *s
+	traced.tracer = nil
+	traced.store = NewTracingUsersStore(s.store, t, span.SpanContext)
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	traced.ServeHTTP(recorder, r)
+
+	span.Attributes["http.response.status_code"] = strconv.Itoa(recorder.status)
+	if recorder.status >= http.StatusInternalServerError {
+		span.Status = SpanStatusError
+	}
+	t.EndSpan(span)
+}
+
+// statusRecorder is a http.ResponseWriter which records the status of the response. It implements http.Flusher and
+// http.Hijacker if the wrapped one does, for /events and /ws
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// OTLPTraceRequest is an OTLP ExportTraceServiceRequest, in its JSON encoding
+type OTLPTraceRequest struct {
+	ResourceSpans []OTLPResourceSpans `json:"resourceSpans"`
+}
+
+// OTLPResourceSpans are the spans of a service
+type OTLPResourceSpans struct {
+	Resource   OTLPResource     `json:"resource"`
+	ScopeSpans []OTLPScopeSpans `json:"scopeSpans"`
+}
+
+// OTLPResource describes the service which produced spans
+type OTLPResource struct {
+	Attributes []OTLPAttribute `json:"attributes"`
+}
+
+// OTLPScopeSpans are the spans produced by an instrumentation scope
+type OTLPScopeSpans struct {
+	Scope OTLPScope  `json:"scope"`
+	Spans []OTLPSpan `json:"spans"`
+}
+
+// OTLPScope is an instrumentation scope
+type OTLPScope struct {
+	Name string `json:"name"`
+}
+
+// OTLPSpan is a span in the OTLP JSON encoding (IDs are hex and timestamps are nanoseconds since the epoch as
+// strings)
+type OTLPSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []OTLPAttribute `json:"attributes,omitempty"`
+	Status            OTLPStatus      `json:"status"`
+}
+
+// OTLPAttribute is a key-value pair. Only string values are used
+type OTLPAttribute struct {
+	Key   string    `json:"key"`
+	Value OTLPValue `json:"value"`
+}
+
+// OTLPValue is the value of an attribute
+type OTLPValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// OTLPStatus is the status of a span
+type OTLPStatus struct {
+	Code int `json:"code"`
+}
+
+// WriterSpanExporter writes each batch of spans to Writer (eg stdout) as an OTLP JSON line
+type WriterSpanExporter struct {
+	mu     sync.Mutex
+	Writer io.Writer
+}
+
+// ExportSpans writes request to the writer
+func (e *WriterSpanExporter) ExportSpans(request OTLPTraceRequest) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return json.NewEncoder(e.Writer).Encode(request)
+}
+
+// OTLPSpanExporter sends each batch of spans to an OTLP/HTTP collector with the JSON encoding
+type OTLPSpanExporter struct {
+	Endpoint string       // eg DefaultOTLPEndpoint
+	Client   *http.Client // http.DefaultClient if nil
+}
+
+// ExportSpans posts request to the collector
+func (e *OTLPSpanExporter) ExportSpans(request OTLPTraceRequest) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	response, err := client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// --- AUXILIARY FUNCTIONS ---
+
+// NewOTLPTraceRequest returns the OTLP request which exports spans of service serviceName
+func NewOTLPTraceRequest(serviceName string, spans []Span) OTLPTraceRequest {
+	otlpSpans := make([]OTLPSpan, 0, len(spans))
+	for _, span := range spans {
+		keys := GetKeys(&span.Attributes)
+		sort.Strings(keys)
+		attributes := make([]OTLPAttribute, 0, len(keys))
+		for _, key := range keys {
+			attributes = append(attributes, OTLPAttribute{Key: key, Value: OTLPValue{StringValue: span.Attributes[key]}})
+		}
+		otlpSpans = append(otlpSpans, OTLPSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentSpanID,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        attributes,
+			Status:            OTLPStatus{Code: span.Status},
+		})
+	}
+
+	resource := OTLPResource{Attributes: []OTLPAttribute{{Key: "service.name", Value: OTLPValue{StringValue: serviceName}}}}
+	return OTLPTraceRequest{ResourceSpans: []OTLPResourceSpans{{
+		Resource:   resource,
+		ScopeSpans: []OTLPScopeSpans{{Scope: OTLPScope{Name: serviceName}, Spans: otlpSpans}},
+	}}}
+}
+
+// ParseTraceParent returns the span given by a W3C traceparent header ("00-<trace ID>-<span ID>-<flags>").
+// ok is false iff the header is not valid
+func ParseTraceParent(header string) (parent SpanContext, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || parts[0] != "00" || !IsTraceID(parts[1], 16) || !IsTraceID(parts[2], 8) || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	return SpanContext{TraceID: parts[1], SpanID: parts[2]}, true
+}
+
+// FormatTraceParent returns the W3C traceparent header which propagates span (as sampled)
+func FormatTraceParent(span SpanContext) string {
+	return "00-" + span.TraceID + "-" + span.SpanID + "-01"
+}
+
+// IsTraceID returns true iff id is the lowercase hex encoding of n bytes, not all zero
+func IsTraceID(id string, n int) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == n && id == strings.ToLower(id) && strings.Trim(id, "0") != ""
+}
+
+// NewTraceID returns a new random ID of n bytes, hex encoded
+func NewTraceID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// --- INITIALIZER ---
+
+// NewTracer returns a Tracer which exports spans of service serviceName with exporter (if not nil) and logs to
+// the default logger
+func NewTracer(exporter SpanExporter, serviceName string) *Tracer {
+	return &Tracer{ServiceName: serviceName, Logger: log.Default(), exporter: exporter}
+}
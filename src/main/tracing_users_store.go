@@ -0,0 +1,337 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// TracingUsersStore is a UsersStore which wraps another one, recording a span for every call (children of the span
+// given as parent, eg the span of the HTTP request being served; see Tracer.ServeTracedHTTP) and logging the calls
+// which take longer than the SlowThreshold of the tracer. Passwords are never recorded
+type TracingUsersStore struct {
+	store  UsersStore
+	tracer *Tracer
+	parent SpanContext
+}
+
+// GetUsers retrieves a list of all users, sorted alphabetically
+func (s *TracingUsersStore) GetUsers() []string {
+	span := s.start("GetUsers", "")
+	users := s.store.GetUsers()
+	s.end(span, strconv.Itoa(len(users)))
+	return users
+}
+
+// AddUser adds a user with given username and password (see UsersStore)
+func (s *TracingUsersStore) AddUser(name string, password string) bool {
+	span := s.start("AddUser", name)
+	ok := s.store.AddUser(name, password)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// AddUserWithID adds a user with given ID, username and password (see UsersStore)
+func (s *TracingUsersStore) AddUserWithID(id, name, password string) bool {
+	span := s.start("AddUserWithID", name)
+	ok := s.store.AddUserWithID(id, name, password)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// UserExists returns true iff user with name `name` exists
+func (s *TracingUsersStore) UserExists(name string) bool {
+	span := s.start("UserExists", name)
+	exists := s.store.UserExists(name)
+	s.end(span, strconv.FormatBool(exists))
+	return exists
+}
+
+// GetUserID returns the ID of user with name `name` (see UsersStore)
+func (s *TracingUsersStore) GetUserID(name string) (string, bool) {
+	span := s.start("GetUserID", name)
+	id, ok := s.store.GetUserID(name)
+	s.end(span, strconv.FormatBool(ok))
+	return id, ok
+}
+
+// GetUsername returns the username of user with ID `id` (see UsersStore)
+func (s *TracingUsersStore) GetUsername(id string) (string, bool) {
+	span := s.start("GetUsername", "")
+	span.Attributes["store.id"] = id
+	name, ok := s.store.GetUsername(id)
+	s.end(span, strconv.FormatBool(ok))
+	return name, ok
+}
+
+// IsDeletedUser returns true iff `name` is the username of a deleted user which has not been purged yet (see
+// UsersStore)
+func (s *TracingUsersStore) IsDeletedUser(name string) bool {
+	span := s.start("IsDeletedUser", name)
+	isDeleted := s.store.IsDeletedUser(name)
+	s.end(span, strconv.FormatBool(isDeleted))
+	return isDeleted
+}
+
+// IsDeletedID returns true iff `id` is the ID of a deleted user which has not been purged yet (see UsersStore)
+func (s *TracingUsersStore) IsDeletedID(id string) bool {
+	span := s.start("IsDeletedID", "")
+	span.Attributes["store.id"] = id
+	isDeleted := s.store.IsDeletedID(id)
+	s.end(span, strconv.FormatBool(isDeleted))
+	return isDeleted
+}
+
+// RequestFriendship adds a friendship request from user `from` to user `to` (see UsersStore)
+func (s *TracingUsersStore) RequestFriendship(from, to string) bool {
+	span := s.start("RequestFriendship", from, to)
+	ok := s.store.RequestFriendship(from, to)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// RequestFriendshipIf adds a friendship request from user `from` to user `to` iff condition returns true (see
+// UsersStore)
+func (s *TracingUsersStore) RequestFriendshipIf(from, to string, condition func(versions UserVersions) bool) bool {
+	span := s.start("RequestFriendshipIf", from, to)
+	ok := s.store.RequestFriendshipIf(from, to, condition)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// GetPassword returns the password of user (see UsersStore)
+func (s *TracingUsersStore) GetPassword(user string) (string, bool) {
+	span := s.start("GetPassword", user)
+	password, ok := s.store.GetPassword(user)
+	s.end(span, strconv.FormatBool(ok))
+	return password, ok
+}
+
+// CheckUsersPassword returns true if user exists and has this password
+func (s *TracingUsersStore) CheckUsersPassword(user, password string) bool {
+	span := s.start("CheckUsersPassword", user)
+	ok := s.store.CheckUsersPassword(user, password)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// ChangePassword sets the password of user to newPassword (see UsersStore)
+func (s *TracingUsersStore) ChangePassword(user, newPassword string) bool {
+	span := s.start("ChangePassword", user)
+	ok := s.store.ChangePassword(user, newPassword)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// RespondToFriendshipRequest responds to a friendship request from otherUser made to user (see UsersStore)
+func (s *TracingUsersStore) RespondToFriendshipRequest(user, otherUser string, acceptRequest bool) bool {
+	span := s.start("RespondToFriendshipRequest", user, otherUser)
+	span.Attributes["store.accept"] = strconv.FormatBool(acceptRequest)
+	ok := s.store.RespondToFriendshipRequest(user, otherUser, acceptRequest)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// RespondToFriendshipRequestIf responds to a friendship request from otherUser made to user iff condition returns true
+// (see UsersStore)
+func (s *TracingUsersStore) RespondToFriendshipRequestIf(user, otherUser string, acceptRequest bool, condition func(versions UserVersions) bool) bool {
+	span := s.start("RespondToFriendshipRequestIf", user, otherUser)
+	span.Attributes["store.accept"] = strconv.FormatBool(acceptRequest)
+	ok := s.store.RespondToFriendshipRequestIf(user, otherUser, acceptRequest, condition)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// GetFriends returns the list of friends of a given user, sorted (see UsersStore)
+func (s *TracingUsersStore) GetFriends(user string) []string {
+	span := s.start("GetFriends", user)
+	friends := s.store.GetFriends(user)
+	s.end(span, strconv.Itoa(len(friends)))
+	return friends
+}
+
+// GetFriendshipRequests returns the pending friendship requests sent and received by user (see UsersStore)
+func (s *TracingUsersStore) GetFriendshipRequests(user string) (sent, received []string, ok bool) {
+	span := s.start("GetFriendshipRequests", user)
+	sent, received, ok = s.store.GetFriendshipRequests(user)
+	s.end(span, strconv.FormatBool(ok))
+	return sent, received, ok
+}
+
+// AreFriends returns true iff users user and otherUser exist and are friends (see UsersStore)
+func (s *TracingUsersStore) AreFriends(user, otherUser string) bool {
+	span := s.start("AreFriends", user, otherUser)
+	areFriends := s.store.AreFriends(user, otherUser)
+	s.end(span, strconv.FormatBool(areFriends))
+	return areFriends
+}
+
+// HasFriendshipRequest returns true iff there is a pending friendship request from user `from` to user `to` (see
+// UsersStore)
+func (s *TracingUsersStore) HasFriendshipRequest(from, to string) bool {
+	span := s.start("HasFriendshipRequest", from, to)
+	hasRequest := s.store.HasFriendshipRequest(from, to)
+	s.end(span, strconv.FormatBool(hasRequest))
+	return hasRequest
+}
+
+// HaveCommonFriend returns true iff users user and otherUser have a friend in common (see UsersStore)
+func (s *TracingUsersStore) HaveCommonFriend(user, otherUser string) bool {
+	span := s.start("HaveCommonFriend", user, otherUser)
+	haveCommonFriend := s.store.HaveCommonFriend(user, otherUser)
+	s.end(span, strconv.FormatBool(haveCommonFriend))
+	return haveCommonFriend
+}
+
+// GetVersions returns the versions of the friends list and the friendship requests of user (see UsersStore)
+func (s *TracingUsersStore) GetVersions(user string) (UserVersions, bool) {
+	span := s.start("GetVersions", user)
+	versions, ok := s.store.GetVersions(user)
+	s.end(span, strconv.FormatBool(ok))
+	return versions, ok
+}
+
+// RemoveFriendship removes the friendship between user and otherUser (see UsersStore)
+func (s *TracingUsersStore) RemoveFriendship(user, otherUser string) bool {
+	span := s.start("RemoveFriendship", user, otherUser)
+	ok := s.store.RemoveFriendship(user, otherUser)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// GetProfile returns the profile of user (see UsersStore)
+func (s *TracingUsersStore) GetProfile(user string) (Profile, bool) {
+	span := s.start("GetProfile", user)
+	profile, ok := s.store.GetProfile(user)
+	s.end(span, strconv.FormatBool(ok))
+	return profile, ok
+}
+
+// UpdateProfile modifies the profile of user (see UsersStore)
+func (s *TracingUsersStore) UpdateProfile(user string, update ProfileUpdate) bool {
+	span := s.start("UpdateProfile", user)
+	ok := s.store.UpdateProfile(user, update)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// GetPrivacySettings returns the privacy settings of user (see UsersStore)
+func (s *TracingUsersStore) GetPrivacySettings(user string) (PrivacySettings, bool) {
+	span := s.start("GetPrivacySettings", user)
+	settings, ok := s.store.GetPrivacySettings(user)
+	s.end(span, strconv.FormatBool(ok))
+	return settings, ok
+}
+
+// UpdatePrivacySettings modifies the privacy settings of user (see UsersStore)
+func (s *TracingUsersStore) UpdatePrivacySettings(user string, update PrivacySettingsUpdate) bool {
+	span := s.start("UpdatePrivacySettings", user)
+	ok := s.store.UpdatePrivacySettings(user, update)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// GetRole returns the role of user (see UsersStore)
+func (s *TracingUsersStore) GetRole(user string) (string, bool) {
+	span := s.start("GetRole", user)
+	role, ok := s.store.GetRole(user)
+	s.end(span, strconv.FormatBool(ok))
+	return role, ok
+}
+
+// SetRole sets the role of user (see UsersStore)
+func (s *TracingUsersStore) SetRole(user, role string) bool {
+	span := s.start("SetRole", user)
+	span.Attributes["store.role"] = role
+	ok := s.store.SetRole(user, role)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// TouchUser sets the last time user was seen to now (see UsersStore)
+func (s *TracingUsersStore) TouchUser(user string) {
+	span := s.start("TouchUser", user)
+	s.store.TouchUser(user)
+	s.end(span, "")
+}
+
+// RenameUser changes the username of user oldName to newName (see UsersStore)
+func (s *TracingUsersStore) RenameUser(oldName, newName string) bool {
+	span := s.start("RenameUser", oldName, newName)
+	ok := s.store.RenameUser(oldName, newName)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// DeleteUser soft-deletes user `name` (see UsersStore)
+func (s *TracingUsersStore) DeleteUser(name string) bool {
+	span := s.start("DeleteUser", name)
+	ok := s.store.DeleteUser(name)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// RestoreUser restores the soft-deleted user `name` (see UsersStore)
+func (s *TracingUsersStore) RestoreUser(name, password string) bool {
+	span := s.start("RestoreUser", name)
+	ok := s.store.RestoreUser(name, password)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// PurgeDeletedUsers permanently removes the users deleted before deletedBefore (see UsersStore)
+func (s *TracingUsersStore) PurgeDeletedUsers(deletedBefore time.Time) []string {
+	span := s.start("PurgeDeletedUsers", "")
+	purged := s.store.PurgeDeletedUsers(deletedBefore)
+	s.end(span, strconv.Itoa(len(purged)))
+	return purged
+}
+
+// PurgeDeletedUser permanently removes the deleted user `name` (see UsersStore)
+func (s *TracingUsersStore) PurgeDeletedUser(name string) bool {
+	span := s.start("PurgeDeletedUser", name)
+	ok := s.store.PurgeDeletedUser(name)
+	s.end(span, strconv.FormatBool(ok))
+	return ok
+}
+
+// BeginTransaction tells the wrapped store that a transaction begins (see TransactionParticipant)
+func (s *TracingUsersStore) BeginTransaction() {
+	BeginTransaction(s.store)
+}
+
+// EndTransaction tells the wrapped store that the transaction ended (see TransactionParticipant)
+func (s *TracingUsersStore) EndTransaction(commit bool) {
+	EndTransaction(s.store, commit)
+}
+
+// start starts the span of a call to method, with the users it is about (if not empty) as attributes
+func (s *TracingUsersStore) start(method, user string, otherUser ...string) *Span {
+	span := s.tracer.StartSpan(s.parent, "UsersStore."+method, SpanKindInternal)
+	if user != "" {
+		span.Attributes["store.user"] = user
+	}
+	if len(otherUser) > 0 {
+		span.Attributes["store.other_user"] = otherUser[0]
+	}
+	return span
+}
+
+// end ends span with its result (if not empty) as attribute, logging it if slow
+func (s *TracingUsersStore) end(span *Span, result string) {
+	if result != "" {
+		span.Attributes["store.result"] = result
+	}
+	s.tracer.EndSpan(span)
+	if threshold := s.tracer.SlowThreshold; threshold > 0 && span.Duration() > threshold {
+		s.tracer.Logger.Printf("slow store call %s %v took %v (trace %s)", span.Name, span.Attributes,
+			span.Duration(), span.TraceID)
+	}
+}
+
+// --- INITIALIZER ---
+
+// NewTracingUsersStore returns a TracingUsersStore wrapping store, whose spans are children of parent (or roots of new
+// traces if parent is the zero SpanContext)
+func NewTracingUsersStore(store UsersStore, tracer *Tracer, parent SpanContext) *TracingUsersStore {
+	return &TracingUsersStore{store: store, tracer: tracer, parent: parent}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// TransactionalUsersStore is a UsersStore which wraps another one and supports transactions (see Begin): sets of
+// mutations which are applied all or nothing, without other operations seeing them half done.
+// Operations take a shared lock, so they run concurrently as allowed by the wrapped store, and transactions take it
+// exclusively. The wrapped store must not be used directly
+type TransactionalUsersStore struct {
+	store UsersStore
+	mu    sync.RWMutex // held for reading by each operation, and for writing by each transaction until it ends
+}
+
+// UsersTransaction is a transaction of a TransactionalUsersStore. It is a UsersStore: operations made through it are
+// applied right away, and kept in an undo log so that Rollback can revert them. Until Commit or Rollback are called
+// any other operation on the store waits, so transactions must be short, and Rollback should be deferred right after
+// Begin so that the transaction ends even if its caller panics. A transaction must not be used after it ended, nor
+// from several goroutines
+type UsersTransaction struct {
+	UsersStore
+	store *TransactionalUsersStore
+	undo  []func() // in the order the operations were applied
+	ended bool
+}
+
+// TransactionParticipant is implemented by the stores which keep track of their mutations besides applying them (eg
+// the versions of the lists, or a log for replicas), so that the mutations of a transaction which is rolled back, and
+// the ones which revert them, leave no trace. Stores which wrap another one must pass the calls on to it
+type TransactionParticipant interface {
+	// BeginTransaction is called when a transaction begins, before its mutations
+	BeginTransaction()
+	// EndTransaction is called when the transaction ends, after its mutations (and, unless commit, the ones which
+	// revert them)
+	EndTransaction(commit bool)
+}
+
+// Begin starts a transaction, waiting for the operations and transactions in progress to end
+func (s *TransactionalUsersStore) Begin() *UsersTransaction {
+	s.mu.Lock()
+	BeginTransaction(s.store)
+	return &UsersTransaction{UsersStore: s.store, store: s}
+}
+
+// Commit ends the transaction, keeping its changes. It does nothing if the transaction already ended
+func (tx *UsersTransaction) Commit() {
+	tx.end(true)
+}
+
+// Rollback ends the transaction, reverting its changes in reverse order. It does nothing if the transaction already
+// ended, so that it can be deferred even if the transaction is committed
+func (tx *UsersTransaction) Rollback() {
+	if tx.ended {
+		return
+	}
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.end(false)
+}
+
+// end ends the transaction, if it did not end already, and releases the store
+func (tx *UsersTransaction) end(commit bool) {
+	if tx.ended {
+		return
+	}
+	tx.ended = true
+	tx.undo = nil
+	defer tx.store.mu.Unlock()
+	EndTransaction(tx.store.store, commit)
+}
+
+// BeginTransaction tells store that a transaction begins if it is a TransactionParticipant
+func BeginTransaction(store UsersStore) {
+	if participant, ok := store.(TransactionParticipant); ok {
+		participant.BeginTransaction()
+	}
+}
+
+// EndTransaction tells store that a transaction ended if it is a TransactionParticipant
+func EndTransaction(store UsersStore, commit bool) {
+	if participant, ok := store.(TransactionParticipant); ok {
+		participant.EndTransaction(commit)
+	}
+}
+
+// AddUser adds a user with given username and password (see UsersStore). Rollback deletes them for good
+func (tx *UsersTransaction) AddUser(name string, password string) bool {
+	return tx.AddUserWithID(NewUserID(), name, password)
+}
+
+// AddUserWithID adds a user with given ID, username and password (see UsersStore). Rollback deletes them for good
+func (tx *UsersTransaction) AddUserWithID(id, name, password string) bool {
+	return tx.apply(tx.UsersStore.AddUserWithID(id, name, password), func() {
+		tx.UsersStore.DeleteUser(name)
+		tx.UsersStore.PurgeDeletedUser(name)
+	})
+}
+
+// RequestFriendship adds a friendship request from user `from` to user `to` (see UsersStore)
+func (tx *UsersTransaction) RequestFriendship(from, to string) bool {
+	return tx.apply(tx.UsersStore.RequestFriendship(from, to), func() {
+		tx.UsersStore.RespondToFriendshipRequest(to, from, false)
+	})
+}
+
+// RequestFriendshipIf adds a friendship request from user `from` to user `to` iff condition returns true (see
+// UsersStore)
+func (tx *UsersTransaction) RequestFriendshipIf(from, to string, condition func(versions UserVersions) bool) bool {
+	return tx.apply(tx.UsersStore.RequestFriendshipIf(from, to, condition), func() {
+		tx.UsersStore.RespondToFriendshipRequest(to, from, false)
+	})
+}
+
+// ChangePassword sets the password of user to newPassword (see UsersStore)
+func (tx *UsersTransaction) ChangePassword(user, newPassword string) bool {
+	oldPassword, _ := tx.UsersStore.GetPassword(user)
+	return tx.apply(tx.UsersStore.ChangePassword(user, newPassword), func() {
+		tx.UsersStore.ChangePassword(user, oldPassword)
+	})
+}
+
+// RespondToFriendshipRequest responds to a friendship request from otherUser made to user (see UsersStore)
+func (tx *UsersTransaction) RespondToFriendshipRequest(user, otherUser string, acceptRequest bool) bool {
+	return tx.apply(tx.UsersStore.RespondToFriendshipRequest(user, otherUser, acceptRequest), func() {
+		if acceptRequest {
+			tx.UsersStore.RemoveFriendship(user, otherUser)
+		}
+		tx.UsersStore.RequestFriendship(otherUser, user)
+	})
+}
+
+// RespondToFriendshipRequestIf responds to a friendship request from otherUser made to user iff condition returns true
+// (see UsersStore)
+func (tx *UsersTransaction) RespondToFriendshipRequestIf(user, otherUser string, acceptRequest bool, condition func(versions UserVersions) bool) bool {
+	return tx.apply(tx.UsersStore.RespondToFriendshipRequestIf(user, otherUser, acceptRequest, condition), func() {
+		if acceptRequest {
+			tx.UsersStore.RemoveFriendship(user, otherUser)
+		}
+		tx.UsersStore.RequestFriendship(otherUser, user)
+	})
+}
+
+// RemoveFriendship removes the friendship between user and otherUser (see UsersStore)
+func (tx *UsersTransaction) RemoveFriendship(user, otherUser string) bool {
+	return tx.apply(tx.UsersStore.RemoveFriendship(user, otherUser), func() {
+		tx.UsersStore.RequestFriendship(user, otherUser)
+		tx.UsersStore.RespondToFriendshipRequest(otherUser, user, true)
+	})
+}
+
+// UpdateProfile modifies the profile of user (see UsersStore)
+func (tx *UsersTransaction) UpdateProfile(user string, update ProfileUpdate) bool {
+	old, _ := tx.UsersStore.GetProfile(user)
+	return tx.apply(tx.UsersStore.UpdateProfile(user, update), func() {
+		tx.UsersStore.UpdateProfile(user, ProfileUpdate{DisplayName: &old.DisplayName, Bio: &old.Bio, AvatarURL: &old.AvatarURL})
+	})
+}
+
+// UpdatePrivacySettings modifies the privacy settings of user (see UsersStore)
+func (tx *UsersTransaction) UpdatePrivacySettings(user string, update PrivacySettingsUpdate) bool {
+	old, _ := tx.UsersStore.GetPrivacySettings(user)
+	return tx.apply(tx.UsersStore.UpdatePrivacySettings(user, update), func() {
+		tx.UsersStore.UpdatePrivacySettings(user, PrivacySettingsUpdate{
+			FriendsVisibility:  &old.FriendsVisibility,
+			FriendshipRequests: &old.FriendshipRequests,
+		})
+	})
+}
+
+// SetRole sets the role of user (see UsersStore)
+func (tx *UsersTransaction) SetRole(user, role string) bool {
+	oldRole, _ := tx.UsersStore.GetRole(user)
+	return tx.apply(tx.UsersStore.SetRole(user, role), func() {
+		tx.UsersStore.SetRole(user, oldRole)
+	})
+}
+
+// RenameUser changes the username of user oldName to newName (see UsersStore)
+func (tx *UsersTransaction) RenameUser(oldName, newName string) bool {
+	return tx.apply(tx.UsersStore.RenameUser(oldName, newName), func() {
+		tx.UsersStore.RenameUser(newName, oldName)
+	})
+}
+
+// DeleteUser soft-deletes user `name` (see UsersStore). Rollback restores them with their friendships and requests
+func (tx *UsersTransaction) DeleteUser(name string) bool {
+	password, _ := tx.UsersStore.GetPassword(name)
+	return tx.apply(tx.UsersStore.DeleteUser(name), func() {
+		tx.UsersStore.RestoreUser(name, password)
+	})
+}
+
+// RestoreUser can't be reverted exactly (deleting the user again would lose their relationships with users who are
+// deleted, which are not restored), so it is not allowed in transactions: it does nothing and returns false
+func (tx *UsersTransaction) RestoreUser(name, password string) bool {
+	return false
+}
+
+// PurgeDeletedUsers can't be reverted, so it is not allowed in transactions: it does nothing and returns no users
+func (tx *UsersTransaction) PurgeDeletedUsers(deletedBefore time.Time) []string {
+	return []string{}
+}
+
+// PurgeDeletedUser can't be reverted, so it is not allowed in transactions: it does nothing and returns false
+func (tx *UsersTransaction) PurgeDeletedUser(name string) bool {
+	return false
+}
+
+// apply records undo in the undo log if the operation was applied (ok). Returns ok
+func (tx *UsersTransaction) apply(ok bool, undo func()) bool {
+	if ok {
+		tx.undo = append(tx.undo, undo)
+	}
+	return ok
+}
+
+// GetUsers retrieves a list of all users, sorted alphabetically
+func (s *TransactionalUsersStore) GetUsers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetUsers()
+}
+
+// AddUser adds a user with given username and password (see UsersStore)
+func (s *TransactionalUsersStore) AddUser(name string, password string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.AddUser(name, password)
+}
+
+// AddUserWithID adds a user with given ID, username and password (see UsersStore)
+func (s *TransactionalUsersStore) AddUserWithID(id, name, password string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.AddUserWithID(id, name, password)
+}
+
+// UserExists returns true iff user with name `name` exists
+func (s *TransactionalUsersStore) UserExists(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.UserExists(name)
+}
+
+// GetUserID returns the ID of user with name `name` (see UsersStore)
+func (s *TransactionalUsersStore) GetUserID(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetUserID(name)
+}
+
+// GetUsername returns the username of user with ID `id` (see UsersStore)
+func (s *TransactionalUsersStore) GetUsername(id string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetUsername(id)
+}
+
+// IsDeletedUser returns true iff `name` is the username of a deleted user which has not been purged yet (see
+// UsersStore)
+func (s *TransactionalUsersStore) IsDeletedUser(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.IsDeletedUser(name)
+}
+
+// IsDeletedID returns true iff `id` is the ID of a deleted user which has not been purged yet (see UsersStore)
+func (s *TransactionalUsersStore) IsDeletedID(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.IsDeletedID(id)
+}
+
+// RequestFriendship adds a friendship request from user `from` to user `to` (see UsersStore)
+func (s *TransactionalUsersStore) RequestFriendship(from, to string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.RequestFriendship(from, to)
+}
+
+// RequestFriendshipIf adds a friendship request from user `from` to user `to` iff condition returns true (see
+// UsersStore)
+func (s *TransactionalUsersStore) RequestFriendshipIf(from, to string, condition func(versions UserVersions) bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.RequestFriendshipIf(from, to, condition)
+}
+
+// GetPassword returns the password of user (see UsersStore)
+func (s *TransactionalUsersStore) GetPassword(user string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetPassword(user)
+}
+
+// CheckUsersPassword returns true if user exists and has this password
+func (s *TransactionalUsersStore) CheckUsersPassword(user, password string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.CheckUsersPassword(user, password)
+}
+
+// ChangePassword sets the password of user to newPassword (see UsersStore)
+func (s *TransactionalUsersStore) ChangePassword(user, newPassword string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.ChangePassword(user, newPassword)
+}
+
+// RespondToFriendshipRequest responds to a friendship request from otherUser made to user (see UsersStore)
+func (s *TransactionalUsersStore) RespondToFriendshipRequest(user, otherUser string, acceptRequest bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.RespondToFriendshipRequest(user, otherUser, acceptRequest)
+}
+
+// RespondToFriendshipRequestIf responds to a friendship request from otherUser made to user iff condition returns true
+// (see UsersStore)
+func (s *TransactionalUsersStore) RespondToFriendshipRequestIf(user, otherUser string, acceptRequest bool, condition func(versions UserVersions) bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.RespondToFriendshipRequestIf(user, otherUser, acceptRequest, condition)
+}
+
+// GetFriends returns the list of friends of a given user, sorted (see UsersStore)
+func (s *TransactionalUsersStore) GetFriends(user string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetFriends(user)
+}
+
+// GetFriendshipRequests returns the pending friendship requests sent and received by user (see UsersStore)
+func (s *TransactionalUsersStore) GetFriendshipRequests(user string) (sent, received []string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetFriendshipRequests(user)
+}
+
+// AreFriends returns true iff users user and otherUser exist and are friends (see UsersStore)
+func (s *TransactionalUsersStore) AreFriends(user, otherUser string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.AreFriends(user, otherUser)
+}
+
+// HasFriendshipRequest returns true iff there is a pending friendship request from user `from` to user `to` (see
+// UsersStore)
+func (s *TransactionalUsersStore) HasFriendshipRequest(from, to string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.HasFriendshipRequest(from, to)
+}
+
+// HaveCommonFriend returns true iff users user and otherUser have a friend in common (see UsersStore)
+func (s *TransactionalUsersStore) HaveCommonFriend(user, otherUser string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.HaveCommonFriend(user, otherUser)
+}
+
+// GetVersions returns the versions of the friends list and the friendship requests of user (see UsersStore)
+func (s *TransactionalUsersStore) GetVersions(user string) (UserVersions, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetVersions(user)
+}
+
+// RemoveFriendship removes the friendship between user and otherUser (see UsersStore)
+func (s *TransactionalUsersStore) RemoveFriendship(user, otherUser string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.RemoveFriendship(user, otherUser)
+}
+
+// GetProfile returns the profile of user (see UsersStore)
+func (s *TransactionalUsersStore) GetProfile(user string) (Profile, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetProfile(user)
+}
+
+// UpdateProfile modifies the profile of user (see UsersStore)
+func (s *TransactionalUsersStore) UpdateProfile(user string, update ProfileUpdate) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.UpdateProfile(user, update)
+}
+
+// GetPrivacySettings returns the privacy settings of user (see UsersStore)
+func (s *TransactionalUsersStore) GetPrivacySettings(user string) (PrivacySettings, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetPrivacySettings(user)
+}
+
+// UpdatePrivacySettings modifies the privacy settings of user (see UsersStore)
+func (s *TransactionalUsersStore) UpdatePrivacySettings(user string, update PrivacySettingsUpdate) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.UpdatePrivacySettings(user, update)
+}
+
+// GetRole returns the role of user (see UsersStore)
+func (s *TransactionalUsersStore) GetRole(user string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetRole(user)
+}
+
+// SetRole sets the role of user (see UsersStore)
+func (s *TransactionalUsersStore) SetRole(user, role string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.SetRole(user, role)
+}
+
+// TouchUser sets the last time user was seen to now (see UsersStore)
+func (s *TransactionalUsersStore) TouchUser(user string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.store.TouchUser(user)
+}
+
+// RenameUser changes the username of user oldName to newName (see UsersStore)
+func (s *TransactionalUsersStore) RenameUser(oldName, newName string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.RenameUser(oldName, newName)
+}
+
+// DeleteUser soft-deletes user `name` (see UsersStore)
+func (s *TransactionalUsersStore) DeleteUser(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.DeleteUser(name)
+}
+
+// RestoreUser restores the soft-deleted user `name` (see UsersStore)
+func (s *TransactionalUsersStore) RestoreUser(name, password string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.RestoreUser(name, password)
+}
+
+// PurgeDeletedUsers permanently removes the users deleted before deletedBefore (see UsersStore)
+func (s *TransactionalUsersStore) PurgeDeletedUsers(deletedBefore time.Time) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.PurgeDeletedUsers(deletedBefore)
+}
+
+// PurgeDeletedUser permanently removes the deleted user `name` (see UsersStore)
+func (s *TransactionalUsersStore) PurgeDeletedUser(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.PurgeDeletedUser(name)
+}
+
+// --- INITIALIZER ---
+
+// NewTransactionalUsersStore returns a TransactionalUsersStore wrapping store
+func NewTransactionalUsersStore(store UsersStore) *TransactionalUsersStore {
+	return &TransactionalUsersStore{store: store}
+}
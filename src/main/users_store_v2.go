@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Errors returned by UsersStoreV2. Any other error (eg a disk or network failure of the backend, or the context being
+// done) means that the operation could not be carried out. GetStoreErrorStatus gives the message of the HTTP response
+// of each of them
+var (
+	ErrNotFound        = errors.New("user does not exist")
+	ErrUserExists      = errors.New("user already exists")
+	ErrWrongPassword   = errors.New("wrong password")
+	ErrAlreadyFriends  = errors.New("users are already friends")
+	ErrNotFriends      = errors.New("users are not friends")
+	ErrRequestPending  = errors.New("friendship request already exists")
+	ErrRequestNotFound = errors.New("friendship request does not exist")
+)
+
+// UsersStoreV2 is an interface for a DB in which we can add and retrieve users, like UsersStore, but whose operations
+// can be cancelled with a context and return an error telling why they failed instead of false.
+// See UsersStoreAdapter implementation for interface specifications
+type UsersStoreV2 interface {
+	GetUsers(ctx context.Context) ([]string, error)
+	AddUser(ctx context.Context, name, password string) error
+	AddUserWithID(ctx context.Context, id, name, password string) error
+	UserExists(ctx context.Context, name string) (bool, error)
+	GetUserID(ctx context.Context, name string) (string, error)
+	GetUsername(ctx context.Context, id string) (string, error)
+	RequestFriendship(ctx context.Context, from, to string) error
+	GetPassword(ctx context.Context, user string) (string, error)
+	CheckUsersPassword(ctx context.Context, user, password string) error
+	ChangePassword(ctx context.Context, user, newPassword string) error
+	RespondToFriendshipRequest(ctx context.Context, user, otherUser string, acceptRequest bool) error
+	GetFriends(ctx context.Context, user string) ([]string, error)
+	GetFriendshipRequests(ctx context.Context, user string) (sent, received []string, err error)
+	AreFriends(ctx context.Context, user, otherUser string) (bool, error)
+	HaveCommonFriend(ctx context.Context, user, otherUser string) (bool, error)
+	GetVersions(ctx context.Context, user string) (UserVersions, error)
+	RemoveFriendship(ctx context.Context, user, otherUser string) error
+	GetProfile(ctx context.Context, user string) (Profile, error)
+	UpdateProfile(ctx context.Context, user string, update ProfileUpdate) error
+	GetPrivacySettings(ctx context.Context, user string) (PrivacySettings, error)
+	UpdatePrivacySettings(ctx context.Context, user string, update PrivacySettingsUpdate) error
+	GetRole(ctx context.Context, user string) (string, error)
+	SetRole(ctx context.Context, user, role string) error
+	TouchUser(ctx context.Context, user string) error
+	RenameUser(ctx context.Context, oldName, newName string) error
+	DeleteUser(ctx context.Context, name string) error
+	RestoreUser(ctx context.Context, name, password string) error
+	PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) ([]string, error)
+	PurgeDeletedUser(ctx context.Context, name string) error
+}
+
+// UsersStoreAdapter implements UsersStoreV2 on top of a UsersStore (eg InMemoryUsersStore). Operations fail with the
+// error of the context if it is done before they start; once started they can't be cancelled. When the wrapped store
+// returns false, the reason is found with further queries, so with concurrent modifications the error may not be
+// accurate (eg ErrNotFound for a user deleted right after the operation failed because of something else)
+type UsersStoreAdapter struct {
+	store UsersStore
+}
+
+// GetUsers retrieves a list of all users, sorted alphabetically
+func (a *UsersStoreAdapter) GetUsers(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.store.GetUsers(), nil
+}
+
+// AddUser adds a user with given username and password, and a newly generated ID.
+// Returns ErrUserExists if the username is taken by another user or by a deleted user which has not been purged yet
+// Precondition: username and password are valid (ie using CheckUsernameAndPassword function)
+func (a *UsersStoreAdapter) AddUser(ctx context.Context, name, password string) error {
+	return a.AddUserWithID(ctx, NewUserID(), name, password)
+}
+
+// AddUserWithID adds a user with given ID, username and password.
+// Returns ErrUserExists if the username or the ID are taken (see AddUser)
+func (a *UsersStoreAdapter) AddUserWithID(ctx context.Context, id, name, password string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !a.store.AddUserWithID(id, name, password) {
+		return ErrUserExists
+	}
+	return nil
+}
+
+// UserExists returns true iff user with name `name` exists
+func (a *UsersStoreAdapter) UserExists(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return a.store.UserExists(name), nil
+}
+
+// GetUserID returns the ID of user with name `name`, or ErrNotFound if user does not exist
+func (a *UsersStoreAdapter) GetUserID(ctx context.Context, name string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	id, ok := a.store.GetUserID(name)
+	return id, getNotFoundError(ok)
+}
+
+// GetUsername returns the username of user with ID `id`, or ErrNotFound if user does not exist
+func (a *UsersStoreAdapter) GetUsername(ctx context.Context, id string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	name, ok := a.store.GetUsername(id)
+	return name, getNotFoundError(ok)
+}
+
+// RequestFriendship adds a friendship request from user `from` to user `to`.
+// Returns ErrNotFound if any of them does not exist, ErrAlreadyFriends if they are friends and ErrRequestPending if
+// there is a pending request between them in any direction
+func (a *UsersStoreAdapter) RequestFriendship(ctx context.Context, from, to string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if a.store.RequestFriendship(from, to) {
+		return nil
+	}
+	if !a.store.UserExists(from) || !a.store.UserExists(to) {
+		return ErrNotFound
+	}
+	if a.store.AreFriends(from, to) {
+		return ErrAlreadyFriends
+	}
+	return ErrRequestPending
+}
+
+// GetPassword returns the password of user, or ErrNotFound if user does not exist
+func (a *UsersStoreAdapter) GetPassword(ctx context.Context, user string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	password, ok := a.store.GetPassword(user)
+	return password, getNotFoundError(ok)
+}
+
+// CheckUsersPassword returns nil if user exists and has this password, and ErrWrongPassword otherwise (not
+// ErrNotFound, so that it does not tell whether user exists)
+func (a *UsersStoreAdapter) CheckUsersPassword(ctx context.Context, user, password string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !a.store.CheckUsersPassword(user, password) {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// ChangePassword sets the password of user to newPassword, or returns ErrNotFound if user does not exist
+// Precondition: newPassword is valid (ie using CheckUsernameAndPassword function)
+func (a *UsersStoreAdapter) ChangePassword(ctx context.Context, user, newPassword string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return getNotFoundError(a.store.ChangePassword(user, newPassword))
+}
+
+// RespondToFriendshipRequest responds to a friendship request from otherUser made to user, adding the friendship if
+// acceptRequest is true.
+// Returns ErrNotFound if any of them does not exist and ErrRequestNotFound if there is no such request
+func (a *UsersStoreAdapter) RespondToFriendshipRequest(ctx context.Context, user, otherUser string, acceptRequest bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if a.store.RespondToFriendshipRequest(user, otherUser, acceptRequest) {
+		return nil
+	}
+	if !a.store.UserExists(user) || !a.store.UserExists(otherUser) {
+		return ErrNotFound
+	}
+	return ErrRequestNotFound
+}
+
+// GetFriends returns the list of friends of user, sorted, or ErrNotFound if user does not exist
+func (a *UsersStoreAdapter) GetFriends(ctx context.Context, user string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !a.store.UserExists(user) {
+		return nil, ErrNotFound
+	}
+	return a.store.GetFriends(user), nil
+}
+
+// GetFriendshipRequests returns the pending friendship requests sent and received by user, sorted, or ErrNotFound if
+// user does not exist
+func (a *UsersStoreAdapter) GetFriendshipRequests(ctx context.Context, user string) (sent, received []string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	sent, received, ok := a.store.GetFriendshipRequests(user)
+	return sent, received, getNotFoundError(ok)
+}
+
+// AreFriends returns true iff user and otherUser are friends, or ErrNotFound if any of them does not exist
+func (a *UsersStoreAdapter) AreFriends(ctx context.Context, user, otherUser string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if a.store.AreFriends(user, otherUser) {
+		return true, nil
+	}
+	if !a.store.UserExists(user) || !a.store.UserExists(otherUser) {
+		return false, ErrNotFound
+	}
+	return false, nil
+}
+
+// HaveCommonFriend returns true iff user and otherUser have a friend in common, or ErrNotFound if any of them does
+// not exist
+func (a *UsersStoreAdapter) HaveCommonFriend(ctx context.Context, user, otherUser string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if a.store.HaveCommonFriend(user, otherUser) {
+		return true, nil
+	}
+	if !a.store.UserExists(user) || !a.store.UserExists(otherUser) {
+		return false, ErrNotFound
+	}
+	return false, nil
+}
+
+// GetVersions returns the versions of the friends list and the friendship requests of user, or ErrNotFound if user
+// does not exist
+func (a *UsersStoreAdapter) GetVersions(ctx context.Context, user string) (UserVersions, error) {
+	if err := ctx.Err(); err != nil {
+		return UserVersions{}, err
+	}
+	versions, ok := a.store.GetVersions(user)
+	return versions, getNotFoundError(ok)
+}
+
+// RemoveFriendship removes the friendship between user and otherUser.
+// Returns ErrNotFound if any of them does not exist and ErrNotFriends if they are not friends
+func (a *UsersStoreAdapter) RemoveFriendship(ctx context.Context, user, otherUser string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if a.store.RemoveFriendship(user, otherUser) {
+		return nil
+	}
+	if !a.store.UserExists(user) || !a.store.UserExists(otherUser) {
+		return ErrNotFound
+	}
+	return ErrNotFriends
+}
+
+// GetProfile returns the profile of user, or ErrNotFound if user does not exist
+func (a *UsersStoreAdapter) GetProfile(ctx context.Context, user string) (Profile, error) {
+	if err := ctx.Err(); err != nil {
+		return Profile{}, err
+	}
+	profile, ok := a.store.GetProfile(user)
+	return profile, getNotFoundError(ok)
+}
+
+// UpdateProfile modifies the profile of user with the non-nil fields of update, or returns ErrNotFound if user does
+// not exist
+func (a *UsersStoreAdapter) UpdateProfile(ctx context.Context, user string, update ProfileUpdate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return getNotFoundError(a.store.UpdateProfile(user, update))
+}
+
+// GetPrivacySettings returns the privacy settings of user, or ErrNotFound if user does not exist
+func (a *UsersStoreAdapter) GetPrivacySettings(ctx context.Context, user string) (PrivacySettings, error) {
+	if err := ctx.Err(); err != nil {
+		return PrivacySettings{}, err
+	}
+	settings, ok := a.store.GetPrivacySettings(user)
+	return settings, getNotFoundError(ok)
+}
+
+// UpdatePrivacySettings modifies the privacy settings of user with the non-nil fields of update, or returns
+// ErrNotFound if user does not exist
+func (a *UsersStoreAdapter) UpdatePrivacySettings(ctx context.Context, user string, update PrivacySettingsUpdate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return getNotFoundError(a.store.UpdatePrivacySettings(user, update))
+}
+
+// GetRole returns the role of user, or ErrNotFound if user does not exist
+func (a *UsersStoreAdapter) GetRole(ctx context.Context, user string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	role, ok := a.store.GetRole(user)
+	return role, getNotFoundError(ok)
+}
+
+// SetRole sets the role of user, or returns ErrNotFound if user does not exist
+// Precondition: role is valid (ie using IsValidRole function)
+func (a *UsersStoreAdapter) SetRole(ctx context.Context, user, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return getNotFoundError(a.store.SetRole(user, role))
+}
+
+// TouchUser sets the last time user was seen to now, or returns ErrNotFound if user does not exist
+func (a *UsersStoreAdapter) TouchUser(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !a.store.UserExists(user) {
+		return ErrNotFound
+	}
+	a.store.TouchUser(user)
+	return nil
+}
+
+// RenameUser changes the username of user oldName to newName.
+// Returns ErrNotFound if oldName does not exist and ErrUserExists if newName is taken (see AddUser)
+// Precondition: newName is valid (ie using CheckUsernameAndPassword function)
+func (a *UsersStoreAdapter) RenameUser(ctx context.Context, oldName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if a.store.RenameUser(oldName, newName) {
+		return nil
+	}
+	if !a.store.UserExists(oldName) {
+		return ErrNotFound
+	}
+	return ErrUserExists
+}
+
+// DeleteUser soft-deletes user `name` (see InMemoryUsersStore.DeleteUser), or returns ErrNotFound if user does not
+// exist
+func (a *UsersStoreAdapter) DeleteUser(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return getNotFoundError(a.store.DeleteUser(name))
+}
+
+// RestoreUser restores the soft-deleted user `name` (see InMemoryUsersStore.RestoreUser), or returns ErrNotFound if
+// there is no deleted user with this name and password
+func (a *UsersStoreAdapter) RestoreUser(ctx context.Context, name, password string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return getNotFoundError(a.store.RestoreUser(name, password))
+}
+
+// PurgeDeletedUsers permanently removes the users deleted before deletedBefore. Returns the usernames of the purged
+// users
+func (a *UsersStoreAdapter) PurgeDeletedUsers(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.store.PurgeDeletedUsers(deletedBefore), nil
+}
+
+// PurgeDeletedUser permanently removes the deleted user `name`, or returns ErrNotFound if there is no deleted user
+// with this name
+func (a *UsersStoreAdapter) PurgeDeletedUser(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return getNotFoundError(a.store.PurgeDeletedUser(name))
+}
+
+// --- AUXILIARY FUNCTIONS ---
+
+// GetStoreErrorStatus returns the HTTP status and error message of the response to a request which failed because of
+// err, returned by a UsersStoreV2
+func GetStoreErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrWrongPassword):
+		return http.StatusUnauthorized, ""
+	case errors.Is(err, ErrNotFound):
+		return http.StatusBadRequest, "User does not exist"
+	case errors.Is(err, ErrUserExists):
+		return http.StatusBadRequest, "User already exists"
+	case errors.Is(err, ErrAlreadyFriends):
+		return http.StatusBadRequest, "Users are already friends"
+	case errors.Is(err, ErrNotFriends):
+		return http.StatusBadRequest, "Users are not friends"
+	case errors.Is(err, ErrRequestPending):
+		return http.StatusBadRequest, "Friendship request already exists"
+	case errors.Is(err, ErrRequestNotFound):
+		return http.StatusBadRequest, "Cannot respond to friendship request because request does not exist"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable, "Request was cancelled"
+	default:
+		log.Printf("store error: %v", err)
+		return http.StatusInternalServerError, "Internal server error"
+	}
+}
+
+func getNotFoundError(ok bool) error {
+	if !ok {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// --- INITIALIZER ---
+
+// NewUsersStoreAdapter returns a UsersStoreV2 wrapping store
+func NewUsersStoreAdapter(store UsersStore) *UsersStoreAdapter {
+	return &UsersStoreAdapter{store: store}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// UserVersions are the versions of the friends list and of the pending friendship requests (sent and received) of a
+// user. Stores take them from a single counter, increased every time any list changes, so a version is never reused
+// (not even by a user deleted and restored, or by a different user) and every change gets a higher one
+type UserVersions struct {
+	Friends  uint64 `json:"friends"`
+	Requests uint64 `json:"requests"`
+}
+
+// FormatETag returns the (strong) entity tag of version
+func FormatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// MatchesETag returns true iff the value of an If-Match (or If-None-Match, if weak) header matches etag: it is "*"
+// or a comma-separated list which contains etag. If weak, tags marked as weak (W/"...") also match
+func MatchesETag(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
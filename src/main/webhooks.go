@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhook event types, sent after the corresponding successful operation
+const (
+	WebhookUserSignedUp        = "userSignedUp"
+	WebhookFriendshipRequested = "friendshipRequested"
+	WebhookFriendshipAccepted  = "friendshipAccepted"
+	WebhookFriendshipDeclined  = "friendshipDeclined"
+)
+
+// DefaultWebhookWorkers is the number of deliveries a WebhookDispatcher makes at the same time
+const DefaultWebhookWorkers = 8
+
+// DefaultWebhookQueueSize is the number of deliveries which can wait for a worker. When the queue is full, new
+// payloads are recorded as dead letters right away
+const DefaultWebhookQueueSize = 1000
+
+// DefaultWebhookDeadLetters is the number of dead letters a WebhookDispatcher keeps
+const DefaultWebhookDeadLetters = 1000
+
+// WebhookSignatureHeader is the header which holds the HMAC-SHA256 signature of the payload, computed with the
+// subscription's secret and formatted as "sha256=<hex digest>"
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
+// WebhookSubscription is a URL to which payloads are POSTed when the events it is subscribed to happen. Its Secret
+// is only returned when it is created (see GetSubscriptions)
+type WebhookSubscription struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Events []string `json:"events,omitempty"` // if empty, subscribed to all events
+}
+
+// WebhookPayload is the JSON body POSTed to subscriptions
+type WebhookPayload struct {
+	Event string            `json:"event"`
+	Time  time.Time         `json:"time"`
+	Data  map[string]string `json:"data"`
+}
+
+// WebhookDeadLetter records a payload which could not be delivered after all retries
+type WebhookDeadLetter struct {
+	SubscriptionID string    `json:"subscriptionId"`
+	URL            string    `json:"url"`
+	Payload        string    `json:"payload"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"lastError"`
+	FailedAt       time.Time `json:"failedAt"`
+}
+
+// WebhookDispatcher delivers webhook payloads to subscriptions in the background, from a fixed pool of workers which
+// take them from a bounded queue. Failed deliveries (network errors or non-2xx responses) are retried with
+// exponential backoff up to MaxAttempts times, after which the payload is recorded as a dead letter. Only the last
+// dead letters are kept (see GetDeadLetters).
+// Notify can be called on a nil *WebhookDispatcher, in which case it does nothing.
+type WebhookDispatcher struct {
+	Client      *http.Client
+	MaxAttempts int
+	BaseBackoff time.Duration // wait before the first retry; doubled after each failed retry
+	MaxBackoff  time.Duration
+
+	mu             sync.Mutex
+	lastID         int
+	subscriptions  map[string]WebhookSubscription
+	deadLetters    []WebhookDeadLetter // last dead letters, oldest first; never longer than maxDeadLetters
+	maxDeadLetters int
+	queue          chan webhookDelivery
+	ctx            context.Context // done when the dispatcher is closed
+	cancel         context.CancelFunc
+	pending        sync.WaitGroup
+}
+
+// webhookDelivery is a payload for event to be delivered to sub
+type webhookDelivery struct {
+	sub     WebhookSubscription
+	event   string
+	payload []byte
+}
+
+// Subscribe adds a new subscription and returns it (with its ID)
+func (d *WebhookDispatcher) Subscribe(url, secret string, events []string) WebhookSubscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastID++
+	sub := WebhookSubscription{ID: strconv.Itoa(d.lastID), URL: url, Secret: secret, Events: events}
+	d.subscriptions[sub.ID] = sub
+	return sub
+}
+
+// Unsubscribe removes the subscription with the given id.
+// Returns false iff subscription does not exist
+func (d *WebhookDispatcher) Unsubscribe(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.subscriptions[id]; !exists {
+		return false
+	}
+	delete(d.subscriptions, id)
+	return true
+}
+
+// GetSubscriptions returns all subscriptions, without their secrets
+func (d *WebhookDispatcher) GetSubscriptions() []WebhookSubscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subs := make([]WebhookSubscription, 0, len(d.subscriptions))
+	for _, sub := range d.subscriptions {
+		sub.Secret = ""
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// GetDeadLetters returns the last payloads which could not be delivered, oldest first
+func (d *WebhookDispatcher) GetDeadLetters() []WebhookDeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]WebhookDeadLetter{}, d.deadLetters...)
+}
+
+// Notify queues a payload for event to every subscription interested in it. It does not wait for the deliveries to
+// finish (see Wait), and does nothing once the dispatcher is closed
+func (d *WebhookDispatcher) Notify(event string, data map[string]string) {
+	if d == nil || d.ctx.Err() != nil {
+		return
+	}
+
+	payload, _ := json.Marshal(WebhookPayload{Event: event, Time: time.Now().UTC(), Data: data})
+
+	d.mu.Lock()
+	deliveries := make([]webhookDelivery, 0, len(d.subscriptions))
+	for _, sub := range d.subscriptions {
+		if len(sub.Events) > 0 && !Contains(sub.Events, event) {
+			continue
+		}
+		deliveries = append(deliveries, webhookDelivery{sub: sub, event: event, payload: payload})
+	}
+	d.mu.Unlock()
+
+	for _, delivery := range deliveries {
+		d.pending.Add(1)
+		select {
+		case d.queue <- delivery:
+		default:
+			d.deadLetter(delivery, 0, "delivery queue is full")
+			d.pending.Done()
+		}
+	}
+}
+
+// Wait blocks until all queued deliveries have either succeeded or been dead-lettered. It must not be called after
+// Close
+func (d *WebhookDispatcher) Wait() {
+	d.pending.Wait()
+}
+
+// Close stops the workers: deliveries in progress are dead-lettered at their next attempt or wait, and queued ones
+// are dropped
+func (d *WebhookDispatcher) Close() {
+	d.cancel()
+}
+
+// work delivers the payloads in the queue until the dispatcher is closed
+func (d *WebhookDispatcher) work() {
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case delivery := <-d.queue:
+			d.deliver(delivery)
+		}
+	}
+}
+
+// deliver POSTs the payload of delivery to its subscription, retrying as many times as allowed
+func (d *WebhookDispatcher) deliver(delivery webhookDelivery) {
+	defer d.pending.Done()
+
+	backoff := d.BaseBackoff
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		if err = d.post(delivery.sub, delivery.event, delivery.payload); err == nil {
+			return
+		}
+		if attempt >= d.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-d.ctx.Done():
+			d.deadLetter(delivery, attempt, err.Error())
+			return
+		}
+		backoff *= 2
+		if backoff > d.MaxBackoff {
+			backoff = d.MaxBackoff
+		}
+	}
+
+	d.deadLetter(delivery, attempt, err.Error())
+}
+
+// deadLetter records that the payload of delivery could not be delivered after attempts, the last of which failed
+// with lastError, forgetting the oldest dead letter if there are too many
+func (d *WebhookDispatcher) deadLetter(delivery webhookDelivery, attempts int, lastError string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deadLetters = append(d.deadLetters, WebhookDeadLetter{
+		SubscriptionID: delivery.sub.ID,
+		URL:            delivery.sub.URL,
+		Payload:        string(delivery.payload),
+		Attempts:       attempts,
+		LastError:      lastError,
+		FailedAt:       time.Now().UTC(),
+	})
+	if len(d.deadLetters) > d.maxDeadLetters {
+		d.deadLetters = append([]WebhookDeadLetter(nil), d.deadLetters[len(d.deadLetters)-d.maxDeadLetters:]...)
+	}
+}
+
+// post makes a single delivery attempt, which is cancelled if the dispatcher is closed
+func (d *WebhookDispatcher) post(sub WebhookSubscription, event string, payload []byte) error {
+	request, err := http.NewRequestWithContext(d.ctx, http.MethodPost, sub.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-Event", event)
+	request.Header.Set(WebhookSignatureHeader, SignWebhookPayload(sub.Secret, payload))
+
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhookPayload returns the value of the signature header for payload signed with secret
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// --- INITIALIZER ---
+
+// NewWebhookDispatcher returns a WebhookDispatcher with no subscriptions which makes up to 5 delivery attempts,
+// waiting 1s, 2s, 4s and 8s between them, from DefaultWebhookWorkers workers. It must be closed (see Close) once it
+// is no longer used
+func NewWebhookDispatcher() *WebhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	dispatcher := WebhookDispatcher{
+		Client:         &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts:    5,
+		BaseBackoff:    time.Second,
+		MaxBackoff:     time.Minute,
+		subscriptions:  map[string]WebhookSubscription{},
+		maxDeadLetters: DefaultWebhookDeadLetters,
+		queue:          make(chan webhookDelivery, DefaultWebhookQueueSize),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+	for i := 0; i < DefaultWebhookWorkers; i++ {
+		go dispatcher.work()
+	}
+	return &dispatcher
+}
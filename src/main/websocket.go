@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal implementation of the server side of the WebSocket protocol (RFC 6455): handshake, (fragmented) data
+// frames and control frames. Extensions and subprotocols are not supported.
+
+// WebSocket frame opcodes
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// MaxWebSocketMessageSize is the maximum size of a message accepted from a client
+const MaxWebSocketMessageSize = 1 << 16
+
+// webSocketGUID is the magic string used to compute Sec-WebSocket-Accept
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrWebSocketClosed is returned by ReadMessage when the client closes the connection
+var ErrWebSocketClosed = errors.New("websocket: connection closed")
+
+// WebSocketConn is a WebSocket connection with a client. Messages can be written concurrently from several
+// goroutines, but only one goroutine should read messages.
+type WebSocketConn struct {
+	ReadTimeout time.Duration // if not 0, ReadMessage fails when no frame (pongs included) arrives for this long
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// UpgradeWebSocket performs the WebSocket opening handshake for request r and takes over the connection.
+// Iff an error happens, w will be populated with HTTP status 400 Bad Request and an error will be returned
+func UpgradeWebSocket(w *http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!HeaderContainsToken(r.Header, "Connection", "upgrade") ||
+		!HeaderContainsToken(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		(*w).WriteHeader(http.StatusBadRequest)
+		return nil, errors.New("websocket: not a valid websocket handshake")
+	}
+
+	hijacker, ok := (*w).(http.Hijacker)
+	if !ok {
+		(*w).WriteHeader(http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not implement http.Hijacker")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	accept := base64.StdEncoding.EncodeToString(hash[:])
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &WebSocketConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// ReadMessage returns the next data message (text or binary) sent by the client.
+// Ping frames are answered automatically and pong frames are ignored (although they reset the ReadTimeout).
+// If the client closes the connection, the close frame is echoed and ErrWebSocketClosed is returned.
+func (c *WebSocketConn) ReadMessage() (opcode byte, payload []byte, err error) {
+	for {
+		if c.ReadTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+		}
+
+		fin, frameOpcode, framePayload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch frameOpcode {
+		case OpPing:
+			if err := c.WriteMessage(OpPong, framePayload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			c.WriteMessage(OpClose, framePayload)
+			return 0, nil, ErrWebSocketClosed
+		case OpContinuation:
+			if opcode == 0 {
+				return 0, nil, errors.New("websocket: unexpected continuation frame")
+			}
+		case OpText, OpBinary:
+			if opcode != 0 {
+				return 0, nil, errors.New("websocket: expected continuation frame")
+			}
+			opcode = frameOpcode
+		default:
+			return 0, nil, errors.New("websocket: unknown opcode")
+		}
+
+		payload = append(payload, framePayload...)
+		if len(payload) > MaxWebSocketMessageSize {
+			return 0, nil, errors.New("websocket: message too big")
+		}
+		if fin {
+			return opcode, payload, nil
+		}
+	}
+}
+
+// readFrame reads a single frame from the client and unmasks its payload
+func (c *WebSocketConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("websocket: extensions are not supported")
+	}
+	if !masked {
+		return false, 0, nil, errors.New("websocket: client frames must be masked")
+	}
+	if opcode >= OpClose && (!fin || length > 125) {
+		return false, 0, nil, errors.New("websocket: invalid control frame")
+	}
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > MaxWebSocketMessageSize {
+		return false, 0, nil, errors.New("websocket: message too big")
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, mask); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends a single unfragmented, unmasked frame to the client
+func (c *WebSocketConn) WriteMessage(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	frame = append(frame, payload...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close closes the underlying connection without sending a close frame
+func (c *WebSocketConn) Close() error {
+	return c.conn.Close()
+}
+
+// HeaderContainsToken returns true iff the comma-separated header `name` contains token (case insensitive)
+func HeaderContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}